@@ -8,6 +8,7 @@ import (
 	"godis/dataStruct/sortedset"
 	"godis/interface/database"
 	"godis/redis/protocol"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -19,10 +20,21 @@ var (
 	hMSetCmd       = []byte(constant.HMSet)
 	zAddCmd        = []byte(constant.ZAdd)
 	pExpireAtBytes = []byte(constant.PExpireAt)
+	hPExpireAtCmd  = []byte(constant.HPExpireAt)
+	fieldsBytes    = []byte("FIELDS")
 )
 
-// EntityToCmd serialize data entity to redis command
+// EntityToCmd serialize data entity to redis command, ttl of hash fields is not included, see EntityToCmds
 func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkReply {
+	cmds := EntityToCmds(key, entity)
+	if len(cmds) == 0 {
+		return nil
+	}
+	return cmds[0]
+}
+
+// EntityToCmds serialize data entity to redis commands, following commands restore ttl of hash fields
+func EntityToCmds(key string, entity *database.DataEntity) []*protocol.MultiBulkReply {
 	if entity == nil {
 		return nil
 	}
@@ -30,16 +42,19 @@ func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkRep
 	switch val := entity.Data.(type) {
 	case []byte:
 		cmd = stringToCmd(key, val)
-	case *list.LinkedList:
+	case *list.QuickList:
 		cmd = listToCmd(key, val)
 	case *set.Set:
 		cmd = setToCmd(key, val)
 	case dict.Dict:
-		cmd = hashToCmd(key, val)
+		return hashToCmd(key, val)
 	case *sortedset.SortedSet:
 		cmd = zSetToCmd(key, val)
 	}
-	return cmd
+	if cmd == nil {
+		return nil
+	}
+	return []*protocol.MultiBulkReply{cmd}
 }
 
 func stringToCmd(key string, bytes []byte) *protocol.MultiBulkReply {
@@ -50,13 +65,12 @@ func stringToCmd(key string, bytes []byte) *protocol.MultiBulkReply {
 	return protocol.MakeMultiBulkReply(args)
 }
 
-func listToCmd(key string, list *list.LinkedList) *protocol.MultiBulkReply {
+func listToCmd(key string, list *list.QuickList) *protocol.MultiBulkReply {
 	args := make([][]byte, 2+list.Len())
 	args[0] = rPushAllCmd
 	args[1] = []byte(key)
-	list.ForEach(func(i int, val interface{}) bool {
-		bytes, _ := val.([]byte)
-		args[2+i] = bytes
+	list.ForEach(func(i int, val []byte) bool {
+		args[2+i] = val
 		return true
 	})
 	return protocol.MakeMultiBulkReply(args)
@@ -75,19 +89,50 @@ func setToCmd(key string, set *set.Set) *protocol.MultiBulkReply {
 	return protocol.MakeMultiBulkReply(args)
 }
 
-func hashToCmd(key string, hash dict.Dict) *protocol.MultiBulkReply {
-	args := make([][]byte, 2+hash.Len()*2)
+// hashToCmd returns HMSET command of hash, followed by HPEXPIREAT commands of fields having ttl.
+// It returns nil if all fields of hash were expired
+func hashToCmd(key string, hash dict.Dict) []*protocol.MultiBulkReply {
+	args := make([][]byte, 2, 2+hash.Len()*2)
 	args[0] = hMSetCmd
 	args[1] = []byte(key)
-	i := 0
-	hash.ForEach(func(key string, val interface{}) bool {
+	hash.ForEach(func(field string, val interface{}) bool {
 		bytes, _ := val.([]byte)
-		args[2+2*i] = []byte(key)
-		args[3+2*i] = bytes
-		i++
+		args = append(args, []byte(field), bytes)
 		return true
 	})
-	return protocol.MakeMultiBulkReply(args)
+	if len(args) == 2 {
+		return nil
+	}
+	cmds := []*protocol.MultiBulkReply{protocol.MakeMultiBulkReply(args)}
+	compact, ok := hash.(*dict.CompactDict)
+	if !ok {
+		return cmds
+	}
+	// group fields by expiration time to reduce commands
+	groups := make(map[int64][]string)
+	compact.ForEachExpire(func(field string, expireTime time.Time) bool {
+		expireAt := expireTime.UnixNano() / 1e6
+		groups[expireAt] = append(groups[expireAt], field)
+		return true
+	})
+	expireAts := make([]int64, 0, len(groups))
+	for expireAt := range groups {
+		expireAts = append(expireAts, expireAt)
+	}
+	sort.Slice(expireAts, func(i, j int) bool {
+		return expireAts[i] < expireAts[j]
+	})
+	for _, expireAt := range expireAts {
+		fields := groups[expireAt]
+		args := make([][]byte, 0, 5+len(fields))
+		args = append(args, hPExpireAtCmd, []byte(key), []byte(strconv.FormatInt(expireAt, 10)),
+			fieldsBytes, []byte(strconv.Itoa(len(fields))))
+		for _, field := range fields {
+			args = append(args, []byte(field))
+		}
+		cmds = append(cmds, protocol.MakeMultiBulkReply(args))
+	}
+	return cmds
 }
 
 func zSetToCmd(key string, zset *sortedset.SortedSet) *protocol.MultiBulkReply {
@@ -61,11 +61,11 @@ func (h *Handler) DoRewrite(ctx *RewriteCtx) error {
 		}
 		// dump db
 		tmpAof.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
-			cmd := EntityToCmd(key, entity)
-			if cmd != nil {
+			cmds := EntityToCmds(key, entity)
+			for _, cmd := range cmds {
 				_, _ = tmpFile.Write(cmd.ToBytes())
 			}
-			if expiration != nil {
+			if len(cmds) > 0 && expiration != nil {
 				cmd := MakeExpireCmd(key, *expiration)
 				if cmd != nil {
 					_, _ = tmpFile.Write(cmd.ToBytes())
@@ -1,3 +1,4 @@
 #!/usr/bin/env bash
 
-go build -o target/godis-darwin ./
\ No newline at end of file
+go build -o target/godis-darwin ./
+go build -o target/godis-proxy-darwin ./cmd/godis-proxy
\ No newline at end of file
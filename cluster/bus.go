@@ -0,0 +1,592 @@
+package cluster
+
+import (
+	"bytes"
+	"godis/config"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * bus.go implements failure detection and automatic failover.
+ * Every node sends `_heartbeat` to all known nodes per second, the heartbeat carries nodes flagged PFAIL by sender.
+ * A node not responding for cluster-node-timeout is flagged PFAIL (possibly failing), once the majority of masters
+ * flagged it, it is marked FAIL and the FAIL flag spreads with heartbeats.
+ * A replica whose master failed starts an election in a new epoch, masters vote for at most one replica per epoch.
+ * The replica got votes from the majority replaces its master in topology, and keys of the failed master
+ * are served by the replica from then on.
+ */
+
+const (
+	// _heartbeat sender replica-of(- for master) current-epoch topology-version nodes pfail-nodes fail-nodes slots
+	relayHeartbeat = "_heartbeat"
+	// _failoverauth epoch replica master
+	relayFailoverAuth = "_failoverauth"
+
+	heartbeatInterval = time.Second
+)
+
+// nodeState is the view of current node on a peer
+type nodeState struct {
+	addr      string
+	replicaOf string // empty if the node is a master
+	// pingSent is the time the earliest unanswered heartbeat was sent, zero if all heartbeats were answered
+	pingSent time.Time
+	pongRecv time.Time
+	sending  bool
+	pfail    bool
+	fail     bool
+	// failReports: master -> last time it flagged the node as PFAIL
+	failReports map[string]time.Time
+}
+
+// clusterBus stores states of peers
+type clusterBus struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeState
+	// replicaOf is the master of current node, empty if current node is a master
+	replicaOf     string
+	currentEpoch  int64
+	lastVoteEpoch int64
+	// failoverAt is the time to start next election, zero if master is ok
+	failoverAt time.Time
+	electing   bool
+
+	messagesSent     int64
+	messagesReceived int64
+	stop             chan struct{}
+	stopOnce         sync.Once
+}
+
+func makeClusterBus(replicaOf string) *clusterBus {
+	return &clusterBus{
+		nodes:     make(map[string]*nodeState),
+		replicaOf: replicaOf,
+		stop:      make(chan struct{}),
+	}
+}
+
+func getNodeTimeout() time.Duration {
+	if config.Properties.ClusterNodeTimeout <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+}
+
+// getState returns state of node, creates it if not exists, invoker should hold bus.mu
+func (bus *clusterBus) getState(node string) *nodeState {
+	state, ok := bus.nodes[node]
+	if !ok {
+		state = &nodeState{
+			addr:        node,
+			failReports: make(map[string]time.Time),
+		}
+		bus.nodes[node] = state
+	}
+	return state
+}
+
+func (bus *clusterBus) isReplica(node string) bool {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	state, ok := bus.nodes[node]
+	return ok && state.replicaOf != ""
+}
+
+func (bus *clusterBus) getReplicaOf() string {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return bus.replicaOf
+}
+
+func (bus *clusterBus) close() {
+	bus.stopOnce.Do(func() {
+		close(bus.stop)
+	})
+}
+
+// isNodeFailed returns true if the node is in FAIL state
+func (cluster *Cluster) isNodeFailed(node string) bool {
+	cluster.bus.mu.Lock()
+	defer cluster.bus.mu.Unlock()
+	state, ok := cluster.bus.nodes[node]
+	return ok && state.fail
+}
+
+// onTopologyChanged forgets nodes removed from cluster, invoker should hold topologyMu
+func (cluster *Cluster) onTopologyChanged(aliases map[string]string) {
+	bus := cluster.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if containsNode(cluster.nodes, cluster.self) {
+		bus.replicaOf = ""
+		bus.failoverAt = time.Time{}
+	} else if owner, ok := aliases[cluster.self]; ok {
+		// a failed master rejoins as replica of the node serving its keys
+		bus.replicaOf = owner
+		bus.failoverAt = time.Time{}
+	} else if master, ok := aliases[bus.replicaOf]; ok {
+		// follow the replica promoted as new master
+		bus.replicaOf = master
+		bus.failoverAt = time.Time{}
+	}
+	for node, state := range bus.nodes {
+		if containsNode(cluster.nodes, node) {
+			continue
+		}
+		if replacement, ok := aliases[state.replicaOf]; ok {
+			state.replicaOf = replacement
+		}
+		if state.replicaOf == "" || !containsNode(cluster.nodes, state.replicaOf) {
+			delete(bus.nodes, node)
+		}
+	}
+}
+
+// guessAliases finds replicas took place of failed masters between two topologies, since heartbeats carry no aliases.
+// Failover replaces the failed master in place, otherwise a single removed node is paired with a single added node.
+func guessAliases(prevNodes []string, nodes []string) map[string]string {
+	var added, removed []string
+	for _, node := range nodes {
+		if !containsNode(prevNodes, node) {
+			added = append(added, node)
+		}
+	}
+	for _, node := range prevNodes {
+		if !containsNode(nodes, node) {
+			removed = append(removed, node)
+		}
+	}
+	aliases := make(map[string]string)
+	for i, node := range prevNodes {
+		if i < len(nodes) && containsNode(removed, node) && containsNode(added, nodes[i]) {
+			aliases[node] = nodes[i]
+		}
+	}
+	if len(aliases) == 0 && len(removed) == 1 && len(added) == 1 {
+		aliases[removed[0]] = added[0]
+	}
+	return aliases
+}
+
+func (cluster *Cluster) startBus() {
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cluster.busCron()
+			case <-cluster.bus.stop:
+				return
+			}
+		}
+	}()
+}
+
+// busCron sends heartbeats and detects failures
+func (cluster *Cluster) busCron() {
+	nodes := cluster.getNodes()
+	cluster.topologyMu.RLock()
+	version := cluster.version
+	slots := cluster.formatSlots()
+	cluster.topologyMu.RUnlock()
+	isMaster := containsNode(nodes, cluster.self)
+	timeout := getNodeTimeout()
+	now := time.Now()
+
+	bus := cluster.bus
+	bus.mu.Lock()
+	for _, node := range nodes {
+		if node != cluster.self {
+			bus.getState(node)
+		}
+	}
+	var pfailNodes, failNodes, targets []string
+	for node, state := range bus.nodes {
+		if !state.sending {
+			state.sending = true
+			targets = append(targets, node)
+		}
+		if state.pingSent.IsZero() {
+			state.pingSent = now
+		} else if now.Sub(state.pingSent) > timeout && !state.pfail {
+			state.pfail = true
+			logger.Warn("node " + node + " is possibly failing")
+		}
+		if state.pfail {
+			pfailNodes = append(pfailNodes, node)
+		}
+	}
+	// failure reports from the majority of masters make PFAIL to FAIL
+	quorum := len(nodes)/2 + 1
+	for _, node := range pfailNodes {
+		state := bus.nodes[node]
+		if state.fail {
+			failNodes = append(failNodes, node)
+			continue
+		}
+		reports := 0
+		if isMaster {
+			reports++
+		}
+		for reporter, reportedAt := range state.failReports {
+			if containsNode(nodes, reporter) && now.Sub(reportedAt) <= 2*timeout {
+				reports++
+			}
+		}
+		if reports >= quorum {
+			state.fail = true
+			failNodes = append(failNodes, node)
+			logger.Warn("node " + node + " is marked as failed")
+		}
+	}
+	replicaOf := bus.replicaOf
+	startElection := false
+	if master, ok := bus.nodes[replicaOf]; ok && master.fail && !bus.electing {
+		if bus.failoverAt.IsZero() {
+			// random delay prevents replicas from starting elections at the same time
+			bus.failoverAt = now.Add(500*time.Millisecond + time.Duration(rand.Intn(500))*time.Millisecond)
+		} else if now.After(bus.failoverAt) {
+			bus.electing = true
+			startElection = true
+		}
+	}
+	currentEpoch := bus.currentEpoch
+	bus.mu.Unlock()
+
+	master := replicaOf
+	if master == "" {
+		master = emptyArg
+	}
+	heartbeat := utils.ToCmdLine(relayHeartbeat, cluster.self, master, strconv.FormatInt(currentEpoch, 10),
+		strconv.FormatInt(version, 10), joinNodes(nodes), joinNodes(pfailNodes), joinNodes(failNodes), slots)
+	for _, target := range targets {
+		go cluster.sendHeartbeat(target, heartbeat)
+	}
+	if startElection {
+		go cluster.failover(replicaOf)
+	}
+	if replicaOf != "" {
+		go cluster.replicationCron()
+	}
+}
+
+func (cluster *Cluster) sendHeartbeat(node string, heartbeat CmdLine) {
+	if !cluster.hasPeerConnection(node) {
+		cluster.topologyMu.Lock()
+		cluster.addPeerConnection(node)
+		cluster.topologyMu.Unlock()
+	}
+	atomic.AddInt64(&cluster.bus.messagesSent, 1)
+	reply := cluster.relayPeer(node, makeMigrationConn(0), heartbeat)
+	bus := cluster.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	state, ok := bus.nodes[node]
+	if !ok {
+		return
+	}
+	state.sending = false
+	if protocol.IsErrorReply(reply) {
+		// keep pingSent, so that the node will be flagged PFAIL after timeout
+		return
+	}
+	state.pingSent = time.Time{}
+	state.pongRecv = time.Now()
+	if state.pfail || state.fail {
+		logger.Info("node " + node + " is reachable again")
+	}
+	state.pfail = false
+	state.fail = false
+}
+
+func (cluster *Cluster) hasPeerConnection(node string) bool {
+	cluster.topologyMu.RLock()
+	defer cluster.topologyMu.RUnlock()
+	_, ok := cluster.peerConnection[node]
+	return ok
+}
+
+// execHeartbeat updates states of nodes by heartbeat from a peer
+// cmdLine: _heartbeat sender replica-of current-epoch topology-version nodes pfail-nodes fail-nodes slots
+func execHeartbeat(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 9 {
+		return protocol.MakeArgNumErrReply(relayHeartbeat)
+	}
+	sender := string(cmdLine[1])
+	replicaOf := string(cmdLine[2])
+	if replicaOf == emptyArg {
+		replicaOf = ""
+	}
+	epoch, err1 := strconv.ParseInt(string(cmdLine[3]), 10, 64)
+	version, err2 := strconv.ParseInt(string(cmdLine[4]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return protocol.MakeErrReply("ERR illegal heartbeat")
+	}
+	if sender == cluster.self {
+		return protocol.MakeStatusReply("PONG")
+	}
+	atomic.AddInt64(&cluster.bus.messagesReceived, 1)
+	// replicas do not take part in topology changes, and a failed master misses changes made while it was
+	// unreachable, both of them follow the newer topology in heartbeats
+	demoted := false
+	cluster.topologyMu.Lock()
+	if version > cluster.version && cluster.pending == nil {
+		nodes := splitNodes(cmdLine[5])
+		// assignment of sender is taken in slots mode, since the changes missed are unknown
+		slots, _ := parseSlots(cmdLine[8])
+		// current node must not serve keys any more once replaced by its replica
+		demoted = containsNode(cluster.nodes, cluster.self) && !containsNode(nodes, cluster.self)
+		// masters still in topology pull keys they newly own like a committed change
+		cluster.pending = &topologyChange{
+			version:   version,
+			prevNodes: cluster.nodes,
+			nodes:     nodes,
+			aliases:   guessAliases(cluster.nodes, nodes),
+			slots:     slots,
+		}
+		cluster.commitTopology()
+	}
+	cluster.topologyMu.Unlock()
+	if demoted {
+		cluster.closeReplicationLinks()
+		logger.Warn(cluster.self + " was replaced in topology " + strconv.FormatInt(version, 10) +
+			", becomes replica of " + cluster.bus.getReplicaOf())
+	}
+
+	now := time.Now()
+	bus := cluster.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if epoch > bus.currentEpoch {
+		bus.currentEpoch = epoch
+	}
+	state := bus.getState(sender)
+	state.replicaOf = replicaOf
+	pfailNodes := splitNodes(cmdLine[6])
+	if replicaOf == "" {
+		// only masters take part in failure detection
+		for node, target := range bus.nodes {
+			if containsNode(pfailNodes, node) {
+				target.failReports[sender] = now
+			} else {
+				delete(target.failReports, sender)
+			}
+		}
+	}
+	for _, node := range splitNodes(cmdLine[7]) {
+		if target, ok := bus.nodes[node]; ok && !target.fail {
+			target.pfail = true
+			target.fail = true
+			logger.Warn("node " + node + " is marked as failed by " + sender)
+		}
+	}
+	return protocol.MakeStatusReply("PONG")
+}
+
+// failover runs an election as replica of the failed master, and replaces the master if won
+func (cluster *Cluster) failover(master string) {
+	bus := cluster.bus
+	defer func() {
+		bus.mu.Lock()
+		bus.electing = false
+		bus.mu.Unlock()
+	}()
+	nodes := cluster.getNodes()
+	bus.mu.Lock()
+	bus.currentEpoch++
+	epoch := bus.currentEpoch
+	bus.mu.Unlock()
+	logger.Info("start election for failed master " + master + " in epoch " + strconv.FormatInt(epoch, 10))
+
+	votes := 0
+	request := utils.ToCmdLine(relayFailoverAuth, strconv.FormatInt(epoch, 10), cluster.self, master)
+	for _, node := range nodes {
+		if node == master || cluster.isNodeFailed(node) {
+			continue
+		}
+		reply := cluster.relayPeer(node, makeMigrationConn(0), request)
+		if intReply, ok := reply.(*protocol.IntReply); ok && intReply.Code == 1 {
+			votes++
+		}
+	}
+	if votes < len(nodes)/2+1 {
+		logger.Warn("election in epoch " + strconv.FormatInt(epoch, 10) + " failed, got " + strconv.Itoa(votes) + " votes")
+		bus.mu.Lock()
+		bus.failoverAt = time.Now().Add(2 * getNodeTimeout())
+		bus.mu.Unlock()
+		return
+	}
+
+	newNodes := make([]string, len(nodes))
+	for i, node := range nodes {
+		if node == master {
+			newNodes[i] = cluster.self
+		} else {
+			newNodes[i] = node
+		}
+	}
+	reply := cluster.changeTopology(makeMigrationConn(0), newNodes, map[string]string{master: cluster.self})
+	if protocol.IsErrorReply(reply) {
+		logger.Error("replace failed master " + master + " failed: " + reply.(protocol.ErrorReply).Error())
+		bus.mu.Lock()
+		bus.failoverAt = time.Now().Add(heartbeatInterval)
+		bus.mu.Unlock()
+		return
+	}
+	logger.Info("replaced failed master " + master + " in epoch " + strconv.FormatInt(epoch, 10))
+}
+
+// execFailoverAuth votes for the replica of a failed master, a master votes at most once per epoch
+// cmdLine: _failoverauth epoch replica master
+func execFailoverAuth(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 4 {
+		return protocol.MakeArgNumErrReply(relayFailoverAuth)
+	}
+	epoch, err := strconv.ParseInt(string(cmdLine[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal epoch")
+	}
+	replica := string(cmdLine[2])
+	master := string(cmdLine[3])
+	nodes := cluster.getNodes()
+	bus := cluster.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if epoch > bus.currentEpoch {
+		bus.currentEpoch = epoch
+	}
+	if !containsNode(nodes, cluster.self) || !containsNode(nodes, master) || epoch <= bus.lastVoteEpoch {
+		return protocol.MakeIntReply(0)
+	}
+	masterState, ok1 := bus.nodes[master]
+	replicaState, ok2 := bus.nodes[replica]
+	if !ok1 || !masterState.fail || !ok2 || replicaState.replicaOf != master {
+		return protocol.MakeIntReply(0)
+	}
+	bus.lastVoteEpoch = epoch
+	logger.Info("vote for " + replica + " to replace " + master + " in epoch " + strconv.FormatInt(epoch, 10))
+	return protocol.MakeIntReply(1)
+}
+
+// execClusterInfo: CLUSTER INFO
+func (cluster *Cluster) execClusterInfo() redis.Reply {
+	nodes := cluster.getNodes()
+	cluster.topologyMu.RLock()
+	version := cluster.version
+	cluster.topologyMu.RUnlock()
+
+	bus := cluster.bus
+	bus.mu.Lock()
+	state := "ok"
+	var pfail, fail []string
+	for _, node := range nodes {
+		if nodeState, ok := bus.nodes[node]; ok {
+			if nodeState.fail {
+				fail = append(fail, node)
+				state = "fail"
+			} else if nodeState.pfail {
+				pfail = append(pfail, node)
+			}
+		}
+	}
+	knownNodes := len(bus.nodes)
+	if _, ok := bus.nodes[cluster.self]; !ok {
+		knownNodes++
+	}
+	currentEpoch := bus.currentEpoch
+	bus.mu.Unlock()
+
+	fields := [][2]string{
+		{"cluster_enabled", "1"},
+		{"cluster_state", state},
+	}
+	if cluster.slots != nil {
+		var assigned, slotsPfail, slotsFail int
+		for _, r := range cluster.slots.GetRanges() {
+			count := int(r.End - r.Start + 1)
+			assigned += count
+			if containsNode(fail, r.Node) {
+				slotsFail += count
+			} else if containsNode(pfail, r.Node) {
+				slotsPfail += count
+			}
+		}
+		fields = append(fields,
+			[2]string{"cluster_slots_assigned", strconv.Itoa(assigned)},
+			[2]string{"cluster_slots_ok", strconv.Itoa(assigned - slotsPfail - slotsFail)},
+			[2]string{"cluster_slots_pfail", strconv.Itoa(slotsPfail)},
+			[2]string{"cluster_slots_fail", strconv.Itoa(slotsFail)},
+		)
+	}
+	fields = append(fields,
+		[2]string{"cluster_known_nodes", strconv.Itoa(knownNodes)},
+		[2]string{"cluster_size", strconv.Itoa(len(nodes))},
+		[2]string{"cluster_nodes_pfail", strconv.Itoa(len(pfail))},
+		[2]string{"cluster_nodes_fail", strconv.Itoa(len(fail))},
+		[2]string{"cluster_current_epoch", strconv.FormatInt(currentEpoch, 10)},
+		[2]string{"cluster_topology_version", strconv.FormatInt(version, 10)},
+		[2]string{"cluster_stats_messages_sent", strconv.FormatInt(atomic.LoadInt64(&bus.messagesSent), 10)},
+		[2]string{"cluster_stats_messages_received", strconv.FormatInt(atomic.LoadInt64(&bus.messagesReceived), 10)},
+	)
+	fields = append(fields, cluster.replicationInfo()...)
+	var buf bytes.Buffer
+	for _, field := range fields {
+		buf.WriteString(field[0] + ":" + field[1] + protocol.CRLF)
+	}
+	return protocol.MakeBulkReply(buf.Bytes())
+}
+
+// getNodeFlags returns flags of node in `CLUSTER NODES`, and its master
+func (cluster *Cluster) getNodeFlags(node string) (string, string) {
+	bus := cluster.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	var flags []string
+	replicaOf := ""
+	if node == cluster.self {
+		flags = append(flags, "myself")
+		replicaOf = bus.replicaOf
+	} else if state, ok := bus.nodes[node]; ok {
+		replicaOf = state.replicaOf
+	}
+	if replicaOf == "" {
+		flags = append(flags, "master")
+	} else {
+		flags = append(flags, "slave")
+	}
+	if state, ok := bus.nodes[node]; ok {
+		if state.fail {
+			flags = append(flags, "fail")
+		} else if state.pfail {
+			flags = append(flags, "fail?")
+		}
+	}
+	return strings.Join(flags, ","), replicaOf
+}
+
+// getReplicas returns known replicas in cluster, including current node
+func (cluster *Cluster) getReplicas() []string {
+	bus := cluster.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	var replicas []string
+	if bus.replicaOf != "" {
+		replicas = append(replicas, cluster.self)
+	}
+	for node, state := range bus.nodes {
+		if state.replicaOf != "" {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
@@ -0,0 +1,155 @@
+package cluster
+
+import (
+	"godis/interface/redis"
+	"godis/lib/slot"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"strconv"
+	"testing"
+)
+
+// makeTestCluster creates a node of cluster without starting bus, peers are never dialed unless relayed
+func makeTestCluster(self string, nodes []string, replicaOf string, version int64) *Cluster {
+	cluster := &Cluster{
+		self:           self,
+		nodes:          nodes,
+		version:        version,
+		peerPicker:     makePeerPicker(),
+		peerConnection: make(map[string]*peerConn),
+		muxWorkers:     makeMuxPool(muxMaxWorkers),
+		bus:            makeClusterBus(replicaOf),
+		replication:    makeReplication(),
+		relayImpl: func(cluster *Cluster, node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+			return protocol.MakeErrReply("ERR unreachable")
+		},
+	}
+	cluster.peerPicker.AddNode(nodes...)
+	return cluster
+}
+
+func closeTestCluster(cluster *Cluster) {
+	cluster.topologyMu.Lock()
+	defer cluster.topologyMu.Unlock()
+	for _, peer := range cluster.peerConnection {
+		peer.close()
+	}
+}
+
+func makeHeartbeat(sender string, replicaOf string, epoch int64, version int64, nodes []string) CmdLine {
+	if replicaOf == "" {
+		replicaOf = emptyArg
+	}
+	return utils.ToCmdLine(relayHeartbeat, sender, replicaOf, strconv.FormatInt(epoch, 10),
+		strconv.FormatInt(version, 10), joinNodes(nodes), emptyArg, emptyArg, emptyArg)
+}
+
+func TestFailedMasterRejoin(t *testing.T) {
+	// a:6399 failed and was replaced by its replica a:6400 in epoch 3 and topology 2
+	prevNodes := []string{"a:6399", "b:6399", "c:6399"}
+	nodes := []string{"a:6400", "b:6399", "c:6399"}
+	cluster := makeTestCluster("a:6399", prevNodes, "", 1)
+	defer closeTestCluster(cluster)
+
+	// heartbeat in stale topology changes nothing
+	execHeartbeat(cluster, nil, makeHeartbeat("b:6399", "", 1, 1, prevNodes))
+	if cluster.bus.getReplicaOf() != "" {
+		t.Fatal("master should not be demoted by stale topology")
+	}
+
+	reply := execHeartbeat(cluster, nil, makeHeartbeat("b:6399", "", 3, 2, nodes))
+	if protocol.IsErrorReply(reply) {
+		t.Fatal(string(reply.ToBytes()))
+	}
+	if cluster.bus.getReplicaOf() != "a:6400" {
+		t.Errorf("failed master should be replica of a:6400, actual %q", cluster.bus.getReplicaOf())
+	}
+	if cluster.version != 2 || joinNodes(cluster.getNodes()) != joinNodes(nodes) {
+		t.Errorf("topology is not updated: %d %v", cluster.version, cluster.getNodes())
+	}
+	if cluster.bus.currentEpoch != 3 {
+		t.Errorf("epoch is not updated: %d", cluster.bus.currentEpoch)
+	}
+	for i := 0; i < 100; i++ {
+		if node := cluster.peerPicker.PickNode("key" + strconv.Itoa(i)); node == "a:6399" {
+			t.Fatal("failed master should not serve keys")
+		}
+	}
+	// new master rejects replication from the demoted node
+	reply = execReplSync(cluster, nil, utils.ToCmdLine(relayReplSync, "d:6399", emptyArg))
+	if !protocol.IsErrorReply(reply) {
+		t.Error("demoted node should not accept replicas")
+	}
+}
+
+func TestReplicaFollowsTopology(t *testing.T) {
+	prevNodes := []string{"a:6399", "b:6399"}
+	nodes := []string{"a:6400", "b:6399"}
+	// replica a:6401 missed the failover of its master
+	cluster := makeTestCluster("a:6401", prevNodes, "a:6399", 1)
+	defer closeTestCluster(cluster)
+	execHeartbeat(cluster, nil, makeHeartbeat("b:6399", "", 2, 2, nodes))
+	if cluster.bus.getReplicaOf() != "a:6400" {
+		t.Errorf("replica should follow a:6400, actual %q", cluster.bus.getReplicaOf())
+	}
+
+	// a master forgotten while it was unreachable follows nobody
+	cluster = makeTestCluster("a:6400", nodes, "", 2)
+	defer closeTestCluster(cluster)
+	execHeartbeat(cluster, nil, makeHeartbeat("b:6399", "", 3, 3, []string{"b:6399"}))
+	if cluster.bus.getReplicaOf() != "" {
+		t.Error("forgotten node has no master to follow")
+	}
+}
+
+func TestGuessAliases(t *testing.T) {
+	aliases := guessAliases([]string{"a", "b", "c"}, []string{"a", "d", "c", "e"})
+	if len(aliases) != 1 || aliases["b"] != "d" {
+		t.Errorf("wrong aliases: %v", aliases)
+	}
+	aliases = guessAliases([]string{"a", "b", "c"}, []string{"a", "c", "d"})
+	if len(aliases) != 1 || aliases["b"] != "d" {
+		t.Errorf("wrong aliases: %v", aliases)
+	}
+	aliases = guessAliases([]string{"a", "b", "c", "d"}, []string{"c", "d", "e", "f"})
+	if len(aliases) != 0 {
+		t.Errorf("wrong aliases: %v", aliases)
+	}
+}
+
+func TestFollowSlots(t *testing.T) {
+	prevNodes := []string{"a:6399", "b:6399", "c:6399"}
+	coordinator := slot.New()
+	coordinator.AddNode(prevNodes...)
+	coordinator.SetNode(0, "c:6399")
+	prevSlots := slot.FormatRanges(coordinator.GetRanges())
+
+	// d:6399 joins with a node list different from the cluster
+	cluster := makeTestCluster("d:6399", []string{"d:6399"}, "", 0)
+	defer closeTestCluster(cluster)
+	cluster.slots = slot.New()
+	cluster.peerPicker = cluster.slots
+	cluster.slots.AddNode(prevNodes...)
+	nodes := append(prevNodes, "d:6399")
+	reply := execTopology(cluster, nil, utils.ToCmdLine(relayTopology, "prepare", "1",
+		joinNodes(prevNodes), joinNodes(nodes), emptyArg, prevSlots))
+	if protocol.IsErrorReply(reply) {
+		t.Fatal(string(reply.ToBytes()))
+	}
+	execTopology(cluster, nil, utils.ToCmdLine(relayTopology, "commit", "1"))
+	coordinator.AddNode("d:6399")
+	if actual := slot.FormatRanges(cluster.slots.GetRanges()); actual != slot.FormatRanges(coordinator.GetRanges()) {
+		t.Errorf("joined node should have the same assignment, actual %s", actual)
+	}
+	if owner := cluster.getMigration().prevPicker.(*slot.Map).GetNode(0); owner != "c:6399" {
+		t.Errorf("previous owner should be taken from coordinator, actual %s", owner)
+	}
+
+	// the assignment of sender is taken when following topology in heartbeats
+	coordinator.RemoveNode("a:6399")
+	execHeartbeat(cluster, nil, utils.ToCmdLine(relayHeartbeat, "b:6399", emptyArg, "0", "2",
+		joinNodes(nodes[1:]), emptyArg, emptyArg, slot.FormatRanges(coordinator.GetRanges())))
+	if actual := slot.FormatRanges(cluster.slots.GetRanges()); actual != slot.FormatRanges(coordinator.GetRanges()) {
+		t.Errorf("follower should have the same assignment, actual %s", actual)
+	}
+}
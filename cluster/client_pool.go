@@ -1,51 +0,0 @@
-package cluster
-
-import (
-	"context"
-	"errors"
-	pool "github.com/jolestar/go-commons-pool/v2"
-	"godis/config"
-	"godis/lib/utils"
-	"godis/redis/client"
-)
-
-type connectionFactory struct {
-	Peer string
-}
-
-func (f *connectionFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
-	c, err := client.MakeClient(f.Peer)
-	if err != nil {
-		return nil, err
-	}
-	c.Start()
-	// all peers of cluster should use the same password
-	if config.Properties.RequirePass != "" {
-		c.Send(utils.ToCmdLine("AUTH", config.Properties.RequirePass))
-	}
-	return pool.NewPooledObject(c), nil
-}
-
-func (f *connectionFactory) DestroyObject(ctx context.Context, object *pool.PooledObject) error {
-	c, ok := object.Object.(*client.Client)
-	if !ok {
-		return errors.New("type mismatch")
-	}
-	c.Close()
-	return nil
-}
-
-func (f *connectionFactory) ValidateObject(ctx context.Context, object *pool.PooledObject) bool {
-	// do validate
-	return true
-}
-
-func (f *connectionFactory) ActivateObject(ctx context.Context, object *pool.PooledObject) error {
-	// do activate
-	return nil
-}
-
-func (f *connectionFactory) PassivateObject(ctx context.Context, object *pool.PooledObject) error {
-	// dp passivate
-	return nil
-}
@@ -1,9 +1,7 @@
 package cluster
 
 import (
-	"context"
 	"fmt"
-	"github.com/jolestar/go-commons-pool/v2"
 	"godis/config"
 	"godis/dataStruct/dict"
 	database2 "godis/database"
@@ -12,13 +10,16 @@ import (
 	"godis/lib/consistenthash"
 	"godis/lib/idgenerator"
 	"godis/lib/logger"
+	"godis/lib/slot"
 	"godis/redis/protocol"
 	"runtime/debug"
 	"strings"
+	"sync"
 )
 
 type PeerPicker interface {
 	AddNode(keys ...string)
+	RemoveNode(keys ...string)
 	PickNode(key string) string
 }
 
@@ -27,12 +28,44 @@ type PeerPicker interface {
 type Cluster struct {
 	self string
 
+	// topologyMu guards nodes, peerConnection and the topology change states below
+	topologyMu     sync.RWMutex
 	nodes          []string
 	peerPicker     PeerPicker
-	peerConnection map[string]*pool.ObjectPool
+	peerConnection map[string]*peerConn
+	// version increases every time nodes of cluster changed
+	version int64
+	// pending is the prepared but not committed topology change
+	pending *topologyChange
+	// migration is the latest key migration caused by topology change
+	migration *migration
+	bus       *clusterBus
+	// replication holds links to replicas on master, and replication state on replica
+	replication *replication
+	// slots is the peerPicker in slots mode, nil in consistent-hash mode
+	slots *slot.Map
+	// connections who sent `ASKING`, *redis.Connection -> placeholder
+	asking sync.Map
+	// connections in READONLY mode, *redis.Connection -> placeholder
+	readOnly sync.Map
+	// sessions of client connections on peers, redis.Connection -> session id
+	sessions    sync.Map
+	nextSession uint64
+	// sessions from peers, connection from peer -> *muxPeer
+	muxPeers sync.Map
+	// muxWorkers limits requests from peers executing concurrently
+	muxWorkers *muxPool
 
 	db           database.EmbedDB
 	transactions *dict.SimpleDict // id -> Transaction
+	// journal persists states of distributed transactions
+	journal *tccJournal
+	// txMu guards coordinating and decisions
+	txMu sync.Mutex
+	// transactions coordinated by current node and not decided yet, id -> participants
+	coordinating map[string][]string
+	// results of transactions coordinated by current node, kept until all participants acknowledged
+	decisions map[string]*txDecision
 
 	idGenerator *idgenerator.IDGenerator
 	// use a variable to allow injecting stub for testing
@@ -41,6 +74,8 @@ type Cluster struct {
 
 const (
 	replicas = 4
+	// shardingSlots distributes keys by 16384 hash slots like redis cluster
+	shardingSlots = "slots"
 )
 
 // if only one node involved in a transaction, just execute the command don't apply tcc procedure
@@ -56,11 +91,20 @@ func MakeCluster() *Cluster {
 
 		db:             database2.NewStandaloneServer(),
 		transactions:   dict.MakeSimple(),
-		peerPicker:     consistenthash.New(replicas, nil),
-		peerConnection: make(map[string]*pool.ObjectPool),
+		coordinating:   make(map[string][]string),
+		decisions:      make(map[string]*txDecision),
+		peerConnection: make(map[string]*peerConn),
+		muxWorkers:     makeMuxPool(muxMaxWorkers),
 
 		idGenerator: idgenerator.MakeGenerator(config.Properties.Self),
 		relayImpl:   defaultRelayImpl,
+		bus:         makeClusterBus(config.Properties.ClusterReplicaOf),
+		replication: makeReplication(),
+	}
+	cluster.db.SetWriteCallback(cluster.propagate)
+	cluster.peerPicker = makePeerPicker()
+	if slots, ok := cluster.peerPicker.(*slot.Map); ok {
+		cluster.slots = slots
 	}
 	contains := make(map[string]struct{})
 	nodes := make([]string, 0, len(config.Properties.Peers)+1)
@@ -71,20 +115,60 @@ func MakeCluster() *Cluster {
 		contains[peer] = struct{}{}
 		nodes = append(nodes, peer)
 	}
-	nodes = append(nodes, config.Properties.Self)
+	if config.Properties.ClusterReplicaOf == "" {
+		// replicas serve no keys until promoted
+		nodes = append(nodes, config.Properties.Self)
+	}
 	cluster.peerPicker.AddNode(nodes...)
-	ctx := context.Background()
 	for _, peer := range config.Properties.Peers {
-		cluster.peerConnection[peer] = pool.NewObjectPoolWithDefaultConfig(ctx, &connectionFactory{
-			Peer: peer,
-		})
+		cluster.addPeerConnection(peer)
 	}
 	cluster.nodes = nodes
+	journal, err := openTccJournal(config.Properties.ClusterTccJournal)
+	if err != nil {
+		panic(err)
+	}
+	cluster.journal = journal
+	cluster.recoverTransactions()
+	cluster.startBus()
 	return cluster
 }
 
+// makePeerPicker creates an empty PeerPicker according to `cluster-sharding`
+func makePeerPicker() PeerPicker {
+	if config.Properties.ClusterSharding == shardingSlots {
+		return slot.New()
+	}
+	return consistenthash.New(replicas, nil)
+}
+
+// addPeerConnection creates connection to peer if not exists, invoker should hold topologyMu
+func (cluster *Cluster) addPeerConnection(peer string) {
+	if _, ok := cluster.peerConnection[peer]; ok || peer == cluster.self {
+		return
+	}
+	cluster.peerConnection[peer] = makePeerConn(peer, false)
+}
+
+// getNodes returns a copy of nodes in cluster
+func (cluster *Cluster) getNodes() []string {
+	cluster.topologyMu.RLock()
+	defer cluster.topologyMu.RUnlock()
+	nodes := make([]string, len(cluster.nodes))
+	copy(nodes, cluster.nodes)
+	return nodes
+}
+
 // Close stops current node of cluster
 func (cluster *Cluster) Close() {
+	cluster.bus.close()
+	cluster.closeReplicationLinks()
+	cluster.journal.close()
+	cluster.topologyMu.Lock()
+	for _, peer := range cluster.peerConnection {
+		peer.close()
+	}
+	cluster.topologyMu.Unlock()
 	cluster.db.Close()
 }
 
@@ -133,6 +217,26 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 			return protocol.MakeArgNumErrReply(cmdName)
 		}
 		return execSelect(c, cmdLine)
+	} else if cmdName == "cluster" {
+		return execCluster(cluster, c, cmdLine)
+	} else if cmdName == "asking" {
+		return execAsking(cluster, c, cmdLine)
+	} else if cmdName == relayMux {
+		return execMux(cluster, c, cmdLine)
+	}
+	// keys may be not moved to current node yet during migration
+	if errReply := cluster.ensureMigrated(c, cmdLine); errReply != nil {
+		return errReply
+	}
+	if cluster.isRedirectMode() {
+		errReply, keyed := cluster.checkRedirect(c, cmdLine)
+		if errReply != nil {
+			return errReply
+		}
+		if keyed && (c == nil || !c.InMultiState()) {
+			// all keys are served by current node
+			return cluster.db.Exec(c, cmdLine)
+		}
 	}
 	if c != nil && c.InMultiState() {
 		return database2.EnqueueCmd(c, cmdLine)
@@ -147,5 +251,14 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 
 // AfterClientClose does some clean after client close connection
 func (cluster *Cluster) AfterClientClose(c redis.Connection) {
+	cluster.asking.Delete(c)
+	cluster.readOnly.Delete(c)
+	cluster.closeSessions(c)
 	cluster.db.AfterClientClose(c)
 }
+
+// SetKeysChangedCallback registers the callback fired whenever keys in local database were modified.
+// Modifications on peers are not reported, clients should track keys on the node owning them.
+func (cluster *Cluster) SetKeysChangedCallback(callback database.KeysChangedCallback) {
+	cluster.db.SetKeysChangedCallback(callback)
+}
@@ -1,37 +1,23 @@
 package cluster
 
 import (
-	"context"
 	"errors"
 	"godis/interface/redis"
-	"godis/lib/utils"
-	"godis/redis/client"
 	"godis/redis/protocol"
-	"strconv"
 )
 
-func (cluster *Cluster) getPeerClient(peer string) (*client.Client, error) {
-	factory, ok := cluster.peerConnection[peer]
-	if !ok {
-		return nil, errors.New("connection factory not found")
-	}
-	raw, err := factory.BorrowObject(context.Background())
-	if err != nil {
-		return nil, err
-	}
-	conn, ok := raw.(*client.Client)
-	if !ok {
-		return nil, errors.New("connection factory make wrong type")
-	}
-	return conn, nil
-}
+// _local cmdName args..., see broadcast
+const relayLocal = "_local"
 
-func (cluster *Cluster) returnPeerClient(peer string, peerClient *client.Client) error {
-	connectionFactory, ok := cluster.peerConnection[peer]
+// getPeerConn returns connection to peer
+func (cluster *Cluster) getPeerConn(peer string) (*peerConn, error) {
+	cluster.topologyMu.RLock()
+	defer cluster.topologyMu.RUnlock()
+	conn, ok := cluster.peerConnection[peer]
 	if !ok {
-		return errors.New("connection factory not found")
+		return nil, errors.New("connection to " + peer + " not found")
 	}
-	return connectionFactory.ReturnObject(context.Background(), peerClient)
+	return conn, nil
 }
 
 var defaultRelayImpl = func(cluster *Cluster, node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
@@ -39,15 +25,19 @@ var defaultRelayImpl = func(cluster *Cluster, node string, c redis.Connection, c
 		// to self db
 		return cluster.db.Exec(c, cmdLine)
 	}
-	peerClient, err := cluster.getPeerClient(node)
+	if cluster.isNodeFailed(node) {
+		return protocol.MakeErrReply("CLUSTERDOWN The cluster is down, node " + node + " is in FAIL state")
+	}
+	return cluster.relayPeer(node, c, cmdLine)
+}
+
+// relayPeer sends command to peer regardless of its state
+func (cluster *Cluster) relayPeer(node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	peer, err := cluster.getPeerConn(node)
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
-	defer func() {
-		_ = cluster.returnPeerClient(node, peerClient)
-	}()
-	peerClient.Send(utils.ToCmdLine("SELECT", strconv.Itoa(c.GetDBIndex())))
-	return peerClient.Send(cmdLine)
+	return peer.send(cluster.sessionOf(c), c.GetDBIndex(), cmdLine)
 }
 
 // relay function relays command to peer
@@ -58,12 +48,38 @@ func (cluster *Cluster) relay(peer string, c redis.Connection, args [][]byte) re
 	return cluster.relayImpl(cluster, peer, c, args)
 }
 
-// broadcast function broadcasts command to all node in cluster
+// relayIdempotent relays command to peer, and sends it again if the reply timed out.
+// The timed out request may still be executed by peer, so the command must be idempotent
+func (cluster *Cluster) relayIdempotent(peer string, c redis.Connection, args [][]byte) redis.Reply {
+	reply := cluster.relay(peer, c, args)
+	if isPeerTimeout(reply) {
+		reply = cluster.relay(peer, c, args)
+	}
+	return reply
+}
+
+// broadcast function executes command on local db of all node in cluster
+// the command is wrapped by _local for peers, otherwise peers may broadcast it again
 func (cluster *Cluster) broadcast(c redis.Connection, args [][]byte) map[string]redis.Reply {
 	result := make(map[string]redis.Reply)
-	for _, node := range cluster.nodes {
-		reply := cluster.relay(node, c, args)
+	localCmdLine := append([][]byte{[]byte(relayLocal)}, args...)
+	for _, node := range cluster.getNodes() {
+		var reply redis.Reply
+		if node == cluster.self {
+			reply = cluster.db.Exec(c, args)
+		} else {
+			reply = cluster.relay(node, c, localCmdLine)
+		}
 		result[node] = reply
 	}
 	return result
 }
+
+// execLocal executes command on local db of current node
+// cmdLine: _local cmdName args...
+func execLocal(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply(relayLocal)
+	}
+	return cluster.db.Exec(c, cmdLine[1:])
+}
@@ -3,7 +3,6 @@ package cluster
 import (
 	"godis/interface/redis"
 	"godis/redis/protocol"
-	"strconv"
 )
 
 // Del atomically removes given writeKeys from cluster, writeKeys can be distributed on any node
@@ -24,11 +23,10 @@ func Del(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	}
 	// prepare
 	var errReply redis.Reply
-	txID := cluster.idGenerator.NextID()
-	txIDStr := strconv.FormatInt(txID, 10)
+	txID := cluster.beginTransaction(groupMap)
 	rollback := false
 	for peer, peerKeys := range groupMap {
-		peerArgs := []string{txIDStr, "DEL"}
+		peerArgs := []string{txID, "DEL"}
 		peerArgs = append(peerArgs, peerKeys...)
 		var resp redis.Reply
 		if peer == cluster.self {
@@ -42,7 +40,7 @@ func Del(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 			break
 		}
 	}
-	var respList []redis.Reply
+	var respList map[string]redis.Reply
 	if rollback {
 		// rollback
 		requestRollback(cluster, c, txID, groupMap)
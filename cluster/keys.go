@@ -2,7 +2,12 @@ package cluster
 
 import (
 	"godis/interface/redis"
+	"godis/lib/utils"
 	"godis/redis/protocol"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // FlushDB removes all data in current database
@@ -21,7 +26,194 @@ func FlushDB(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	return protocol.MakeErrReply("error occurs: " + errReply.Error())
 }
 
+// SwapDB swaps databases on all nodes
+func SwapDB(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 3 {
+		return protocol.MakeArgNumErrReply("swapdb")
+	}
+	replies := cluster.broadcast(c, args)
+	if errReply := getBroadcastError(replies); errReply != nil {
+		return errReply
+	}
+	return &protocol.OkReply{}
+}
+
 // FlushAll removes all data in cluster
 func FlushAll(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	return FlushDB(cluster, c, args)
 }
+
+/*
+ * Commands below gather keys of the whole cluster, SCAN uses a composite cursor:
+ * the lower scanNodeBits bits are index of node in sorted nodes, the higher bits are cursor of the node.
+ */
+
+const (
+	// _scan cursor [MATCH pattern] [COUNT count] [TYPE type], returns flat list: next-cursor keys...
+	relayScan    = "_scan"
+	scanNodeBits = 10
+	scanNodeMask = 1<<scanNodeBits - 1
+)
+
+// Keys returns keys matching pattern in cluster
+func Keys(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	replies := cluster.broadcast(c, args)
+	if errReply := getBroadcastError(replies); errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, 0)
+	seen := make(map[string]struct{})
+	for _, v := range replies {
+		keysReply, ok := v.(*protocol.MultiBulkReply)
+		if !ok {
+			// no keys
+			continue
+		}
+		for _, key := range keysReply.Args {
+			// keys may exist on both source and target node during migration
+			if _, ok := seen[string(key)]; ok {
+				continue
+			}
+			seen[string(key)] = struct{}{}
+			result = append(result, key)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// DBSize returns count of keys in cluster
+func DBSize(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	replies := cluster.broadcast(c, args)
+	if errReply := getBroadcastError(replies); errReply != nil {
+		return errReply
+	}
+	var size int64
+	for _, v := range replies {
+		if intReply, ok := v.(*protocol.IntReply); ok {
+			size += intReply.Code
+		}
+	}
+	return protocol.MakeIntReply(size)
+}
+
+// RandomKey returns a random key in cluster
+func RandomKey(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	nodes := cluster.getNodes()
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	for _, node := range nodes {
+		var reply redis.Reply
+		if node == cluster.self {
+			reply = cluster.db.Exec(c, args)
+		} else {
+			reply = cluster.relay(node, c, append([][]byte{[]byte(relayLocal)}, args...))
+		}
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			return makeNodeErrReply(node, errReply.Error())
+		}
+		if bulkReply, ok := reply.(*protocol.BulkReply); ok {
+			return bulkReply
+		}
+	}
+	return &protocol.NullBulkReply{}
+}
+
+// Scan iterates keys in cluster node by node
+func Scan(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("scan")
+	}
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	nodes := cluster.getNodes()
+	// all nodes should agree on index of nodes
+	sort.Strings(nodes)
+	nodeIndex := int(cursor & scanNodeMask)
+	nodeCursor := cursor >> scanNodeBits
+	if nodeIndex >= len(nodes) {
+		// nodes changed during iteration
+		return makeScanReply(0, nil)
+	}
+	node := nodes[nodeIndex]
+	relayCmdLine := append(utils.ToCmdLine(relayScan, strconv.FormatUint(nodeCursor, 10)), args[2:]...)
+	var reply redis.Reply
+	if node == cluster.self {
+		reply = execRelayedScan(cluster, c, relayCmdLine)
+	} else {
+		reply = cluster.relay(node, c, relayCmdLine)
+	}
+	if errReply, ok := reply.(protocol.ErrorReply); ok {
+		return makeNodeErrReply(node, errReply.Error())
+	}
+	scanReply, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(scanReply.Args) == 0 {
+		return makeNodeErrReply(node, "illegal scan reply")
+	}
+	nextNodeCursor, err := strconv.ParseUint(string(scanReply.Args[0]), 10, 64)
+	if err != nil {
+		return makeNodeErrReply(node, "illegal scan cursor")
+	}
+	var nextCursor uint64
+	if nextNodeCursor != 0 {
+		nextCursor = nextNodeCursor<<scanNodeBits | uint64(nodeIndex)
+	} else if nodeIndex+1 < len(nodes) {
+		// continue with next node
+		nextCursor = uint64(nodeIndex + 1)
+	}
+	return makeScanReply(nextCursor, scanReply.Args[1:])
+}
+
+// execRelayedScan scans keys of current node, the reply is flattened to a MultiBulkReply: next-cursor keys...,
+// proxy flattens replies of backends the same way, so that Scan handles replies of all nodes in one format
+func execRelayedScan(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply(relayScan)
+	}
+	cmdLine := append(utils.ToCmdLine("scan"), args[1:]...)
+	return flattenScanReply(cluster.db.Exec(c, cmdLine))
+}
+
+// flattenScanReply converts reply of SCAN to a flat list: next-cursor keys...
+func flattenScanReply(reply redis.Reply) redis.Reply {
+	scanReply, ok := reply.(*protocol.MultiRawReply)
+	if !ok || len(scanReply.Replies) != 2 {
+		return reply
+	}
+	cursorReply, ok := scanReply.Replies[0].(*protocol.BulkReply)
+	if !ok {
+		return reply
+	}
+	result := [][]byte{cursorReply.Arg}
+	if keysReply, ok := scanReply.Replies[1].(*protocol.MultiBulkReply); ok {
+		result = append(result, keysReply.Args...)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+func makeScanReply(cursor uint64, keys [][]byte) redis.Reply {
+	if keys == nil {
+		keys = [][]byte{}
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		protocol.MakeMultiBulkReply(keys),
+	})
+}
+
+// getBroadcastError returns the first error in replies of broadcast with its node
+func getBroadcastError(replies map[string]redis.Reply) redis.Reply {
+	for node, v := range replies {
+		if errReply, ok := v.(protocol.ErrorReply); ok {
+			return makeNodeErrReply(node, errReply.Error())
+		}
+	}
+	return nil
+}
+
+// makeNodeErrReply adds the node to error message
+func makeNodeErrReply(node string, msg string) redis.Reply {
+	return protocol.MakeErrReply("ERR node " + node + ": " + strings.TrimPrefix(msg, "ERR "))
+}
@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	database2 "godis/database"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"strings"
+	"time"
+)
+
+// RPopLPush pops the last element of source and pushes it to the head of destination, keys can be on any node
+func RPopLPush(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 3 {
+		return protocol.MakeArgNumErrReply("rpoplpush")
+	}
+	src := string(args[1])
+	dest := string(args[2])
+	if node, ok := cluster.isSameNode(src, dest); ok {
+		return cluster.relay(node, c, args)
+	}
+	return moveListElement(cluster, c, src, dest, "right", "left")
+}
+
+// LMove pops an element of source and pushes it to destination, keys can be on any node
+// args: LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func LMove(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 5 {
+		return protocol.MakeArgNumErrReply("lmove")
+	}
+	src := string(args[1])
+	dest := string(args[2])
+	from := strings.ToLower(string(args[3]))
+	to := strings.ToLower(string(args[4]))
+	if (from != "left" && from != "right") || (to != "left" && to != "right") {
+		return protocol.MakeSyntaxErrReply()
+	}
+	if node, ok := cluster.isSameNode(src, dest); ok {
+		return cluster.relay(node, c, args)
+	}
+	return moveListElement(cluster, c, src, dest, from, to)
+}
+
+// blockingPollInterval is the interval of retrying blocking commands whose keys are not all on current node,
+// since requests to peers cannot block longer than cluster-peer-timeout
+const blockingPollInterval = 100 * time.Millisecond
+
+// lmpop pops elements from the first non-empty list of keys which may be distributed on any node.
+// args are arguments of LMPOP after the keys: LEFT|RIGHT [COUNT count]
+func lmpop(cluster *Cluster, c redis.Connection, keys []string, args [][]byte) redis.Reply {
+	for _, key := range keys {
+		node := cluster.peerPicker.PickNode(key)
+		reply := cluster.relay(node, c, append(utils.ToCmdLine("LMPop", "1", key), args...))
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+		if _, ok := reply.(*protocol.NullMultiBulkReply); ok {
+			continue
+		}
+		return reply
+	}
+	return protocol.MakeNullMultiBulkReply()
+}
+
+// LMPop pops elements from the first non-empty list, keys can be on any node
+// args: LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func LMPop(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 4 {
+		return protocol.MakeArgNumErrReply("lmpop")
+	}
+	keys, _, _, errReply := database2.ParseLMPop(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	if node, ok := cluster.isSameNode(keys...); ok {
+		return cluster.relay(node, c, args)
+	}
+	return lmpop(cluster, c, keys, args[len(keys)+2:])
+}
+
+// BLMPop pops elements from the first non-empty list, or blocks until any list is pushed.
+// It blocks on local db if all keys are on current node, otherwise polls nodes of the keys until timeout
+// args: BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func BLMPop(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 5 {
+		return protocol.MakeArgNumErrReply("blmpop")
+	}
+	timeout, errReply := database2.ParseBlockingTimeout(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	keys, _, _, errReply := database2.ParseLMPop(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	if node, ok := cluster.isSameNode(keys...); ok && node == cluster.self {
+		return cluster.db.Exec(c, args)
+	}
+	return pollBlocking(c, timeout, func() redis.Reply {
+		return lmpop(cluster, c, keys, args[len(keys)+3:])
+	})
+}
+
+// pollBlocking retries the non-blocking try every blockingPollInterval,
+// until it returns something other than null array, timeout or the client disconnected
+func pollBlocking(c redis.Connection, timeout time.Duration, try func() redis.Reply) redis.Reply {
+	deadline := time.Now().Add(timeout)
+	for {
+		reply := try()
+		if _, ok := reply.(*protocol.NullMultiBulkReply); !ok {
+			return reply
+		}
+		wait := blockingPollInterval
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return reply
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.Done():
+			timer.Stop()
+			return reply
+		}
+	}
+}
+
+// moveListElement moves an element from the given side of src to the given side of dest in a cross-node transaction
+func moveListElement(cluster *Cluster, c redis.Connection, src, dest, from, to string) redis.Reply {
+	index, popCmd := "0", "LPop"
+	if from == "right" {
+		index, popCmd = "-1", "RPop"
+	}
+	pushCmd := "LPush"
+	if to == "right" {
+		pushCmd = "RPush"
+	}
+	return execReadThenWrite(cluster, c, []string{src, dest}, func() ([]CmdLine, redis.Reply) {
+		reply := cluster.relay(cluster.peerPicker.PickNode(src), c, utils.ToCmdLine("LIndex", src, index))
+		element, ok := reply.(*protocol.BulkReply)
+		if !ok {
+			// error or source is empty
+			return nil, reply
+		}
+		// check type of destination before popping, in case of losing the element
+		typeReply := cluster.relay(cluster.peerPicker.PickNode(dest), c, utils.ToCmdLine("Type", dest))
+		if protocol.IsErrorReply(typeReply) {
+			return nil, typeReply
+		}
+		if status, ok := typeReply.(*protocol.StatusReply); ok && status.Status != "none" && status.Status != "list" {
+			return nil, &protocol.WrongTypeErrReply{}
+		}
+		cmdLines := []CmdLine{
+			utils.ToCmdLine(popCmd, src),
+			utils.ToCmdLine3(pushCmd, []byte(dest), element.Arg),
+		}
+		return cmdLines, protocol.MakeBulkReply(element.Arg)
+	})
+}
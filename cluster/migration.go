@@ -0,0 +1,714 @@
+package cluster
+
+import (
+	"godis/config"
+	database2 "godis/database"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/lib/slot"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * migration.go implements live membership changes.
+ * `CLUSTER MEET ip port` adds a node and `CLUSTER FORGET node-id` removes a node, the node received the command
+ * coordinates all nodes to change topology in two phases:
+ *   1. `_topology prepare version prev-nodes nodes aliases slots`: every node saves the new node list
+ *   2. `_topology commit version`: every node applies the new node list
+ * In slots mode, slots are the assignment of coordinator before the change, so that nodes joining the cluster
+ * start from the same assignment, and only slots of added or removed nodes are moved.
+ * After committed, every node pulls keys it newly owns from their previous owners in background.
+ * If a failed node is replaced by its replica, keys of the failed node are pulled from the replica instead.
+ * New owner holds the lock of key while pulling it: previous owner dumps the key, new owner restores it and then
+ * tells previous owner to remove it, so that the key survives a timed out pull.
+ * A command accessing a key not pulled yet pulls it before executing, so that every key is served by exactly
+ * one node during migration.
+ */
+
+const (
+	relayTopology = "_topology"
+	// _migratekey version key: dumps key, returns result of DumpKey
+	relayMigrateKey = "_migratekey"
+	// _migrateack version key: removes key restored by its new owner
+	relayMigrateAck = "_migrateack"
+	// _migratekeys version node cursor count: scans keys in selected db should be moved to node,
+	// returns next cursor followed by keys
+	relayMigrateKeys = "_migratekeys"
+	// migrateKeysBatch is the count of keys scanned by each _migratekeys
+	migrateKeysBatch = 1000
+
+	// writes may reach previous owner before it applies new topology, so keys are scanned several rounds
+	maxMigrateRounds = 3
+)
+
+// topologyChange is a prepared topology change
+type topologyChange struct {
+	version   int64
+	prevNodes []string
+	nodes     []string
+	// aliases: failed node -> replica serving its data
+	aliases map[string]string
+	// prevSlots is the assignment before change, slots is the assignment after change.
+	// They are nil in consistent-hash mode or if unknown
+	prevSlots []*slot.Range
+	slots     []*slot.Range
+}
+
+// migration stores the progress of moving keys to current node after topology changed
+type migration struct {
+	version int64
+	// prevPicker finds previous owner of keys
+	prevPicker PeerPicker
+	// sources are previous owners of keys, in name of prevPicker
+	sources   []string
+	aliases   map[string]string
+	startedAt time.Time
+
+	sourcesDone  int32
+	keysMigrated int64
+	keysFailed   int64
+
+	mu         sync.Mutex
+	finishedAt time.Time
+	lastErr    string
+	// keys restored but may be not removed from source, "db-index key" -> placeholder.
+	// They must not be pulled again, otherwise the stale copy on source may overwrite later writes
+	unacked map[string]struct{}
+}
+
+// getAddr returns address of node holding keys of the given source
+func (m *migration) getAddr(source string) string {
+	if addr, ok := m.aliases[source]; ok {
+		return addr
+	}
+	return source
+}
+
+func (m *migration) isRunning() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.finishedAt.IsZero()
+}
+
+func (m *migration) isUnacked(dbIndex int, key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.unacked[strconv.Itoa(dbIndex)+" "+key]
+	return ok
+}
+
+func (m *migration) setUnacked(dbIndex int, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unacked == nil {
+		m.unacked = make(map[string]struct{})
+	}
+	m.unacked[strconv.Itoa(dbIndex)+" "+key] = struct{}{}
+}
+
+func (m *migration) fail(err string) {
+	atomic.AddInt64(&m.keysFailed, 1)
+	m.mu.Lock()
+	m.lastErr = err
+	m.mu.Unlock()
+	logger.Error("migration " + strconv.FormatInt(m.version, 10) + ": " + err)
+}
+
+func (cluster *Cluster) getMigration() *migration {
+	cluster.topologyMu.RLock()
+	defer cluster.topologyMu.RUnlock()
+	return cluster.migration
+}
+
+// emptyArg is the placeholder of empty list in internal commands
+const emptyArg = "-"
+
+func joinNodes(nodes []string) string {
+	if len(nodes) == 0 {
+		return emptyArg
+	}
+	return strings.Join(nodes, ",")
+}
+
+func splitNodes(arg []byte) []string {
+	if len(arg) == 0 || string(arg) == emptyArg {
+		return nil
+	}
+	return strings.Split(string(arg), ",")
+}
+
+func joinAliases(aliases map[string]string) string {
+	pairs := make([]string, 0, len(aliases))
+	for node, alias := range aliases {
+		pairs = append(pairs, node+"="+alias)
+	}
+	return joinNodes(pairs)
+}
+
+func splitAliases(arg []byte) map[string]string {
+	aliases := make(map[string]string)
+	for _, pair := range splitNodes(arg) {
+		if i := strings.Index(pair, "="); i > 0 {
+			aliases[pair[:i]] = pair[i+1:]
+		}
+	}
+	return aliases
+}
+
+// formatSlots returns assignment of slots as argument of internal commands, invoker should hold topologyMu
+func (cluster *Cluster) formatSlots() string {
+	if cluster.slots == nil {
+		return emptyArg
+	}
+	return slot.FormatRanges(cluster.slots.GetRanges())
+}
+
+func parseSlots(arg []byte) ([]*slot.Range, error) {
+	if string(arg) == emptyArg {
+		return nil, nil
+	}
+	return slot.ParseRanges(string(arg))
+}
+
+func containsNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// execClusterMeet: CLUSTER MEET ip port
+func (cluster *Cluster) execClusterMeet(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("cluster|meet")
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return protocol.MakeErrReply("ERR Invalid node address specified: " + string(args[0]) + ":" + string(args[1]))
+	}
+	node := net.JoinHostPort(string(args[0]), string(args[1]))
+	nodes := cluster.getNodes()
+	if containsNode(nodes, node) {
+		return protocol.MakeOkReply()
+	}
+	return cluster.changeTopology(c, append(nodes, node), nil)
+}
+
+// execClusterForget: CLUSTER FORGET node-id, address of node is also accepted
+func (cluster *Cluster) execClusterForget(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("cluster|forget")
+	}
+	target := string(args[0])
+	nodes := cluster.getNodes()
+	newNodes := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node == target || slot.GenNodeID(node) == target {
+			target = node
+			continue
+		}
+		newNodes = append(newNodes, node)
+	}
+	if len(newNodes) == len(nodes) {
+		return protocol.MakeErrReply("ERR Unknown node " + string(args[0]))
+	}
+	if target == cluster.self {
+		return protocol.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	return cluster.changeTopology(c, newNodes, nil)
+}
+
+// changeTopology coordinates all nodes in current and new topology to apply the new node list,
+// aliases maps failed nodes to replicas serving their data, nodes in FAIL state are skipped
+func (cluster *Cluster) changeTopology(c redis.Connection, nodes []string, aliases map[string]string) redis.Reply {
+	cluster.topologyMu.RLock()
+	prevNodes := make([]string, len(cluster.nodes))
+	copy(prevNodes, cluster.nodes)
+	version := cluster.version + 1
+	slots := cluster.formatSlots()
+	busy := cluster.pending != nil || (cluster.migration != nil && cluster.migration.isRunning())
+	cluster.topologyMu.RUnlock()
+	if busy {
+		return protocol.MakeErrReply("ERR cluster topology is changing, try again later")
+	}
+	// current node must be prepared first to create connections to new nodes
+	members := []string{cluster.self}
+	for _, node := range append(prevNodes, nodes...) {
+		if !containsNode(members, node) && !cluster.isNodeFailed(node) {
+			members = append(members, node)
+		}
+	}
+	versionStr := strconv.FormatInt(version, 10)
+	prepareCmd := utils.ToCmdLine(relayTopology, "prepare", versionStr,
+		joinNodes(prevNodes), joinNodes(nodes), joinAliases(aliases), slots)
+	for i, member := range members {
+		reply := cluster.relayTopology(member, c, prepareCmd)
+		if protocol.IsErrorReply(reply) {
+			for _, prepared := range members[:i+1] {
+				cluster.relayTopology(prepared, c, utils.ToCmdLine(relayTopology, "abort", versionStr))
+			}
+			return protocol.MakeErrReply("ERR prepare topology on " + member + " failed: " +
+				strings.TrimPrefix(reply.(protocol.ErrorReply).Error(), "ERR "))
+		}
+	}
+	var errReply redis.Reply
+	for _, member := range members {
+		reply := cluster.relayTopology(member, c, utils.ToCmdLine(relayTopology, "commit", versionStr))
+		if protocol.IsErrorReply(reply) {
+			// the node will catch up when its keys are pulled by other nodes
+			logger.Error("commit topology on " + member + " failed: " + reply.(protocol.ErrorReply).Error())
+			errReply = reply
+		}
+	}
+	if errReply != nil {
+		return errReply
+	}
+	return protocol.MakeOkReply()
+}
+
+func (cluster *Cluster) relayTopology(node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if node == cluster.self {
+		return execTopology(cluster, c, cmdLine)
+	}
+	return cluster.relay(node, c, cmdLine)
+}
+
+// execTopology is the participant of topology change
+// _topology prepare version prev-nodes nodes aliases slots
+// _topology commit version
+// _topology abort version
+func execTopology(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 3 {
+		return protocol.MakeArgNumErrReply(relayTopology)
+	}
+	action := strings.ToLower(string(cmdLine[1]))
+	version, err := strconv.ParseInt(string(cmdLine[2]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal topology version")
+	}
+	cluster.topologyMu.Lock()
+	defer cluster.topologyMu.Unlock()
+	switch action {
+	case "prepare":
+		if len(cmdLine) != 7 {
+			return protocol.MakeArgNumErrReply(relayTopology)
+		}
+		if version <= cluster.version {
+			return protocol.MakeErrReply("ERR topology version " + string(cmdLine[2]) + " is stale")
+		}
+		if cluster.pending != nil && cluster.pending.version != version {
+			return protocol.MakeErrReply("ERR another topology change is in progress")
+		}
+		if cluster.migration != nil && cluster.migration.isRunning() {
+			return protocol.MakeErrReply("ERR keys are migrating, try again later")
+		}
+		prevSlots, err := parseSlots(cmdLine[6])
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		change := &topologyChange{
+			version:   version,
+			prevNodes: splitNodes(cmdLine[3]),
+			nodes:     splitNodes(cmdLine[4]),
+			aliases:   splitAliases(cmdLine[5]),
+			prevSlots: prevSlots,
+		}
+		for _, node := range change.nodes {
+			cluster.addPeerConnection(node)
+		}
+		for _, node := range change.prevNodes {
+			cluster.addPeerConnection(node)
+		}
+		for _, node := range change.aliases {
+			cluster.addPeerConnection(node)
+		}
+		cluster.pending = change
+		return protocol.MakeOkReply()
+	case "commit":
+		if version <= cluster.version {
+			// committed already when keys were pulled
+			return protocol.MakeOkReply()
+		}
+		if cluster.pending == nil || cluster.pending.version != version {
+			return protocol.MakeErrReply("ERR topology version " + string(cmdLine[2]) + " is not prepared")
+		}
+		cluster.commitTopology()
+		return protocol.MakeOkReply()
+	case "abort":
+		if cluster.pending != nil && cluster.pending.version == version {
+			cluster.pending = nil
+		}
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown topology action '" + action + "'")
+}
+
+// commitTopology applies the pending topology change and starts migration, invoker should hold topologyMu
+func (cluster *Cluster) commitTopology() {
+	change := cluster.pending
+	cluster.pending = nil
+	var prevPicker PeerPicker
+	if cluster.slots != nil {
+		if change.prevSlots != nil {
+			cluster.slots.SetRanges(change.prevNodes, change.prevSlots)
+		}
+		prevPicker = cluster.slots.Clone()
+		// replicas take over slots of failed masters
+		for node, alias := range change.aliases {
+			cluster.slots.ReplaceNode(node, alias)
+		}
+	} else {
+		prevPicker = makePeerPicker()
+		prevPicker.AddNode(change.prevNodes...)
+	}
+	cluster.applyNodes(change.version, change.nodes)
+	if cluster.slots != nil && change.slots != nil {
+		cluster.slots.SetRanges(change.nodes, change.slots)
+	}
+	cluster.onTopologyChanged(change.aliases)
+
+	m := &migration{
+		version:    change.version,
+		prevPicker: prevPicker,
+		aliases:    change.aliases,
+		startedAt:  time.Now(),
+	}
+	if containsNode(change.nodes, cluster.self) {
+		for _, node := range change.prevNodes {
+			if m.getAddr(node) != cluster.self {
+				m.sources = append(m.sources, node)
+			}
+		}
+	}
+	cluster.migration = m
+	logger.Info("topology " + strconv.FormatInt(change.version, 10) + " committed, nodes: " + joinNodes(change.nodes))
+	go cluster.runMigration(m)
+}
+
+// applyNodes replaces nodes of cluster without moving keys, invoker should hold topologyMu
+func (cluster *Cluster) applyNodes(version int64, nodes []string) {
+	prevNodes := cluster.nodes
+	if cluster.slots != nil {
+		// assignment may be replaced by the view of coordinator
+		prevNodes = cluster.slots.GetNodes()
+	}
+	var added, removed []string
+	for _, node := range nodes {
+		if !containsNode(prevNodes, node) {
+			added = append(added, node)
+		}
+	}
+	for _, node := range prevNodes {
+		if !containsNode(nodes, node) {
+			removed = append(removed, node)
+		}
+	}
+	for _, node := range nodes {
+		cluster.addPeerConnection(node)
+	}
+	cluster.peerPicker.AddNode(added...)
+	cluster.peerPicker.RemoveNode(removed...)
+	cluster.nodes = nodes
+	cluster.version = version
+}
+
+// catchUpTopology commits the prepared topology if a peer has committed it already
+func (cluster *Cluster) catchUpTopology(version int64) redis.Reply {
+	cluster.topologyMu.Lock()
+	defer cluster.topologyMu.Unlock()
+	if version <= cluster.version {
+		return nil
+	}
+	if cluster.pending != nil && cluster.pending.version == version {
+		cluster.commitTopology()
+		return nil
+	}
+	return protocol.MakeErrReply("TRYAGAIN topology version " + strconv.FormatInt(version, 10) + " is not prepared")
+}
+
+// runMigration pulls keys owned by current node from previous owners
+func (cluster *Cluster) runMigration(m *migration) {
+	for _, source := range m.sources {
+		for dbIndex := 0; dbIndex < config.Properties.Databases; dbIndex++ {
+			for round := 0; round < maxMigrateRounds; round++ {
+				found, ok := cluster.pullKeys(m, dbIndex, source)
+				if !ok || found == 0 {
+					break
+				}
+			}
+		}
+		atomic.AddInt32(&m.sourcesDone, 1)
+	}
+
+	cluster.topologyMu.Lock()
+	m.mu.Lock()
+	m.finishedAt = time.Now()
+	m.mu.Unlock()
+	// connections to removed nodes are useless once keys were pulled, replicas are still reached by heartbeats
+	for peer, peerConn := range cluster.peerConnection {
+		if !containsNode(cluster.nodes, peer) && !cluster.bus.isReplica(peer) &&
+			(cluster.pending == nil || !containsNode(cluster.pending.nodes, peer)) {
+			peerConn.close()
+			delete(cluster.peerConnection, peer)
+		}
+	}
+	cluster.topologyMu.Unlock()
+	logger.Info("migration " + strconv.FormatInt(m.version, 10) + " finished, " +
+		strconv.FormatInt(atomic.LoadInt64(&m.keysMigrated), 10) + " keys migrated, " +
+		strconv.FormatInt(atomic.LoadInt64(&m.keysFailed), 10) + " failed")
+}
+
+func makeMigrationConn(dbIndex int) redis.Connection {
+	conn := &connection.FakeConn{}
+	conn.SelectDB(dbIndex)
+	return conn
+}
+
+// pullKeys scans all keys in db on source should be moved to current node and pulls them,
+// returns count of keys found, ok is false if scanning failed
+func (cluster *Cluster) pullKeys(m *migration, dbIndex int, source string) (int, bool) {
+	found := 0
+	cursor := 0
+	for {
+		keys, next, errReply := cluster.listMigratingKeys(dbIndex, m.getAddr(source), m.version, cursor)
+		if errReply != nil {
+			m.fail("list keys on " + m.getAddr(source) + " failed: " + errReply.(protocol.ErrorReply).Error())
+			return found, false
+		}
+		found += len(keys)
+		for _, key := range keys {
+			cluster.pullKey(m, dbIndex, source, key)
+		}
+		if next == 0 {
+			return found, true
+		}
+		cursor = next
+	}
+}
+
+// listMigratingKeys returns a batch of keys on source should be moved to current node, and the next cursor
+func (cluster *Cluster) listMigratingKeys(dbIndex int, source string, version int64, cursor int) ([]string, int, redis.Reply) {
+	reply := cluster.relay(source, makeMigrationConn(dbIndex), utils.ToCmdLine(relayMigrateKeys,
+		strconv.FormatInt(version, 10), cluster.self, strconv.Itoa(cursor), strconv.Itoa(migrateKeysBatch)))
+	if protocol.IsErrorReply(reply) {
+		return nil, 0, reply
+	}
+	multiBulk, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(multiBulk.Args) == 0 {
+		return nil, 0, protocol.MakeErrReply("ERR illegal reply of " + relayMigrateKeys)
+	}
+	next, err := strconv.Atoi(string(multiBulk.Args[0]))
+	if err != nil {
+		return nil, 0, protocol.MakeErrReply("ERR illegal cursor of " + relayMigrateKeys)
+	}
+	keys := make([]string, len(multiBulk.Args)-1)
+	for i, arg := range multiBulk.Args[1:] {
+		keys[i] = string(arg)
+	}
+	return keys, next, nil
+}
+
+// pullKey moves key from source to current node if it does not exist locally
+func (cluster *Cluster) pullKey(m *migration, dbIndex int, source string, key string) redis.Reply {
+	conn := makeMigrationConn(dbIndex)
+	keys := []string{key}
+	// hold the lock, so that commands on the key wait until pulled
+	cluster.db.RWLocks(dbIndex, keys, nil)
+	defer cluster.db.RWUnLocks(dbIndex, keys, nil)
+	if _, ok := cluster.db.ExecWithLock(conn, utils.ToCmdLine("ExistIn", key)).(*protocol.MultiBulkReply); ok {
+		return nil
+	}
+	if m.isUnacked(dbIndex, key) {
+		return nil
+	}
+	addr := m.getAddr(source)
+	version := strconv.FormatInt(m.version, 10)
+	reply := cluster.relayIdempotent(addr, conn, utils.ToCmdLine(relayMigrateKey, version, key))
+	if protocol.IsErrorReply(reply) {
+		m.fail("pull " + key + " from " + addr + " failed: " + reply.(protocol.ErrorReply).Error())
+		return reply
+	}
+	dump, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(dump.Args) < 2 {
+		// key not exists
+		return nil
+	}
+	result := cluster.db.ExecWithLock(conn, makeRenameToCmd("RenameTo", key, dump))
+	if protocol.IsErrorReply(result) {
+		m.fail("restore " + key + " failed: " + result.(protocol.ErrorReply).Error())
+		return result
+	}
+	reply = cluster.relayIdempotent(addr, conn, utils.ToCmdLine(relayMigrateAck, version, key))
+	if protocol.IsErrorReply(reply) {
+		// key is served by current node anyway, the copy on source is left over
+		m.setUnacked(dbIndex, key)
+		m.fail("remove " + key + " from " + addr + " failed: " + reply.(protocol.ErrorReply).Error())
+		return nil
+	}
+	atomic.AddInt64(&m.keysMigrated, 1)
+	return nil
+}
+
+// ensureMigrated pulls keys of the command which are owned by current node but not moved here yet
+func (cluster *Cluster) ensureMigrated(c redis.Connection, cmdLine CmdLine) redis.Reply {
+	m := cluster.getMigration()
+	if m == nil || len(m.sources) == 0 || !m.isRunning() {
+		return nil
+	}
+	writeKeys, readKeys := database2.GetRelatedKeys(cmdLine)
+	dbIndex := 0
+	if c != nil {
+		dbIndex = c.GetDBIndex()
+	}
+	for _, key := range append(writeKeys, readKeys...) {
+		if cluster.peerPicker.PickNode(key) != cluster.self {
+			continue
+		}
+		source := m.prevPicker.PickNode(key)
+		if !containsNode(m.sources, source) {
+			continue
+		}
+		if errReply := cluster.pullKey(m, dbIndex, source, key); errReply != nil {
+			return errReply
+		}
+	}
+	return nil
+}
+
+// checkMigrateKey returns the key of _migratekey or _migrateack if it is owned by another node in given version
+func (cluster *Cluster) checkMigrateKey(cmdLine CmdLine) (string, redis.Reply) {
+	if len(cmdLine) != 3 {
+		return "", protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	version, err := strconv.ParseInt(string(cmdLine[1]), 10, 64)
+	if err != nil {
+		return "", protocol.MakeErrReply("ERR illegal topology version")
+	}
+	if errReply := cluster.catchUpTopology(version); errReply != nil {
+		return "", errReply
+	}
+	key := string(cmdLine[2])
+	if cluster.peerPicker.PickNode(key) == cluster.self {
+		return "", protocol.MakeErrReply("ERR key " + key + " is owned by " + cluster.self)
+	}
+	return key, nil
+}
+
+// execMigrateKey dumps the key which is pulled by its new owner.
+// The key is kept until _migrateack, so that the new owner can pull it again if the reply timed out
+// cmdLine: _migratekey version key
+func execMigrateKey(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	key, errReply := cluster.checkMigrateKey(cmdLine)
+	if errReply != nil {
+		return errReply
+	}
+	keys := []string{key}
+	dbIndex := c.GetDBIndex()
+	cluster.db.RWLocks(dbIndex, nil, keys)
+	defer cluster.db.RWUnLocks(dbIndex, nil, keys)
+	return cluster.db.ExecWithLock(c, utils.ToCmdLine("DumpKey", key))
+}
+
+// execMigrateAck removes the key restored by its new owner, it is idempotent
+// cmdLine: _migrateack version key
+func execMigrateAck(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	key, errReply := cluster.checkMigrateKey(cmdLine)
+	if errReply != nil {
+		return errReply
+	}
+	keys := []string{key}
+	dbIndex := c.GetDBIndex()
+	cluster.db.RWLocks(dbIndex, keys, nil)
+	defer cluster.db.RWUnLocks(dbIndex, keys, nil)
+	return cluster.db.ExecWithLock(c, utils.ToCmdLine("Del", key))
+}
+
+// execMigrateKeys scans keys in selected db should be moved to the given node, count is the number of keys scanned.
+// Returns next cursor followed by keys, the scan is finished once next cursor is 0
+// cmdLine: _migratekeys version node cursor count
+func execMigrateKeys(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 5 {
+		return protocol.MakeArgNumErrReply(relayMigrateKeys)
+	}
+	version, err := strconv.ParseInt(string(cmdLine[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal topology version")
+	}
+	if errReply := cluster.catchUpTopology(version); errReply != nil {
+		return errReply
+	}
+	node := string(cmdLine[2])
+	reply := cluster.db.Exec(c, utils.ToCmdLine("Scan", string(cmdLine[3]), "COUNT", string(cmdLine[4])))
+	scanReply, ok := reply.(*protocol.MultiRawReply)
+	if !ok || len(scanReply.Replies) != 2 {
+		return reply
+	}
+	cursor := scanReply.Replies[0].(*protocol.BulkReply).Arg
+	result := [][]byte{cursor}
+	for _, key := range scanReply.Replies[1].(*protocol.MultiBulkReply).Args {
+		if cluster.peerPicker.PickNode(string(key)) == node {
+			result = append(result, key)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execClusterMigration: CLUSTER MIGRATION, reports progress of the latest key migration on current node
+func (cluster *Cluster) execClusterMigration() redis.Reply {
+	cluster.topologyMu.RLock()
+	version := cluster.version
+	m := cluster.migration
+	cluster.topologyMu.RUnlock()
+	state := "none"
+	var sources, sourcesDone, migrated, failed, elapsed int64
+	var lastErr string
+	if m != nil {
+		state = "running"
+		m.mu.Lock()
+		finishedAt := m.finishedAt
+		lastErr = m.lastErr
+		m.mu.Unlock()
+		if finishedAt.IsZero() {
+			finishedAt = time.Now()
+		} else {
+			state = "finished"
+		}
+		sources = int64(len(m.sources))
+		sourcesDone = int64(atomic.LoadInt32(&m.sourcesDone))
+		migrated = atomic.LoadInt64(&m.keysMigrated)
+		failed = atomic.LoadInt64(&m.keysFailed)
+		elapsed = int64(finishedAt.Sub(m.startedAt) / time.Millisecond)
+	}
+	var lastErrReply redis.Reply = protocol.MakeNullBulkReply()
+	if lastErr != "" {
+		lastErrReply = protocol.MakeBulkReply([]byte(lastErr))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("state")),
+		protocol.MakeBulkReply([]byte(state)),
+		protocol.MakeBulkReply([]byte("topology-version")),
+		protocol.MakeIntReply(version),
+		protocol.MakeBulkReply([]byte("sources")),
+		protocol.MakeIntReply(sources),
+		protocol.MakeBulkReply([]byte("sources-done")),
+		protocol.MakeIntReply(sourcesDone),
+		protocol.MakeBulkReply([]byte("keys-migrated")),
+		protocol.MakeIntReply(migrated),
+		protocol.MakeBulkReply([]byte("keys-failed")),
+		protocol.MakeIntReply(failed),
+		protocol.MakeBulkReply([]byte("elapsed-ms")),
+		protocol.MakeIntReply(elapsed),
+		protocol.MakeBulkReply([]byte("last-error")),
+		lastErrReply,
+	})
+}
@@ -5,7 +5,6 @@ import (
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/redis/protocol"
-	"strconv"
 )
 
 const keyExistsErr = "key exists"
@@ -65,11 +64,10 @@ func MSet(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 
 	//prepare
 	var errReply redis.Reply
-	txID := cluster.idGenerator.NextID()
-	txIDStr := strconv.FormatInt(txID, 10)
+	txID := cluster.beginTransaction(groupMap)
 	rollback := false
 	for peer, group := range groupMap {
-		peerArgs := []string{txIDStr, "MSET"}
+		peerArgs := []string{txID, "MSET"}
 		for _, k := range group {
 			peerArgs = append(peerArgs, k, valueMap[k])
 		}
@@ -125,11 +123,10 @@ func MSetNX(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	// 1. Normal tcc preparation (undo log and lock related keys)
 	// 2. Peer checks whether any key already exists, If so it will return keyExistsErr. Then coordinator will request rollback over all participated nodes
 	var errReply redis.Reply
-	txID := cluster.idGenerator.NextID()
-	txIDStr := strconv.FormatInt(txID, 10)
+	txID := cluster.beginTransaction(groupMap)
 	rollback := false
 	for node, group := range groupMap {
-		nodeArgs := []string{txIDStr, "MSETNX"}
+		nodeArgs := []string{txID, "MSETNX"}
 		for _, k := range group {
 			nodeArgs = append(nodeArgs, k, valueMap[k])
 		}
@@ -1,16 +1,21 @@
 package cluster
 
 import (
+	"errors"
 	"godis/database"
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/redis/protocol"
+	"sort"
 	"strconv"
 )
 
 const relayMulti = "_multi"
 const innerWatch = "_watch"
 
+// watchingChangedErr is returned by participant whose watching keys changed while preparing cross-node MULTI
+const watchingChangedErr = "ERR watching keys changed"
+
 var relayMultiBytes = []byte(relayMulti)
 
 // cmdLine == []string{"exec"}
@@ -40,7 +45,7 @@ func execMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.R
 	}
 	groupMap := cluster.groupBy(keys)
 	if len(groupMap) > 1 {
-		return protocol.MakeErrReply("ERR MULTI commands transaction must within one slot in cluster mode")
+		return execCrossNodeMulti(cluster, conn, watching, cmdLines)
 	}
 	var peer string
 	// assert len(groupMap) == 1
@@ -55,11 +60,8 @@ func execMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.R
 	return execMultiOnOtherNode(cluster, conn, peer, watching, cmdLines)
 }
 
-func execMultiOnOtherNode(cluster *Cluster, conn redis.Connection, peer string, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
-	defer func() {
-		conn.ClearQueuedCmds()
-		conn.SetMultiState(false)
-	}()
+// makeRelayedMulti encodes watching keys and commands into format of execRelayedMulti
+func makeRelayedMulti(watching map[string]uint32, cmdLines []CmdLine) CmdLine {
 	relayCmdLine := [][]byte{ // relay it to executing node
 		relayMultiBytes,
 	}
@@ -71,6 +73,49 @@ func execMultiOnOtherNode(cluster *Cluster, conn redis.Connection, peer string,
 	}
 	relayCmdLine = append(relayCmdLine, encodeCmdLine([]CmdLine{watchingCmdLine})...)
 	relayCmdLine = append(relayCmdLine, encodeCmdLine(cmdLines)...)
+	return relayCmdLine
+}
+
+// parseRelayedMulti decodes watching keys and commands made by makeRelayedMulti
+func parseRelayedMulti(cmdLine CmdLine) (map[string]uint32, []CmdLine, error) {
+	if len(cmdLine) < 2 {
+		return nil, nil, errors.New("ERR wrong number of arguments for '" + relayMulti + "' command")
+	}
+	decoded, err := parseEncodedMultiRawReply(cmdLine[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	var txCmdLines []CmdLine
+	for _, rep := range decoded.Replies {
+		mbr, ok := rep.(*protocol.MultiBulkReply)
+		if !ok {
+			return nil, nil, errors.New("exec failed")
+		}
+		txCmdLines = append(txCmdLines, mbr.Args)
+	}
+	if len(txCmdLines) == 0 {
+		return nil, nil, errors.New("exec failed")
+	}
+	watching := make(map[string]uint32)
+	watchCmdLine := txCmdLines[0] // format: _watch key1 ver1 key2 ver2...
+	for i := 2; i < len(watchCmdLine); i += 2 {
+		key := string(watchCmdLine[i-1])
+		verStr := string(watchCmdLine[i])
+		ver, err := strconv.ParseUint(verStr, 10, 64)
+		if err != nil {
+			return nil, nil, errors.New("watching command line failed")
+		}
+		watching[key] = uint32(ver)
+	}
+	return watching, txCmdLines[1:], nil
+}
+
+func execMultiOnOtherNode(cluster *Cluster, conn redis.Connection, peer string, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
+	defer func() {
+		conn.ClearQueuedCmds()
+		conn.SetMultiState(false)
+	}()
+	relayCmdLine := makeRelayedMulti(watching, cmdLines)
 	var rawRelayResult redis.Reply
 	if peer == cluster.self {
 		// this branch just for testing
@@ -103,30 +148,16 @@ func execRelayedMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine)
 	if len(cmdLine) < 2 {
 		return protocol.MakeArgNumErrReply("_exec")
 	}
-	decoded, err := parseEncodedMultiRawReply(cmdLine[1:])
+	watching, txCmdLines, err := parseRelayedMulti(cmdLine)
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
-	var txCmdLines []CmdLine
-	for _, rep := range decoded.Replies {
-		mbr, ok := rep.(*protocol.MultiBulkReply)
-		if !ok {
-			return protocol.MakeErrReply("exec failed")
+	for _, txCmdLine := range txCmdLines {
+		if errReply := cluster.ensureMigrated(conn, txCmdLine); errReply != nil {
+			return errReply
 		}
-		txCmdLines = append(txCmdLines, mbr.Args)
 	}
-	watching := make(map[string]uint32)
-	watchCmdLine := txCmdLines[0] // format: _watch key1 ver1 key2 ver2...
-	for i := 2; i < len(watchCmdLine); i += 2 {
-		key := string(watchCmdLine[i-1])
-		verStr := string(watchCmdLine[i])
-		ver, err := strconv.ParseUint(verStr, 10, 64)
-		if err != nil {
-			return protocol.MakeErrReply("watching command line failed")
-		}
-		watching[key] = uint32(ver)
-	}
-	rawResult := cluster.db.ExecMulti(conn, watching, txCmdLines[1:])
+	rawResult := cluster.db.ExecMulti(conn, watching, txCmdLines)
 	_, ok := rawResult.(*protocol.EmptyMultiBulkReply)
 	if ok {
 		return rawResult
@@ -138,24 +169,174 @@ func execRelayedMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine)
 	return encodeMultiRawReply(resultMBR)
 }
 
+// execCrossNodeMulti executes MULTI transaction whose keys are distributed on several nodes by TCC.
+// Every node prepares the commands related to its keys and checks its watching keys, then executes them while committing.
+// Keys of a single command must be served by one node.
+func execCrossNodeMulti(cluster *Cluster, conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
+	// node -> indexes of its commands
+	nodeCmds := make(map[string][]int)
+	var keyless []int
+	for i, cmdLine := range cmdLines {
+		writeKeys, readKeys := database.GetRelatedKeys(cmdLine)
+		keys := append(writeKeys, readKeys...)
+		if len(keys) == 0 {
+			keyless = append(keyless, i)
+			continue
+		}
+		node := cluster.peerPicker.PickNode(keys[0])
+		for _, key := range keys[1:] {
+			if cluster.peerPicker.PickNode(key) != node {
+				return protocol.MakeErrReply("ERR keys of '" + string(cmdLine[0]) + "' must be served by one node in cluster mode")
+			}
+		}
+		nodeCmds[node] = append(nodeCmds[node], i)
+	}
+	// node -> its watching keys
+	nodeWatching := make(map[string]map[string]uint32)
+	for key, ver := range watching {
+		node := cluster.peerPicker.PickNode(key)
+		if nodeWatching[node] == nil {
+			nodeWatching[node] = make(map[string]uint32)
+		}
+		nodeWatching[node][key] = ver
+	}
+	// participants of transaction, node -> keys
+	groupMap := make(map[string][]string)
+	for node := range nodeCmds {
+		groupMap[node] = nil
+	}
+	for node, keys := range nodeWatching {
+		for key := range keys {
+			groupMap[node] = append(groupMap[node], key)
+		}
+	}
+	if len(keyless) > 0 {
+		// commands without keys are executed by current node if possible
+		node := cluster.self
+		if _, ok := groupMap[node]; !ok {
+			for n := range groupMap {
+				node = n
+				break
+			}
+		}
+		nodeCmds[node] = append(nodeCmds[node], keyless...)
+		sort.Ints(nodeCmds[node])
+		if _, ok := groupMap[node]; !ok {
+			groupMap[node] = nil
+		}
+	}
+
+	// prepare
+	txID := cluster.beginTransaction(groupMap)
+	for node := range groupMap {
+		peerCmdLines := make([]CmdLine, 0, len(nodeCmds[node]))
+		for _, i := range nodeCmds[node] {
+			peerCmdLines = append(peerCmdLines, cmdLines[i])
+		}
+		prepareCmdLine := append(utils.ToCmdLine("Prepare", txID), makeRelayedMulti(nodeWatching[node], peerCmdLines)...)
+		resp := cluster.relayPrepare(node, conn, prepareCmdLine)
+		if errReply, ok := resp.(protocol.ErrorReply); ok {
+			requestRollback(cluster, conn, txID, groupMap)
+			if errReply.Error() == watchingChangedErr {
+				return protocol.MakeEmptyMultiBulkReply()
+			}
+			return errReply
+		}
+	}
+	// commit
+	respMap, errReply := requestCommit(cluster, conn, txID, groupMap)
+	if errReply != nil {
+		return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	// merge results in order of commands
+	results := make([]redis.Reply, len(cmdLines))
+	for node, resp := range respMap {
+		if len(nodeCmds[node]) == 0 {
+			// node only checks watching keys
+			continue
+		}
+		relayResult, ok := resp.(*protocol.MultiBulkReply)
+		if !ok {
+			return protocol.MakeErrReply("execute failed")
+		}
+		nodeResult, err := parseEncodedMultiRawReply(relayResult.Args)
+		if err != nil {
+			return protocol.MakeErrReply(err.Error())
+		}
+		if len(nodeResult.Replies) != len(nodeCmds[node]) {
+			return protocol.MakeErrReply("execute failed")
+		}
+		for i, reply := range nodeResult.Replies {
+			results[nodeCmds[node][i]] = reply
+		}
+	}
+	return protocol.MakeMultiRawReply(results)
+}
+
 func execWatch(cluster *Cluster, conn redis.Connection, args [][]byte) redis.Reply {
 	if len(args) < 2 {
 		return protocol.MakeArgNumErrReply("watch")
 	}
-	args = args[1:]
+	keys := make([]string, 0, len(args)-1)
+	for _, bkey := range args[1:] {
+		keys = append(keys, string(bkey))
+	}
+	versions, errReply := cluster.getVersions(conn, keys)
+	if errReply != nil {
+		return errReply
+	}
 	watching := conn.GetWatching()
-	for _, bkey := range args {
-		key := string(bkey)
+	for key, ver := range versions {
+		watching[key] = ver
+	}
+	return protocol.MakeOkReply()
+}
+
+// getVersions returns versions of keys from their nodes
+func (cluster *Cluster) getVersions(conn redis.Connection, keys []string) (map[string]uint32, redis.Reply) {
+	versions := make(map[string]uint32, len(keys))
+	for _, key := range keys {
 		peer := cluster.peerPicker.PickNode(key)
 		result := cluster.relay(peer, conn, utils.ToCmdLine("GetVer", key))
 		if protocol.IsErrorReply(result) {
-			return result
+			return nil, result
 		}
 		intResult, ok := result.(*protocol.IntReply)
 		if !ok {
-			return protocol.MakeErrReply("get version failed")
+			return nil, protocol.MakeErrReply("get version failed")
 		}
-		watching[key] = uint32(intResult.Code)
+		versions[key] = uint32(intResult.Code)
 	}
-	return protocol.MakeOkReply()
+	return versions, nil
+}
+
+// maxReadThenWriteRetries limits retries of execReadThenWrite when keys were modified by others
+const maxReadThenWriteRetries = 3
+
+// execReadThenWrite reads keys from their nodes by read, then executes commands returned by read in a cross-node
+// transaction. Keys are watched before reading, so that commands are not executed if keys were modified after
+// being read, and read is called again in this case. keys should contain destination too, otherwise writes to
+// destination by others during reading may be overwritten silently.
+// read returns commands to execute and the reply for client, nothing is executed if it returns error or no commands
+func execReadThenWrite(cluster *Cluster, c redis.Connection, keys []string, read func() ([]CmdLine, redis.Reply)) redis.Reply {
+	for i := 0; i < maxReadThenWriteRetries; i++ {
+		watching, errReply := cluster.getVersions(c, keys)
+		if errReply != nil {
+			return errReply
+		}
+		cmdLines, reply := read()
+		if protocol.IsErrorReply(reply) || len(cmdLines) == 0 {
+			return reply
+		}
+		result := execCrossNodeMulti(cluster, c, watching, cmdLines)
+		if _, ok := result.(*protocol.EmptyMultiBulkReply); ok {
+			// keys changed, read again
+			continue
+		}
+		if protocol.IsErrorReply(result) {
+			return result
+		}
+		return reply
+	}
+	return protocol.MakeErrReply("ERR keys were modified by others during execution, please retry")
 }
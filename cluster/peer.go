@@ -0,0 +1,576 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"godis/config"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/parser"
+	"godis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * peer.go implements the multiplexed transport between nodes of cluster.
+ * A node keeps one long-lived connection to each peer, requests are tagged with id, session and db index:
+ * `_mux id session db-index cmd args...`, and pipelined with batched writes.
+ * The peer replies `id raw-reply` once finished, so replies may be out of order and a slow request does not block
+ * others on the same connection.
+ * A session is the logical connection of a client on the sender, the peer executes requests of a session in order
+ * on a connection keeping its state, e.g. ASKING, READONLY and transaction, until the sender sends `_muxclose`
+ * or the peer connection is closed. Requests of session 0 keep no state and are executed concurrently.
+ * Requests are executed by a bounded number of workers, the peer stops reading requests once all workers are busy.
+ * A request timed out on the sender may still be executed by the peer, so commands re-sent on timeout, e.g.
+ * commit of transaction and _migratekey, are idempotent.
+ * In plain mode, e.g. connections from proxy to standalone backends, requests are sent as they are and replies are
+ * matched in order, `SELECT` is inserted once the db index differs from the previous request.
+ */
+
+const (
+	relayMux      = "_mux"
+	relayMuxClose = "_muxclose"
+
+	// peerMaxInflight limits requests waiting for reply on a connection, senders wait once it is reached
+	peerMaxInflight = 1024
+	// peerRedialInterval is the min interval between dials, requests fail fast during the interval
+	peerRedialInterval = 200 * time.Millisecond
+	// peerMaxBatchBytes is the max bytes written in one batch
+	peerMaxBatchBytes = 1 << 16
+	// muxMaxWorkers is the max number of requests from peers executing concurrently
+	muxMaxWorkers = 1024
+)
+
+// getPeerTimeout returns the max time to wait for a reply, including waiting for inflight limit
+func getPeerTimeout() time.Duration {
+	if config.Properties.ClusterPeerTimeout <= 0 {
+		return 3 * time.Second
+	}
+	return time.Duration(config.Properties.ClusterPeerTimeout) * time.Millisecond
+}
+
+var (
+	errPeerClosed  = errors.New("peer connection closed")
+	errPeerTimeout = errors.New("server time out")
+)
+
+type peerRequest struct {
+	id      uint64
+	dbIndex int
+	payload []byte
+	// conn is the connection the request was written to, nil if not written yet
+	conn  net.Conn
+	reply chan redis.Reply
+}
+
+// peerConn is a multiplexed connection to a peer, it reconnects automatically
+type peerConn struct {
+	addr     string
+	plain    bool
+	nextID   uint64
+	queue    chan *peerRequest
+	inflight chan struct{}
+	closing  chan struct{}
+
+	// mu guards fields below
+	mu       sync.Mutex
+	conn     net.Conn
+	lastDial time.Time
+	closed   bool
+	// pending requests waiting for reply, id -> request
+	pending map[uint64]*peerRequest
+	// written requests of conn in order, only used in plain mode
+	written []*peerRequest
+	// sessions have sent requests to peer, the peer should be notified when they are closed
+	sessions map[uint64]struct{}
+}
+
+// makePeerConn creates connection to peer, plain is true if the peer does not support `_mux`
+func makePeerConn(addr string, plain bool) *peerConn {
+	peer := &peerConn{
+		addr:     addr,
+		plain:    plain,
+		queue:    make(chan *peerRequest, peerMaxInflight),
+		inflight: make(chan struct{}, peerMaxInflight),
+		closing:  make(chan struct{}),
+		pending:  make(map[uint64]*peerRequest),
+		sessions: make(map[uint64]struct{}),
+	}
+	go peer.writeLoop()
+	return peer
+}
+
+// send sends command of session to peer and waits for its reply, session is ignored in plain mode
+func (peer *peerConn) send(session uint64, dbIndex int, cmdLine CmdLine) redis.Reply {
+	timer := time.NewTimer(getPeerTimeout())
+	defer timer.Stop()
+	// backpressure
+	select {
+	case peer.inflight <- struct{}{}:
+	case <-timer.C:
+		return protocol.MakeErrReply(errPeerTimeout.Error())
+	case <-peer.closing:
+		return protocol.MakeErrReply(errPeerClosed.Error())
+	}
+	defer func() {
+		<-peer.inflight
+	}()
+
+	id := atomic.AddUint64(&peer.nextID, 1)
+	args := cmdLine
+	if !peer.plain {
+		args = make([][]byte, 0, len(cmdLine)+4)
+		args = append(args, []byte(relayMux), []byte(strconv.FormatUint(id, 10)),
+			[]byte(strconv.FormatUint(session, 10)), []byte(strconv.Itoa(dbIndex)))
+		args = append(args, cmdLine...)
+	}
+	req := &peerRequest{
+		id:      id,
+		dbIndex: dbIndex,
+		payload: protocol.MakeMultiBulkReply(args).ToBytes(),
+		reply:   make(chan redis.Reply, 1),
+	}
+	peer.mu.Lock()
+	if peer.closed {
+		peer.mu.Unlock()
+		return protocol.MakeErrReply(errPeerClosed.Error())
+	}
+	peer.pending[id] = req
+	if session != 0 && !peer.plain {
+		peer.sessions[session] = struct{}{}
+	}
+	peer.mu.Unlock()
+	// never blocks since queue is as large as inflight limit
+	peer.queue <- req
+
+	select {
+	case reply := <-req.reply:
+		return reply
+	case <-timer.C:
+		peer.mu.Lock()
+		delete(peer.pending, id)
+		peer.mu.Unlock()
+		return protocol.MakeErrReply(errPeerTimeout.Error())
+	}
+}
+
+// isPeerTimeout returns true if reply is the timeout error of send
+func isPeerTimeout(reply redis.Reply) bool {
+	errReply, ok := reply.(protocol.ErrorReply)
+	return ok && errReply.Error() == errPeerTimeout.Error()
+}
+
+// closeSession tells peer to release the state of session, if the session has sent requests to it
+func (peer *peerConn) closeSession(session uint64) {
+	peer.mu.Lock()
+	_, ok := peer.sessions[session]
+	delete(peer.sessions, session)
+	peer.mu.Unlock()
+	if ok {
+		peer.send(session, 0, utils.ToCmdLine(relayMuxClose))
+	}
+}
+
+// finish delivers reply to the pending request, invoker should hold peer.mu
+func (peer *peerConn) finish(id uint64, reply redis.Reply) {
+	req, ok := peer.pending[id]
+	if !ok {
+		// timeout
+		return
+	}
+	delete(peer.pending, id)
+	req.reply <- reply
+}
+
+func (peer *peerConn) writeLoop() {
+	// db index selected on lastConn, only used in plain mode
+	var lastConn net.Conn
+	var dbIndex int
+	for {
+		var req *peerRequest
+		select {
+		case req = <-peer.queue:
+		case <-peer.closing:
+			return
+		}
+		conn, err := peer.getConn()
+		if err != nil {
+			peer.mu.Lock()
+			peer.finish(req.id, protocol.MakeErrReply(err.Error()))
+			peer.mu.Unlock()
+			continue
+		}
+		if conn != lastConn {
+			lastConn, dbIndex = conn, 0
+		}
+		// write all queued requests in a batch
+		writer := bufio.NewWriterSize(conn, peerMaxBatchBytes)
+		for req != nil {
+			peer.mu.Lock()
+			_, waiting := peer.pending[req.id]
+			selecting := false
+			if waiting {
+				req.conn = conn
+				if peer.plain {
+					selecting = req.dbIndex != dbIndex
+					if selecting {
+						// reply of SELECT is dropped since no request has id 0
+						peer.written = append(peer.written, &peerRequest{})
+					}
+					peer.written = append(peer.written, req)
+				}
+			}
+			peer.mu.Unlock()
+			if selecting {
+				dbIndex = req.dbIndex
+				_, _ = writer.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(dbIndex))).ToBytes())
+			}
+			if waiting {
+				// skip requests already timeout
+				_, _ = writer.Write(req.payload)
+			}
+			req = nil
+			if writer.Buffered() < peerMaxBatchBytes {
+				select {
+				case req = <-peer.queue:
+				default:
+				}
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			peer.closeConn(conn, err)
+		}
+	}
+}
+
+// getConn returns current connection, or dials a new one if disconnected
+func (peer *peerConn) getConn() (net.Conn, error) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.conn != nil {
+		return peer.conn, nil
+	}
+	if time.Since(peer.lastDial) < peerRedialInterval {
+		return nil, errors.New("connection to " + peer.addr + " is broken")
+	}
+	peer.lastDial = time.Now()
+	conn, err := net.DialTimeout("tcp", peer.addr, getPeerTimeout())
+	if err != nil {
+		return nil, err
+	}
+	peer.written = nil
+	// all peers of cluster should use the same password
+	if config.Properties.RequirePass != "" {
+		auth := protocol.MakeMultiBulkReply(utils.ToCmdLine("AUTH", config.Properties.RequirePass))
+		if _, err := conn.Write(auth.ToBytes()); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if peer.plain {
+			peer.written = append(peer.written, &peerRequest{})
+		}
+	}
+	peer.conn = conn
+	go peer.readLoop(conn)
+	return conn, nil
+}
+
+func (peer *peerConn) readLoop(conn net.Conn) {
+	for payload := range parser.ParseStream(conn) {
+		if payload.Err != nil {
+			// ParseStream stops on io error
+			peer.closeConn(conn, payload.Err)
+			continue
+		}
+		if peer.plain {
+			peer.finishWritten(conn, payload.Data)
+			continue
+		}
+		reply, ok := payload.Data.(*protocol.MultiBulkReply)
+		if !ok || len(reply.Args) != 2 {
+			// reply of AUTH
+			if errReply, ok := payload.Data.(protocol.ErrorReply); ok {
+				logger.Warn("peer " + peer.addr + " replied error: " + errReply.Error())
+			}
+			continue
+		}
+		id, err := strconv.ParseUint(string(reply.Args[0]), 10, 64)
+		if err != nil {
+			logger.Warn("illegal reply id from peer " + peer.addr)
+			continue
+		}
+		result, err := parser.ParseOne(reply.Args[1])
+		if err != nil {
+			result = protocol.MakeErrReply("ERR illegal reply from peer: " + err.Error())
+		}
+		peer.mu.Lock()
+		peer.finish(id, result)
+		peer.mu.Unlock()
+	}
+	peer.closeConn(conn, errPeerClosed)
+}
+
+// finishWritten delivers reply to the earliest written request of conn in plain mode
+func (peer *peerConn) finishWritten(conn net.Conn, reply redis.Reply) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.conn != conn {
+		// requests were failed by closeConn
+		return
+	}
+	if len(peer.written) == 0 {
+		logger.Warn("unexpected reply from " + peer.addr)
+		return
+	}
+	req := peer.written[0]
+	peer.written[0] = nil
+	peer.written = peer.written[1:]
+	peer.finish(req.id, reply)
+}
+
+// closeConn closes the broken connection, and fails requests written to it
+func (peer *peerConn) closeConn(conn net.Conn, err error) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.conn == conn {
+		peer.conn = nil
+		peer.written = nil
+		logger.Warn("connection to peer " + peer.addr + " closed: " + err.Error())
+	}
+	_ = conn.Close()
+	for id, req := range peer.pending {
+		if req.conn == conn {
+			peer.finish(id, protocol.MakeErrReply("ERR connection lost: "+err.Error()))
+		}
+	}
+}
+
+func (peer *peerConn) close() {
+	peer.mu.Lock()
+	if peer.closed {
+		peer.mu.Unlock()
+		return
+	}
+	peer.closed = true
+	close(peer.closing)
+	conn := peer.conn
+	peer.conn = nil
+	for id := range peer.pending {
+		peer.finish(id, protocol.MakeErrReply(errPeerClosed.Error()))
+	}
+	peer.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// muxConn is the connection of a session on the peer, it keeps the state of session among requests
+type muxConn struct {
+	connection.FakeConn
+}
+
+type muxRequest struct {
+	id      []byte
+	dbIndex int
+	cmdLine CmdLine
+}
+
+// muxSession executes requests of a session in order
+type muxSession struct {
+	id   uint64
+	conn *muxConn
+	// fields below are guarded by muxPeer.mu
+	queue   []*muxRequest
+	running bool
+	closed  bool
+}
+
+// muxPeer holds sessions of a connection from peer
+type muxPeer struct {
+	mu       sync.Mutex
+	sessions map[uint64]*muxSession
+}
+
+// muxPool executes requests from peers by at most max goroutines, requests exceeding the limit wait in backlog,
+// so that reading from peer never blocks and replies of requests in flight are still received
+type muxPool struct {
+	mu      sync.Mutex
+	max     int
+	running int
+	backlog []func()
+}
+
+func makeMuxPool(max int) *muxPool {
+	return &muxPool{max: max}
+}
+
+// submit executes task once a worker is available without blocking
+func (pool *muxPool) submit(task func()) {
+	pool.mu.Lock()
+	if pool.running >= pool.max {
+		pool.backlog = append(pool.backlog, task)
+		pool.mu.Unlock()
+		return
+	}
+	pool.running++
+	pool.mu.Unlock()
+	go pool.work(task)
+}
+
+// work executes task and then tasks in backlog until backlog is empty
+func (pool *muxPool) work(task func()) {
+	for task != nil {
+		task()
+		pool.mu.Lock()
+		if len(pool.backlog) == 0 {
+			pool.running--
+			task = nil
+		} else {
+			task = pool.backlog[0]
+			pool.backlog[0] = nil
+			pool.backlog = pool.backlog[1:]
+		}
+		pool.mu.Unlock()
+	}
+}
+
+// sessionOf returns the session of c on peer connections, returns 0 if c keeps no state among commands,
+// e.g. connections made for internal requests, which are never closed by AfterClientClose
+func (cluster *Cluster) sessionOf(c redis.Connection) uint64 {
+	switch c.(type) {
+	case *connection.Connection, *muxConn:
+	default:
+		return 0
+	}
+	if session, ok := cluster.sessions.Load(c); ok {
+		return session.(uint64)
+	}
+	session, _ := cluster.sessions.LoadOrStore(c, atomic.AddUint64(&cluster.nextSession, 1))
+	return session.(uint64)
+}
+
+// closeSessions releases the session of c on peers, and sessions from peer if c is a peer connection
+func (cluster *Cluster) closeSessions(c redis.Connection) {
+	if session, ok := cluster.sessions.LoadAndDelete(c); ok {
+		cluster.topologyMu.RLock()
+		for _, peer := range cluster.peerConnection {
+			go peer.closeSession(session.(uint64))
+		}
+		cluster.topologyMu.RUnlock()
+	}
+	if raw, ok := cluster.muxPeers.LoadAndDelete(c); ok {
+		raw.(*muxPeer).close(cluster)
+	}
+}
+
+// execMux executes a multiplexed request from peer asynchronously, and replies `id raw-reply` once finished
+// cmdLine: _mux id session db-index cmd args...
+func execMux(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 5 {
+		return protocol.MakeArgNumErrReply(relayMux)
+	}
+	session, err := strconv.ParseUint(string(cmdLine[2]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal session")
+	}
+	dbIndex, err := strconv.Atoi(string(cmdLine[3]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal db index")
+	}
+	req := &muxRequest{id: cmdLine[1], dbIndex: dbIndex, cmdLine: cmdLine[4:]}
+	if session == 0 {
+		conn := &connection.FakeConn{}
+		conn.SetPassword(c.GetPassword())
+		cluster.muxWorkers.submit(func() {
+			cluster.execMuxRequest(c, conn, req)
+		})
+		return &protocol.NoReply{}
+	}
+
+	raw, ok := cluster.muxPeers.Load(c)
+	if !ok {
+		raw, _ = cluster.muxPeers.LoadOrStore(c, &muxPeer{sessions: make(map[uint64]*muxSession)})
+	}
+	mp := raw.(*muxPeer)
+	mp.mu.Lock()
+	s, ok := mp.sessions[session]
+	if !ok {
+		s = &muxSession{id: session, conn: &muxConn{}}
+		s.conn.SetPassword(c.GetPassword())
+		mp.sessions[session] = s
+	}
+	s.queue = append(s.queue, req)
+	start := !s.running
+	s.running = true
+	mp.mu.Unlock()
+	if start {
+		cluster.muxWorkers.submit(func() {
+			cluster.runMuxSession(c, mp, s)
+		})
+	}
+	return &protocol.NoReply{}
+}
+
+// runMuxSession executes queued requests of session until the queue is empty, it holds a worker during running
+func (cluster *Cluster) runMuxSession(c redis.Connection, mp *muxPeer, s *muxSession) {
+	for {
+		mp.mu.Lock()
+		if len(s.queue) == 0 || s.closed {
+			s.running = false
+			closed := s.closed
+			mp.mu.Unlock()
+			if closed {
+				cluster.AfterClientClose(s.conn)
+			}
+			return
+		}
+		req := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		mp.mu.Unlock()
+
+		if strings.ToLower(string(req.cmdLine[0])) == relayMuxClose {
+			mp.mu.Lock()
+			delete(mp.sessions, s.id)
+			s.closed = true
+			s.running = false
+			mp.mu.Unlock()
+			cluster.AfterClientClose(s.conn)
+			_ = c.Write(protocol.MakeMultiBulkReply([][]byte{req.id, protocol.MakeOkReply().ToBytes()}).ToBytes())
+			return
+		}
+		cluster.execMuxRequest(c, s.conn, req)
+	}
+}
+
+func (cluster *Cluster) execMuxRequest(c redis.Connection, conn redis.Connection, req *muxRequest) {
+	conn.SelectDB(req.dbIndex)
+	reply := cluster.Exec(conn, req.cmdLine)
+	_ = c.Write(protocol.MakeMultiBulkReply([][]byte{req.id, reply.ToBytes()}).ToBytes())
+}
+
+// close drops sessions once the connection from peer is closed
+func (mp *muxPeer) close(cluster *Cluster) {
+	mp.mu.Lock()
+	var idle []*muxSession
+	for _, s := range mp.sessions {
+		s.closed = true
+		s.queue = nil
+		if !s.running {
+			idle = append(idle, s)
+		}
+	}
+	mp.sessions = make(map[uint64]*muxSession)
+	mp.mu.Unlock()
+	// running sessions are cleaned by runMuxSession
+	for _, s := range idle {
+		cluster.AfterClientClose(s.conn)
+	}
+}
@@ -0,0 +1,240 @@
+package cluster
+
+import (
+	"godis/config"
+	database2 "godis/database"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/parser"
+	"godis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// servePeer accepts connections of peerConn, and passes requests to handle with a function to reply them
+func servePeer(t *testing.T, handle func(conn net.Conn, request *protocol.MultiBulkReply)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					handle(conn, payload.Data.(*protocol.MultiBulkReply))
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func writeMuxReply(conn net.Conn, id []byte, reply redis.Reply) {
+	_, _ = conn.Write(protocol.MakeMultiBulkReply([][]byte{id, reply.ToBytes()}).ToBytes())
+}
+
+func TestPeerInterleavedReplies(t *testing.T) {
+	held := make(chan *protocol.MultiBulkReply, 1)
+	listener := servePeer(t, func(conn net.Conn, request *protocol.MultiBulkReply) {
+		// reply the first request after the second one
+		if string(request.Args[4]) == "slow" {
+			held <- request
+			return
+		}
+		writeMuxReply(conn, request.Args[1], protocol.MakeBulkReply(request.Args[4]))
+		slow := <-held
+		writeMuxReply(conn, slow.Args[1], protocol.MakeBulkReply(slow.Args[4]))
+	})
+	defer listener.Close()
+	peer := makePeerConn(listener.Addr().String(), false)
+	defer peer.close()
+
+	replies := make(chan [2]string, 2)
+	for _, arg := range []string{"slow", "fast"} {
+		arg := arg
+		go func() {
+			reply := peer.send(0, 0, utils.ToCmdLine(arg))
+			replies <- [2]string{arg, string(reply.ToBytes())}
+		}()
+		if arg == "slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		// every request receives its own reply
+		reply := <-replies
+		if expected := string(protocol.MakeBulkReply([]byte(reply[0])).ToBytes()); reply[1] != expected {
+			t.Errorf("expect %q, actual %q", expected, reply[1])
+		}
+	}
+}
+
+func TestPeerTimeout(t *testing.T) {
+	timeout := config.Properties.ClusterPeerTimeout
+	config.Properties.ClusterPeerTimeout = 200
+	defer func() {
+		config.Properties.ClusterPeerTimeout = timeout
+	}()
+	replied := make(chan []byte, 1)
+	listener := servePeer(t, func(conn net.Conn, request *protocol.MultiBulkReply) {
+		// reply after the sender gave up
+		time.Sleep(300 * time.Millisecond)
+		writeMuxReply(conn, request.Args[1], protocol.MakeOkReply())
+		replied <- request.Args[1]
+	})
+	defer listener.Close()
+	peer := makePeerConn(listener.Addr().String(), false)
+	defer peer.close()
+
+	reply := peer.send(0, 0, utils.ToCmdLine("ping"))
+	if !isPeerTimeout(reply) {
+		t.Fatalf("expect timeout, actual %q", reply.ToBytes())
+	}
+	<-replied
+	peer.mu.Lock()
+	pending := len(peer.pending)
+	peer.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("timed out request should be dropped, pending: %d", pending)
+	}
+}
+
+func TestPeerDroppedConnection(t *testing.T) {
+	listener := servePeer(t, func(conn net.Conn, request *protocol.MultiBulkReply) {
+		if string(request.Args[4]) == "drop" {
+			_ = conn.Close()
+			return
+		}
+		writeMuxReply(conn, request.Args[1], protocol.MakeOkReply())
+	})
+	defer listener.Close()
+	peer := makePeerConn(listener.Addr().String(), false)
+	defer peer.close()
+
+	start := time.Now()
+	reply := peer.send(0, 0, utils.ToCmdLine("drop"))
+	if !protocol.IsErrorReply(reply) || isPeerTimeout(reply) {
+		t.Errorf("expect connection lost, actual %q", reply.ToBytes())
+	}
+	if time.Since(start) >= getPeerTimeout() {
+		t.Error("requests on dropped connection should fail without waiting for timeout")
+	}
+	// reconnect after redial interval
+	time.Sleep(peerRedialInterval)
+	if reply := peer.send(0, 0, utils.ToCmdLine("ping")); protocol.IsErrorReply(reply) {
+		t.Errorf("expect reconnected, actual %q", reply.ToBytes())
+	}
+}
+
+func TestMuxPool(t *testing.T) {
+	pool := makeMuxPool(1)
+	release := make(chan struct{})
+	executed := make(chan int, 2)
+	pool.submit(func() {
+		<-release
+		executed <- 1
+	})
+	submitted := make(chan struct{})
+	go func() {
+		// submitting never blocks even if all workers are busy
+		pool.submit(func() {
+			executed <- 2
+		})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("submit blocked while workers are busy")
+	}
+	close(release)
+	if first, second := <-executed, <-executed; first != 1 || second != 2 {
+		t.Errorf("expect tasks executed in order, actual %d %d", first, second)
+	}
+	// worker exits after the last task returned
+	deadline := time.Now().Add(time.Second)
+	for {
+		pool.mu.Lock()
+		running := pool.running
+		pool.mu.Unlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workers should exit after backlog is empty, running: %d", running)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// muxClient is the connection from peer, it passes replies of _mux by channel
+type muxClient struct {
+	connection.FakeConn
+	replies chan string
+}
+
+func (c *muxClient) Write(b []byte) error {
+	reply, err := parser.ParseOne(b)
+	if err != nil {
+		return err
+	}
+	args := reply.(*protocol.MultiBulkReply).Args
+	c.replies <- string(args[0]) + " " + strings.TrimSpace(string(args[1]))
+	return nil
+}
+
+func TestMuxSession(t *testing.T) {
+	cluster := makeTestCluster("a:6399", []string{"a:6399"}, "", 1)
+	cluster.db = database2.NewStandaloneServer()
+	cluster.relayImpl = defaultRelayImpl
+	defer closeTestCluster(cluster)
+	client := &muxClient{replies: make(chan string, 16)}
+	id := 0
+	send := func(session string, args ...string) string {
+		id++
+		cmdLine := append(utils.ToCmdLine(relayMux, strconv.Itoa(id), session, "0"), utils.ToCmdLine(args...)...)
+		if reply := execMux(cluster, client, cmdLine); len(reply.ToBytes()) != 0 {
+			t.Fatalf("unexpected reply %q", reply.ToBytes())
+		}
+		return <-client.replies
+	}
+
+	// transaction state is kept among requests of a session
+	send("1", "multi")
+	if reply := send("1", "set", "a", "1"); reply != strconv.Itoa(id)+" +QUEUED" {
+		t.Errorf("expect queued, actual %q", reply)
+	}
+	if reply := send("2", "get", "a"); reply != strconv.Itoa(id)+" $-1" {
+		t.Errorf("other sessions should not see queued commands, actual %q", reply)
+	}
+	send("1", "exec")
+	if reply := send("0", "get", "a"); reply != strconv.Itoa(id)+" $1\r\n1" {
+		t.Errorf("expect committed, actual %q", reply)
+	}
+
+	send("3", "readonly")
+	raw, _ := cluster.muxPeers.Load(client)
+	session := raw.(*muxPeer).sessions[3]
+	if _, ok := cluster.readOnly.Load(session.conn); !ok {
+		t.Error("session should be in READONLY mode")
+	}
+	send("3", relayMuxClose)
+	if _, ok := cluster.readOnly.Load(session.conn); ok {
+		t.Error("state of closed session should be released")
+	}
+	cluster.AfterClientClose(client)
+	if _, ok := cluster.muxPeers.Load(client); ok {
+		t.Error("sessions should be released after peer connection closed")
+	}
+}
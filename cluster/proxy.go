@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"fmt"
+	"godis/config"
+	database2 "godis/database"
+	"godis/interface/database"
+	"godis/interface/redis"
+	"godis/lib/consistenthash"
+	"godis/lib/logger"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"runtime/debug"
+	"strings"
+)
+
+/*
+ * Proxy is a front-end holding no data, it distributes keys among standalone godis backends by consistent hash.
+ * Proxy reuses handlers of cluster on a Cluster without local db, whose relay sends commands to backends directly.
+ * Backends know nothing about each other, so there is no transaction across backends:
+ * - DEL, EXISTS, MGET and MSET are split by backends, they are not atomic if keys are served by different backends
+ * - other commands are relayed to the backend serving all their keys, e.g. RENAME, SINTERSTORE,
+ *   they are rejected if keys are served by different backends
+ * - MULTI, pub/sub and blocking commands are not supported
+ */
+
+// Proxy routes commands to standalone backends
+type Proxy struct {
+	cluster *Cluster
+}
+
+// MakeProxy creates a Proxy in front of backends of `proxy-backends`
+func MakeProxy() *Proxy {
+	if config.Properties.Databases == 0 {
+		// same as backends
+		config.Properties.Databases = 16
+	}
+	cluster := &Cluster{
+		peerPicker:     consistenthash.New(replicas, nil),
+		peerConnection: make(map[string]*peerConn),
+		relayImpl:      proxyRelayImpl,
+	}
+	for _, backend := range config.Properties.ProxyBackends {
+		if _, ok := cluster.peerConnection[backend]; ok {
+			continue
+		}
+		cluster.peerConnection[backend] = makePeerConn(backend, true)
+		cluster.nodes = append(cluster.nodes, backend)
+	}
+	cluster.peerPicker.AddNode(cluster.nodes...)
+	return &Proxy{cluster: cluster}
+}
+
+var proxyRouter = makeProxyRouter()
+
+// makeProxyRouter returns handlers of commands not routed by their keys, see proxyDefaultFunc
+func makeProxyRouter() map[string]CmdFunc {
+	routerMap := make(map[string]CmdFunc)
+	routerMap["ping"] = proxyPing
+	routerMap["del"] = proxyCount
+	routerMap["exists"] = proxyCount
+	routerMap["unlink"] = proxyCount
+	routerMap["touch"] = proxyCount
+	routerMap["move"] = defaultFunc
+	routerMap["mset"] = proxyMSet
+	routerMap["mget"] = MGet
+	routerMap["lcs"] = LCS
+	routerMap["lmpop"] = LMPop
+	routerMap["blmpop"] = BLMPop
+	routerMap["bzpopmin"] = BZPopMin
+	routerMap["bzpopmax"] = BZPopMin
+
+	routerMap["sinter"] = SetAlgebra
+	routerMap["sunion"] = SetAlgebra
+	routerMap["sdiff"] = SetAlgebra
+	routerMap["sintercard"] = SInterCard
+	routerMap["zunion"] = ZSetAlgebra
+	routerMap["zinter"] = ZSetAlgebra
+	routerMap["zdiff"] = ZSetAlgebra
+	routerMap["zintercard"] = ZInterCard
+
+	routerMap["flushdb"] = FlushDB
+	routerMap["flushall"] = FlushAll
+	routerMap["keys"] = Keys
+	routerMap["dbsize"] = DBSize
+	routerMap["randomkey"] = RandomKey
+	routerMap["swapdb"] = SwapDB
+	routerMap["scan"] = Scan
+	return routerMap
+}
+
+// Exec executes command by backends
+func (proxy *Proxy) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &protocol.UnknownErrReply{}
+		}
+	}()
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "auth" {
+		return database2.Auth(c, cmdLine[1:])
+	}
+	if !isAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH Authentication required")
+	}
+	if cmdName == "select" {
+		if len(cmdLine) != 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execSelect(c, cmdLine)
+	}
+	if cmdFunc, ok := proxyRouter[cmdName]; ok {
+		return cmdFunc(proxy.cluster, c, cmdLine)
+	}
+	return proxyDefaultFunc(proxy.cluster, c, cmdLine)
+}
+
+// AfterClientClose does nothing since proxy keeps no state of clients
+func (proxy *Proxy) AfterClientClose(c redis.Connection) {
+}
+
+// Close closes connections to backends
+func (proxy *Proxy) Close() {
+	for _, backend := range proxy.cluster.peerConnection {
+		backend.close()
+	}
+}
+
+// SetKeysChangedCallback does nothing, modifications on backends are not reported to proxy
+func (proxy *Proxy) SetKeysChangedCallback(callback database.KeysChangedCallback) {
+}
+
+// proxyRelayImpl sends command to backend, internal commands of cluster are translated since backends are standalone
+func proxyRelayImpl(cluster *Cluster, node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	switch strings.ToLower(string(cmdLine[0])) {
+	case relayLocal:
+		// backends execute all commands locally
+		return cluster.relayPeer(node, c, cmdLine[1:])
+	case relayScan:
+		return flattenScanReply(cluster.relayPeer(node, c, utils.ToCmdLine3("scan", cmdLine[1:]...)))
+	}
+	return cluster.relayPeer(node, c, cmdLine)
+}
+
+// proxyDefaultFunc relays command to the backend serving all its keys
+func proxyDefaultFunc(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if !database2.IsReadOnlyCommand(cmdName) && !database2.IsWriteCommand(cmdName) {
+		return protocol.MakeErrReply("ERR unknown command '" + cmdName + "', or not supported in proxy mode")
+	}
+	if !database2.ValidateArity(cmdLine) {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	writeKeys, readKeys := database2.GetRelatedKeys(cmdLine)
+	keys := append(writeKeys, readKeys...)
+	if len(keys) == 0 {
+		return protocol.MakeErrReply("ERR command '" + cmdName + "' is not supported in proxy mode")
+	}
+	node, ok := cluster.isSameNode(keys...)
+	if !ok {
+		return protocol.MakeErrReply("CROSSSLOT Keys in request don't hash to the same backend")
+	}
+	return cluster.relay(node, c, cmdLine)
+}
+
+func proxyPing(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	return database2.Ping(nil, cmdLine[1:])
+}
+
+// proxyCount executes DEL, UNLINK, EXISTS or TOUCH on backends of keys, and sums up their replies
+func proxyCount(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	keys := make([]string, len(cmdLine)-1)
+	for i := 1; i < len(cmdLine); i++ {
+		keys[i-1] = string(cmdLine[i])
+	}
+	var count int64
+	for node, group := range cluster.groupBy(keys) {
+		reply := cluster.relay(node, c, makeArgs(cmdName, group...))
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			return makeNodeErrReply(node, errReply.Error())
+		}
+		if intReply, ok := reply.(*protocol.IntReply); ok {
+			count += intReply.Code
+		}
+	}
+	return protocol.MakeIntReply(count)
+}
+
+// proxyMSet sets key-values on their backends
+func proxyMSet(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	argCount := len(cmdLine) - 1
+	if argCount%2 != 0 || argCount < 1 {
+		return protocol.MakeArgNumErrReply("mset")
+	}
+	groupMap := make(map[string]CmdLine)
+	for i := 1; i < len(cmdLine); i += 2 {
+		node := cluster.peerPicker.PickNode(string(cmdLine[i]))
+		group, ok := groupMap[node]
+		if !ok {
+			group = utils.ToCmdLine("MSET")
+		}
+		groupMap[node] = append(group, cmdLine[i], cmdLine[i+1])
+	}
+	for node, group := range groupMap {
+		reply := cluster.relay(node, c, group)
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			return makeNodeErrReply(node, errReply.Error())
+		}
+	}
+	return &protocol.OkReply{}
+}
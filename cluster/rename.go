@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	database2 "godis/database"
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/redis/protocol"
@@ -23,10 +24,9 @@ func Rename(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		srcNode:  {srcKey},
 		destNode: {destKey},
 	}
-	txID := cluster.idGenerator.NextID()
-	txIDStr := strconv.FormatInt(txID, 10)
+	txID := cluster.beginTransaction(groupMap)
 	// prepare rename from
-	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txIDStr, "RenameFrom", srcKey))
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txID, "RenameFrom", srcKey))
 	if protocol.IsErrorReply(srcPrepareResp) {
 		// rollback src node
 		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
@@ -38,8 +38,8 @@ func Rename(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		return protocol.MakeErrReply("ERR invalid prepare response")
 	}
 	// prepare rename to
-	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
-		[]byte("RenameTo"), []byte(destKey), srcPrepareMBR.Args[0], srcPrepareMBR.Args[1]))
+	destPrepareResp := cluster.relayPrepare(destNode, c, append(utils.ToCmdLine("Prepare", txID),
+		makeRenameToCmd("RenameTo", destKey, srcPrepareMBR)...))
 	if protocol.IsErrorReply(destPrepareResp) {
 		// rollback src node
 		requestRollback(cluster, c, txID, groupMap)
@@ -70,7 +70,7 @@ func prepareRenameFrom(cluster *Cluster, conn redis.Connection, cmdLine CmdLine)
 }
 
 func prepareRenameNxTo(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.Reply {
-	if len(cmdLine) != 4 {
+	if len(cmdLine) < 4 {
 		return protocol.MakeArgNumErrReply("RenameNxTo")
 	}
 	key := string(cmdLine[1])
@@ -85,6 +85,13 @@ func prepareRenameNxTo(cluster *Cluster, conn redis.Connection, cmdLine CmdLine)
 	return protocol.MakeOkReply()
 }
 
+// makeRenameToCmd makes RenameTo or RenameNxTo command loading the result of DumpKey as key
+func makeRenameToCmd(cmdName string, key string, dump *protocol.MultiBulkReply) CmdLine {
+	cmdLine := make(CmdLine, 0, len(dump.Args)+2)
+	cmdLine = append(cmdLine, []byte(cmdName), []byte(key))
+	return append(cmdLine, dump.Args...)
+}
+
 func init() {
 	registerPrepareFunc("RenameFrom", prepareRenameFrom)
 	registerPrepareFunc("RenameNxTo", prepareRenameNxTo)
@@ -107,10 +114,9 @@ func RenameNx(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		srcNode:  {srcKey},
 		destNode: {destKey},
 	}
-	txID := cluster.idGenerator.NextID()
-	txIDStr := strconv.FormatInt(txID, 10)
+	txID := cluster.beginTransaction(groupMap)
 	// prepare rename from
-	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txIDStr, "RenameFrom", srcKey))
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txID, "RenameFrom", srcKey))
 	if protocol.IsErrorReply(srcPrepareResp) {
 		// rollback src node
 		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
@@ -122,8 +128,8 @@ func RenameNx(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		return protocol.MakeErrReply("ERR invalid prepare response")
 	}
 	// prepare rename to
-	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
-		[]byte("RenameNxTo"), []byte(destKey), srcPrepareMBR.Args[0], srcPrepareMBR.Args[1]))
+	destPrepareResp := cluster.relayPrepare(destNode, c, append(utils.ToCmdLine("Prepare", txID),
+		makeRenameToCmd("RenameNxTo", destKey, srcPrepareMBR)...))
 	if protocol.IsErrorReply(destPrepareResp) {
 		// rollback src node
 		requestRollback(cluster, c, txID, groupMap)
@@ -138,3 +144,61 @@ func RenameNx(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	}
 	return protocol.MakeIntReply(1)
 }
+
+// Copy copies a key in cluster, the value is transferred by DUMP and RESTORE if keys are on different nodes
+func Copy(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply("copy")
+	}
+	dbIndex, replace, errReply := database2.ParseCopyArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	src, dest := string(args[1]), string(args[2])
+	if node, ok := cluster.isSameNode(src, dest); ok {
+		return cluster.relay(node, c, args)
+	}
+	if dbIndex >= 0 && dbIndex != c.GetDBIndex() {
+		return protocol.MakeErrReply("ERR COPY to another database requires keys on the same node")
+	}
+	srcNode := cluster.peerPicker.PickNode(src)
+	destNode := cluster.peerPicker.PickNode(dest)
+	return execReadThenWrite(cluster, c, []string{src, dest}, func() ([]CmdLine, redis.Reply) {
+		reply := cluster.relay(srcNode, c, utils.ToCmdLine("Dump", src))
+		if protocol.IsErrorReply(reply) {
+			return nil, reply
+		}
+		payload, ok := reply.(*protocol.BulkReply)
+		if !ok {
+			return nil, protocol.MakeIntReply(0)
+		}
+		if !replace {
+			reply = cluster.relay(destNode, c, utils.ToCmdLine("Exists", dest))
+			if protocol.IsErrorReply(reply) {
+				return nil, reply
+			}
+			if exists, ok := reply.(*protocol.IntReply); ok && exists.Code > 0 {
+				return nil, protocol.MakeIntReply(0)
+			}
+		}
+		reply = cluster.relay(srcNode, c, utils.ToCmdLine("PTTL", src))
+		if protocol.IsErrorReply(reply) {
+			return nil, reply
+		}
+		ttl, _ := reply.(*protocol.IntReply)
+		if ttl == nil || ttl.Code == -2 {
+			// src expired
+			return nil, protocol.MakeIntReply(0)
+		}
+		// 0 means no ttl for RESTORE
+		ttlArg := ttl.Code
+		if ttlArg < 0 {
+			ttlArg = 0
+		} else if ttlArg == 0 {
+			ttlArg = 1
+		}
+		return []CmdLine{
+			utils.ToCmdLine3("Restore", []byte(dest), []byte(strconv.FormatInt(ttlArg, 10)), payload.Arg, []byte("REPLACE")),
+		}, protocol.MakeIntReply(1)
+	})
+}
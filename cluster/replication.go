@@ -0,0 +1,551 @@
+package cluster
+
+import (
+	"godis/config"
+	database2 "godis/database"
+	"godis/interface/database"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/parser"
+	"godis/redis/protocol"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * replication.go keeps replicas in sync with their master and lets them serve reads.
+ * A replica sends `_replsync` to its master every second, the master creates a replication link for the
+ * replica if it has no alive link. Through the link the master sends `flushall` and dumps of all keys,
+ * then every command modified data of the master in order of execution, the same as commands appended to aof.
+ * Commands are sent in `_replicate` batches, the replica rejects batches out of order, which breaks the link
+ * and causes a full synchronization later.
+ * Read-only commands from connections in READONLY mode are served by a synced replica of the key owner.
+ */
+
+const (
+	// _replsync replica link-id(- for none): creates replication link if replica has no alive link
+	relayReplSync = "_replsync"
+	// _replicate master link-id seq synced [db-index cmd]...
+	relayReplicate = "_replicate"
+	// _replicaread cmd args...: executes read-only command on a synced replica
+	relayReplicaRead = "_replicaread"
+
+	maxReplicateBatch = 1024
+)
+
+// replEntry is a command waiting to be sent to replica, cmdLine is nil for the mark of full sync finished
+type replEntry struct {
+	dbIndex int
+	cmdLine CmdLine
+	size    int64
+}
+
+// replicationLink sends commands of master to a replica
+type replicationLink struct {
+	id      string
+	replica string
+
+	mu    sync.Mutex
+	queue []*replEntry
+	// size of pending commands, limited by client-output-buffer-limit of replica class
+	queueBytes int64
+	// time when queueBytes exceeds soft limit, zero if not exceeded
+	softLimitReachedAt time.Time
+	closed             bool
+	// seq of the next batch
+	seq    int64
+	signal chan struct{}
+}
+
+// replication stores replication links of a master, and replication state of a replica
+type replication struct {
+	// linksMu guards links, replica applies commands holding mu, and propagates them holding linksMu
+	linksMu sync.Mutex
+	// links: replica -> link, on master
+	links map[string]*replicationLink
+
+	// following fields are used on replica, guarded by mu
+	mu sync.Mutex
+	// master is the node sending commands through link
+	master  string
+	linkID  string
+	nextSeq int64
+	// synced is true once full synchronization finished
+	synced       bool
+	requesting   bool
+	appliedCmds  int64
+	lastReceived time.Time
+}
+
+func makeReplication() *replication {
+	return &replication{
+		links: make(map[string]*replicationLink),
+	}
+}
+
+func makeReplicationLink(replica string) *replicationLink {
+	return &replicationLink{
+		id:      strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.Itoa(rand.Intn(1000)),
+		replica: replica,
+		signal:  make(chan struct{}, 1),
+	}
+}
+
+// push appends a command to link, the link will be closed once reached output buffer limit
+func (link *replicationLink) push(entry *replEntry) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.closed {
+		return
+	}
+	link.queue = append(link.queue, entry)
+	link.queueBytes += entry.size
+	if link.isOutputLimitReached() {
+		connection.RecordOutputLimitDisconnection(config.ClientClassReplica)
+		logger.Warn("replica " + link.replica + " reached output buffer limit, disconnecting")
+		link.closeWithLock()
+		return
+	}
+	select {
+	case link.signal <- struct{}{}:
+	default:
+	}
+}
+
+// isOutputLimitReached checks hard and soft limit, invoker should hold link.mu
+func (link *replicationLink) isOutputLimitReached() bool {
+	limit := config.Properties.GetOutputBufferLimit(config.ClientClassReplica)
+	if limit == nil {
+		return false
+	}
+	if limit.HardLimit > 0 && link.queueBytes >= limit.HardLimit {
+		return true
+	}
+	if limit.SoftLimit > 0 && link.queueBytes >= limit.SoftLimit {
+		now := time.Now()
+		if link.softLimitReachedAt.IsZero() {
+			link.softLimitReachedAt = now
+		}
+		return now.Sub(link.softLimitReachedAt) >= time.Duration(limit.SoftSeconds)*time.Second
+	}
+	link.softLimitReachedAt = time.Time{}
+	return false
+}
+
+// take removes at most maxReplicateBatch commands from queue, synced is true if full sync finished in them
+func (link *replicationLink) take() (entries []*replEntry, synced bool, closed bool) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.closed {
+		return nil, false, true
+	}
+	n := len(link.queue)
+	if n > maxReplicateBatch {
+		n = maxReplicateBatch
+	}
+	for _, entry := range link.queue[:n] {
+		link.queueBytes -= entry.size
+		if entry.cmdLine == nil {
+			synced = true
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	link.queue = link.queue[n:]
+	return entries, synced, false
+}
+
+func (link *replicationLink) close() {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	link.closeWithLock()
+}
+
+func (link *replicationLink) closeWithLock() {
+	if link.closed {
+		return
+	}
+	link.closed = true
+	link.queue = nil
+	link.queueBytes = 0
+	close(link.signal)
+}
+
+func (link *replicationLink) isClosed() bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	return link.closed
+}
+
+func makeReplEntry(dbIndex int, cmdLine CmdLine) *replEntry {
+	size := int64(0)
+	for _, arg := range cmdLine {
+		size += int64(len(arg))
+	}
+	return &replEntry{
+		dbIndex: dbIndex,
+		cmdLine: cmdLine,
+		size:    size,
+	}
+}
+
+// propagate sends command modified local database to all replicas, it is the WriteCallback of cluster.db
+func (cluster *Cluster) propagate(dbIndex int, cmdLine CmdLine) {
+	rep := cluster.replication
+	rep.linksMu.Lock()
+	if len(rep.links) == 0 {
+		rep.linksMu.Unlock()
+		return
+	}
+	links := make([]*replicationLink, 0, len(rep.links))
+	for _, link := range rep.links {
+		links = append(links, link)
+	}
+	rep.linksMu.Unlock()
+	entry := makeReplEntry(dbIndex, cmdLine)
+	for _, link := range links {
+		link.push(entry)
+	}
+}
+
+// execReplSync creates replication link for replica if it has no alive link
+// cmdLine: _replsync replica link-id
+func execReplSync(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 3 {
+		return protocol.MakeArgNumErrReply(relayReplSync)
+	}
+	if cluster.bus.getReplicaOf() != "" {
+		return protocol.MakeErrReply("ERR " + cluster.self + " is not a master")
+	}
+	replica := string(cmdLine[1])
+	linkID := string(cmdLine[2])
+	rep := cluster.replication
+	rep.linksMu.Lock()
+	link, ok := rep.links[replica]
+	if ok && link.id == linkID && !link.isClosed() {
+		rep.linksMu.Unlock()
+		return protocol.MakeStatusReply(link.id)
+	}
+	if ok {
+		link.close()
+	}
+	link = makeReplicationLink(replica)
+	// replica drops its data before loading the dump
+	link.push(makeReplEntry(0, utils.ToCmdLine("FlushAll")))
+	rep.links[replica] = link
+	rep.linksMu.Unlock()
+
+	cluster.topologyMu.Lock()
+	cluster.addPeerConnection(replica)
+	cluster.topologyMu.Unlock()
+	logger.Info("start full synchronization to replica " + replica)
+	go cluster.syncReplica(link)
+	go cluster.sendReplication(link)
+	return protocol.MakeStatusReply(link.id)
+}
+
+// syncReplica sends dumps of all keys through link.
+// Commands executed during dumping are sent as well, a command executed before dumping a key is overwritten by the
+// dump, and a command executed after is applied on the dump, so that replica will be consistent with master.
+func (cluster *Cluster) syncReplica(link *replicationLink) {
+	for dbIndex := 0; dbIndex < config.Properties.Databases; dbIndex++ {
+		var keys []string
+		cluster.db.ForEach(dbIndex, func(key string, _ *database.DataEntity, _ *time.Time) bool {
+			keys = append(keys, key)
+			return true
+		})
+		conn := makeMigrationConn(dbIndex)
+		for _, key := range keys {
+			if link.isClosed() {
+				return
+			}
+			readKeys := []string{key}
+			cluster.db.RWLocks(dbIndex, nil, readKeys)
+			reply := cluster.db.ExecWithLock(conn, utils.ToCmdLine("SyncKey", key))
+			if dump, ok := reply.(*protocol.MultiBulkReply); ok && len(dump.Args) >= 2 {
+				link.push(makeReplEntry(dbIndex, makeRenameToCmd("RenameTo", key, dump)))
+			}
+			cluster.db.RWUnLocks(dbIndex, nil, readKeys)
+		}
+	}
+	link.push(&replEntry{})
+	logger.Info("full synchronization to replica " + link.replica + " finished")
+}
+
+// sendReplication sends commands in link to replica until link closed
+func (cluster *Cluster) sendReplication(link *replicationLink) {
+	defer cluster.removeReplicationLink(link)
+	conn := makeMigrationConn(0)
+	for range link.signal {
+		for {
+			entries, synced, closed := link.take()
+			if closed {
+				return
+			}
+			if len(entries) == 0 && !synced {
+				break
+			}
+			cmdLine := make(CmdLine, 0, 5+2*len(entries))
+			cmdLine = append(cmdLine, []byte(relayReplicate), []byte(cluster.self), []byte(link.id),
+				[]byte(strconv.FormatInt(link.seq, 10)), []byte(strconv.FormatBool(synced)))
+			for _, entry := range entries {
+				cmdLine = append(cmdLine, []byte(strconv.Itoa(entry.dbIndex)),
+					protocol.MakeMultiBulkReply(entry.cmdLine).ToBytes())
+			}
+			link.seq++
+			reply := cluster.relayPeer(link.replica, conn, cmdLine)
+			if protocol.IsErrorReply(reply) {
+				logger.Warn("replication to " + link.replica + " broken: " + string(reply.ToBytes()))
+				link.close()
+				return
+			}
+		}
+	}
+}
+
+func (cluster *Cluster) removeReplicationLink(link *replicationLink) {
+	rep := cluster.replication
+	rep.linksMu.Lock()
+	defer rep.linksMu.Unlock()
+	if rep.links[link.replica] == link {
+		delete(rep.links, link.replica)
+	}
+}
+
+// closeReplicationLinks closes all links of master
+func (cluster *Cluster) closeReplicationLinks() {
+	rep := cluster.replication
+	rep.linksMu.Lock()
+	defer rep.linksMu.Unlock()
+	for replica, link := range rep.links {
+		link.close()
+		delete(rep.links, replica)
+	}
+}
+
+// replicationCron asks master for replication link, runs on replica
+func (cluster *Cluster) replicationCron() {
+	master := cluster.bus.getReplicaOf()
+	if master == "" || cluster.isNodeFailed(master) {
+		return
+	}
+	rep := cluster.replication
+	rep.mu.Lock()
+	if rep.requesting {
+		rep.mu.Unlock()
+		return
+	}
+	rep.requesting = true
+	linkID := rep.linkID
+	if rep.master != master || linkID == "" {
+		linkID = emptyArg
+	}
+	rep.mu.Unlock()
+
+	reply := cluster.relayPeer(master, makeMigrationConn(0), utils.ToCmdLine(relayReplSync, cluster.self, linkID))
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.requesting = false
+	if protocol.IsErrorReply(reply) {
+		logger.Warn("replication sync to " + master + " failed: " + string(reply.ToBytes()))
+		return
+	}
+	status, ok := reply.(*protocol.StatusReply)
+	if ok && (status.Status != rep.linkID || rep.master != master) {
+		// wait for the new link, otherwise master will create another link in the next round
+		rep.master = master
+		rep.linkID = status.Status
+		rep.nextSeq = 0
+		rep.synced = false
+	}
+}
+
+// execReplicate applies commands from master
+// cmdLine: _replicate master link-id seq synced [db-index cmd]...
+func execReplicate(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 5 || len(cmdLine)%2 == 0 {
+		return protocol.MakeArgNumErrReply(relayReplicate)
+	}
+	master := string(cmdLine[1])
+	linkID := string(cmdLine[2])
+	seq, err1 := strconv.ParseInt(string(cmdLine[3]), 10, 64)
+	synced, err2 := strconv.ParseBool(string(cmdLine[4]))
+	if err1 != nil || err2 != nil {
+		return protocol.MakeErrReply("ERR illegal replication batch")
+	}
+	if master != cluster.bus.getReplicaOf() {
+		return protocol.MakeErrReply("ERR " + cluster.self + " is not a replica of " + master)
+	}
+	rep := cluster.replication
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if seq == 0 {
+		// a new link always starts with full synchronization
+		rep.master = master
+		rep.linkID = linkID
+		rep.nextSeq = 0
+		rep.synced = false
+	} else if master != rep.master || linkID != rep.linkID || seq != rep.nextSeq {
+		return protocol.MakeErrReply("ERR replication batch out of order")
+	}
+	for i := 5; i < len(cmdLine); i += 2 {
+		dbIndex, err := strconv.Atoi(string(cmdLine[i]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal db index in replication batch")
+		}
+		raw, err := parser.ParseOne(cmdLine[i+1])
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal command in replication batch: " + err.Error())
+		}
+		line, ok := raw.(*protocol.MultiBulkReply)
+		if !ok {
+			return protocol.MakeErrReply("ERR illegal command in replication batch")
+		}
+		conn := makeMigrationConn(dbIndex)
+		// commands from master is trusted
+		conn.SetPassword(config.Properties.RequirePass)
+		reply := cluster.db.Exec(conn, line.Args)
+		if protocol.IsErrorReply(reply) {
+			logger.Warn("replicated command failed: " + string(reply.ToBytes()))
+		}
+		rep.appliedCmds++
+	}
+	rep.nextSeq++
+	rep.lastReceived = time.Now()
+	if synced {
+		rep.synced = true
+		logger.Info("full synchronization from " + master + " finished")
+	}
+	return protocol.MakeOkReply()
+}
+
+// isSyncedReplicaOf returns true if current node is a replica of master and has finished full synchronization
+func (cluster *Cluster) isSyncedReplicaOf(master string) bool {
+	if master == "" || cluster.bus.getReplicaOf() != master {
+		return false
+	}
+	rep := cluster.replication
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.master == master && rep.synced
+}
+
+func execReadOnly(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 1 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	if c != nil {
+		cluster.readOnly.Store(c, struct{}{})
+	}
+	return protocol.MakeOkReply()
+}
+
+func execReadWrite(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 1 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	if c != nil {
+		cluster.readOnly.Delete(c)
+	}
+	return protocol.MakeOkReply()
+}
+
+// canReadFromReplica returns true if the command can be served by replicas
+func (cluster *Cluster) canReadFromReplica(c redis.Connection, cmdLine CmdLine) bool {
+	if c == nil || c.InMultiState() {
+		return false
+	}
+	if _, ok := cluster.readOnly.Load(c); !ok {
+		return false
+	}
+	return database2.IsReadOnlyCommand(string(cmdLine[0]))
+}
+
+// pickReplica returns a random replica of master not flagged PFAIL or FAIL, returns empty string if not found
+func (cluster *Cluster) pickReplica(master string) string {
+	bus := cluster.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	var candidates []string
+	if bus.replicaOf == master {
+		candidates = append(candidates, cluster.self)
+	}
+	for node, state := range bus.nodes {
+		if state.replicaOf == master && !state.pfail && !state.fail {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// readFromReplica executes read-only command on a replica of master, ok is false if no replica available
+func (cluster *Cluster) readFromReplica(master string, c redis.Connection, cmdLine CmdLine) (redis.Reply, bool) {
+	replica := cluster.pickReplica(master)
+	if replica == "" {
+		return nil, false
+	}
+	if replica == cluster.self {
+		if !cluster.isSyncedReplicaOf(master) {
+			return nil, false
+		}
+		return cluster.db.Exec(c, cmdLine), true
+	}
+	reply := cluster.relay(replica, c, utils.ToCmdLine3(relayReplicaRead, cmdLine...))
+	if protocol.IsErrorReply(reply) {
+		// replica may be not synced yet, let master serve it
+		return nil, false
+	}
+	return reply, true
+}
+
+// execReplicaRead executes read-only command if current node is a synced replica
+// cmdLine: _replicaread cmd args...
+func execReplicaRead(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply(relayReplicaRead)
+	}
+	if !database2.IsReadOnlyCommand(string(cmdLine[1])) {
+		return protocol.MakeErrReply("ERR " + string(cmdLine[1]) + " is not a read-only command")
+	}
+	if !cluster.isSyncedReplicaOf(cluster.bus.getReplicaOf()) {
+		return protocol.MakeErrReply("ERR " + cluster.self + " is not a synced replica")
+	}
+	return cluster.db.Exec(c, cmdLine[1:])
+}
+
+// replicationInfo returns fields of replication state in `CLUSTER INFO`
+func (cluster *Cluster) replicationInfo() [][2]string {
+	master := cluster.bus.getReplicaOf()
+	rep := cluster.replication
+	if master == "" {
+		rep.linksMu.Lock()
+		defer rep.linksMu.Unlock()
+		return [][2]string{
+			{"cluster_role", "master"},
+			{"cluster_connected_replicas", strconv.Itoa(len(rep.links))},
+		}
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	linkStatus := "down"
+	if rep.master == master && rep.synced {
+		linkStatus = "up"
+	}
+	lastIO := int64(-1)
+	if !rep.lastReceived.IsZero() {
+		lastIO = int64(time.Since(rep.lastReceived) / time.Second)
+	}
+	return [][2]string{
+		{"cluster_role", "replica"},
+		{"cluster_master_link_status", linkStatus},
+		{"cluster_master_last_io_seconds_ago", strconv.FormatInt(lastIO, 10)},
+		{"cluster_replicated_commands", strconv.FormatInt(rep.appliedCmds, 10)},
+	}
+}
@@ -12,6 +12,8 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["prepare"] = execPrepare
 	routerMap["commit"] = execCommit
 	routerMap["rollback"] = execRollback
+	routerMap[relayTxStatus] = execTxStatus
+	routerMap[relayTxAck] = execTxAck
 	routerMap["del"] = Del
 
 	routerMap["expire"] = defaultFunc
@@ -25,6 +27,13 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["type"] = defaultFunc
 	routerMap["rename"] = Rename
 	routerMap["renamenx"] = RenameNx
+	routerMap["object"] = subCommandFunc
+	routerMap["unlink"] = Del
+	routerMap["touch"] = proxyCount
+	routerMap["dump"] = defaultFunc
+	routerMap["restore"] = defaultFunc
+	routerMap["move"] = defaultFunc
+	routerMap["copy"] = Copy
 
 	routerMap["set"] = defaultFunc
 	routerMap["setnx"] = defaultFunc
@@ -40,6 +49,14 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["incrbyfloat"] = defaultFunc
 	routerMap["decr"] = defaultFunc
 	routerMap["decrby"] = defaultFunc
+	routerMap["getex"] = defaultFunc
+	routerMap["getdel"] = defaultFunc
+	routerMap["strlen"] = defaultFunc
+	routerMap["append"] = defaultFunc
+	routerMap["setrange"] = defaultFunc
+	routerMap["getrange"] = defaultFunc
+	routerMap["substr"] = defaultFunc
+	routerMap["lcs"] = LCS
 
 	routerMap["lpush"] = defaultFunc
 	routerMap["lpushx"] = defaultFunc
@@ -47,7 +64,13 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["rpushx"] = defaultFunc
 	routerMap["lpop"] = defaultFunc
 	routerMap["rpop"] = defaultFunc
-	//routerMap["rpoplpush"] = RPopLPush
+	routerMap["rpoplpush"] = RPopLPush
+	routerMap["lmove"] = LMove
+	routerMap["lmpop"] = LMPop
+	routerMap["blmpop"] = BLMPop
+	routerMap["lpos"] = defaultFunc
+	routerMap["linsert"] = defaultFunc
+	routerMap["ltrim"] = defaultFunc
 	routerMap["lrem"] = defaultFunc
 	routerMap["llen"] = defaultFunc
 	routerMap["lindex"] = defaultFunc
@@ -67,6 +90,19 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["hgetall"] = defaultFunc
 	routerMap["hincrby"] = defaultFunc
 	routerMap["hincrbyfloat"] = defaultFunc
+	routerMap["hstrlen"] = defaultFunc
+	routerMap["hrandfield"] = defaultFunc
+	routerMap["hscan"] = defaultFunc
+	routerMap["hexpire"] = defaultFunc
+	routerMap["hpexpire"] = defaultFunc
+	routerMap["hexpireat"] = defaultFunc
+	routerMap["hpexpireat"] = defaultFunc
+	routerMap["httl"] = defaultFunc
+	routerMap["hpttl"] = defaultFunc
+	routerMap["hexpiretime"] = defaultFunc
+	routerMap["hpexpiretime"] = defaultFunc
+	routerMap["hpersist"] = defaultFunc
+	routerMap["hgetdel"] = defaultFunc
 
 	routerMap["sadd"] = defaultFunc
 	routerMap["sismember"] = defaultFunc
@@ -74,13 +110,16 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["spop"] = defaultFunc
 	routerMap["scard"] = defaultFunc
 	routerMap["smembers"] = defaultFunc
-	routerMap["sinter"] = defaultFunc
-	routerMap["sinterstore"] = defaultFunc
-	routerMap["sunion"] = defaultFunc
-	routerMap["sunionstore"] = defaultFunc
-	routerMap["sdiff"] = defaultFunc
-	routerMap["sdiffstore"] = defaultFunc
+	routerMap["sinter"] = SetAlgebra
+	routerMap["sinterstore"] = SetAlgebraStore
+	routerMap["sunion"] = SetAlgebra
+	routerMap["sunionstore"] = SetAlgebraStore
+	routerMap["sdiff"] = SetAlgebra
+	routerMap["sdiffstore"] = SetAlgebraStore
 	routerMap["srandmember"] = defaultFunc
+	routerMap["smismember"] = defaultFunc
+	routerMap["smove"] = SMove
+	routerMap["sintercard"] = SInterCard
 
 	routerMap["zadd"] = defaultFunc
 	routerMap["zscore"] = defaultFunc
@@ -96,6 +135,24 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["zrem"] = defaultFunc
 	routerMap["zremrangebyscore"] = defaultFunc
 	routerMap["zremrangebyrank"] = defaultFunc
+	routerMap["zrangebylex"] = defaultFunc
+	routerMap["zrevrangebylex"] = defaultFunc
+	routerMap["zlexcount"] = defaultFunc
+	routerMap["zremrangebylex"] = defaultFunc
+	routerMap["zpopmin"] = defaultFunc
+	routerMap["zpopmax"] = defaultFunc
+	routerMap["zrandmember"] = defaultFunc
+	routerMap["zmscore"] = defaultFunc
+	routerMap["bzpopmin"] = BZPopMin
+	routerMap["bzpopmax"] = BZPopMin
+	routerMap["zunionstore"] = ZSetAlgebraStore
+	routerMap["zinterstore"] = ZSetAlgebraStore
+	routerMap["zdiffstore"] = ZSetAlgebraStore
+	routerMap["zunion"] = ZSetAlgebra
+	routerMap["zinter"] = ZSetAlgebra
+	routerMap["zdiff"] = ZSetAlgebra
+	routerMap["zintercard"] = ZInterCard
+	routerMap["zrangestore"] = ZRangeStore
 
 	routerMap["geoadd"] = defaultFunc
 	routerMap["geopos"] = defaultFunc
@@ -111,9 +168,28 @@ func makeRouter() map[string]CmdFunc {
 
 	routerMap["flushdb"] = FlushDB
 	routerMap["flushall"] = FlushAll
+	routerMap["keys"] = Keys
+	routerMap["dbsize"] = DBSize
+	routerMap["randomkey"] = RandomKey
+	routerMap["swapdb"] = SwapDB
+	routerMap["scan"] = Scan
+	routerMap["memory"] = subCommandFunc
+	routerMap[relayScan] = execRelayedScan
+	routerMap[relayLocal] = execLocal
 	routerMap[relayMulti] = execRelayedMulti
 	routerMap["getver"] = defaultFunc
 	routerMap["watch"] = execWatch
+	routerMap[relayTopology] = execTopology
+	routerMap[relayMigrateKey] = execMigrateKey
+	routerMap[relayMigrateAck] = execMigrateAck
+	routerMap[relayMigrateKeys] = execMigrateKeys
+	routerMap[relayHeartbeat] = execHeartbeat
+	routerMap[relayFailoverAuth] = execFailoverAuth
+	routerMap[relayReplSync] = execReplSync
+	routerMap[relayReplicate] = execReplicate
+	routerMap[relayReplicaRead] = execReplicaRead
+	routerMap["readonly"] = execReadOnly
+	routerMap["readwrite"] = execReadWrite
 
 	return routerMap
 }
@@ -122,5 +198,20 @@ func makeRouter() map[string]CmdFunc {
 func defaultFunc(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	key := string(args[1])
 	peer := cluster.peerPicker.PickNode(key)
+	if cluster.canReadFromReplica(c, args) {
+		if reply, ok := cluster.readFromReplica(peer, c, args); ok {
+			return reply
+		}
+	}
+	return cluster.relay(peer, c, args)
+}
+
+// subCommandFunc relays command whose key follows a sub command, such as OBJECT ENCODING key
+func subCommandFunc(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		// no key, let local db reply the error
+		return cluster.db.Exec(c, args)
+	}
+	peer := cluster.peerPicker.PickNode(string(args[2]))
 	return cluster.relay(peer, c, args)
 }
@@ -0,0 +1,171 @@
+package cluster
+
+import (
+	"godis/dataStruct/set"
+	database2 "godis/database"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"strings"
+)
+
+// isSameNode returns whether all keys are served by one node, and the node
+func (cluster *Cluster) isSameNode(keys ...string) (string, bool) {
+	groupMap := cluster.groupBy(keys)
+	if len(groupMap) != 1 {
+		return "", false
+	}
+	for node := range groupMap {
+		return node, true
+	}
+	return "", false
+}
+
+// fetchSets gets members of sets from their nodes, a set not exists is empty
+func fetchSets(cluster *Cluster, c redis.Connection, keys []string) ([]*set.Set, redis.Reply) {
+	sets := make([]*set.Set, len(keys))
+	for i, key := range keys {
+		node := cluster.peerPicker.PickNode(key)
+		reply := cluster.relay(node, c, utils.ToCmdLine("SMembers", key))
+		if protocol.IsErrorReply(reply) {
+			return nil, reply
+		}
+		sets[i] = set.Make()
+		if members, ok := reply.(*protocol.MultiBulkReply); ok {
+			for _, member := range members.Args {
+				sets[i].Add(string(member))
+			}
+		}
+	}
+	return sets, nil
+}
+
+// computeSets computes sinter, sunion or sdiff of sets
+func computeSets(op string, sets []*set.Set) *set.Set {
+	result := sets[0]
+	for _, s := range sets[1:] {
+		switch op {
+		case "sinter":
+			result = result.Intersect(s)
+		case "sunion":
+			result = result.Union(s)
+		case "sdiff":
+			result = result.Diff(s)
+		}
+	}
+	return result
+}
+
+// SetAlgebra executes SINTER, SUNION or SDIFF on sets distributed on any node
+func SetAlgebra(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	keys := make([]string, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		keys[i-1] = string(args[i])
+	}
+	if node, ok := cluster.isSameNode(keys...); ok {
+		return cluster.relay(node, c, args)
+	}
+	sets, errReply := fetchSets(cluster, c, keys)
+	if errReply != nil {
+		return errReply
+	}
+	result := computeSets(cmdName, sets)
+	if result.Len() == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	members := make([][]byte, 0, result.Len())
+	result.ForEach(func(member string) bool {
+		members = append(members, []byte(member))
+		return true
+	})
+	return protocol.MakeMultiBulkReply(members)
+}
+
+// SetAlgebraStore executes SINTERSTORE, SUNIONSTORE or SDIFFSTORE on sets distributed on any node,
+// the destination is written by a cross-node transaction
+func SetAlgebraStore(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	dest := string(args[1])
+	keys := make([]string, len(args)-2)
+	for i := 2; i < len(args); i++ {
+		keys[i-2] = string(args[i])
+	}
+	if node, ok := cluster.isSameNode(append(keys, dest)...); ok {
+		return cluster.relay(node, c, args)
+	}
+	op := strings.TrimSuffix(cmdName, "store")
+	return execReadThenWrite(cluster, c, append([]string{dest}, keys...), func() ([]CmdLine, redis.Reply) {
+		sets, errReply := fetchSets(cluster, c, keys)
+		if errReply != nil {
+			return nil, errReply
+		}
+		result := computeSets(op, sets)
+		cmdLines := []CmdLine{utils.ToCmdLine("Del", dest)}
+		if result.Len() > 0 {
+			cmdLines = append(cmdLines, utils.ToCmdLine2("SAdd", append([]string{dest}, result.ToSlice()...)...))
+		}
+		return cmdLines, protocol.MakeIntReply(int64(result.Len()))
+	})
+}
+
+// SInterCard executes SINTERCARD on sets distributed on any node
+func SInterCard(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply("sintercard")
+	}
+	keys, limit, errReply := database2.ParseInterCardArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	if node, ok := cluster.isSameNode(keys...); ok {
+		return cluster.relay(node, c, args)
+	}
+	sets, reply := fetchSets(cluster, c, keys)
+	if reply != nil {
+		return reply
+	}
+	result := computeSets("sinter", sets)
+	if limit > 0 && int64(result.Len()) > limit {
+		return protocol.MakeIntReply(limit)
+	}
+	return protocol.MakeIntReply(int64(result.Len()))
+}
+
+// SMove moves a member between sets on different nodes by a cross-node transaction
+func SMove(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 4 {
+		return protocol.MakeArgNumErrReply("smove")
+	}
+	src, dest, member := string(args[1]), string(args[2]), string(args[3])
+	if node, ok := cluster.isSameNode(src, dest); ok {
+		return cluster.relay(node, c, args)
+	}
+	return execReadThenWrite(cluster, c, []string{src, dest}, func() ([]CmdLine, redis.Reply) {
+		reply := cluster.relay(cluster.peerPicker.PickNode(src), c, utils.ToCmdLine("SIsMember", src, member))
+		if protocol.IsErrorReply(reply) {
+			return nil, reply
+		}
+		isMember, ok := reply.(*protocol.IntReply)
+		if !ok || isMember.Code == 0 {
+			return nil, protocol.MakeIntReply(0)
+		}
+		reply = cluster.relay(cluster.peerPicker.PickNode(dest), c, utils.ToCmdLine("Type", dest))
+		if protocol.IsErrorReply(reply) {
+			return nil, reply
+		}
+		if status, ok := reply.(*protocol.StatusReply); ok && status.Status != "none" && status.Status != "set" {
+			return nil, &protocol.WrongTypeErrReply{}
+		}
+		return []CmdLine{
+			utils.ToCmdLine("SRem", src, member),
+			utils.ToCmdLine("SAdd", dest, member),
+		}, protocol.MakeIntReply(1)
+	})
+}
@@ -0,0 +1,414 @@
+package cluster
+
+import (
+	"bytes"
+	"godis/config"
+	database2 "godis/database"
+	"godis/interface/database"
+	"godis/interface/redis"
+	"godis/lib/slot"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * slot.go implements hash slot sharding like redis cluster, enabled by `cluster-sharding slots`.
+ * By default commands are relayed to the node serving the slot, with `cluster-redirect yes`,
+ * node replies -MOVED/-ASK instead, so that cluster-aware clients can talk to the cluster directly.
+ */
+
+func (cluster *Cluster) isRedirectMode() bool {
+	return cluster.slots != nil && config.Properties.ClusterRedirect
+}
+
+func slotsModeRequiredReply() redis.Reply {
+	return protocol.MakeErrReply("ERR This instance has slots sharding disabled, set `cluster-sharding slots` to enable it")
+}
+
+// checkRedirect returns -MOVED, -ASK, -CROSSSLOT or -TRYAGAIN if the command should not be executed by current node.
+// keyed is false if the command has no keys
+func (cluster *Cluster) checkRedirect(c redis.Connection, cmdLine CmdLine) (errReply redis.Reply, keyed bool) {
+	asking := false
+	if c != nil {
+		// ASKING only affects the next command
+		_, asking = cluster.asking.LoadAndDelete(c)
+	}
+	writeKeys, readKeys := database2.GetRelatedKeys(cmdLine)
+	keys := append(writeKeys, readKeys...)
+	if len(keys) == 0 {
+		return nil, false
+	}
+	slotIndex := slot.GetSlot(keys[0])
+	for _, key := range keys[1:] {
+		if slot.GetSlot(key) != slotIndex {
+			return protocol.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot"), true
+		}
+	}
+	owner := cluster.slots.GetNode(slotIndex)
+	if owner == cluster.self {
+		target, migrating := cluster.slots.GetMigrating(slotIndex)
+		if !migrating {
+			return nil, true
+		}
+		// keys already moved to target node are served by target
+		existed := cluster.countExistingKeys(c, keys)
+		if existed == len(uniqueKeys(keys)) {
+			return nil, true
+		}
+		if existed > 0 {
+			return protocol.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot"), true
+		}
+		return protocol.MakeErrReply("ASK " + strconv.Itoa(int(slotIndex)) + " " + target), true
+	}
+	if _, importing := cluster.slots.GetImporting(slotIndex); importing && asking {
+		return nil, true
+	}
+	if owner == "" {
+		return protocol.MakeErrReply("CLUSTERDOWN Hash slot not served"), true
+	}
+	if cluster.canReadFromReplica(c, cmdLine) && cluster.isSyncedReplicaOf(owner) {
+		// replicas serve reads of their master for connections in READONLY mode
+		return nil, true
+	}
+	return protocol.MakeErrReply("MOVED " + strconv.Itoa(int(slotIndex)) + " " + owner), true
+}
+
+func uniqueKeys(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+	return set
+}
+
+// countExistingKeys returns the count of given keys existing in local db
+func (cluster *Cluster) countExistingKeys(c redis.Connection, keys []string) int {
+	unique := uniqueKeys(keys)
+	args := make([]string, 0, len(unique))
+	for key := range unique {
+		args = append(args, key)
+	}
+	reply := cluster.db.ExecWithLock(c, utils.ToCmdLine2("ExistIn", args...))
+	if multiBulk, ok := reply.(*protocol.MultiBulkReply); ok {
+		return len(multiBulk.Args)
+	}
+	return 0
+}
+
+// execAsking allows the next command to access an importing slot
+func execAsking(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 1 {
+		return protocol.MakeArgNumErrReply("asking")
+	}
+	if cluster.slots == nil {
+		return slotsModeRequiredReply()
+	}
+	cluster.asking.Store(c, struct{}{})
+	return protocol.MakeOkReply()
+}
+
+// execCluster dispatches CLUSTER sub commands
+func execCluster(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply("cluster")
+	}
+	subCmd := strings.ToLower(string(cmdLine[1]))
+	args := cmdLine[2:]
+	switch subCmd {
+	case "keyslot":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("cluster|keyslot")
+		}
+		return protocol.MakeIntReply(int64(slot.GetSlot(string(args[0]))))
+	case "myid":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("cluster|myid")
+		}
+		return protocol.MakeBulkReply([]byte(slot.GenNodeID(cluster.self)))
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("cluster|countkeysinslot")
+		}
+		slotIndex, errReply := parseSlot(args[0])
+		if errReply != nil {
+			return errReply
+		}
+		keys := cluster.getKeysInSlot(c.GetDBIndex(), slotIndex, -1)
+		return protocol.MakeIntReply(int64(len(keys)))
+	case "getkeysinslot":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("cluster|getkeysinslot")
+		}
+		slotIndex, errReply := parseSlot(args[0])
+		if errReply != nil {
+			return errReply
+		}
+		count, err := strconv.Atoi(string(args[1]))
+		if err != nil || count < 0 {
+			return protocol.MakeErrReply("ERR Invalid number of keys")
+		}
+		keys := cluster.getKeysInSlot(c.GetDBIndex(), slotIndex, count)
+		result := make([][]byte, len(keys))
+		for i, key := range keys {
+			result[i] = []byte(key)
+		}
+		return protocol.MakeMultiBulkReply(result)
+	case "meet":
+		return cluster.execClusterMeet(c, args)
+	case "forget":
+		return cluster.execClusterForget(c, args)
+	case "info":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("cluster|info")
+		}
+		return cluster.execClusterInfo()
+	case "migration":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("cluster|migration")
+		}
+		return cluster.execClusterMigration()
+	}
+
+	if cluster.slots == nil {
+		return slotsModeRequiredReply()
+	}
+	switch subCmd {
+	case "slots":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("cluster|slots")
+		}
+		return cluster.execClusterSlots()
+	case "shards":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("cluster|shards")
+		}
+		return cluster.execClusterShards()
+	case "nodes":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("cluster|nodes")
+		}
+		return protocol.MakeBulkReply([]byte(cluster.clusterNodes()))
+	case "setslot":
+		return cluster.execClusterSetSlot(args)
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CLUSTER HELP.")
+}
+
+func parseSlot(arg []byte) (uint32, redis.Reply) {
+	slotIndex, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || slotIndex < 0 || slotIndex >= slot.SlotCount {
+		return 0, protocol.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	return uint32(slotIndex), nil
+}
+
+// getKeysInSlot scans local db for keys in the given slot, returns at most limit keys, limit < 0 means no limit
+func (cluster *Cluster) getKeysInSlot(dbIndex int, slotIndex uint32, limit int) []string {
+	var keys []string
+	if limit == 0 {
+		return keys
+	}
+	now := time.Now()
+	cluster.db.ForEach(dbIndex, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		if expiration != nil && expiration.Before(now) {
+			return true
+		}
+		if slot.GetSlot(key) == slotIndex {
+			keys = append(keys, key)
+		}
+		return limit < 0 || len(keys) < limit
+	})
+	return keys
+}
+
+func splitAddr(node string) (string, int) {
+	host, portStr, err := net.SplitHostPort(node)
+	if err != nil {
+		return node, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// execClusterSlots returns slot ranges and their nodes, in the format of redis `CLUSTER SLOTS`
+func (cluster *Cluster) execClusterSlots() redis.Reply {
+	ranges := cluster.slots.GetRanges()
+	replies := make([]redis.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		host, port := splitAddr(r.Node)
+		replies = append(replies, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeIntReply(int64(r.Start)),
+			protocol.MakeIntReply(int64(r.End)),
+			protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte(host)),
+				protocol.MakeIntReply(int64(port)),
+				protocol.MakeBulkReply([]byte(slot.GenNodeID(r.Node))),
+			}),
+		}))
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// getNodeRanges groups slot ranges by node
+func (cluster *Cluster) getNodeRanges() map[string][]*slot.Range {
+	result := make(map[string][]*slot.Range)
+	for _, node := range cluster.slots.GetNodes() {
+		result[node] = nil
+	}
+	for _, r := range cluster.slots.GetRanges() {
+		result[r.Node] = append(result[r.Node], r)
+	}
+	return result
+}
+
+// execClusterShards returns shards in the format of redis `CLUSTER SHARDS`, every node is a shard
+func (cluster *Cluster) execClusterShards() redis.Reply {
+	nodeRanges := cluster.getNodeRanges()
+	nodes := make([]string, 0, len(nodeRanges))
+	for node := range nodeRanges {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	shards := make([]redis.Reply, 0, len(nodes))
+	for _, node := range nodes {
+		slotReplies := make([]redis.Reply, 0, 2*len(nodeRanges[node]))
+		for _, r := range nodeRanges[node] {
+			slotReplies = append(slotReplies, protocol.MakeIntReply(int64(r.Start)), protocol.MakeIntReply(int64(r.End)))
+		}
+		host, port := splitAddr(node)
+		nodeInfo := protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("id")),
+			protocol.MakeBulkReply([]byte(slot.GenNodeID(node))),
+			protocol.MakeBulkReply([]byte("port")),
+			protocol.MakeIntReply(int64(port)),
+			protocol.MakeBulkReply([]byte("ip")),
+			protocol.MakeBulkReply([]byte(host)),
+			protocol.MakeBulkReply([]byte("endpoint")),
+			protocol.MakeBulkReply([]byte(host)),
+			protocol.MakeBulkReply([]byte("role")),
+			protocol.MakeBulkReply([]byte("master")),
+			protocol.MakeBulkReply([]byte("replication-offset")),
+			protocol.MakeIntReply(0),
+			protocol.MakeBulkReply([]byte("health")),
+			protocol.MakeBulkReply([]byte("online")),
+		})
+		shards = append(shards, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("slots")),
+			protocol.MakeMultiRawReply(slotReplies),
+			protocol.MakeBulkReply([]byte("nodes")),
+			protocol.MakeMultiRawReply([]redis.Reply{nodeInfo}),
+		}))
+	}
+	return protocol.MakeMultiRawReply(shards)
+}
+
+// clusterNodes returns node list in the format of redis `CLUSTER NODES`
+func (cluster *Cluster) clusterNodes() string {
+	nodeRanges := cluster.getNodeRanges()
+	nodes := make([]string, 0, len(nodeRanges))
+	for node := range nodeRanges {
+		nodes = append(nodes, node)
+	}
+	for _, replica := range cluster.getReplicas() {
+		if _, ok := nodeRanges[replica]; !ok {
+			nodes = append(nodes, replica)
+		}
+	}
+	sort.Strings(nodes)
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		_, port := splitAddr(node)
+		flags, replicaOf := cluster.getNodeFlags(node)
+		masterID := "-"
+		if replicaOf != "" {
+			masterID = slot.GenNodeID(replicaOf)
+		}
+		linkState := "connected"
+		if strings.Contains(flags, "fail") {
+			linkState = "disconnected"
+		}
+		buf.WriteString(slot.GenNodeID(node) + " " + node + "@" + strconv.Itoa(port+10000) + " " + flags +
+			" " + masterID + " 0 0 0 " + linkState)
+		for _, r := range nodeRanges[node] {
+			if r.Start == r.End {
+				buf.WriteString(" " + strconv.Itoa(int(r.Start)))
+			} else {
+				buf.WriteString(" " + strconv.Itoa(int(r.Start)) + "-" + strconv.Itoa(int(r.End)))
+			}
+		}
+		if node == cluster.self {
+			buf.WriteString(cluster.migrationStates())
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// migrationStates returns migrating and importing slots of current node, like: [93->-id] [94-<-id]
+func (cluster *Cluster) migrationStates() string {
+	var buf bytes.Buffer
+	for s := uint32(0); s < slot.SlotCount; s++ {
+		if target, ok := cluster.slots.GetMigrating(s); ok {
+			buf.WriteString(" [" + strconv.Itoa(int(s)) + "->-" + slot.GenNodeID(target) + "]")
+		}
+		if source, ok := cluster.slots.GetImporting(s); ok {
+			buf.WriteString(" [" + strconv.Itoa(int(s)) + "-<-" + slot.GenNodeID(source) + "]")
+		}
+	}
+	return buf.String()
+}
+
+// execClusterSetSlot: CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node-id, or CLUSTER SETSLOT slot STABLE
+func (cluster *Cluster) execClusterSetSlot(args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("cluster|setslot")
+	}
+	slotIndex, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToLower(string(args[1]))
+	if action == "stable" {
+		if len(args) != 2 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		cluster.slots.SetStable(slotIndex)
+		return protocol.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	node, ok := cluster.slots.GetNodeByID(string(args[2]))
+	if !ok {
+		return protocol.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	owner := cluster.slots.GetNode(slotIndex)
+	switch action {
+	case "migrating":
+		if owner != cluster.self {
+			return protocol.MakeErrReply("ERR I'm not the owner of hash slot " + strconv.Itoa(int(slotIndex)))
+		}
+		if node == cluster.self {
+			return protocol.MakeErrReply("ERR I can't migrate a slot to myself")
+		}
+		cluster.slots.SetMigrating(slotIndex, node)
+	case "importing":
+		if owner == cluster.self {
+			return protocol.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(int(slotIndex)))
+		}
+		if node == cluster.self {
+			return protocol.MakeErrReply("ERR I can't import a slot from myself")
+		}
+		cluster.slots.SetImporting(slotIndex, node)
+	case "node":
+		cluster.slots.SetNode(slotIndex, node)
+	default:
+		return protocol.MakeErrReply("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	return protocol.MakeOkReply()
+}
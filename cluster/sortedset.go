@@ -0,0 +1,194 @@
+package cluster
+
+import (
+	SortedSet "godis/dataStruct/sortedset"
+	database2 "godis/database"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// fetchZSet gets a sorted set from its node, a sorted set not exists is empty
+func fetchZSet(cluster *Cluster, c redis.Connection, key string) (*SortedSet.SortedSet, redis.Reply) {
+	node := cluster.peerPicker.PickNode(key)
+	reply := cluster.relay(node, c, utils.ToCmdLine("ZRange", key, "0", "-1", "WITHSCORES"))
+	if protocol.IsErrorReply(reply) {
+		return nil, reply
+	}
+	result := SortedSet.Make()
+	if elements, ok := reply.(*protocol.MultiBulkReply); ok {
+		for i := 0; i+1 < len(elements.Args); i += 2 {
+			score, err := strconv.ParseFloat(string(elements.Args[i+1]), 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR illegal score of " + key)
+			}
+			result.Add(string(elements.Args[i]), score)
+		}
+	}
+	return result, nil
+}
+
+// fetchZSets gets sorted sets of keys from their nodes
+func fetchZSets(cluster *Cluster, c redis.Connection, keys []string) ([]*SortedSet.SortedSet, redis.Reply) {
+	sets := make([]*SortedSet.SortedSet, len(keys))
+	for i, key := range keys {
+		sortedSet, errReply := fetchZSet(cluster, c, key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		sets[i] = sortedSet
+	}
+	return sets, nil
+}
+
+// zaddCmdLine makes a ZADD command line which adds all elements of sorted set into key
+func zaddCmdLine(key string, sortedSet *SortedSet.SortedSet) CmdLine {
+	zaddArgs := make([]string, 0, 1+2*sortedSet.Len())
+	zaddArgs = append(zaddArgs, key)
+	sortedSet.ForEach(0, sortedSet.Len(), false, func(element *SortedSet.Element) bool {
+		zaddArgs = append(zaddArgs, strconv.FormatFloat(element.Score, 'f', -1, 64), element.Member)
+		return true
+	})
+	return utils.ToCmdLine2("ZAdd", zaddArgs...)
+}
+
+// ZSetAlgebra executes ZUNION, ZINTER or ZDIFF on sorted sets distributed on any node
+func ZSetAlgebra(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	params, errReply := database2.ParseZSetAlgebraArgs(cmdName, args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	if node, ok := cluster.isSameNode(params.Keys...); ok {
+		return cluster.relay(node, c, args)
+	}
+	sets, reply := fetchZSets(cluster, c, params.Keys)
+	if reply != nil {
+		return reply
+	}
+	return params.MakeReply(params.Compute(sets))
+}
+
+// ZSetAlgebraStore executes ZUNIONSTORE, ZINTERSTORE or ZDIFFSTORE on sorted sets distributed on any node,
+// the destination is written by a cross-node transaction
+func ZSetAlgebraStore(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	if len(args) < 4 {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	dest := string(args[1])
+	params, errReply := database2.ParseZSetAlgebraArgs(cmdName, args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	if node, ok := cluster.isSameNode(append([]string{dest}, params.Keys...)...); ok {
+		return cluster.relay(node, c, args)
+	}
+	return execReadThenWrite(cluster, c, append([]string{dest}, params.Keys...), func() ([]CmdLine, redis.Reply) {
+		sets, errReply := fetchZSets(cluster, c, params.Keys)
+		if errReply != nil {
+			return nil, errReply
+		}
+		result := params.Compute(sets)
+		cmdLines := []CmdLine{utils.ToCmdLine("Del", dest)}
+		if result.Len() > 0 {
+			cmdLines = append(cmdLines, zaddCmdLine(dest, result))
+		}
+		return cmdLines, protocol.MakeIntReply(result.Len())
+	})
+}
+
+// ZInterCard executes ZINTERCARD on sorted sets distributed on any node
+func ZInterCard(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply("zintercard")
+	}
+	keys, limit, errReply := database2.ParseInterCardArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	if node, ok := cluster.isSameNode(keys...); ok {
+		return cluster.relay(node, c, args)
+	}
+	sets, reply := fetchZSets(cluster, c, keys)
+	if reply != nil {
+		return reply
+	}
+	return protocol.MakeIntReply(SortedSet.IntersectCard(sets, limit))
+}
+
+// ZRangeStore executes ZRANGESTORE while source and destination may be on different nodes,
+// the destination is written by a cross-node transaction
+func ZRangeStore(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 5 {
+		return protocol.MakeArgNumErrReply("zrangestore")
+	}
+	dest, src := string(args[1]), string(args[2])
+	if node, ok := cluster.isSameNode(dest, src); ok {
+		return cluster.relay(node, c, args)
+	}
+	return execReadThenWrite(cluster, c, []string{src, dest}, func() ([]CmdLine, redis.Reply) {
+		sortedSet, errReply := fetchZSet(cluster, c, src)
+		if errReply != nil {
+			return nil, errReply
+		}
+		elements, errReply := database2.ZRangeStoreElements(sortedSet, args[3:])
+		if errReply != nil {
+			return nil, errReply
+		}
+		result := SortedSet.Make()
+		for _, element := range elements {
+			result.Add(element.Member, element.Score)
+		}
+		cmdLines := []CmdLine{utils.ToCmdLine("Del", dest)}
+		if result.Len() > 0 {
+			cmdLines = append(cmdLines, zaddCmdLine(dest, result))
+		}
+		return cmdLines, protocol.MakeIntReply(result.Len())
+	})
+}
+
+// BZPopMin pops a member from the first non-empty sorted set of keys which may be distributed on any node,
+// or blocks until any sorted set is added. It is used by BZPOPMIN and BZPOPMAX
+// args: BZPOPMIN key [key ...] timeout
+func BZPopMin(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	timeout, errReply := database2.ParseBlockingTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+	keys := make([]string, len(args)-2)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	if node, ok := cluster.isSameNode(keys...); ok && node == cluster.self {
+		return cluster.db.Exec(c, args)
+	}
+	popCmd := "ZPopMin"
+	if cmdName == "bzpopmax" {
+		popCmd = "ZPopMax"
+	}
+	return pollBlocking(c, timeout, func() redis.Reply {
+		for _, key := range keys {
+			node := cluster.peerPicker.PickNode(key)
+			reply := cluster.relay(node, c, utils.ToCmdLine(popCmd, key))
+			if protocol.IsErrorReply(reply) {
+				return reply
+			}
+			popped, ok := reply.(*protocol.MultiBulkReply)
+			if !ok || len(popped.Args) == 0 {
+				continue
+			}
+			return protocol.MakeMultiBulkReply(append([][]byte{[]byte(key)}, popped.Args...))
+		}
+		return protocol.MakeNullMultiBulkReply()
+	})
+}
@@ -0,0 +1,36 @@
+package cluster
+
+import (
+	database2 "godis/database"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"strings"
+)
+
+// LCS finds the longest common subsequence of two strings which may be distributed on different nodes
+func LCS(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply("lcs")
+	}
+	keys := []string{string(args[1]), string(args[2])}
+	if node, ok := cluster.isSameNode(keys...); ok {
+		return cluster.relay(node, c, args)
+	}
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		node := cluster.peerPicker.PickNode(key)
+		reply := cluster.relay(node, c, utils.ToCmdLine("Get", key))
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			// replies from peers are parsed as standard errors
+			if strings.HasPrefix(errReply.Error(), "WRONGTYPE") {
+				return protocol.MakeErrReply("ERR The specified keys must contain string values")
+			}
+			return reply
+		}
+		if bulkReply, ok := reply.(*protocol.BulkReply); ok {
+			values[i] = bulkReply.Arg
+		}
+	}
+	return database2.LCS(values[0], values[1], args[3:])
+}
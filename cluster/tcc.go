@@ -1,11 +1,14 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
 	"godis/database"
 	"godis/interface/redis"
 	"godis/lib/logger"
 	"godis/lib/timewheel"
+	"godis/lib/utils"
+	"godis/redis/parser"
 	"godis/redis/protocol"
 	"strconv"
 	"strings"
@@ -33,6 +36,13 @@ type Transaction struct {
 	readKeys   []string
 	keysLocked bool
 	undoLog    []CmdLine
+	// cmdLines and watching are decoded from cmdLine of cross-node MULTI transaction, see execCrossNodeMulti
+	cmdLines [][][]byte
+	watching map[string]uint32
+	// executed is true if cmdLine may have been executed, only executed transaction should be undone
+	executed bool
+	// result is the reply of commit, replied again if coordinator re-sends commit after timeout
+	result redis.Reply
 
 	status int8
 	mu     *sync.Mutex
@@ -46,8 +56,28 @@ const (
 	preparedStatus   = 1
 	committedStatus  = 2
 	rolledBackStatus = 3
+
+	// results of transaction replied by `_txstatus`
+	txPending    = "pending"
+	txCommitted  = "committed"
+	txRolledBack = "rolledback"
+	// txUnknown means coordinator doesn't hold the transaction, participant must not undo it
+	txUnknown = "unknown"
+
+	// _txstatus tx-id: returns result of transaction coordinated by current node
+	relayTxStatus = "_txstatus"
+	// _txack tx-id node: participant has applied result of transaction coordinated by current node
+	relayTxAck = "_txack"
 )
 
+// txDecision is result of a transaction coordinated by current node,
+// it is kept until every participant acknowledged it
+type txDecision struct {
+	commit bool
+	// participants not acknowledged yet
+	pending map[string]struct{}
+}
+
 func genTaskKey(txID string) string {
 	return "tx:" + txID
 }
@@ -65,6 +95,15 @@ func NewTransaction(cluster *Cluster, c redis.Connection, id string, cmdLine Cmd
 	}
 }
 
+// getCoordinator returns the node coordinating the transaction, transaction id is formatted as `seq@node`
+func getCoordinator(txID string) string {
+	i := strings.LastIndex(txID, "@")
+	if i < 0 {
+		return ""
+	}
+	return txID[i+1:]
+}
+
 // Reentrant. invoker should hold tx.mu
 func (tx *Transaction) lockKeys() {
 	if !tx.keysLocked {
@@ -85,23 +124,125 @@ func (tx *Transaction) prepare() error {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	tx.writeKeys, tx.readKeys = database.GetRelatedKeys(tx.cmdLine)
+	tx.writeKeys, tx.readKeys = tx.getRelatedKeys()
 	// lock writeKeys
 	tx.lockKeys()
 
-	// build undo log
-	tx.undoLog = tx.cluster.db.GetUndoLogs(tx.dbIndex, tx.cmdLine)
+	if tx.isMulti() {
+		if tx.isWatchingChanged() {
+			tx.unLockKeys()
+			tx.status = rolledBackStatus
+			return errors.New(watchingChangedErr)
+		}
+		// undo logs of MULTI are built while committing, since every command changes keys for the following ones
+	} else {
+		// build undo log
+		tx.undoLog = tx.cluster.db.GetUndoLogs(tx.dbIndex, tx.cmdLine)
+	}
 	tx.status = preparedStatus
+	tx.cluster.journal.append(makePrepareRecord(tx))
 	taskKey := genTaskKey(tx.id)
 	timewheel.Delay(maxLockTime, taskKey, func() {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
 		if tx.status == preparedStatus {
-			// rollback transaction uncommitted until expire
+			// rollback transaction uncommitted until expire, so that keys will not be locked forever
 			logger.Info("abort transaction: " + tx.id)
+			tx.rollbackWithLock()
+			tx.cluster.cleanTransactionLater(tx)
 		}
 	})
 	return nil
 }
 
+func (tx *Transaction) isMulti() bool {
+	return strings.ToLower(string(tx.cmdLine[0])) == relayMulti
+}
+
+// parseMulti decodes commands and watching keys of cross-node MULTI transaction
+func (tx *Transaction) parseMulti() error {
+	if !tx.isMulti() {
+		return nil
+	}
+	watching, cmdLines, err := parseRelayedMulti(tx.cmdLine)
+	if err != nil {
+		return err
+	}
+	tx.watching = watching
+	tx.cmdLines = cmdLines
+	return nil
+}
+
+func (tx *Transaction) getRelatedKeys() ([]string, []string) {
+	if !tx.isMulti() {
+		return database.GetRelatedKeys(tx.cmdLine)
+	}
+	var writeKeys, readKeys []string
+	for _, cmdLine := range tx.cmdLines {
+		write, read := database.GetRelatedKeys(cmdLine)
+		writeKeys = append(writeKeys, write...)
+		readKeys = append(readKeys, read...)
+	}
+	for key := range tx.watching {
+		readKeys = append(readKeys, key)
+	}
+	return writeKeys, readKeys
+}
+
+// isWatchingChanged checks versions of watching keys, invoker should lock watching keys
+func (tx *Transaction) isWatchingChanged() bool {
+	conn := makeMigrationConn(tx.dbIndex)
+	for key, ver := range tx.watching {
+		reply := tx.cluster.db.ExecWithLock(conn, utils.ToCmdLine("GetVer", key))
+		if intReply, ok := reply.(*protocol.IntReply); !ok || uint32(intReply.Code) != ver {
+			return true
+		}
+	}
+	return false
+}
+
+// commitMulti executes commands of cross-node MULTI transaction, invoker should hold tx.mu
+func (tx *Transaction) commitMulti(c redis.Connection) redis.Reply {
+	results := make([]redis.Reply, 0, len(tx.cmdLines))
+	undoLogs := make([][]CmdLine, 0, len(tx.cmdLines))
+	var errReply redis.Reply
+	for _, cmdLine := range tx.cmdLines {
+		undo := tx.cluster.db.GetUndoLogs(tx.dbIndex, cmdLine)
+		// persist undo logs before executing, so that commands executed before crash can be undone
+		record := utils.ToCmdLine(journalUndo, tx.id)
+		for _, line := range undo {
+			record = append(record, protocol.MakeMultiBulkReply(line).ToBytes())
+		}
+		tx.cluster.journal.append(record)
+		result := tx.cluster.db.ExecWithLock(c, cmdLine)
+		if protocol.IsErrorReply(result) {
+			// don't rollback failed commands
+			errReply = result
+			break
+		}
+		undoLogs = append(undoLogs, undo)
+		results = append(results, result)
+	}
+	// undo the latter commands first
+	tx.undoLog = nil
+	for i := len(undoLogs) - 1; i >= 0; i-- {
+		tx.undoLog = append(tx.undoLog, undoLogs[i]...)
+	}
+	if errReply != nil {
+		return errReply
+	}
+	return encodeMultiRawReply(protocol.MakeMultiRawReply(results))
+}
+
+func makePrepareRecord(tx *Transaction) CmdLine {
+	record := utils.ToCmdLine(journalPrepare, tx.id, strconv.Itoa(tx.dbIndex))
+	record = append(record, protocol.MakeMultiBulkReply(tx.cmdLine).ToBytes())
+	for _, undo := range tx.undoLog {
+		record = append(record, protocol.MakeMultiBulkReply(undo).ToBytes())
+	}
+	return record
+}
+
 func (tx *Transaction) rollback() error {
 	curStatus := tx.status
 	tx.mu.Lock()
@@ -111,16 +252,33 @@ func (tx *Transaction) rollback() error {
 	if tx.status != curStatus { // ensure status not changed by other goroutine
 		return fmt.Errorf("tx %s status changed", tx.id)
 	}
+	tx.rollbackWithLock()
+	return nil
+}
+
+// rollbackWithLock undoes executed command and releases keys, invoker should hold tx.mu
+func (tx *Transaction) rollbackWithLock() {
 	if tx.status == rolledBackStatus { // no need to rollback a rolled-back transaction
-		return nil
+		return
 	}
 	tx.lockKeys()
-	for _, cmdLine := range tx.undoLog {
-		tx.cluster.db.ExecWithLock(tx.conn, cmdLine)
+	if tx.executed {
+		// connection of coordinator may have selected another db
+		conn := makeMigrationConn(tx.dbIndex)
+		for _, cmdLine := range tx.undoLog {
+			tx.cluster.db.ExecWithLock(conn, cmdLine)
+		}
 	}
 	tx.unLockKeys()
 	tx.status = rolledBackStatus
-	return nil
+	tx.cluster.journal.append(utils.ToCmdLine(journalRollback, tx.id))
+}
+
+// cleanTransactionLater removes finished transaction, do not clean immediately in case of rollback
+func (cluster *Cluster) cleanTransactionLater(tx *Transaction) {
+	timewheel.Delay(waitBeforeCleanTx, "", func() {
+		cluster.transactions.Remove(tx.id)
+	})
 }
 
 // cmdLine: Prepare id cmdName args...
@@ -130,7 +288,18 @@ func execPrepare(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Re
 	}
 	txID := string(cmdLine[1])
 	cmdName := strings.ToLower(string(cmdLine[2]))
+	if errReply := cluster.ensureMigrated(c, cmdLine[2:]); errReply != nil {
+		return errReply
+	}
 	tx := NewTransaction(cluster, c, txID, cmdLine[2:])
+	if err := tx.parseMulti(); err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	for _, line := range tx.cmdLines {
+		if errReply := cluster.ensureMigrated(c, line); errReply != nil {
+			return errReply
+		}
+	}
 	cluster.transactions.Put(txID, tx)
 	err := tx.prepare()
 	if err != nil {
@@ -159,9 +328,7 @@ func execRollback(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.R
 		return protocol.MakeErrReply(err.Error())
 	}
 	// clean transaction
-	timewheel.Delay(waitBeforeCleanTx, "", func() {
-		cluster.transactions.Remove(tx.id)
-	})
+	cluster.cleanTransactionLater(tx)
 	return protocol.MakeIntReply(1)
 }
 
@@ -173,67 +340,419 @@ func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Rep
 	txID := string(cmdLine[1])
 	raw, ok := cluster.transactions.Get(txID)
 	if !ok {
-		return protocol.MakeIntReply(0)
+		// transaction may be lost by restart, coordinator should roll back
+		return protocol.MakeErrReply("ERR transaction " + txID + " not found")
 	}
 	tx, _ := raw.(*Transaction)
 
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	result := cluster.db.ExecWithLock(c, tx.cmdLine)
+	if tx.status == committedStatus && tx.result != nil {
+		return tx.result
+	}
+	if tx.status != preparedStatus {
+		// rolled back for timeout
+		return protocol.MakeErrReply("ERR transaction " + txID + " is not prepared")
+	}
+	tx.executed = true
+	var result redis.Reply
+	if tx.isMulti() {
+		result = tx.commitMulti(c)
+	} else {
+		result = cluster.db.ExecWithLock(c, tx.cmdLine)
+	}
 
 	if protocol.IsErrorReply(result) {
 		// failed
-		err2 := tx.rollback()
-		return protocol.MakeErrReply(fmt.Sprintf("err occurs when rollback: %v, origin err: %s", err2, result))
+		tx.rollbackWithLock()
+		cluster.cleanTransactionLater(tx)
+		return protocol.MakeErrReply(fmt.Sprintf("err occurs when commit, rolled back: %s", result.ToBytes()))
 	}
 	// after committed
 	tx.unLockKeys()
 	tx.status = committedStatus
-	// clean finished transaction
-	// do not clean immediately, in case rollback
+	tx.result = result
+	tx.cluster.journal.append(utils.ToCmdLine(journalCommit, tx.id))
+	// coordinator may still roll back, confirm the result before cleaning
 	timewheel.Delay(waitBeforeCleanTx, "", func() {
-		cluster.transactions.Remove(tx.id)
+		cluster.resolveTransaction(tx)
 	})
 	return result
 }
 
+// resolveTransaction asks coordinator for the result of a committed transaction, and rolls it back if coordinator
+// did not commit it. The transaction is removed once resolved.
+func (cluster *Cluster) resolveTransaction(tx *Transaction) {
+	tx.mu.Lock()
+	status := tx.status
+	tx.mu.Unlock()
+	if status != committedStatus {
+		cluster.cleanTransactionLater(tx)
+		return
+	}
+	result := cluster.queryTransaction(tx.id)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != committedStatus {
+		// rolled back by coordinator during query
+		cluster.cleanTransactionLater(tx)
+		return
+	}
+	switch result {
+	case txCommitted:
+		cluster.journal.append(utils.ToCmdLine(journalDone, tx.id))
+		cluster.transactions.Remove(tx.id)
+		go cluster.ackTransaction(tx.id)
+	case txRolledBack:
+		logger.Info("roll back transaction not committed by coordinator: " + tx.id)
+		tx.rollbackWithLock()
+		cluster.transactions.Remove(tx.id)
+		go cluster.ackTransaction(tx.id)
+	case txUnknown:
+		// coordinator lost the decision, e.g. its journal was removed. Undoing may overwrite later writes,
+		// so the committed result is kept
+		logger.Warn("result of transaction " + tx.id + " is unknown to coordinator, keep it committed")
+		cluster.journal.append(utils.ToCmdLine(journalDone, tx.id))
+		cluster.transactions.Remove(tx.id)
+	default:
+		// coordinator is unreachable or still committing
+		timewheel.Delay(waitBeforeCleanTx, "", func() {
+			cluster.resolveTransaction(tx)
+		})
+	}
+}
+
+// queryTransaction returns result of transaction from its coordinator, returns empty string if failed
+func (cluster *Cluster) queryTransaction(txID string) string {
+	coordinator := getCoordinator(txID)
+	if coordinator == "" {
+		return txUnknown
+	}
+	if coordinator == cluster.self {
+		return cluster.getTransactionResult(txID)
+	}
+	reply := cluster.relay(coordinator, makeMigrationConn(0), utils.ToCmdLine(relayTxStatus, txID))
+	if status, ok := reply.(*protocol.StatusReply); ok {
+		return status.Status
+	}
+	return ""
+}
+
+// ackTransaction tells coordinator that current node has applied result of the transaction
+func (cluster *Cluster) ackTransaction(txID string) {
+	coordinator := getCoordinator(txID)
+	if coordinator == cluster.self {
+		cluster.onTransactionAck(txID, cluster.self)
+		return
+	}
+	// coordinator asks again if the ack is lost
+	cluster.relay(coordinator, makeMigrationConn(0), utils.ToCmdLine(relayTxAck, txID, cluster.self))
+}
+
+// beginTransaction starts a distributed transaction coordinated by current node, returns id of transaction
+func (cluster *Cluster) beginTransaction(groupMap map[string][]string) string {
+	txID := strconv.FormatInt(cluster.idGenerator.NextID(), 10) + "@" + cluster.self
+	nodes := make([]string, 0, len(groupMap))
+	for node := range groupMap {
+		nodes = append(nodes, node)
+	}
+	cluster.txMu.Lock()
+	cluster.coordinating[txID] = nodes
+	cluster.txMu.Unlock()
+	cluster.journal.append(utils.ToCmdLine(journalBegin, txID, joinNodes(nodes)))
+	return txID
+}
+
+// decideTransaction persists result of transaction coordinated by current node,
+// the result is kept until all participants acknowledged it
+func (cluster *Cluster) decideTransaction(txID string, commit bool) {
+	cluster.txMu.Lock()
+	nodes, ok := cluster.coordinating[txID]
+	delete(cluster.coordinating, txID)
+	if ok {
+		cluster.decisions[txID] = makeTxDecision(commit, nodes)
+	}
+	cluster.txMu.Unlock()
+	if !ok {
+		// already decided
+		return
+	}
+	decision := decisionRollback
+	if commit {
+		decision = decisionCommit
+	}
+	cluster.journal.append(utils.ToCmdLine(journalDecide, txID, decision,
+		strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)))
+}
+
+func makeTxDecision(commit bool, nodes []string) *txDecision {
+	decision := &txDecision{
+		commit:  commit,
+		pending: make(map[string]struct{}, len(nodes)),
+	}
+	for _, node := range nodes {
+		decision.pending[node] = struct{}{}
+	}
+	return decision
+}
+
+// onTransactionAck records that node has applied result of the transaction,
+// the result is forgotten once all participants acknowledged it
+func (cluster *Cluster) onTransactionAck(txID string, node string) {
+	cluster.txMu.Lock()
+	decision, ok := cluster.decisions[txID]
+	if ok {
+		if _, ok = decision.pending[node]; ok {
+			delete(decision.pending, node)
+		}
+	}
+	finished := ok && len(decision.pending) == 0
+	if finished {
+		delete(cluster.decisions, txID)
+	}
+	cluster.txMu.Unlock()
+	if !ok {
+		return
+	}
+	if finished {
+		cluster.journal.append(utils.ToCmdLine(journalForget, txID))
+	} else {
+		cluster.journal.append(utils.ToCmdLine(journalAck, txID, node))
+	}
+}
+
+// getPendingRollback returns participants not acknowledged the rolled back transaction yet
+func (cluster *Cluster) getPendingRollback(txID string) []string {
+	cluster.txMu.Lock()
+	defer cluster.txMu.Unlock()
+	decision, ok := cluster.decisions[txID]
+	if !ok || decision.commit {
+		return nil
+	}
+	nodes := make([]string, 0, len(decision.pending))
+	for node := range decision.pending {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// notifyRollback sends rollback to participants until all of them acknowledged.
+// Rollback is harmless to participants not prepared or rolled back already
+func (cluster *Cluster) notifyRollback(c redis.Connection, txID string) {
+	for _, node := range cluster.getPendingRollback(txID) {
+		var reply redis.Reply
+		if node == cluster.self {
+			reply = execRollback(cluster, c, makeArgs("rollback", txID))
+		} else {
+			reply = cluster.relay(node, c, makeArgs("rollback", txID))
+		}
+		if !protocol.IsErrorReply(reply) {
+			cluster.onTransactionAck(txID, node)
+		}
+	}
+	if len(cluster.getPendingRollback(txID)) > 0 {
+		timewheel.Delay(waitBeforeCleanTx, "", func() {
+			cluster.notifyRollback(makeMigrationConn(0), txID)
+		})
+	}
+}
+
+// getTransactionResult returns result of transaction coordinated by current node
+func (cluster *Cluster) getTransactionResult(txID string) string {
+	cluster.txMu.Lock()
+	defer cluster.txMu.Unlock()
+	if _, ok := cluster.coordinating[txID]; ok {
+		return txPending
+	}
+	if decision, ok := cluster.decisions[txID]; ok {
+		if decision.commit {
+			return txCommitted
+		}
+		return txRolledBack
+	}
+	return txUnknown
+}
+
+// execTxStatus returns result of transaction coordinated by current node
+// cmdLine: _txstatus tx-id
+func execTxStatus(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 2 {
+		return protocol.MakeArgNumErrReply(relayTxStatus)
+	}
+	return protocol.MakeStatusReply(cluster.getTransactionResult(string(cmdLine[1])))
+}
+
+// execTxAck records acknowledgement of participant
+// cmdLine: _txack tx-id node
+func execTxAck(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 3 {
+		return protocol.MakeArgNumErrReply(relayTxAck)
+	}
+	cluster.onTransactionAck(string(cmdLine[1]), string(cmdLine[2]))
+	return protocol.MakeOkReply()
+}
+
+// recoverTransactions resolves transactions interrupted by crash
+func (cluster *Cluster) recoverTransactions() {
+	for _, records := range cluster.journal.getLiveRecords() {
+		record := records[0]
+		txID := string(record[1])
+		switch strings.ToLower(string(record[0])) {
+		case journalBegin:
+			if len(record) < 3 {
+				continue
+			}
+			cluster.recoverDecision(txID, splitNodes(record[2]), records[1:])
+		case journalPrepare:
+			tx, err := cluster.loadTransaction(record)
+			if err != nil {
+				logger.Warn("load transaction " + txID + " failed: " + err.Error())
+				continue
+			}
+			committed := false
+			var undoLogs [][]CmdLine
+			for _, r := range records[1:] {
+				switch strings.ToLower(string(r[0])) {
+				case journalCommit:
+					committed = true
+				case journalUndo:
+					undo, err := parseCmdLines(r[2:])
+					if err != nil {
+						logger.Warn("load undo logs of transaction " + txID + " failed: " + err.Error())
+						continue
+					}
+					undoLogs = append(undoLogs, undo)
+				}
+			}
+			if tx.isMulti() {
+				// undo the latter commands first
+				tx.undoLog = nil
+				for i := len(undoLogs) - 1; i >= 0; i-- {
+					tx.undoLog = append(tx.undoLog, undoLogs[i]...)
+				}
+			}
+			tx.executed = true
+			if !committed {
+				// coordinator never got the reply of commit without commit record, so it did not commit.
+				// the command may be executed before crash, undo logs restores the keys
+				logger.Info("roll back transaction interrupted by restart: " + txID)
+				tx.rollbackWithLock()
+				continue
+			}
+			tx.status = committedStatus
+			cluster.transactions.Put(txID, tx)
+			go cluster.resolveTransaction(tx)
+		}
+	}
+}
+
+// recoverDecision restores transaction coordinated by current node from its begin record and following records
+func (cluster *Cluster) recoverDecision(txID string, nodes []string, records []CmdLine) {
+	if len(records) == 0 {
+		// crashed before decided, roll back it, participants will query the result
+		cluster.txMu.Lock()
+		cluster.coordinating[txID] = nodes
+		cluster.txMu.Unlock()
+		logger.Info("roll back transaction interrupted by restart: " + txID)
+		cluster.decideTransaction(txID, false)
+		go cluster.notifyRollback(makeMigrationConn(0), txID)
+		return
+	}
+	decide := records[0]
+	if len(decide) < 3 {
+		return
+	}
+	decision := makeTxDecision(string(decide[2]) == decisionCommit, nodes)
+	for _, record := range records[1:] {
+		if strings.ToLower(string(record[0])) == journalAck && len(record) > 2 {
+			delete(decision.pending, string(record[2]))
+		}
+	}
+	if len(decision.pending) == 0 {
+		cluster.journal.append(utils.ToCmdLine(journalForget, txID))
+		return
+	}
+	cluster.txMu.Lock()
+	cluster.decisions[txID] = decision
+	cluster.txMu.Unlock()
+	if !decision.commit {
+		go cluster.notifyRollback(makeMigrationConn(0), txID)
+	}
+}
+
+// loadTransaction restores transaction from prepare record of journal
+func (cluster *Cluster) loadTransaction(record CmdLine) (*Transaction, error) {
+	if len(record) < 4 {
+		return nil, errors.New("illegal prepare record")
+	}
+	dbIndex, err := strconv.Atoi(string(record[2]))
+	if err != nil {
+		return nil, err
+	}
+	lines, err := parseCmdLines(record[3:])
+	if err != nil {
+		return nil, err
+	}
+	tx := NewTransaction(cluster, makeMigrationConn(dbIndex), string(record[1]), lines[0])
+	if err := tx.parseMulti(); err != nil {
+		return nil, err
+	}
+	tx.writeKeys, tx.readKeys = tx.getRelatedKeys()
+	tx.undoLog = lines[1:]
+	tx.status = preparedStatus
+	return tx, nil
+}
+
+// parseCmdLines decodes command lines encoded in RESP
+func parseCmdLines(args [][]byte) ([]CmdLine, error) {
+	lines := make([]CmdLine, 0, len(args))
+	for _, arg := range args {
+		raw, err := parser.ParseOne(arg)
+		if err != nil {
+			return nil, err
+		}
+		line, ok := raw.(*protocol.MultiBulkReply)
+		if !ok {
+			return nil, errors.New("illegal command in journal record")
+		}
+		lines = append(lines, line.Args)
+	}
+	return lines, nil
+}
+
 // requestCommit commands all node to commit transaction as coordinator
-func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) ([]redis.Reply, protocol.ErrorReply) {
+// returns node -> reply of commit
+func requestCommit(cluster *Cluster, c redis.Connection, txID string, groupMap map[string][]string) (map[string]redis.Reply, protocol.ErrorReply) {
 	var errReply protocol.ErrorReply
-	txIDStr := strconv.FormatInt(txID, 10)
-	respList := make([]redis.Reply, 0, len(groupMap))
+	respMap := make(map[string]redis.Reply, len(groupMap))
 	for node := range groupMap {
 		var resp redis.Reply
 		if node == cluster.self {
-			resp = execCommit(cluster, c, makeArgs("commit", txIDStr))
+			resp = execCommit(cluster, c, makeArgs("commit", txID))
 		} else {
-			resp = cluster.relay(node, c, makeArgs("commit", txIDStr))
+			resp = cluster.relayIdempotent(node, c, makeArgs("commit", txID))
 		}
 		if protocol.IsErrorReply(resp) {
 			errReply = resp.(protocol.ErrorReply)
 			break
 		}
-		respList = append(respList, resp)
+		respMap[node] = resp
 	}
 	if errReply != nil {
 		requestRollback(cluster, c, txID, groupMap)
 		return nil, errReply
 	}
-	return respList, nil
+	cluster.decideTransaction(txID, true)
+	return respMap, nil
 }
 
 // requestRollback requests all node rollback transaction as coordinator
 // groupMap: node -> keys
-func requestRollback(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) {
-	txIDStr := strconv.FormatInt(txID, 10)
-	for node := range groupMap {
-		if node == cluster.self {
-			execRollback(cluster, c, makeArgs("rollback", txIDStr))
-		} else {
-			cluster.relay(node, c, makeArgs("rollback", txIDStr))
-		}
-	}
+func requestRollback(cluster *Cluster, c redis.Connection, txID string, groupMap map[string][]string) {
+	// decide before notifying, participants querying the result will roll back as well
+	cluster.decideTransaction(txID, false)
+	cluster.notifyRollback(c, txID)
 }
 
 func (cluster *Cluster) relayPrepare(node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
@@ -0,0 +1,198 @@
+package cluster
+
+import (
+	"godis/lib/logger"
+	"godis/redis/parser"
+	"godis/redis/protocol"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+ * tccJournal persists states of distributed transactions, so that a restarted node can resolve transactions
+ * interrupted by crash. Records are saved in RESP like aof:
+ * - begin tx-id nodes: coordinator started a transaction
+ * - decide tx-id commit|rollback unix-ms: coordinator decided the result of transaction
+ * - ack tx-id node: participant applied the result
+ * - forget tx-id: all participants applied the result, coordinator no longer keeps it
+ * - prepare tx-id db-index cmd undo-logs...: participant locked keys, cmd and undo logs are encoded in RESP
+ * - undo tx-id undo-logs...: participant is going to execute a command of MULTI, whose undo logs are built just
+ *   before executing it
+ * - commit tx-id: participant executed the command
+ * - rollback tx-id: participant released keys and undid changes
+ * - done tx-id: participant confirmed the transaction was committed by coordinator
+ * The journal keeps records of unfinished transactions in memory, and rewrites the file with them once
+ * the file has too many finished records.
+ */
+
+const (
+	journalBegin    = "begin"
+	journalDecide   = "decide"
+	journalPrepare  = "prepare"
+	journalUndo     = "undo"
+	journalCommit   = "commit"
+	journalRollback = "rollback"
+	journalDone     = "done"
+	journalAck      = "ack"
+	journalForget   = "forget"
+
+	decisionCommit   = "commit"
+	decisionRollback = "rollback"
+
+	// journal file is rewritten once it has journalRewriteThreshold records more than live records
+	journalRewriteThreshold = 1 << 12
+)
+
+type tccJournal struct {
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+	// live records of unfinished transactions, key is role and transaction id, e.g. "c:id" for coordinator
+	live map[string][]CmdLine
+	// records in file
+	written int
+}
+
+// openTccJournal loads records in file and compacts it
+func openTccJournal(filename string) (*tccJournal, error) {
+	journal := &tccJournal{
+		filename: filename,
+		live:     make(map[string][]CmdLine),
+	}
+	file, err := os.Open(filename)
+	if err == nil {
+		journal.load(file)
+		_ = file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := journal.rewrite(); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (journal *tccJournal) load(reader io.Reader) {
+	for payload := range parser.ParseStream(reader) {
+		if payload.Err != nil {
+			if payload.Err == io.EOF {
+				break
+			}
+			// the last record may be broken by crash
+			logger.Warn("parse tcc journal error: " + payload.Err.Error())
+			continue
+		}
+		record, ok := payload.Data.(*protocol.MultiBulkReply)
+		if !ok || len(record.Args) < 2 {
+			logger.Warn("illegal tcc journal record")
+			continue
+		}
+		journal.apply(record.Args)
+	}
+}
+
+func getJournalKey(record CmdLine) string {
+	switch strings.ToLower(string(record[0])) {
+	case journalBegin, journalDecide, journalAck, journalForget:
+		return "c:" + string(record[1])
+	}
+	return "p:" + string(record[1])
+}
+
+// apply updates live records, invoker should hold journal.mu
+func (journal *tccJournal) apply(record CmdLine) {
+	key := getJournalKey(record)
+	switch strings.ToLower(string(record[0])) {
+	case journalBegin, journalPrepare:
+		journal.live[key] = []CmdLine{record}
+	case journalDecide, journalAck, journalUndo, journalCommit:
+		if records, ok := journal.live[key]; ok {
+			journal.live[key] = append(records, record)
+		}
+	case journalRollback, journalDone, journalForget:
+		delete(journal.live, key)
+	}
+}
+
+// rewrite writes live records into a new file and replaces the old one, invoker should hold journal.mu
+func (journal *tccJournal) rewrite() error {
+	tmpFilename := journal.filename + ".tmp"
+	tmpFile, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	written := 0
+	for _, records := range journal.live {
+		for _, record := range records {
+			if _, err := tmpFile.Write(protocol.MakeMultiBulkReply(record).ToBytes()); err != nil {
+				_ = tmpFile.Close()
+				return err
+			}
+			written++
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	_ = tmpFile.Close()
+	if journal.file != nil {
+		_ = journal.file.Close()
+		journal.file = nil
+	}
+	if err := os.Rename(tmpFilename, journal.filename); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(journal.filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	journal.file = file
+	journal.written = written
+	return nil
+}
+
+// append persists record before returning
+func (journal *tccJournal) append(record CmdLine) {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	journal.apply(record)
+	if journal.file == nil {
+		return
+	}
+	if _, err := journal.file.Write(protocol.MakeMultiBulkReply(record).ToBytes()); err != nil {
+		logger.Warn("write tcc journal error: " + err.Error())
+		return
+	}
+	if err := journal.file.Sync(); err != nil {
+		logger.Warn("sync tcc journal error: " + err.Error())
+	}
+	journal.written++
+	if journal.written > len(journal.live)+journalRewriteThreshold {
+		if err := journal.rewrite(); err != nil {
+			logger.Warn("rewrite tcc journal error: " + err.Error())
+		}
+	}
+}
+
+// getLiveRecords returns a copy of live records
+func (journal *tccJournal) getLiveRecords() [][]CmdLine {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	result := make([][]CmdLine, 0, len(journal.live))
+	for _, records := range journal.live {
+		result = append(result, append([]CmdLine(nil), records...))
+	}
+	return result
+}
+
+func (journal *tccJournal) close() {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if journal.file != nil {
+		_ = journal.file.Close()
+		journal.file = nil
+	}
+}
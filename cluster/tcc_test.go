@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	database2 "godis/database"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverInterruptedMulti(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tcc.journal")
+	cluster := makeTestCluster("a:6399", []string{"a:6399"}, "", 1)
+	cluster.db = database2.NewStandaloneServer()
+	journal, err := openTccJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.journal = journal
+	conn := &connection.FakeConn{}
+	cluster.db.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+
+	cmdLines := []CmdLine{
+		utils.ToCmdLine("set", "a", "2"),
+		utils.ToCmdLine("set", "b", "2"),
+	}
+	tx := NewTransaction(cluster, conn, "1@b:6399", makeRelayedMulti(nil, cmdLines))
+	if err := tx.parseMulti(); err != nil {
+		t.Fatal(err)
+	}
+	journal.append(makePrepareRecord(tx))
+	// crash after the first command executed
+	tx.cmdLines = cmdLines[:1]
+	tx.commitMulti(conn)
+	journal.close()
+	if reply := cluster.db.Exec(conn, utils.ToCmdLine("get", "a")); string(reply.ToBytes()) != "$1\r\n2\r\n" {
+		t.Fatalf("expect executed, actual %q", reply.ToBytes())
+	}
+
+	journal, err = openTccJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.close()
+	cluster.journal = journal
+	cluster.recoverTransactions()
+	if reply := cluster.db.Exec(conn, utils.ToCmdLine("get", "a")); string(reply.ToBytes()) != "$1\r\n1\r\n" {
+		t.Errorf("expect rolled back, actual %q", reply.ToBytes())
+	}
+	if reply := cluster.db.Exec(conn, utils.ToCmdLine("exists", "b")); string(reply.ToBytes()) != ":0\r\n" {
+		t.Errorf("expect b not exists, actual %q", reply.ToBytes())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"godis/config"
+	"godis/lib/logger"
+	"godis/lib/utils"
+	RedisServer "godis/redis/server"
+	"godis/tcp"
+	"os"
+	"time"
+)
+
+// godis-proxy speaks RESP to clients and relays commands to standalone godis servers set by `proxy-backends`
+
+func main() {
+	logger.Setup(&logger.Settings{
+		Path:       "logs",
+		Name:       "godis-proxy",
+		Ext:        "log",
+		TimeFormat: "2001-01-01",
+	})
+	configName := os.Getenv("CONFIG")
+	if configName == "" {
+		configName = "proxy.conf"
+	}
+	if !utils.FileExists(configName) {
+		logger.Fatal("config file " + configName + " not found")
+	}
+	config.SetupConfig(configName)
+	if len(config.Properties.ProxyBackends) == 0 {
+		logger.Fatal("proxy-backends is required")
+	}
+
+	keepAlive := time.Duration(config.Properties.TcpKeepalive) * time.Second
+	if keepAlive == 0 {
+		keepAlive = -1 // disabled
+	}
+	err := tcp.ListenAndServeWithSignal(&tcp.Config{
+		Address:    fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
+		MaxConnect: uint32(config.Properties.MaxClients),
+		Timeout:    time.Duration(config.Properties.Timeout) * time.Second,
+		KeepAlive:  keepAlive,
+	}, RedisServer.MakeHandler())
+	if err != nil {
+		logger.Error(err)
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"errors"
+	"godis/lib/logger"
+	"strconv"
+	"strings"
+)
+
+// client classes of client-output-buffer-limit
+const (
+	ClientClassNormal  = "normal"
+	ClientClassPubSub  = "pubsub"
+	ClientClassReplica = "replica"
+)
+
+// OutputBufferLimit limits size of data waiting to be sent to a client.
+// Client will be disconnected once its output buffer reaches HardLimit,
+// or exceeds SoftLimit continuously for SoftSeconds. 0 means no limit.
+type OutputBufferLimit struct {
+	HardLimit   int64
+	SoftLimit   int64
+	SoftSeconds int64
+}
+
+// default limits, same as redis
+var defaultOutputBufferLimits = map[string]*OutputBufferLimit{
+	ClientClassNormal:  {},
+	ClientClassPubSub:  {HardLimit: 32 << 20, SoftLimit: 8 << 20, SoftSeconds: 60},
+	ClientClassReplica: {HardLimit: 256 << 20, SoftLimit: 64 << 20, SoftSeconds: 60},
+}
+
+// GetOutputBufferLimit returns limit of the given client class
+func (p *ServerProperties) GetOutputBufferLimit(class string) *OutputBufferLimit {
+	if limit, ok := p.outputBufferLimits[class]; ok {
+		return limit
+	}
+	return defaultOutputBufferLimits[class]
+}
+
+// parseOutputBufferLimits parses lines like `pubsub 32mb 8mb 60`, invalid lines are ignored
+func parseOutputBufferLimits(lines []string) map[string]*OutputBufferLimit {
+	limits := make(map[string]*OutputBufferLimit)
+	for _, line := range lines {
+		class, limit, err := parseOutputBufferLimit(line)
+		if err != nil {
+			logger.Warn("invalid client-output-buffer-limit '" + line + "': " + err.Error())
+			continue
+		}
+		limits[class] = limit
+	}
+	return limits
+}
+
+func parseOutputBufferLimit(line string) (string, *OutputBufferLimit, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return "", nil, errors.New("wrong number of arguments")
+	}
+	class := strings.ToLower(fields[0])
+	if class == "slave" {
+		class = ClientClassReplica
+	}
+	if _, ok := defaultOutputBufferLimits[class]; !ok {
+		return "", nil, errors.New("invalid client class")
+	}
+	hard, err := ParseMemory(fields[1])
+	if err != nil {
+		return "", nil, err
+	}
+	soft, err := ParseMemory(fields[2])
+	if err != nil {
+		return "", nil, err
+	}
+	seconds, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || seconds < 0 {
+		return "", nil, errors.New("invalid soft seconds")
+	}
+	return class, &OutputBufferLimit{
+		HardLimit:   hard,
+		SoftLimit:   soft,
+		SoftSeconds: seconds,
+	}, nil
+}
+
+// ParseMemory parses memory size like redis.conf, e.g. 1k => 1000 bytes, 1kb => 1024 bytes
+func ParseMemory(value string) (int64, error) {
+	value = strings.ToLower(value)
+	units := []struct {
+		suffix string
+		unit   int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSuffix(value, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid memory size")
+	}
+	return n * unit, nil
+}
@@ -20,26 +20,92 @@ type ServerProperties struct {
 	RequirePass    string `cfg:"requirepass"`
 	Databases      int    `cfg:"databases"`
 
+	// Timeout closes connections idle for more than the given seconds, 0 means never
+	Timeout int `cfg:"timeout"`
+	// TcpKeepalive is the period of TCP keepalive probes in seconds, 0 means disabled
+	TcpKeepalive int `cfg:"tcp-keepalive"`
+
+	// ClientOutputBufferLimit stores lines like: normal 0 0 0, see OutputBufferLimit
+	ClientOutputBufferLimit []string `cfg:"client-output-buffer-limit"`
+
 	Peers []string `cfg:"peers"`
 	Self  string   `cfg:"self"`
+	// ClusterSharding is the way to distribute keys among nodes, slots or consistent-hash (default)
+	ClusterSharding string `cfg:"cluster-sharding"`
+	// ClusterRedirect replies -MOVED/-ASK instead of relaying commands to owner node, only available in slots mode
+	ClusterRedirect bool `cfg:"cluster-redirect"`
+	// ClusterNodeTimeout is the milliseconds a node must be unreachable for it to be considered in failure state
+	ClusterNodeTimeout int `cfg:"cluster-node-timeout"`
+	// ClusterPeerTimeout is the milliseconds to wait for reply of a request relayed to peer
+	ClusterPeerTimeout int `cfg:"cluster-peer-timeout"`
+	// ClusterReplicaOf is the address of master node, current node joins the cluster as its replica
+	ClusterReplicaOf string `cfg:"cluster-replica-of"`
+	// ClusterTccJournal is the file persisting states of distributed transactions
+	ClusterTccJournal string `cfg:"cluster-tcc-journal"`
+
+	// ListCompressDepth is the number of segments at each end of list never compressed, 0 means no compression
+	ListCompressDepth int `cfg:"list-compress-depth"`
+
+	// thresholds of compact encodings: small hashes and sorted sets are packed in listpack, small integer sets in intset
+	HashMaxListpackEntries int `cfg:"hash-max-listpack-entries"`
+	HashMaxListpackValue   int `cfg:"hash-max-listpack-value"`
+	SetMaxIntsetEntries    int `cfg:"set-max-intset-entries"`
+	ZSetMaxListpackEntries int `cfg:"zset-max-listpack-entries"`
+	ZSetMaxListpackValue   int `cfg:"zset-max-listpack-value"`
+
+	// LfuLogFactor controls how fast the access counter of keys saturates, see OBJECT FREQ
+	LfuLogFactor int `cfg:"lfu-log-factor"`
+	// LfuDecayTime is the minutes for the access counter to decrease by one, 0 means never decay
+	LfuDecayTime int `cfg:"lfu-decay-time"`
+
+	// ProtoMaxBulkLen is the max length of bulk strings and arrays in requests, longer ones are protocol errors
+	ProtoMaxBulkLen int `cfg:"proto-max-bulk-len"`
+
+	// ProxyBackends are addresses of standalone servers behind proxy, server runs as a proxy holding no data if set
+	ProxyBackends []string `cfg:"proxy-backends"`
+
+	// parsed ClientOutputBufferLimit, class -> limit
+	outputBufferLimits map[string]*OutputBufferLimit
 }
 
 var Properties *ServerProperties
 
 func init() {
 	// default config
-	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
+	Properties = defaultProperties()
+	Properties.Bind = "127.0.0.1"
+	Properties.Port = 6379
+}
+
+// defaultProperties returns properties with default values of options omitted in config file
+func defaultProperties() *ServerProperties {
+	return &ServerProperties{
+		MaxClients:         10000,
+		TcpKeepalive:       300,
+		ClusterNodeTimeout: 15000,
+		ClusterPeerTimeout: 3000,
+		ClusterTccJournal:  "tcc.journal",
+
+		HashMaxListpackEntries: 128,
+		HashMaxListpackValue:   64,
+		SetMaxIntsetEntries:    512,
+		ZSetMaxListpackEntries: 128,
+		ZSetMaxListpackValue:   64,
+
+		LfuLogFactor: 10,
+		LfuDecayTime: 1,
+
+		ProtoMaxBulkLen: 512 * 1024 * 1024,
 	}
 }
 
 func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+	config := defaultProperties()
 
 	// read config file
 	rawMap := make(map[string]string)
+	// directives may appear more than once, e.g. client-output-buffer-limit
+	multiMap := make(map[string][]string)
 	// 逐行读取
 	scanner := bufio.NewScanner(src)
 	for scanner.Scan() {
@@ -52,6 +118,7 @@ func parse(src io.Reader) *ServerProperties {
 			key := line[0:pivot]
 			value := strings.Trim(line[pivot+1:], " ")
 			rawMap[strings.ToLower(key)] = value
+			multiMap[strings.ToLower(key)] = append(multiMap[strings.ToLower(key)], value)
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -85,12 +152,16 @@ func parse(src io.Reader) *ServerProperties {
 				fieldVal.SetBool(boolValue)
 			case reflect.Slice:
 				if field.Type.Elem().Kind() == reflect.String {
-					slice := strings.Split(value, ",")
+					var slice []string
+					for _, line := range multiMap[strings.ToLower(key)] {
+						slice = append(slice, strings.Split(line, ",")...)
+					}
 					fieldVal.Set(reflect.ValueOf(slice))
 				}
 			}
 		}
 	}
+	config.outputBufferLimits = parseOutputBufferLimits(config.ClientOutputBufferLimit)
 	return config
 }
 
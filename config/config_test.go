@@ -28,3 +28,42 @@ func TestParse(t *testing.T) {
 		t.Error("list parse failed")
 	}
 }
+
+func TestParseOutputBufferLimit(t *testing.T) {
+	src := "client-output-buffer-limit normal 0 0 0\n" +
+		"client-output-buffer-limit pubsub 1mb 1k 60\n" +
+		"client-output-buffer-limit slave 2gb 0 0\n"
+	p := parse(strings.NewReader(src))
+	if len(p.ClientOutputBufferLimit) != 3 {
+		t.Errorf("repeated directive parse failed: %v", p.ClientOutputBufferLimit)
+		return
+	}
+	limit := p.GetOutputBufferLimit(ClientClassPubSub)
+	if limit.HardLimit != 1<<20 || limit.SoftLimit != 1000 || limit.SoftSeconds != 60 {
+		t.Errorf("wrong pubsub limit: %+v", limit)
+	}
+	limit = p.GetOutputBufferLimit(ClientClassReplica)
+	if limit.HardLimit != 2<<30 || limit.SoftLimit != 0 {
+		t.Errorf("wrong replica limit: %+v", limit)
+	}
+	limit = p.GetOutputBufferLimit(ClientClassNormal)
+	if limit.HardLimit != 0 {
+		t.Errorf("wrong normal limit: %+v", limit)
+	}
+	// default limit
+	limit = parse(strings.NewReader("")).GetOutputBufferLimit(ClientClassPubSub)
+	if limit.HardLimit != 32<<20 {
+		t.Errorf("wrong default limit: %+v", limit)
+	}
+}
+
+func TestParseEncodingThresholds(t *testing.T) {
+	p := parse(strings.NewReader("hash-max-listpack-entries 0\nzset-max-listpack-value 32\n"))
+	if p.HashMaxListpackEntries != 0 || p.ZSetMaxListpackValue != 32 {
+		t.Errorf("threshold parse failed: %+v", p)
+	}
+	// defaults
+	if p.HashMaxListpackValue != 64 || p.SetMaxIntsetEntries != 512 || p.ZSetMaxListpackEntries != 128 {
+		t.Errorf("wrong default thresholds: %+v", p)
+	}
+}
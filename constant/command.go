@@ -20,6 +20,13 @@ const (
 	Type      = "type"
 	Rename    = "rename"
 	RenameNx  = "renamenx"
+	Object    = "object"
+	Copy      = "copy"
+	Move      = "move"
+	Dump      = "dump"
+	Restore   = "restore"
+	Touch     = "touch"
+	Unlink    = "unlink"
 )
 
 // command related server
@@ -27,9 +34,14 @@ const (
 	FlushDb      = "flushdb"
 	FlushAll     = "flushall"
 	Keys         = "keys"
+	Scan         = "scan"
+	DBSize       = "dbsize"
+	RandomKey    = "randomkey"
 	BgRewriteAof = "bgrewriteaof"
 	RewriteAof   = "rewriteaof"
 	Select       = "select"
+	SwapDB       = "swapdb"
+	Memory       = "memory"
 )
 
 // command related String
@@ -51,6 +63,10 @@ const (
 	Append      = "append"
 	SetRange    = "setrange"
 	GetRange    = "getrange"
+	SubStr      = "substr"
+	GetEx       = "getex"
+	GetDel      = "getdel"
+	Lcs         = "lcs"
 	StrLen      = "strlen"
 )
 
@@ -68,6 +84,12 @@ const (
 	LIndex    = "lindex"
 	LSet      = "lset"
 	LRange    = "lrange"
+	LPos      = "lpos"
+	LInsert   = "linsert"
+	LTrim     = "ltrim"
+	LMove     = "lmove"
+	LMPop     = "lmpop"
+	BLMPop    = "blmpop"
 )
 
 // command related Hash
@@ -85,6 +107,19 @@ const (
 	HGetAll      = "hgetall"
 	HIncrBy      = "hincrby"
 	HIncrByFloat = "hincrbyfloat"
+	HStrLen      = "hstrlen"
+	HRandField   = "hrandfield"
+	HScan        = "hscan"
+	HExpire      = "hexpire"
+	HPExpire     = "hpexpire"
+	HExpireAt    = "hexpireat"
+	HPExpireAt   = "hpexpireat"
+	HTTL         = "httl"
+	HPTTL        = "hpttl"
+	HExpireTime  = "hexpiretime"
+	HPExpireTime = "hpexpiretime"
+	HPersist     = "hpersist"
+	HGetDel      = "hgetdel"
 )
 
 // command related Set
@@ -101,6 +136,10 @@ const (
 	SDiff       = "sdiff"
 	SDiffStore  = "sdiffstore"
 	SRandMember = "srandmember"
+	SPop        = "spop"
+	SMIsMember  = "smismember"
+	SMove       = "smove"
+	SInterCard  = "sintercard"
 )
 
 // command related SortedSet
@@ -119,6 +158,24 @@ const (
 	ZRem             = "zrem"
 	ZRemRangeByScore = "zremrangebyscore"
 	ZRemRangeByRank  = "zremrangebyrank"
+	ZRangeByLex      = "zrangebylex"
+	ZRevRangeByLex   = "zrevrangebylex"
+	ZLexCount        = "zlexcount"
+	ZRemRangeByLex   = "zremrangebylex"
+	ZPopMin          = "zpopmin"
+	ZPopMax          = "zpopmax"
+	BZPopMin         = "bzpopmin"
+	BZPopMax         = "bzpopmax"
+	ZRandMember      = "zrandmember"
+	ZMScore          = "zmscore"
+	ZUnion           = "zunion"
+	ZUnionStore      = "zunionstore"
+	ZInter           = "zinter"
+	ZInterStore      = "zinterstore"
+	ZDiff            = "zdiff"
+	ZDiffStore       = "zdiffstore"
+	ZInterCard       = "zintercard"
+	ZRangeStore      = "zrangestore"
 )
 
 // command related Pub/Sub
@@ -0,0 +1,358 @@
+package dict
+
+import (
+	"godis/dataStruct/listpack"
+	"math/rand"
+	"time"
+)
+
+// CompactDict packs small dict into a listpack as: key value key value ...
+// It converts to SimpleDict once it has more than maxEntries entries, a key or value longer than maxValueBytes,
+// or a value which is not []byte. CompactDict is not thread-safe
+//
+// Keys may have expiration time, which is used by per-field ttl of hash. Expired keys are invisible to all methods
+// except Len, and they stay in dict until RemoveExpired is called
+type CompactDict struct {
+	data  []byte
+	count int
+	// m is not nil after converted to hash table
+	m *SimpleDict
+	// expires maps key to its expiration time, it is nil if no key has ttl
+	expires map[string]time.Time
+
+	maxEntries    int
+	maxValueBytes int
+}
+
+// MakeCompact makes a new CompactDict with the given thresholds of listpack encoding
+func MakeCompact(maxEntries int, maxValueBytes int) *CompactDict {
+	return &CompactDict{
+		maxEntries:    maxEntries,
+		maxValueBytes: maxValueBytes,
+	}
+}
+
+// Encoding returns "listpack" or "hashtable"
+func (dict *CompactDict) Encoding() string {
+	if dict.m != nil {
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+// find returns offset of the entry and offset of the next entry, offset is -1 if key not found
+func (dict *CompactDict) find(key string) (offset int, value []byte, next int) {
+	for offset = 0; offset < len(dict.data); {
+		var k []byte
+		k, next = listpack.Read(dict.data, offset)
+		value, next = listpack.Read(dict.data, next)
+		if string(k) == key {
+			return offset, value, next
+		}
+		offset = next
+	}
+	return -1, nil, 0
+}
+
+func (dict *CompactDict) fits(key string, val interface{}) bool {
+	bytes, ok := val.([]byte)
+	return ok && len(key) <= dict.maxValueBytes && len(bytes) <= dict.maxValueBytes
+}
+
+// convert moves all entries into a SimpleDict
+func (dict *CompactDict) convert() {
+	m := MakeSimple()
+	dict.ForEach(func(key string, val interface{}) bool {
+		m.Put(key, val)
+		return true
+	})
+	dict.m = m
+	dict.data = nil
+	dict.count = 0
+}
+
+// replace writes new value of the entry at offset into a new listpack, so values returned before stay unchanged
+func (dict *CompactDict) replace(offset int, next int, key string, val []byte) {
+	data := make([]byte, 0, len(dict.data)+len(key)+len(val)+2*listpack.MaxHeaderLen)
+	data = append(data, dict.data[:offset]...)
+	data = listpack.Append(data, []byte(key), val)
+	dict.data = append(data, dict.data[next:]...)
+}
+
+func (dict *CompactDict) insert(key string, val []byte) {
+	dict.data = listpack.Append(dict.data, []byte(key), val)
+	dict.count++
+}
+
+// Get returns the value mapped to the key and whether the key exists
+func (dict *CompactDict) Get(key string) (val interface{}, exists bool) {
+	if dict.isExpired(key) {
+		return nil, false
+	}
+	if dict.m != nil {
+		return dict.m.Get(key)
+	}
+	offset, value, _ := dict.find(key)
+	if offset < 0 {
+		return nil, false
+	}
+	return value, true
+}
+
+// Len returns the number of dict, including expired keys which have not been removed
+func (dict *CompactDict) Len() int {
+	if dict.m != nil {
+		return dict.m.Len()
+	}
+	return dict.count
+}
+
+// Put puts key value into dict and returns the number of new inserted key-value.
+// The ttl of an existing key is kept, and an expired key is replaced as a new one
+func (dict *CompactDict) Put(key string, val interface{}) (result int) {
+	if dict.isExpired(key) {
+		dict.Remove(key)
+	}
+	if dict.m == nil && !dict.fits(key, val) {
+		dict.convert()
+	}
+	if dict.m != nil {
+		return dict.m.Put(key, val)
+	}
+	offset, _, next := dict.find(key)
+	if offset >= 0 {
+		dict.replace(offset, next, key, val.([]byte))
+		return 0
+	}
+	if dict.count >= dict.maxEntries {
+		dict.convert()
+		return dict.m.Put(key, val)
+	}
+	dict.insert(key, val.([]byte))
+	return 1
+}
+
+// PutIfAbsent puts value if the key is not exists and returns the number of updated key-value
+func (dict *CompactDict) PutIfAbsent(key string, val interface{}) (result int) {
+	if _, exists := dict.Get(key); exists {
+		return 0
+	}
+	return dict.Put(key, val)
+}
+
+// PutIfExists puts value if the key exists and returns the number of inserted key-value
+func (dict *CompactDict) PutIfExists(key string, val interface{}) (result int) {
+	if _, exists := dict.Get(key); !exists {
+		return 0
+	}
+	dict.Put(key, val)
+	return 1
+}
+
+// Remove removes the key and return the number of deleted key-value, an expired key is not counted
+func (dict *CompactDict) Remove(key string) (result int) {
+	expired := dict.isExpired(key)
+	delete(dict.expires, key)
+	result = dict.remove(key)
+	if expired {
+		return 0
+	}
+	return result
+}
+
+func (dict *CompactDict) remove(key string) int {
+	if dict.m != nil {
+		return dict.m.Remove(key)
+	}
+	offset, _, next := dict.find(key)
+	if offset < 0 {
+		return 0
+	}
+	if next == len(dict.data) {
+		// limit capacity so that appending won't overwrite the removed entry
+		dict.data = dict.data[:offset:offset]
+	} else {
+		data := make([]byte, 0, len(dict.data)-(next-offset))
+		data = append(data, dict.data[:offset]...)
+		dict.data = append(data, dict.data[next:]...)
+	}
+	dict.count--
+	return 1
+}
+
+// ForEach traversal the dict
+func (dict *CompactDict) ForEach(consumer Consumer) {
+	if len(dict.expires) > 0 {
+		now := time.Now()
+		inner := consumer
+		consumer = func(key string, val interface{}) bool {
+			if expireTime, ok := dict.expires[key]; ok && now.After(expireTime) {
+				return true
+			}
+			return inner(key, val)
+		}
+	}
+	if dict.m != nil {
+		dict.m.ForEach(consumer)
+		return
+	}
+	data := dict.data
+	for offset := 0; offset < len(data); {
+		var key, value []byte
+		key, offset = listpack.Read(data, offset)
+		value, offset = listpack.Read(data, offset)
+		if !consumer(string(key), value) {
+			break
+		}
+	}
+}
+
+// Keys returns all keys in dict
+func (dict *CompactDict) Keys() []string {
+	if dict.m != nil && len(dict.expires) == 0 {
+		return dict.m.Keys()
+	}
+	keys := make([]string, 0, dict.count)
+	dict.ForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// RandomKeys randomly returns keys of the given number, may contain duplicated key
+func (dict *CompactDict) RandomKeys(limit int) []string {
+	if dict.m != nil && len(dict.expires) == 0 {
+		return dict.m.RandomKeys(limit)
+	}
+	keys := dict.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	result := make([]string, limit)
+	for i := range result {
+		result[i] = keys[rand.Intn(len(keys))]
+	}
+	return result
+}
+
+// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key
+func (dict *CompactDict) RandomDistinctKeys(limit int) []string {
+	if dict.m != nil && len(dict.expires) == 0 {
+		return dict.m.RandomDistinctKeys(limit)
+	}
+	keys := dict.Keys()
+	rand.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	if limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Scan returns all keys in dict at once
+func (dict *CompactDict) Scan(cursor int, count int) ([]string, int) {
+	if dict.m == nil {
+		return dict.Keys(), 0
+	}
+	keys, nextCursor := dict.m.Scan(cursor, count)
+	if len(dict.expires) > 0 {
+		live := keys[:0]
+		for _, key := range keys {
+			if !dict.isExpired(key) {
+				live = append(live, key)
+			}
+		}
+		keys = live
+	}
+	return keys, nextCursor
+}
+
+// Clear removes all keys in dict
+func (dict *CompactDict) Clear() {
+	*dict = *MakeCompact(dict.maxEntries, dict.maxValueBytes)
+}
+
+/* ---- expiration of keys ---- */
+
+func (dict *CompactDict) isExpired(key string) bool {
+	expireTime, ok := dict.expires[key]
+	return ok && time.Now().After(expireTime)
+}
+
+// Expire sets expiration time of an existing key, returns false if the key not exists
+func (dict *CompactDict) Expire(key string, expireTime time.Time) bool {
+	if _, exists := dict.Get(key); !exists {
+		return false
+	}
+	if dict.expires == nil {
+		dict.expires = make(map[string]time.Time)
+	}
+	dict.expires[key] = expireTime
+	return true
+}
+
+// Persist removes expiration time of the key, returns false if the key has no ttl
+func (dict *CompactDict) Persist(key string) bool {
+	if _, exists := dict.Get(key); !exists {
+		return false
+	}
+	if _, ok := dict.expires[key]; !ok {
+		return false
+	}
+	delete(dict.expires, key)
+	if len(dict.expires) == 0 {
+		dict.expires = nil
+	}
+	return true
+}
+
+// ExpireTime returns expiration time of the key, ok is false if the key not exists or has no ttl
+func (dict *CompactDict) ExpireTime(key string) (expireTime time.Time, ok bool) {
+	if dict.isExpired(key) {
+		return time.Time{}, false
+	}
+	expireTime, ok = dict.expires[key]
+	return expireTime, ok
+}
+
+// ForEachExpire visits keys having ttl and not expired yet
+func (dict *CompactDict) ForEachExpire(consumer func(key string, expireTime time.Time) bool) {
+	now := time.Now()
+	for key, expireTime := range dict.expires {
+		if now.After(expireTime) {
+			continue
+		}
+		if !consumer(key, expireTime) {
+			break
+		}
+	}
+}
+
+// NextExpireTime returns the earliest expiration time of keys, ok is false if no key has ttl
+func (dict *CompactDict) NextExpireTime() (next time.Time, ok bool) {
+	for _, expireTime := range dict.expires {
+		if !ok || expireTime.Before(next) {
+			next = expireTime
+			ok = true
+		}
+	}
+	return next, ok
+}
+
+// RemoveExpired removes all expired keys and returns the number of removed keys
+func (dict *CompactDict) RemoveExpired() int {
+	removed := 0
+	now := time.Now()
+	for key, expireTime := range dict.expires {
+		if now.After(expireTime) {
+			delete(dict.expires, key)
+			removed += dict.remove(key)
+		}
+	}
+	if len(dict.expires) == 0 {
+		dict.expires = nil
+	}
+	return removed
+}
@@ -0,0 +1,173 @@
+package dict
+
+import (
+	"bytes"
+	"godis/lib/utils"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactDict(t *testing.T) {
+	d := MakeCompact(128, 64)
+	expected := make(map[string][]byte)
+	var returned, returnedCopy [][]byte
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i % 100)
+		val := []byte(utils.RandString(5))
+		switch i % 3 {
+		case 0, 1:
+			_, existed := expected[key]
+			result := d.Put(key, val)
+			if existed && result != 0 || !existed && result != 1 {
+				t.Fatalf("wrong result of put %s", key)
+			}
+			expected[key] = val
+		default:
+			if v, ok := d.Get(key); ok {
+				returned = append(returned, v.([]byte))
+				returnedCopy = append(returnedCopy, append([]byte(nil), v.([]byte)...))
+			}
+			_, existed := expected[key]
+			result := d.Remove(key)
+			if existed && result != 1 || !existed && result != 0 {
+				t.Fatalf("wrong result of remove %s", key)
+			}
+			delete(expected, key)
+		}
+	}
+	if d.Encoding() != "listpack" {
+		t.Fatal("expected listpack encoding")
+	}
+	if d.Len() != len(expected) {
+		t.Fatalf("expected len %d, actual %d", len(expected), d.Len())
+	}
+	d.ForEach(func(key string, val interface{}) bool {
+		if !bytes.Equal(val.([]byte), expected[key]) {
+			t.Fatalf("wrong value of %s", key)
+		}
+		return true
+	})
+	for i := range returned {
+		if !bytes.Equal(returned[i], returnedCopy[i]) {
+			t.Fatal("returned value was modified")
+		}
+	}
+}
+
+func TestCompactDict_Convert(t *testing.T) {
+	d := MakeCompact(10, 64)
+	for i := 0; i < 10; i++ {
+		d.Put(strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	if d.Encoding() != "listpack" {
+		t.Fatal("expected listpack encoding")
+	}
+	d.Put("10", []byte("10"))
+	if d.Encoding() != "hashtable" || d.Len() != 11 {
+		t.Fatal("expected hashtable encoding after too many entries")
+	}
+	for i := 0; i <= 10; i++ {
+		if val, _ := d.Get(strconv.Itoa(i)); string(val.([]byte)) != strconv.Itoa(i) {
+			t.Fatalf("wrong value of %d", i)
+		}
+	}
+
+	d = MakeCompact(10, 64)
+	d.Put("a", []byte("a"))
+	d.Put("b", []byte(strings.Repeat("b", 65)))
+	if d.Encoding() != "hashtable" || d.Len() != 2 {
+		t.Fatal("expected hashtable encoding after too long value")
+	}
+}
+
+func TestCompactDict_Random(t *testing.T) {
+	d := MakeCompact(128, 64)
+	if len(d.RandomKeys(3)) != 0 {
+		t.Error("expected no keys")
+	}
+	for i := 0; i < 10; i++ {
+		d.Put(strconv.Itoa(i), []byte("v"))
+	}
+	if len(d.RandomKeys(20)) != 20 {
+		t.Error("expected 20 keys")
+	}
+	keys := d.RandomDistinctKeys(20)
+	if len(keys) != 10 {
+		t.Errorf("expected 10 keys, actual %d", len(keys))
+	}
+	seen := make(map[string]bool)
+	for _, key := range d.RandomDistinctKeys(5) {
+		if seen[key] {
+			t.Error("duplicated key")
+		}
+		seen[key] = true
+	}
+}
+
+func TestCompactDict_Expire(t *testing.T) {
+	for _, maxEntries := range []int{128, 2} {
+		d := MakeCompact(maxEntries, 64)
+		d.Put("a", []byte("a"))
+		d.Put("b", []byte("b"))
+		d.Put("c", []byte("c"))
+		if d.Expire("x", time.Now().Add(time.Hour)) {
+			t.Error("expected failure of expiring missing key")
+		}
+		future := time.Now().Add(time.Hour)
+		if !d.Expire("a", future) || !d.Expire("b", time.Now().Add(-time.Second)) {
+			t.Fatal("expected success of expiring existing key")
+		}
+		if _, exists := d.Get("b"); exists {
+			t.Error("expected expired key invisible")
+		}
+		if expireTime, ok := d.ExpireTime("a"); !ok || !expireTime.Equal(future) {
+			t.Error("wrong expire time")
+		}
+		if len(d.Keys()) != 2 || len(d.RandomDistinctKeys(3)) != 2 {
+			t.Error("expected 2 keys")
+		}
+		if keys, _ := d.Scan(0, 10); len(keys) != 2 {
+			t.Error("expected 2 keys")
+		}
+		for _, key := range d.RandomKeys(10) {
+			if key == "b" {
+				t.Error("expected expired key invisible")
+			}
+		}
+		next, ok := d.NextExpireTime()
+		if !ok || !next.Before(time.Now()) {
+			t.Error("wrong next expire time")
+		}
+		if d.Remove("b") != 0 {
+			t.Error("expected removing expired key returns 0")
+		}
+
+		d.Expire("c", time.Now().Add(-time.Second))
+		if d.Put("c", []byte("c2")) != 1 {
+			t.Error("expected expired key replaced as a new one")
+		}
+		if _, ok := d.ExpireTime("c"); ok {
+			t.Error("expected no ttl of replaced key")
+		}
+		d.Put("a", []byte("a2"))
+		if _, ok := d.ExpireTime("a"); !ok {
+			t.Error("expected ttl kept after put")
+		}
+		if !d.Persist("a") || d.Persist("a") || d.Persist("x") {
+			t.Error("wrong result of persist")
+		}
+
+		d.Expire("a", time.Now().Add(-time.Second))
+		if d.Len() != 2 {
+			t.Errorf("expected len 2, actual %d", d.Len())
+		}
+		if removed := d.RemoveExpired(); removed != 1 || d.Len() != 1 {
+			t.Errorf("expected 1 expired key removed, actual %d", removed)
+		}
+		if _, ok := d.NextExpireTime(); ok {
+			t.Error("expected no ttl")
+		}
+	}
+}
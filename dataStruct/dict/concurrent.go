@@ -289,6 +289,26 @@ func (dict *ConcurrentDict) RandomDistinctKeys(limit int) []string {
 	return arr
 }
 
+// Scan returns keys of shards starting from cursor, it stops after at least count keys were collected.
+// nextCursor is 0 once all shards were scanned.
+// Keys existing during the whole iteration are returned at least once since a shard is scanned as a whole.
+func (dict *ConcurrentDict) Scan(cursor int, count int) ([]string, int) {
+	keys := make([]string, 0, count)
+	for cursor >= 0 && cursor < len(dict.table) && len(keys) < count {
+		shard := dict.table[cursor]
+		shard.mutex.RLock()
+		for key := range shard.m {
+			keys = append(keys, key)
+		}
+		shard.mutex.RUnlock()
+		cursor++
+	}
+	if cursor < 0 || cursor >= len(dict.table) {
+		return keys, 0
+	}
+	return keys, cursor
+}
+
 // Clear removes all keys in dict
 func (dict *ConcurrentDict) Clear() {
 	*dict = *MakeConcurrent(dict.shardCount)
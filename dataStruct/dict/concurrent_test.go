@@ -288,3 +288,26 @@ func TestConcurrentDict_Keys(t *testing.T) {
 		t.Errorf("expect %d keys, actual: %d", size, len(d.Keys()))
 	}
 }
+
+func TestConcurrentDict_Scan(t *testing.T) {
+	d := MakeConcurrent(16)
+	size := 100
+	for i := 0; i < size; i++ {
+		d.Put("k"+strconv.Itoa(i), i)
+	}
+	scanned := make(map[string]struct{})
+	cursor := 0
+	for {
+		var keys []string
+		keys, cursor = d.Scan(cursor, 10)
+		for _, key := range keys {
+			scanned[key] = struct{}{}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(scanned) != size {
+		t.Errorf("expect %d keys, actual: %d", size, len(scanned))
+	}
+}
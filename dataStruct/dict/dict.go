@@ -15,5 +15,6 @@ type Dict interface {
 	Keys() []string
 	RandomKeys(limit int) []string
 	RandomDistinctKeys(limit int) []string
+	Scan(cursor int, count int) (keys []string, nextCursor int)
 	Clear()
 }
@@ -115,6 +115,15 @@ func (dict *SimpleDict) RandomDistinctKeys(limit int) []string {
 	return result
 }
 
+// Scan returns all keys in dict at once
+func (dict *SimpleDict) Scan(cursor int, count int) ([]string, int) {
+	keys := make([]string, 0, len(dict.m))
+	for k := range dict.m {
+		keys = append(keys, k)
+	}
+	return keys, 0
+}
+
 // Clear removes all keys in dict
 func (dict *SimpleDict) Clear() {
 	*dict = *MakeSimple()
@@ -0,0 +1,593 @@
+package list
+
+import (
+	"bytes"
+	"compress/flate"
+	"godis/dataStruct/listpack"
+	"io/ioutil"
+	"unsafe"
+)
+
+const (
+	// segmentMaxBytes limits packed size of a segment, an element larger than it takes a segment alone
+	segmentMaxBytes = 8 * 1024
+	// segments smaller than minCompressBytes are never compressed
+	minCompressBytes = 48
+)
+
+// QuickList is a doubly linked list of segments, each segment packs adjacent elements into one byte slice.
+// Segments far from both ends may be compressed, since lists are mostly accessed at ends.
+// Elements returned by QuickList share memory with it and must not be modified,
+// the list never modifies packed bytes in place, so returned elements stay valid after the list changed.
+type QuickList struct {
+	first *segment
+	last  *segment
+	size  int
+	// compressDepth is the number of segments at each end never compressed, 0 means no compression
+	compressDepth int
+}
+
+// segment packs elements in listpack
+type segment struct {
+	prev  *segment
+	next  *segment
+	count int
+	data  []byte
+	// data is compressed by deflate if compressed is true
+	compressed bool
+}
+
+// MakeQuickList creates a QuickList, compressDepth is the number of segments at each end never compressed,
+// 0 means no compression
+func MakeQuickList(compressDepth int, vals ...[]byte) *QuickList {
+	list := &QuickList{
+		compressDepth: compressDepth,
+	}
+	for _, val := range vals {
+		list.Add(val)
+	}
+	return list
+}
+
+/* ---- segment ---- */
+
+// raw returns uncompressed packed bytes of segment without changing it
+func (seg *segment) raw() []byte {
+	if !seg.compressed {
+		return seg.data
+	}
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(seg.data)))
+	if err != nil {
+		// compressed by ourselves, never happens
+		panic(err)
+	}
+	return data
+}
+
+func (seg *segment) decompress() {
+	if seg.compressed {
+		seg.data = seg.raw()
+		seg.compressed = false
+	}
+}
+
+func (seg *segment) compress() {
+	if seg.compressed || len(seg.data) < minCompressBytes {
+		return
+	}
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	_, _ = writer.Write(seg.data)
+	_ = writer.Close()
+	if buf.Len() >= len(seg.data) {
+		// not compressible
+		return
+	}
+	seg.data = buf.Bytes()
+	seg.compressed = true
+}
+
+// elements returns all elements in segment
+func (seg *segment) elements() [][]byte {
+	return listpack.Unpack(seg.raw(), seg.count)
+}
+
+// setElements replaces elements of segment
+func (seg *segment) setElements(vals [][]byte) {
+	seg.data = listpack.Pack(vals)
+	seg.count = len(vals)
+	seg.compressed = false
+}
+
+func (seg *segment) canAdd(val []byte) bool {
+	return seg.count == 0 || len(seg.data)+len(val)+listpack.MaxHeaderLen <= segmentMaxBytes
+}
+
+/* ---- list structure ---- */
+
+// insertSegment links seg after prev, seg becomes the first segment if prev is nil
+func (list *QuickList) insertSegment(prev *segment, seg *segment) {
+	seg.prev = prev
+	if prev == nil {
+		seg.next = list.first
+		list.first = seg
+	} else {
+		seg.next = prev.next
+		prev.next = seg
+	}
+	if seg.next == nil {
+		list.last = seg
+	} else {
+		seg.next.prev = seg
+	}
+}
+
+func (list *QuickList) removeSegment(seg *segment) {
+	if seg.prev == nil {
+		list.first = seg.next
+	} else {
+		seg.prev.next = seg.next
+	}
+	if seg.next == nil {
+		list.last = seg.prev
+	} else {
+		seg.next.prev = seg.prev
+	}
+	// for gc
+	seg.prev = nil
+	seg.next = nil
+}
+
+// find returns the segment containing the element at index, and index of the element in segment
+func (list *QuickList) find(index int) (*segment, int) {
+	if index < list.size/2 {
+		seg := list.first
+		for index >= seg.count {
+			index -= seg.count
+			seg = seg.next
+		}
+		return seg, index
+	}
+	seg := list.last
+	index = list.size - 1 - index
+	for index >= seg.count {
+		index -= seg.count
+		seg = seg.prev
+	}
+	return seg, seg.count - 1 - index
+}
+
+// isNearEnd returns whether segment is within compressDepth from either end
+func (list *QuickList) isNearEnd(seg *segment) bool {
+	head, tail := list.first, list.last
+	for i := 0; i < list.compressDepth && head != nil; i++ {
+		if head == seg || tail == seg {
+			return true
+		}
+		head, tail = head.next, tail.prev
+	}
+	return false
+}
+
+// update stores elements into segment, it splits segment if too large, and removes segment if empty
+func (list *QuickList) update(seg *segment, vals [][]byte) {
+	if len(vals) == 0 {
+		list.removeSegment(seg)
+		list.updateCompression()
+		return
+	}
+	seg.setElements(vals)
+	if len(seg.data) > segmentMaxBytes && len(vals) > 1 {
+		half := len(vals) / 2
+		seg.setElements(vals[:half])
+		next := &segment{}
+		next.setElements(vals[half:])
+		list.insertSegment(seg, next)
+		list.compressInterior(next)
+	}
+	list.afterUpdate(seg)
+}
+
+// afterUpdate merges small segments and compresses seg if necessary
+func (list *QuickList) afterUpdate(seg *segment) {
+	list.mergeNext(seg)
+	if prev := seg.prev; prev != nil && list.mergeNext(prev) {
+		seg = prev
+	}
+	list.compressInterior(seg)
+	list.updateCompression()
+}
+
+// mergeNext merges the next segment into seg if both of them are small
+func (list *QuickList) mergeNext(seg *segment) bool {
+	next := seg.next
+	if next == nil || seg.compressed || next.compressed || len(seg.data)+len(next.data) > segmentMaxBytes/2 {
+		return false
+	}
+	seg.setElements(append(seg.elements(), next.elements()...))
+	list.removeSegment(next)
+	return true
+}
+
+func (list *QuickList) compressInterior(seg *segment) {
+	if list.compressDepth > 0 && seg.prev != nil && seg.next != nil && !list.isNearEnd(seg) {
+		seg.compress()
+	}
+}
+
+// updateCompression keeps segments near ends uncompressed, and compresses segments just leaving ends
+func (list *QuickList) updateCompression() {
+	if list.compressDepth <= 0 {
+		return
+	}
+	head, tail := list.first, list.last
+	for i := 0; i < list.compressDepth && head != nil; i++ {
+		head.decompress()
+		tail.decompress()
+		head, tail = head.next, tail.prev
+	}
+	if head != nil {
+		list.compressInterior(head)
+		list.compressInterior(tail)
+	}
+}
+
+/* ---- api ---- */
+
+// Add adds value to the tail
+func (list *QuickList) Add(val []byte) {
+	if list == nil {
+		panic("list is nil")
+	}
+	seg := list.last
+	if seg == nil || !seg.canAdd(val) {
+		seg = &segment{}
+		list.insertSegment(list.last, seg)
+		list.updateCompression()
+	}
+	seg.decompress()
+	// appending never modifies packed bytes shared with returned elements
+	seg.data = listpack.Append(seg.data, val)
+	seg.count++
+	list.size++
+}
+
+// Get returns value at the given index
+func (list *QuickList) Get(index int) []byte {
+	if list == nil {
+		panic("list is nil")
+	}
+	if index < 0 || index >= list.size {
+		panic("index out of bound")
+	}
+	seg, i := list.find(index)
+	data := seg.raw()
+	offset := 0
+	var val []byte
+	for j := 0; j <= i; j++ {
+		val, offset = listpack.Read(data, offset)
+	}
+	return val
+}
+
+// Set updates value at the given index
+func (list *QuickList) Set(index int, val []byte) {
+	if list == nil {
+		panic("list is nil")
+	}
+	if index < 0 || index >= list.size {
+		panic("index out of bound")
+	}
+	seg, i := list.find(index)
+	vals := seg.elements()
+	vals[i] = val
+	list.update(seg, vals)
+}
+
+// Insert inserts value at the given index
+func (list *QuickList) Insert(index int, val []byte) {
+	if list == nil {
+		panic("list is nil")
+	}
+	if index < 0 || index > list.size {
+		panic("index out of bound")
+	}
+	if index == list.size {
+		list.Add(val)
+		return
+	}
+	seg, i := list.find(index)
+	if i == 0 && seg.prev != nil && seg.prev.canAdd(val) {
+		// append to the previous segment rather than shifting elements of seg
+		seg = seg.prev
+		seg.decompress()
+		seg.data = listpack.Append(seg.data, val)
+		seg.count++
+		list.size++
+		list.afterUpdate(seg)
+		return
+	}
+	if i == 0 && seg.canAdd(val) {
+		seg.decompress()
+		data := make([]byte, 0, len(seg.data)+len(val)+listpack.MaxHeaderLen)
+		seg.data = append(listpack.Append(data, val), seg.data...)
+		seg.count++
+		list.size++
+		list.afterUpdate(seg)
+		return
+	}
+	if i == 0 {
+		// pushing to head of a full segment, create a new segment rather than splitting it
+		newSeg := &segment{}
+		newSeg.setElements([][]byte{val})
+		list.insertSegment(seg.prev, newSeg)
+		list.size++
+		list.afterUpdate(newSeg)
+		return
+	}
+	vals := seg.elements()
+	vals = append(vals, nil)
+	copy(vals[i+1:], vals[i:])
+	vals[i] = val
+	list.size++
+	list.update(seg, vals)
+}
+
+// Remove removes the element at the given index
+func (list *QuickList) Remove(index int) []byte {
+	if list == nil {
+		panic("list is nil")
+	}
+	if index < 0 || index >= list.size {
+		panic("index out of bound")
+	}
+	seg, i := list.find(index)
+	list.size--
+	if seg.count == 1 {
+		val, _ := listpack.Read(seg.raw(), 0)
+		list.update(seg, nil)
+		return val
+	}
+	if i == 0 {
+		// popping from head needs no copy
+		seg.decompress()
+		val, next := listpack.Read(seg.data, 0)
+		seg.data = seg.data[next:]
+		seg.count--
+		list.afterUpdate(seg)
+		return val
+	}
+	if i == seg.count-1 {
+		seg.decompress()
+		offset := 0
+		for j := 0; j < i; j++ {
+			_, offset = listpack.Read(seg.data, offset)
+		}
+		val, _ := listpack.Read(seg.data, offset)
+		// limit capacity so that appending never overwrites the removed element returned
+		seg.data = seg.data[:offset:offset]
+		seg.count--
+		list.afterUpdate(seg)
+		return val
+	}
+	vals := seg.elements()
+	val := vals[i]
+	vals = append(vals[:i], vals[i+1:]...)
+	list.update(seg, vals)
+	return val
+}
+
+// RemoveLast removes the last element and returns it
+func (list *QuickList) RemoveLast() []byte {
+	if list == nil {
+		panic("list is nil")
+	}
+	if list.size == 0 {
+		return nil
+	}
+	return list.Remove(list.size - 1)
+}
+
+// RemoveAllByVal removes all elements equal to val
+func (list *QuickList) RemoveAllByVal(val []byte) int {
+	return list.removeByVal(val, 0, false)
+}
+
+// RemoveByVal removes at most `count` elements equal to val, scanning from left to right
+func (list *QuickList) RemoveByVal(val []byte, count int) int {
+	return list.removeByVal(val, count, false)
+}
+
+// ReverseRemoveByVal removes at most `count` elements equal to val, scanning from right to left
+func (list *QuickList) ReverseRemoveByVal(val []byte, count int) int {
+	return list.removeByVal(val, count, true)
+}
+
+// removeByVal removes at most `count` elements equal to val, count <= 0 means all
+func (list *QuickList) removeByVal(val []byte, count int, reverse bool) int {
+	if list == nil {
+		panic("list is nil")
+	}
+	removed := 0
+	seg := list.first
+	if reverse {
+		seg = list.last
+	}
+	for seg != nil && (count <= 0 || removed < count) {
+		next := seg.next
+		if reverse {
+			next = seg.prev
+		}
+		vals := seg.elements()
+		keep := make([]bool, len(vals))
+		segRemoved := 0
+		for j := range vals {
+			i := j
+			if reverse {
+				i = len(vals) - 1 - j
+			}
+			if (count <= 0 || removed < count) && bytes.Equal(vals[i], val) {
+				removed++
+				segRemoved++
+				continue
+			}
+			keep[i] = true
+		}
+		if segRemoved > 0 {
+			kept := vals[:0]
+			for i, v := range vals {
+				if keep[i] {
+					kept = append(kept, v)
+				}
+			}
+			list.size -= segRemoved
+			list.update(seg, kept)
+		}
+		seg = next
+	}
+	return removed
+}
+
+// Len returns the number of elements in list
+func (list *QuickList) Len() int {
+	if list == nil {
+		panic("list is nil")
+	}
+	return list.size
+}
+
+// MemoryUsage returns bytes allocated by list, including headers of segments and packed bytes after compression
+func (list *QuickList) MemoryUsage() int64 {
+	size := int64(unsafe.Sizeof(*list))
+	for seg := list.first; seg != nil; seg = seg.next {
+		size += int64(unsafe.Sizeof(*seg)) + int64(cap(seg.data))
+	}
+	return size
+}
+
+// ForEach visits each element in the list
+// if the consumer return false, stop
+func (list *QuickList) ForEach(consumer func(int, []byte) bool) {
+	if list == nil {
+		panic("list is nil")
+	}
+	i := 0
+	for seg := list.first; seg != nil; seg = seg.next {
+		data := seg.raw()
+		for offset := 0; offset < len(data); {
+			var val []byte
+			val, offset = listpack.Read(data, offset)
+			if !consumer(i, val) {
+				return
+			}
+			i++
+		}
+	}
+}
+
+// ReverseForEach visits each element from tail to head, index passed to consumer is still counted from head
+// if the consumer return false, stop
+func (list *QuickList) ReverseForEach(consumer func(int, []byte) bool) {
+	if list == nil {
+		panic("list is nil")
+	}
+	i := list.size - 1
+	for seg := list.last; seg != nil; seg = seg.prev {
+		vals := seg.elements()
+		for j := len(vals) - 1; j >= 0; j-- {
+			if !consumer(i, vals[j]) {
+				return
+			}
+			i--
+		}
+	}
+}
+
+// Contains returns whether the given value exists in the list
+func (list *QuickList) Contains(val []byte) bool {
+	contains := false
+	list.ForEach(func(i int, actual []byte) bool {
+		if bytes.Equal(actual, val) {
+			contains = true
+			return false
+		}
+		return true
+	})
+	return contains
+}
+
+// Range returns elements in [start, end)
+func (list *QuickList) Range(start, end int) [][]byte {
+	if list == nil {
+		panic("list is nil")
+	}
+	if start < 0 || start >= list.size {
+		panic("`start` out of range")
+	}
+	if end < start || end > list.size {
+		panic("`stop` out of range")
+	}
+	result := make([][]byte, 0, end-start)
+	if start == end {
+		return result
+	}
+	seg, i := list.find(start)
+	for ; seg != nil && len(result) < end-start; seg = seg.next {
+		data := seg.raw()
+		offset := 0
+		for j := 0; offset < len(data) && len(result) < end-start; j++ {
+			var val []byte
+			val, offset = listpack.Read(data, offset)
+			if j >= i {
+				result = append(result, val)
+			}
+		}
+		i = 0
+	}
+	return result
+}
+
+// Trim keeps elements in [start, end) and removes the others, whole segments out of range are dropped without unpacking
+func (list *QuickList) Trim(start, end int) {
+	if list == nil {
+		panic("list is nil")
+	}
+	if start < 0 || start > list.size {
+		panic("`start` out of range")
+	}
+	if end < start || end > list.size {
+		panic("`end` out of range")
+	}
+	if start == end {
+		*list = QuickList{compressDepth: list.compressDepth}
+		return
+	}
+	tail := list.size - end
+	for start >= list.first.count {
+		start -= list.first.count
+		list.size -= list.first.count
+		list.removeSegment(list.first)
+	}
+	for tail >= list.last.count {
+		tail -= list.last.count
+		list.size -= list.last.count
+		list.removeSegment(list.last)
+	}
+	list.updateCompression()
+	if start > 0 || (tail > 0 && list.first == list.last) {
+		seg := list.first
+		vals := seg.elements()
+		if seg == list.last {
+			vals = vals[:len(vals)-tail]
+			tail = 0
+		}
+		list.size -= seg.count - len(vals[start:])
+		list.update(seg, vals[start:])
+	}
+	if tail > 0 {
+		seg := list.last
+		vals := seg.elements()
+		list.size -= tail
+		list.update(seg, vals[:len(vals)-tail])
+	}
+}
@@ -0,0 +1,245 @@
+package list
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func randomElement() []byte {
+	if rand.Intn(20) == 0 {
+		// larger than a segment
+		return []byte(strings.Repeat("x", segmentMaxBytes+rand.Intn(100)))
+	}
+	return []byte(strconv.Itoa(rand.Intn(100)) + strings.Repeat("a", rand.Intn(200)))
+}
+
+func assertQuickList(t *testing.T, list *QuickList, expected [][]byte) {
+	if list.Len() != len(expected) {
+		t.Fatalf("expected len %d, actual %d", len(expected), list.Len())
+	}
+	list.ForEach(func(i int, val []byte) bool {
+		if !bytes.Equal(val, expected[i]) {
+			t.Fatalf("wrong element at %d", i)
+		}
+		return true
+	})
+	count := 0
+	for seg := list.first; seg != nil; seg = seg.next {
+		count += seg.count
+		if seg.count == 0 {
+			t.Fatal("empty segment")
+		}
+		if seg.compressed && list.isNearEnd(seg) {
+			t.Fatal("segment near end should not be compressed")
+		}
+	}
+	if count != list.Len() {
+		t.Fatalf("expected count %d, actual %d", list.Len(), count)
+	}
+}
+
+func TestQuickList(t *testing.T) {
+	for _, depth := range []int{0, 1, 2} {
+		list := MakeQuickList(depth)
+		var expected [][]byte
+		// elements returned before must stay valid after list changed
+		var returned, returnedCopy [][]byte
+		for i := 0; i < 3000; i++ {
+			switch op := rand.Intn(10); {
+			case op < 3 || len(expected) == 0:
+				val := randomElement()
+				list.Add(val)
+				expected = append(expected, val)
+			case op < 5:
+				val := randomElement()
+				index := rand.Intn(len(expected) + 1)
+				list.Insert(index, val)
+				expected = append(expected[:index], append([][]byte{val}, expected[index:]...)...)
+			case op < 6:
+				index := rand.Intn(len(expected))
+				val := list.Remove(index)
+				if !bytes.Equal(val, expected[index]) {
+					t.Fatalf("remove wrong element at %d", index)
+				}
+				returned = append(returned, val)
+				returnedCopy = append(returnedCopy, append([]byte(nil), val...))
+				expected = append(expected[:index], expected[index+1:]...)
+			case op < 7:
+				val := list.RemoveLast()
+				if !bytes.Equal(val, expected[len(expected)-1]) {
+					t.Fatal("remove wrong last element")
+				}
+				returned = append(returned, val)
+				returnedCopy = append(returnedCopy, append([]byte(nil), val...))
+				expected = expected[:len(expected)-1]
+			case op < 8:
+				index := rand.Intn(len(expected))
+				val := randomElement()
+				list.Set(index, val)
+				expected[index] = val
+			case op < 9:
+				index := rand.Intn(len(expected))
+				if !bytes.Equal(list.Get(index), expected[index]) {
+					t.Fatalf("get wrong element at %d", index)
+				}
+			default:
+				start := rand.Intn(len(expected))
+				end := start + rand.Intn(len(expected)-start+1)
+				slice := list.Range(start, end)
+				if len(slice) != end-start {
+					t.Fatalf("expected range len %d, actual %d", end-start, len(slice))
+				}
+				for j, val := range slice {
+					if !bytes.Equal(val, expected[start+j]) {
+						t.Fatalf("wrong element in range at %d", start+j)
+					}
+				}
+			}
+		}
+		assertQuickList(t, list, expected)
+		for i := range returned {
+			if !bytes.Equal(returned[i], returnedCopy[i]) {
+				t.Fatal("returned element was modified")
+			}
+		}
+	}
+}
+
+func TestQuickList_RemoveByVal(t *testing.T) {
+	list := MakeQuickList(1)
+	var expected [][]byte
+	for i := 0; i < 2000; i++ {
+		val := []byte(strconv.Itoa(i % 10))
+		list.Add(val)
+		expected = append(expected, val)
+	}
+	removeExpected := func(val []byte, count int, reverse bool) [][]byte {
+		result := make([][]byte, len(expected))
+		copy(result, expected)
+		removed := 0
+		for j := range result {
+			i := j
+			if reverse {
+				i = len(result) - 1 - j
+			}
+			if (count <= 0 || removed < count) && bytes.Equal(result[i], val) {
+				result[i] = nil
+				removed++
+			}
+		}
+		kept := result[:0]
+		for _, v := range result {
+			if v != nil {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	}
+
+	expected = removeExpected([]byte("1"), 50, false)
+	if removed := list.RemoveByVal([]byte("1"), 50); removed != 50 {
+		t.Errorf("expected 50 removed, actual %d", removed)
+	}
+	assertQuickList(t, list, expected)
+
+	expected = removeExpected([]byte("2"), 70, true)
+	if removed := list.ReverseRemoveByVal([]byte("2"), 70); removed != 70 {
+		t.Errorf("expected 70 removed, actual %d", removed)
+	}
+	assertQuickList(t, list, expected)
+
+	expected = removeExpected([]byte("3"), 0, false)
+	if removed := list.RemoveAllByVal([]byte("3")); removed != 200 {
+		t.Errorf("expected 200 removed, actual %d", removed)
+	}
+	assertQuickList(t, list, expected)
+	if list.Contains([]byte("3")) || !list.Contains([]byte("4")) {
+		t.Error("wrong result of contains")
+	}
+}
+
+func TestQuickList_Compress(t *testing.T) {
+	list := MakeQuickList(1)
+	val := []byte(strings.Repeat("godis", 100))
+	for i := 0; i < 1000; i++ {
+		list.Insert(0, val)
+	}
+	compressed := 0
+	for seg := list.first; seg != nil; seg = seg.next {
+		if seg.compressed {
+			compressed++
+		}
+	}
+	if compressed == 0 {
+		t.Error("expected interior segments compressed")
+	}
+	for i := 0; i < 1000; i++ {
+		if !bytes.Equal(list.Remove(0), val) {
+			t.Fatal("wrong element")
+		}
+	}
+	if list.Len() != 0 || list.first != nil || list.last != nil {
+		t.Error("expected empty list")
+	}
+}
+
+func TestQuickList_MemoryUsage(t *testing.T) {
+	val := []byte(strings.Repeat("godis", 100))
+	plain := MakeQuickList(0)
+	compressed := MakeQuickList(1)
+	for i := 0; i < 1000; i++ {
+		plain.Add(val)
+		compressed.Add(val)
+	}
+	if plain.MemoryUsage() < int64(len(val)*1000) {
+		t.Errorf("memory usage %d is less than size of elements", plain.MemoryUsage())
+	}
+	if compressed.MemoryUsage() >= plain.MemoryUsage() {
+		t.Errorf("expected compressed list use less memory, %d >= %d", compressed.MemoryUsage(), plain.MemoryUsage())
+	}
+}
+
+func TestQuickList_Trim(t *testing.T) {
+	for _, depth := range []int{0, 1} {
+		for i := 0; i < 200; i++ {
+			var expected [][]byte
+			list := MakeQuickList(depth)
+			for j := rand.Intn(300); j > 0; j-- {
+				val := randomElement()
+				list.Add(val)
+				expected = append(expected, val)
+			}
+			start := rand.Intn(len(expected) + 1)
+			end := start + rand.Intn(len(expected)-start+1)
+			list.Trim(start, end)
+			assertQuickList(t, list, expected[start:end])
+			val := randomElement()
+			list.Insert(0, val)
+			assertQuickList(t, list, append([][]byte{val}, expected[start:end]...))
+		}
+	}
+}
+
+func TestQuickList_ReverseForEach(t *testing.T) {
+	list := MakeQuickList(1)
+	var expected [][]byte
+	for i := 0; i < 500; i++ {
+		val := randomElement()
+		list.Add(val)
+		expected = append(expected, val)
+	}
+	next := len(expected) - 1
+	list.ReverseForEach(func(i int, val []byte) bool {
+		if i != next || !bytes.Equal(val, expected[i]) {
+			t.Fatalf("wrong element at %d", i)
+		}
+		next--
+		return i > 100
+	})
+	if next != 99 {
+		t.Errorf("expected stop at 100, actual %d", next+1)
+	}
+}
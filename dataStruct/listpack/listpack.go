@@ -0,0 +1,58 @@
+package listpack
+
+import "encoding/binary"
+
+/*
+ * listpack packs byte strings into one byte slice: uvarint(len) element uvarint(len) element ...
+ * It saves pointers and headers of small objects, at the cost of scanning for random access.
+ * Packed bytes are never modified in place: Append only writes beyond the length, and elements returned have
+ * capacity limited to their length, so they stay valid after the listpack changed.
+ */
+
+// MaxHeaderLen is the max length of the header before each element
+const MaxHeaderLen = binary.MaxVarintLen64
+
+// Append appends elements to packed bytes
+func Append(data []byte, vals ...[]byte) []byte {
+	var header [MaxHeaderLen]byte
+	for _, val := range vals {
+		n := binary.PutUvarint(header[:], uint64(len(val)))
+		data = append(data, header[:n]...)
+		data = append(data, val...)
+	}
+	return data
+}
+
+// Read returns element at offset of packed bytes and offset of the next element
+func Read(data []byte, offset int) ([]byte, int) {
+	length, n := binary.Uvarint(data[offset:])
+	start := offset + n
+	end := start + int(length)
+	return data[start:end:end], end
+}
+
+// Unpack returns all elements in packed bytes, count is the expected number of elements
+func Unpack(data []byte, count int) [][]byte {
+	result := make([][]byte, 0, count)
+	for offset := 0; offset < len(data); {
+		var val []byte
+		val, offset = Read(data, offset)
+		result = append(result, val)
+	}
+	return result
+}
+
+// Pack packs elements into a new byte slice
+func Pack(vals [][]byte) []byte {
+	size := 0
+	for _, val := range vals {
+		size += len(val) + MaxHeaderLen
+	}
+	return Append(make([]byte, 0, size), vals...)
+}
+
+// EntrySize returns bytes taken by an element of the given length in listpack, including its header
+func EntrySize(length int) int {
+	var header [MaxHeaderLen]byte
+	return binary.PutUvarint(header[:], uint64(length)) + length
+}
@@ -1,16 +1,35 @@
 package set
 
-import "godis/dataStruct/dict"
+import (
+	"godis/dataStruct/dict"
+	"math/rand"
+	"sort"
+	"strconv"
+)
 
-// Set is a set of elements based on hash table
+// defaultMaxIntsetEntries is the threshold of intset encoding used by Make
+const defaultMaxIntsetEntries = 512
+
+// Set is a set of elements based on hash table.
+// Small sets of integers are encoded as a sorted intset, and converted to hash table when a member is not an integer
+// or there are more than maxIntsetEntries members
 type Set struct {
-	dict dict.Dict
+	// dict is nil while the set is encoded as intset
+	dict   dict.Dict
+	intset []int64
+
+	maxIntsetEntries int
 }
 
 // Make creates a new set
 func Make(members ...string) *Set {
+	return MakeCompact(defaultMaxIntsetEntries, members...)
+}
+
+// MakeCompact creates a new set which is encoded as intset until it has more than maxIntsetEntries members
+func MakeCompact(maxIntsetEntries int, members ...string) *Set {
 	set := &Set{
-		dict: dict.MakeSimple(),
+		maxIntsetEntries: maxIntsetEntries,
 	}
 	for _, member := range members {
 		set.Add(member)
@@ -18,24 +37,112 @@ func Make(members ...string) *Set {
 	return set
 }
 
+// makeEmpty creates an empty set with the same thresholds
+func (set *Set) makeEmpty() *Set {
+	return MakeCompact(set.maxIntsetEntries)
+}
+
+// Encoding returns "intset" or "hashtable"
+func (set *Set) Encoding() string {
+	if set.dict == nil {
+		return "intset"
+	}
+	return "hashtable"
+}
+
+// parseInt returns the integer if val is its canonical representation
+func parseInt(val string) (int64, bool) {
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || strconv.FormatInt(i, 10) != val {
+		return 0, false
+	}
+	return i, true
+}
+
+// search returns the position of i in intset, or where it should be inserted
+func (set *Set) search(i int64) (int, bool) {
+	pos := sort.Search(len(set.intset), func(j int) bool {
+		return set.intset[j] >= i
+	})
+	return pos, pos < len(set.intset) && set.intset[pos] == i
+}
+
+// convert moves all members into hash table
+func (set *Set) convert() {
+	d := dict.MakeSimple()
+	for _, i := range set.intset {
+		d.Put(strconv.FormatInt(i, 10), nil)
+	}
+	set.dict = d
+	set.intset = nil
+}
+
 // Add adds member to set
 func (set *Set) Add(val string) int {
+	if set.dict == nil {
+		i, ok := parseInt(val)
+		if !ok {
+			set.convert()
+			return set.dict.Put(val, nil)
+		}
+		pos, exists := set.search(i)
+		if exists {
+			return 0
+		}
+		if len(set.intset) >= set.maxIntsetEntries {
+			set.convert()
+			return set.dict.Put(val, nil)
+		}
+		// copy on write, so that traversal in progress won't be affected
+		intset := make([]int64, len(set.intset)+1)
+		copy(intset, set.intset[:pos])
+		intset[pos] = i
+		copy(intset[pos+1:], set.intset[pos:])
+		set.intset = intset
+		return 1
+	}
 	return set.dict.Put(val, nil)
 }
 
 // Remove removes member from set
 func (set *Set) Remove(val string) int {
+	if set.dict == nil {
+		i, ok := parseInt(val)
+		if !ok {
+			return 0
+		}
+		pos, exists := set.search(i)
+		if !exists {
+			return 0
+		}
+		intset := make([]int64, len(set.intset)-1)
+		copy(intset, set.intset[:pos])
+		copy(intset[pos:], set.intset[pos+1:])
+		set.intset = intset
+		return 1
+	}
 	return set.dict.Remove(val)
 }
 
 // Has returns true if the val exists in the set
 func (set *Set) Has(val string) bool {
+	if set.dict == nil {
+		i, ok := parseInt(val)
+		if !ok {
+			return false
+		}
+		_, exists := set.search(i)
+		return exists
+	}
 	_, exists := set.dict.Get(val)
 	return exists
 }
 
 // Len returns number of members in the set
 func (set *Set) Len() int {
+	if set.dict == nil {
+		return len(set.intset)
+	}
 	return set.dict.Len()
 }
 
@@ -43,12 +150,12 @@ func (set *Set) Len() int {
 func (set *Set) ToSlice() []string {
 	slice := make([]string, set.Len())
 	i := 0
-	set.dict.ForEach(func(key string, val interface{}) bool {
+	set.ForEach(func(member string) bool {
 		if i < len(slice) {
-			slice[i] = key
+			slice[i] = member
 		} else {
 			// set expands during traversal
-			slice = append(slice, key)
+			slice = append(slice, member)
 		}
 		i++
 		return true
@@ -58,19 +165,31 @@ func (set *Set) ToSlice() []string {
 
 // ForEach visits each member in the set
 func (set *Set) ForEach(consumer func(member string) bool) {
+	if set.dict == nil {
+		for _, i := range set.intset {
+			if !consumer(strconv.FormatInt(i, 10)) {
+				break
+			}
+		}
+		return
+	}
 	set.dict.ForEach(func(key string, val interface{}) bool {
 		return consumer(key)
 	})
 }
 
-// Intersect intersects two sets
+// Intersect intersects two sets, it iterates the smaller set and looks up members in the bigger one
 func (set *Set) Intersect(another *Set) *Set {
 	if set == nil {
 		panic("set is nil")
 	}
-	result := Make()
-	another.ForEach(func(member string) bool {
-		if set.Has(member) {
+	result := set.makeEmpty()
+	smaller, bigger := set, another
+	if another.Len() < set.Len() {
+		smaller, bigger = another, set
+	}
+	smaller.ForEach(func(member string) bool {
+		if bigger.Has(member) {
 			result.Add(member)
 		}
 		return true
@@ -83,7 +202,7 @@ func (set *Set) Union(another *Set) *Set {
 	if set == nil {
 		panic("set is nil")
 	}
-	result := Make()
+	result := set.makeEmpty()
 	another.ForEach(func(member string) bool {
 		result.Add(member)
 		return true
@@ -101,7 +220,7 @@ func (set *Set) Diff(another *Set) *Set {
 		panic("set is nil")
 	}
 
-	result := Make()
+	result := set.makeEmpty()
 	set.ForEach(func(member string) bool {
 		if !another.Has(member) {
 			result.Add(member)
@@ -113,10 +232,30 @@ func (set *Set) Diff(another *Set) *Set {
 
 // RandomMembers randomly returns keys of the given number, may contain duplicated key
 func (set *Set) RandomMembers(limit int) []string {
+	if set.dict == nil {
+		if len(set.intset) == 0 {
+			return nil
+		}
+		result := make([]string, limit)
+		for i := range result {
+			result[i] = strconv.FormatInt(set.intset[rand.Intn(len(set.intset))], 10)
+		}
+		return result
+	}
 	return set.dict.RandomKeys(limit)
 }
 
 // RandomDistinctMembers randomly returns keys of the given number, won't contain duplicated key
 func (set *Set) RandomDistinctMembers(limit int) []string {
+	if set.dict == nil {
+		if limit > len(set.intset) {
+			limit = len(set.intset)
+		}
+		result := make([]string, limit)
+		for i, j := range rand.Perm(len(set.intset))[:limit] {
+			result[i] = strconv.FormatInt(set.intset[j], 10)
+		}
+		return result
+	}
 	return set.dict.RandomDistinctKeys(limit)
 }
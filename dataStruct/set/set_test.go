@@ -30,3 +30,73 @@ func TestSet(t *testing.T) {
 		}
 	}
 }
+
+func TestSet_Intset(t *testing.T) {
+	set := MakeCompact(100)
+	for i := 99; i >= 0; i-- {
+		set.Add(strconv.Itoa(i * 2))
+	}
+	if set.Encoding() != "intset" || set.Len() != 100 {
+		t.Fatal("expected intset encoding")
+	}
+	if set.Has("1") || !set.Has("2") || set.Has("02") || set.Has("a") {
+		t.Error("wrong result of has")
+	}
+	if set.Remove("02") != 0 || set.Remove("2") != 1 || set.Has("2") {
+		t.Error("wrong result of remove")
+	}
+	prev := -1
+	set.ForEach(func(member string) bool {
+		i, _ := strconv.Atoi(member)
+		if i <= prev {
+			t.Fatal("members of intset should be sorted")
+		}
+		prev = i
+		return true
+	})
+	if len(set.RandomDistinctMembers(200)) != 99 || len(set.RandomMembers(200)) != 200 {
+		t.Error("wrong number of random members")
+	}
+
+	set.Add("2")
+	set.Add("1")
+	if set.Encoding() != "hashtable" || set.Len() != 101 || !set.Has("1") || !set.Has("198") {
+		t.Error("expected hashtable encoding after too many members")
+	}
+
+	set = MakeCompact(100, "1", "2")
+	set.Add("02")
+	if set.Encoding() != "hashtable" || set.Len() != 3 || !set.Has("02") || !set.Has("2") {
+		t.Error("expected hashtable encoding after adding non-integer member")
+	}
+}
+
+func TestSet_Algebra(t *testing.T) {
+	a := Make("1", "2", "3")
+	b := Make("2", "3", "x")
+	if inter := a.Intersect(b); inter.Len() != 2 || !inter.Has("2") || !inter.Has("3") {
+		t.Error("wrong result of intersect")
+	}
+	if union := a.Union(b); union.Len() != 4 || !union.Has("x") || !union.Has("1") {
+		t.Error("wrong result of union")
+	}
+	if diff := a.Diff(b); diff.Len() != 1 || !diff.Has("1") || diff.Encoding() != "intset" {
+		t.Error("wrong result of diff")
+	}
+}
+
+func TestSet_IntersectDifferentSizes(t *testing.T) {
+	big := Make()
+	for i := 0; i < 1000; i++ {
+		big.Add("m" + strconv.Itoa(i))
+	}
+	small := Make("m1", "m999", "x")
+	for _, inter := range []*Set{big.Intersect(small), small.Intersect(big)} {
+		if inter.Len() != 2 || !inter.Has("m1") || !inter.Has("m999") || inter.Has("x") {
+			t.Error("wrong result of intersect")
+		}
+	}
+	if inter := big.Intersect(Make()); inter.Len() != 0 {
+		t.Error("intersect with empty set should be empty")
+	}
+}
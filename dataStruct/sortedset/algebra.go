@@ -0,0 +1,140 @@
+package sortedset
+
+import (
+	"math"
+	"sort"
+)
+
+// aggregate functions combining scores of the same member in Union and Intersect
+const (
+	AggregateSum = iota
+	AggregateMin
+	AggregateMax
+)
+
+func aggregateScore(aggregate int, a float64, b float64) float64 {
+	switch aggregate {
+	case AggregateMin:
+		return math.Min(a, b)
+	case AggregateMax:
+		return math.Max(a, b)
+	}
+	sum := a + b
+	if math.IsNaN(sum) {
+		// +inf plus -inf
+		return 0
+	}
+	return sum
+}
+
+func weightScore(score float64, weight float64) float64 {
+	result := score * weight
+	if math.IsNaN(result) {
+		// inf multiplied by 0
+		return 0
+	}
+	return result
+}
+
+func (s *SortedSet) forEachMember(consumer func(element *Element) bool) {
+	if s == nil {
+		return
+	}
+	s.ForEach(0, s.Len(), false, consumer)
+}
+
+// Union returns members in any of the sets, scores are multiplied by weights then aggregated.
+// nil sets are treated as empty sets
+func Union(sets []*SortedSet, weights []float64, aggregate int) map[string]float64 {
+	result := make(map[string]float64)
+	for i, s := range sets {
+		s.forEachMember(func(element *Element) bool {
+			score := weightScore(element.Score, weights[i])
+			if current, ok := result[element.Member]; ok {
+				score = aggregateScore(aggregate, current, score)
+			}
+			result[element.Member] = score
+			return true
+		})
+	}
+	return result
+}
+
+// sortBySize returns indexes of sets ordered by size, so that intersection iterates the smallest set
+func sortBySize(sets []*SortedSet) []int {
+	indexes := make([]int, len(sets))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return sets[indexes[i]].Len() < sets[indexes[j]].Len()
+	})
+	return indexes
+}
+
+// Intersect returns members in all of the sets, scores are multiplied by weights then aggregated.
+// nil sets are treated as empty sets
+func Intersect(sets []*SortedSet, weights []float64, aggregate int) map[string]float64 {
+	result := make(map[string]float64)
+	for _, s := range sets {
+		if s == nil {
+			return result
+		}
+	}
+	indexes := sortBySize(sets)
+	first := indexes[0]
+	sets[first].forEachMember(func(element *Element) bool {
+		score := weightScore(element.Score, weights[first])
+		for _, i := range indexes[1:] {
+			another, ok := sets[i].Get(element.Member)
+			if !ok {
+				return true
+			}
+			score = aggregateScore(aggregate, score, weightScore(another.Score, weights[i]))
+		}
+		result[element.Member] = score
+		return true
+	})
+	return result
+}
+
+// IntersectCard returns the number of members in all of the sets, it stops counting at limit if limit is positive.
+// nil sets are treated as empty sets
+func IntersectCard(sets []*SortedSet, limit int64) int64 {
+	for _, s := range sets {
+		if s == nil {
+			return 0
+		}
+	}
+	indexes := sortBySize(sets)
+	var count int64
+	sets[indexes[0]].forEachMember(func(element *Element) bool {
+		for _, i := range indexes[1:] {
+			if _, ok := sets[i].Get(element.Member); !ok {
+				return true
+			}
+		}
+		count++
+		return limit <= 0 || count < limit
+	})
+	return count
+}
+
+// Diff returns members of the first set which are not in the others, with scores in the first set.
+// nil sets are treated as empty sets
+func Diff(sets []*SortedSet) map[string]float64 {
+	result := make(map[string]float64)
+	sets[0].forEachMember(func(element *Element) bool {
+		for _, s := range sets[1:] {
+			if s == nil {
+				continue
+			}
+			if _, ok := s.Get(element.Member); ok {
+				return true
+			}
+		}
+		result[element.Member] = element.Score
+		return true
+	})
+	return result
+}
@@ -2,9 +2,20 @@ package sortedset
 
 import (
 	"errors"
+	"math"
 	"strconv"
 )
 
+// Border represents `min` or `max` parameter of range commands, it is ScoreBorder or LexBorder
+type Border interface {
+	// less judges whether element is greater than min border
+	less(element *Element) bool
+	// greater judges whether element is less than max border
+	greater(element *Element) bool
+	// isEmptyRange judges whether range from the border to max contains nothing
+	isEmptyRange(max Border) bool
+}
+
 /*
  * ScoreBorder is a struct represents `min` `max` parameter of redis command `ZRANGEBYSCORE`
  * can accept:
@@ -18,44 +29,45 @@ const (
 	positiveInf int8 = 1
 )
 
-// ScoreBorder represents range of a float value, including: <, <=, >, >=, +inf, -inf
+// ScoreBorder represents range of a float value, including: <, <=, >, >=, +inf, -inf.
+// Value of infinite border is ±Inf, so that it is compared by value like other borders,
+// e.g. [+inf, +inf] contains members whose score is +inf
 type ScoreBorder struct {
 	Inf     int8
 	Value   float64
 	Exclude bool
 }
 
-// greater judges whether border.Value is greater than value
-func (border *ScoreBorder) greater(value float64) bool {
-	if border.Inf == negativeInf {
-		return false
-	} else if border.Inf == positiveInf {
-		return true
-	}
+// greater judges whether border.Value is greater than score of element
+func (border *ScoreBorder) greater(element *Element) bool {
+	value := element.Score
 	if border.Exclude {
 		return border.Value > value
 	}
 	return border.Value >= value
 }
 
-func (border *ScoreBorder) less(value float64) bool {
-	if border.Inf == negativeInf {
-		return true
-	} else if border.Inf == positiveInf {
-		return false
-	}
+func (border *ScoreBorder) less(element *Element) bool {
+	value := element.Score
 	if border.Exclude {
 		return border.Value < value
 	}
 	return border.Value <= value
 }
 
+func (border *ScoreBorder) isEmptyRange(max Border) bool {
+	maxBorder := max.(*ScoreBorder)
+	return border.Value > maxBorder.Value || (border.Value == maxBorder.Value && (border.Exclude || maxBorder.Exclude))
+}
+
 var positiveInfBorder = &ScoreBorder{
-	Inf: positiveInf,
+	Inf:   positiveInf,
+	Value: math.Inf(1),
 }
 
 var negativeInfBorder = &ScoreBorder{
-	Inf: negativeInf,
+	Inf:   negativeInf,
+	Value: math.Inf(-1),
 }
 
 // ParseScoreBorder creates ScoreBorder from redis arguments
@@ -66,9 +78,9 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 	if s == "-inf" {
 		return negativeInfBorder, nil
 	}
-	if s[0] == '(' {
+	if len(s) > 0 && s[0] == '(' {
 		value, err := strconv.ParseFloat(s[1:], 64)
-		if err != nil {
+		if err != nil || math.IsNaN(value) {
 			return nil, errors.New("ERR min or max is not a float")
 		}
 		return &ScoreBorder{
@@ -78,7 +90,7 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 		}, nil
 	}
 	value, err := strconv.ParseFloat(s, 64)
-	if err != nil {
+	if err != nil || math.IsNaN(value) {
 		return nil, errors.New("ERR min or max is not a float")
 	}
 	return &ScoreBorder{
@@ -87,3 +99,87 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 		Exclude: false,
 	}, nil
 }
+
+/*
+ * LexBorder is a struct represents `min` `max` parameter of redis command `ZRANGEBYLEX`
+ * can accept:
+ *   inclusive member, such as [a
+ *   exclusive member, such as (a
+ *   infinity: + and -
+ */
+
+// LexBorder represents range of a member, including: <, <=, >, >=, +, -
+type LexBorder struct {
+	Inf     int8
+	Value   string
+	Exclude bool
+}
+
+// greater judges whether border.Value is greater than member of element
+func (border *LexBorder) greater(element *Element) bool {
+	value := element.Member
+	if border.Inf == negativeInf {
+		return false
+	} else if border.Inf == positiveInf {
+		return true
+	}
+	if border.Exclude {
+		return border.Value > value
+	}
+	return border.Value >= value
+}
+
+func (border *LexBorder) less(element *Element) bool {
+	value := element.Member
+	if border.Inf == negativeInf {
+		return true
+	} else if border.Inf == positiveInf {
+		return false
+	}
+	if border.Exclude {
+		return border.Value < value
+	}
+	return border.Value <= value
+}
+
+func (border *LexBorder) isEmptyRange(max Border) bool {
+	maxBorder := max.(*LexBorder)
+	if border.Inf == positiveInf || maxBorder.Inf == negativeInf {
+		return true
+	}
+	if border.Inf == negativeInf || maxBorder.Inf == positiveInf {
+		return false
+	}
+	return border.Value > maxBorder.Value || (border.Value == maxBorder.Value && (border.Exclude || maxBorder.Exclude))
+}
+
+var positiveInfLexBorder = &LexBorder{
+	Inf: positiveInf,
+}
+
+var negativeInfLexBorder = &LexBorder{
+	Inf: negativeInf,
+}
+
+// ParseLexBorder creates LexBorder from redis arguments
+func ParseLexBorder(s string) (*LexBorder, error) {
+	if s == "+" {
+		return positiveInfLexBorder, nil
+	}
+	if s == "-" {
+		return negativeInfLexBorder, nil
+	}
+	if len(s) > 0 && s[0] == '(' {
+		return &LexBorder{
+			Value:   s[1:],
+			Exclude: true,
+		}, nil
+	}
+	if len(s) > 0 && s[0] == '[' {
+		return &LexBorder{
+			Value:   s[1:],
+			Exclude: false,
+		}, nil
+	}
+	return nil, errors.New("ERR min or max not valid string range item")
+}
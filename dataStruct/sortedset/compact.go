@@ -0,0 +1,138 @@
+package sortedset
+
+import (
+	"encoding/binary"
+	"godis/dataStruct/listpack"
+	"math"
+)
+
+/*
+ * Small sorted set is packed into a listpack as: member score member score ...
+ * Elements are sorted by score then member, and score is stored as 8 bytes of float64.
+ * All operations on listpack are O(n), which is acceptable while the set is small.
+ */
+
+const (
+	defaultMaxListpackEntries = 128
+	defaultMaxListpackValue   = 64
+)
+
+func elementLess(a *Element, b *Element) bool {
+	return a.Score < b.Score || a.Score == b.Score && a.Member < b.Member
+}
+
+// forEachPacked visits elements in listpack by ascending order
+func (s *SortedSet) forEachPacked(consumer func(i int64, element *Element) bool) {
+	data := s.packed
+	var i int64
+	for offset := 0; offset < len(data); i++ {
+		var member, score []byte
+		member, offset = listpack.Read(data, offset)
+		score, offset = listpack.Read(data, offset)
+		element := &Element{
+			Member: string(member),
+			Score:  math.Float64frombits(binary.BigEndian.Uint64(score)),
+		}
+		if !consumer(i, element) {
+			break
+		}
+	}
+}
+
+// unpack returns all elements in listpack by ascending order
+func (s *SortedSet) unpack() []*Element {
+	elements := make([]*Element, 0, s.count)
+	s.forEachPacked(func(i int64, element *Element) bool {
+		elements = append(elements, element)
+		return true
+	})
+	return elements
+}
+
+// pack replaces listpack with the given sorted elements
+func (s *SortedSet) pack(elements []*Element) {
+	size := 0
+	for _, element := range elements {
+		size += len(element.Member) + 8 + 2*listpack.MaxHeaderLen
+	}
+	data := make([]byte, 0, size)
+	var score [8]byte
+	for _, element := range elements {
+		binary.BigEndian.PutUint64(score[:], math.Float64bits(element.Score))
+		data = listpack.Append(data, []byte(element.Member), score[:])
+	}
+	s.packed = data
+	s.count = len(elements)
+}
+
+// findPacked returns rank of the member in listpack, or -1 if not found
+func (s *SortedSet) findPacked(member string) (rank int64, element *Element) {
+	rank = -1
+	s.forEachPacked(func(i int64, e *Element) bool {
+		if e.Member == member {
+			rank = i
+			element = e
+			return false
+		}
+		return true
+	})
+	return rank, element
+}
+
+// convert moves all elements into dict and skip list
+func (s *SortedSet) convert() {
+	elements := s.unpack()
+	s.dict = make(map[string]*Element, len(elements))
+	s.skipList = makeSkipList()
+	for _, element := range elements {
+		s.dict[element.Member] = element
+		s.skipList.insert(element.Member, element.Score)
+	}
+	s.packed = nil
+	s.count = 0
+}
+
+// addPacked puts member into listpack, returns false if the set should be converted before adding
+func (s *SortedSet) addPacked(member string, score float64) (inserted bool, ok bool) {
+	elements := s.unpack()
+	inserted = true
+	for i, element := range elements {
+		if element.Member == member {
+			elements = append(elements[:i], elements[i+1:]...)
+			inserted = false
+			break
+		}
+	}
+	if inserted && s.count >= s.maxListpackEntries {
+		return false, false
+	}
+	element := &Element{Member: member, Score: score}
+	pos := len(elements)
+	for i, e := range elements {
+		if elementLess(element, e) {
+			pos = i
+			break
+		}
+	}
+	elements = append(elements, nil)
+	copy(elements[pos+1:], elements[pos:])
+	elements[pos] = element
+	s.pack(elements)
+	return inserted, true
+}
+
+// removePacked removes elements matching the filter from listpack
+func (s *SortedSet) removePacked(filter func(i int64, element *Element) bool) int64 {
+	elements := s.unpack()
+	kept := elements[:0]
+	for i, element := range elements {
+		if !filter(int64(i), element) {
+			kept = append(kept, element)
+		}
+	}
+	removed := int64(len(elements) - len(kept))
+	if removed > 0 {
+		s.pack(kept)
+	}
+	return removed
+}
@@ -137,7 +137,7 @@ func (s *skipList) removeNode(node *node, update []*node) {
 	for i := int16(0); i < s.level; i++ {
 		if update[i].level[i].forward == node {
 			update[i].level[i].span += node.level[i].span - 1
-			update[i].level[i].forward = node
+			update[i].level[i].forward = node.level[i].forward
 		} else {
 			update[i].level[i].span--
 		}
@@ -217,25 +217,25 @@ func (s *skipList) getByRank(rank int64) *node {
 	return nil
 }
 
-func (s *skipList) hasInRange(min *ScoreBorder, max *ScoreBorder) bool {
+func (s *skipList) hasInRange(min Border, max Border) bool {
 	// min & max = empty
-	if min.Value > max.Value || (min.Value == max.Value && (min.Exclude || max.Exclude)) {
+	if min.isEmptyRange(max) {
 		return false
 	}
 	// min > tail
 	n := s.tail
-	if n == nil || !min.less(n.Score) {
+	if n == nil || !min.less(&n.Element) {
 		return false
 	}
 	// max < head
 	n = s.header.level[0].forward
-	if n == nil || !max.greater(n.Score) {
+	if n == nil || !max.greater(&n.Element) {
 		return false
 	}
 	return true
 }
 
-func (s *skipList) getFirstInScoreRange(min *ScoreBorder, max *ScoreBorder) *node {
+func (s *skipList) getFirstInRange(min Border, max Border) *node {
 	if !s.hasInRange(min, max) {
 		return nil
 	}
@@ -243,43 +243,44 @@ func (s *skipList) getFirstInScoreRange(min *ScoreBorder, max *ScoreBorder) *nod
 	// scan from top level
 	for level := s.level - 1; level >= 0; level-- {
 		// if forward is not in range then move forward
-		for n.level[level].forward != nil && !min.less(n.level[level].forward.Score) {
+		for n.level[level].forward != nil && !min.less(&n.level[level].forward.Element) {
 			n = n.level[level].forward
 		}
 	}
 	// this is an inner range, so the next node can not be null
 	n = n.level[0].forward
-	if !max.greater(n.Score) {
+	if !max.greater(&n.Element) {
 		return nil
 	}
 	return n
 }
 
-func (s *skipList) getLastInScoreRange(min *ScoreBorder, max *ScoreBorder) *node {
+func (s *skipList) getLastInRange(min Border, max Border) *node {
 	if !s.hasInRange(min, max) {
 		return nil
 	}
 	n := s.header
 	// scan from top level
 	for level := s.level - 1; level >= 0; level-- {
-		for n.level[level].forward != nil && max.greater(n.level[level].forward.Score) {
+		for n.level[level].forward != nil && max.greater(&n.level[level].forward.Element) {
 			n = n.level[level].forward
 		}
 	}
-	if !min.less(n.Score) {
+	if !min.less(&n.Element) {
 		return nil
 	}
 	return n
 }
 
-func (s *skipList) RemoveRangeByScore(min *ScoreBorder, max *ScoreBorder) []*Element {
+// RemoveRange removes nodes within the given border
+func (s *skipList) RemoveRange(min Border, max Border) []*Element {
 	update := make([]*node, maxLevel)
 	removed := make([]*Element, 0)
 	// find backward nodes
 	node := s.header
 	for i := s.level - 1; i >= 0; i-- {
 		for node.level[i].forward != nil {
-			if min.less(node.level[i].forward.Score) {
+			if min.less(&node.level[i].forward.Element) {
 				// already in range
 				break
 			}
@@ -293,7 +294,7 @@ func (s *skipList) RemoveRangeByScore(min *ScoreBorder, max *ScoreBorder) []*Ele
 
 	// remove nodes in range
 	for node != nil {
-		if !max.greater(node.Score) {
+		if !max.greater(&node.Element) {
 			// already out of range
 			break
 		}
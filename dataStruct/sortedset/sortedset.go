@@ -1,23 +1,56 @@
 package sortedset
 
-import "strconv"
+import (
+	"math/rand"
+	"strconv"
+)
 
-// SortedSet is a set which keys sorted by bound score
+// SortedSet is a set which keys sorted by bound score.
+// Small sorted set is encoded as listpack, and converted to dict and skip list when it has more than
+// maxListpackEntries members or a member longer than maxListpackValue
 type SortedSet struct {
 	dict     map[string]*Element
 	skipList *skipList
+
+	// packed and count are used while dict is nil
+	packed []byte
+	count  int
+
+	maxListpackEntries int
+	maxListpackValue   int
 }
 
 // Make makes a new SortedSet
 func Make() *SortedSet {
+	return MakeCompact(defaultMaxListpackEntries, defaultMaxListpackValue)
+}
+
+// MakeCompact makes a new SortedSet which is encoded as listpack under the given thresholds
+func MakeCompact(maxListpackEntries int, maxListpackValue int) *SortedSet {
 	return &SortedSet{
-		dict:     make(map[string]*Element),
-		skipList: makeSkipList(),
+		maxListpackEntries: maxListpackEntries,
+		maxListpackValue:   maxListpackValue,
 	}
 }
 
+// Encoding returns "listpack" or "skiplist"
+func (s *SortedSet) Encoding() string {
+	if s.dict == nil {
+		return "listpack"
+	}
+	return "skiplist"
+}
+
 // Add puts member into set, return true if insert new member
 func (s *SortedSet) Add(member string, score float64) bool {
+	if s.dict == nil {
+		if len(member) <= s.maxListpackValue {
+			if inserted, ok := s.addPacked(member, score); ok {
+				return inserted
+			}
+		}
+		s.convert()
+	}
 	element, ok := s.dict[member]
 	s.dict[member] = &Element{
 		Member: member,
@@ -36,11 +69,18 @@ func (s *SortedSet) Add(member string, score float64) bool {
 
 // Len returns number of members in set
 func (s *SortedSet) Len() int64 {
+	if s.dict == nil {
+		return int64(s.count)
+	}
 	return int64(len(s.dict))
 }
 
 // Get returns the given member
 func (s *SortedSet) Get(member string) (element *Element, ok bool) {
+	if s.dict == nil {
+		rank, element := s.findPacked(member)
+		return element, rank >= 0
+	}
 	element, ok = s.dict[member]
 	if !ok {
 		return nil, false
@@ -50,6 +90,11 @@ func (s *SortedSet) Get(member string) (element *Element, ok bool) {
 
 // Remove removes the given member from set
 func (s *SortedSet) Remove(member string) bool {
+	if s.dict == nil {
+		return s.removePacked(func(i int64, element *Element) bool {
+			return element.Member == member
+		}) > 0
+	}
 	v, ok := s.dict[member]
 	if ok {
 		s.skipList.remove(member, v.Score)
@@ -62,6 +107,13 @@ func (s *SortedSet) Remove(member string) bool {
 // GetRank returns the rank of the given member, sort by ascending order, rank starts from 0,
 // return -1 if member does not exist in s.dict
 func (s *SortedSet) GetRank(member string, desc bool) (rank int64) {
+	if s.dict == nil {
+		rank, _ = s.findPacked(member)
+		if rank >= 0 && desc {
+			rank = int64(s.count) - 1 - rank
+		}
+		return rank
+	}
 	element, ok := s.dict[member]
 	if !ok {
 		return -1
@@ -78,12 +130,28 @@ func (s *SortedSet) GetRank(member string, desc bool) (rank int64) {
 // ForEach visits each member which rank within [start, stop), sort by ascending order, rank starts from 0
 func (s *SortedSet) ForEach(start int64, stop int64, desc bool, consumer func(element *Element) bool) {
 	size := s.Len()
-	if start < 0 || start >= size {
+	if start < 0 || start > size {
 		panic("illegal start " + strconv.FormatInt(start, 10))
 	}
 	if stop < start || stop > size {
 		panic("illegal end " + strconv.FormatInt(stop, 10))
 	}
+	if start == stop {
+		return
+	}
+	if s.dict == nil {
+		elements := s.unpack()
+		for i := start; i < stop; i++ {
+			index := i
+			if desc {
+				index = size - 1 - i
+			}
+			if !consumer(elements[index]) {
+				break
+			}
+		}
+		return
+	}
 
 	// find start node
 	var node *node
@@ -127,34 +195,78 @@ func (s *SortedSet) Range(start int64, stop int64, desc bool) []*Element {
 
 // Count returns the number of  members which score within the given border
 func (s *SortedSet) Count(min *ScoreBorder, max *ScoreBorder) int64 {
-	var i int64 = 0
-	// ascending order
-	s.ForEach(0, s.Len(), false, func(element *Element) bool {
-		gtMin := min.less(element.Score) // greater than min
-		if !gtMin {
-			// has not into range, continue foreach
+	return s.countInRange(min, max)
+}
+
+// CountByLex returns the number of members within the given lex border, members are supposed to have the same score
+func (s *SortedSet) CountByLex(min *LexBorder, max *LexBorder) int64 {
+	return s.countInRange(min, max)
+}
+
+func (s *SortedSet) countInRange(min Border, max Border) int64 {
+	if s.dict == nil {
+		var i int64
+		s.forEachPacked(func(_ int64, element *Element) bool {
+			if !min.less(element) {
+				// has not into range, continue foreach
+				return true
+			}
+			if !max.greater(element) {
+				// break through border, break foreach
+				return false
+			}
+			i++
 			return true
-		}
-		ltMax := max.greater(element.Score) // less than max
-		if !ltMax {
-			// break through score border, break foreach
-			return false
-		}
-		// gtMin && ltMax
-		i++
-		return true
-	})
-	return i
+		})
+		return i
+	}
+	first := s.skipList.getFirstInRange(min, max)
+	if first == nil {
+		return 0
+	}
+	last := s.skipList.getLastInRange(min, max)
+	return s.skipList.getRank(last.Member, last.Score) - s.skipList.getRank(first.Member, first.Score) + 1
 }
 
 // ForEachByScore visits members which score within the given border
 func (s *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
+	s.forEachInRange(min, max, offset, limit, desc, consumer)
+}
+
+// ForEachByLex visits members within the given lex border, members are supposed to have the same score
+func (s *SortedSet) ForEachByLex(min *LexBorder, max *LexBorder, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
+	s.forEachInRange(min, max, offset, limit, desc, consumer)
+}
+
+func (s *SortedSet) forEachInRange(min Border, max Border, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
+	if s.dict == nil {
+		elements := s.unpack()
+		var i int64
+		for j := range elements {
+			element := elements[j]
+			if desc {
+				element = elements[len(elements)-1-j]
+			}
+			if !min.less(element) || !max.greater(element) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			if limit >= 0 && i >= limit || !consumer(element) {
+				break
+			}
+			i++
+		}
+		return
+	}
 	// find start node
 	var node *node
 	if desc {
-		node = s.skipList.getLastInScoreRange(min, max)
+		node = s.skipList.getLastInRange(min, max)
 	} else {
-		node = s.skipList.getFirstInScoreRange(min, max)
+		node = s.skipList.getFirstInRange(min, max)
 	}
 
 	for node != nil && offset > 0 {
@@ -168,6 +280,9 @@ func (s *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, offset in
 
 	// A negative limit returns all elements from the offset
 	for i := 0; (i < int(limit) || limit < 0) && node != nil; i++ {
+		if !min.less(&node.Element) || !max.greater(&node.Element) {
+			break // break through border
+		}
 		if !consumer(&node.Element) {
 			break
 		}
@@ -176,25 +291,27 @@ func (s *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, offset in
 		} else {
 			node = node.level[0].forward
 		}
-		if node == nil {
-			break
-		}
-		gtMin := min.less(node.Element.Score) // greater than min
-		ltMax := max.greater(node.Element.Score)
-		if !gtMin || !ltMax {
-			break // break through score border
-		}
 	}
 }
 
 // RangeByScore returns members which score within the given border
 // param limit: < 0 means no limit
 func (s *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool) []*Element {
+	return s.rangeInBorder(min, max, offset, limit, desc)
+}
+
+// RangeByLex returns members within the given lex border, members are supposed to have the same score
+// param limit: < 0 means no limit
+func (s *SortedSet) RangeByLex(min *LexBorder, max *LexBorder, offset int64, limit int64, desc bool) []*Element {
+	return s.rangeInBorder(min, max, offset, limit, desc)
+}
+
+func (s *SortedSet) rangeInBorder(min Border, max Border, offset int64, limit int64, desc bool) []*Element {
 	if limit == 0 || offset < 0 {
 		return make([]*Element, 0)
 	}
 	slice := make([]*Element, 0)
-	s.ForEachByScore(min, max, offset, limit, desc, func(element *Element) bool {
+	s.forEachInRange(min, max, offset, limit, desc, func(element *Element) bool {
 		slice = append(slice, element)
 		return true
 	})
@@ -203,7 +320,21 @@ func (s *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, offset int6
 
 // RemoveByScore removes members which score within the given border
 func (s *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) int64 {
-	removed := s.skipList.RemoveRangeByScore(min, max)
+	return s.removeInRange(min, max)
+}
+
+// RemoveByLex removes members within the given lex border, members are supposed to have the same score
+func (s *SortedSet) RemoveByLex(min *LexBorder, max *LexBorder) int64 {
+	return s.removeInRange(min, max)
+}
+
+func (s *SortedSet) removeInRange(min Border, max Border) int64 {
+	if s.dict == nil {
+		return s.removePacked(func(i int64, element *Element) bool {
+			return min.less(element) && max.greater(element)
+		})
+	}
+	removed := s.skipList.RemoveRange(min, max)
 	for _, element := range removed {
 		delete(s.dict, element.Member)
 	}
@@ -213,9 +344,80 @@ func (s *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) int64 {
 // RemoveByRank removes member ranking within [start, stop)
 // sort by ascending order and rank starts from 0
 func (s *SortedSet) RemoveByRank(start int64, stop int64) int64 {
+	if s.dict == nil {
+		return s.removePacked(func(i int64, element *Element) bool {
+			return i >= start && i < stop
+		})
+	}
 	removed := s.skipList.RemoveRangeByRank(start+1, stop+1)
 	for _, element := range removed {
 		delete(s.dict, element.Member)
 	}
 	return int64(len(removed))
 }
+
+// PopMin removes and returns at most count members with the lowest scores, by ascending order
+func (s *SortedSet) PopMin(count int64) []*Element {
+	if count > s.Len() {
+		count = s.Len()
+	}
+	elements := s.Range(0, count, false)
+	s.RemoveByRank(0, count)
+	return elements
+}
+
+// PopMax removes and returns at most count members with the highest scores, by descending order
+func (s *SortedSet) PopMax(count int64) []*Element {
+	size := s.Len()
+	if count > size {
+		count = size
+	}
+	elements := s.Range(0, count, true)
+	s.RemoveByRank(size-count, size)
+	return elements
+}
+
+// RandomMembers randomly returns members of the given number, may contain duplicated members
+func (s *SortedSet) RandomMembers(limit int) []*Element {
+	size := s.Len()
+	if size == 0 {
+		return nil
+	}
+	var elements []*Element
+	if s.dict == nil {
+		elements = s.unpack()
+	}
+	result := make([]*Element, limit)
+	for i := range result {
+		rank := rand.Int63n(size)
+		if elements != nil {
+			result[i] = elements[rank]
+		} else {
+			result[i] = &s.skipList.getByRank(rank + 1).Element
+		}
+	}
+	return result
+}
+
+// RandomDistinctMembers randomly returns members of the given number, won't contain duplicated members
+func (s *SortedSet) RandomDistinctMembers(limit int) []*Element {
+	size := s.Len()
+	if int64(limit) >= size {
+		elements := s.Range(0, size, false)
+		rand.Shuffle(len(elements), func(i, j int) {
+			elements[i], elements[j] = elements[j], elements[i]
+		})
+		return elements
+	}
+	picked := make(map[int64]struct{}, limit)
+	result := make([]*Element, 0, limit)
+	for len(result) < limit {
+		rank := rand.Int63n(size)
+		if _, ok := picked[rank]; ok {
+			continue
+		}
+		picked[rank] = struct{}{}
+		result = append(result, s.Range(rank, rank+1, false)[0])
+	}
+	return result
+}
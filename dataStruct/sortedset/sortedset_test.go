@@ -0,0 +1,177 @@
+package sortedset
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func elementsToString(elements []*Element) string {
+	members := make([]string, 0, len(elements))
+	for _, element := range elements {
+		members = append(members, element.Member)
+	}
+	return strings.Join(members, ",")
+}
+
+// makeTestSortedSets makes sorted sets with the same members in both encodings
+func makeTestSortedSets(members map[string]float64) map[string]*SortedSet {
+	sets := map[string]*SortedSet{
+		"listpack": MakeCompact(128, 64),
+		"skiplist": MakeCompact(0, 0),
+	}
+	for _, s := range sets {
+		for member, score := range members {
+			s.Add(member, score)
+		}
+	}
+	return sets
+}
+
+func TestCompactSortedSet(t *testing.T) {
+	packed := MakeCompact(128, 64)
+	expected := make(map[string]float64)
+	for i := 0; i < 1000; i++ {
+		member := strconv.Itoa(rand.Intn(100))
+		if i%3 == 2 {
+			_, existed := expected[member]
+			if packed.Remove(member) != existed {
+				t.Fatalf("wrong result of remove %s", member)
+			}
+			delete(expected, member)
+			continue
+		}
+		score := float64(rand.Intn(50))
+		_, existed := expected[member]
+		if packed.Add(member, score) == existed {
+			t.Fatalf("wrong result of add %s", member)
+		}
+		expected[member] = score
+	}
+	if packed.Encoding() != "listpack" {
+		t.Fatal("expected listpack encoding")
+	}
+	if packed.Len() != int64(len(expected)) {
+		t.Fatalf("expected len %d, actual %d", len(expected), packed.Len())
+	}
+
+	sets := makeTestSortedSets(expected)
+	for _, desc := range []bool{false, true} {
+		actual := elementsToString(packed.Range(0, packed.Len(), desc))
+		if plain := elementsToString(sets["skiplist"].Range(0, packed.Len(), desc)); actual != plain {
+			t.Fatalf("expected %s, actual %s", plain, actual)
+		}
+	}
+	for member, score := range expected {
+		element, ok := packed.Get(member)
+		if !ok || element.Score != score {
+			t.Fatalf("wrong score of %s", member)
+		}
+		if rank := packed.GetRank(member, true); rank != sets["skiplist"].GetRank(member, true) {
+			t.Fatalf("wrong rank of %s: %d", member, rank)
+		}
+	}
+
+	// converts to skiplist once there are too many members or a member is too long
+	packed.Add(strings.Repeat("a", 65), 0)
+	if packed.Encoding() != "skiplist" {
+		t.Fatal("expected skiplist encoding after adding long member")
+	}
+	small := MakeCompact(2, 64)
+	for i := 0; i < 3; i++ {
+		small.Add(strconv.Itoa(i), float64(i))
+	}
+	if small.Encoding() != "skiplist" || small.Len() != 3 {
+		t.Fatal("expected skiplist encoding after adding too many members")
+	}
+}
+
+func TestRangeByScore(t *testing.T) {
+	sets := makeTestSortedSets(map[string]float64{"n": math.Inf(-1), "a": 1, "b": 2, "c": 3, "d": 4, "p": math.Inf(1)})
+	cases := []struct {
+		min      string
+		max      string
+		expected string
+	}{
+		{"-inf", "+inf", "n,a,b,c,d,p"},
+		{"2", "+inf", "b,c,d,p"},
+		{"(2", "inf", "c,d,p"},
+		{"(2", "(inf", "c,d"},
+		{"-inf", "3", "n,a,b,c"},
+		{"(-inf", "(3", "a,b"},
+		{"2", "3", "b,c"},
+		{"(2", "(3", ""},
+		{"3", "2", ""},
+		{"+inf", "-inf", ""},
+		{"+inf", "+inf", "p"},
+		{"(+inf", "+inf", ""},
+		{"-inf", "-inf", "n"},
+		{"5", "+inf", "p"},
+		{"5", "(+inf", ""},
+	}
+	for encoding, s := range sets {
+		for _, c := range cases {
+			min, _ := ParseScoreBorder(c.min)
+			max, _ := ParseScoreBorder(c.max)
+			if actual := elementsToString(s.RangeByScore(min, max, 0, -1, false)); actual != c.expected {
+				t.Errorf("%s range [%s, %s]: expected %s, actual %s", encoding, c.min, c.max, c.expected, actual)
+			}
+			if actual := s.Count(min, max); actual != int64(len(s.RangeByScore(min, max, 0, -1, false))) {
+				t.Errorf("%s count [%s, %s]: wrong count %d", encoding, c.min, c.max, actual)
+			}
+		}
+		min, _ := ParseScoreBorder("2")
+		max, _ := ParseScoreBorder("+inf")
+		if actual := elementsToString(s.RangeByScore(min, max, 1, 1, true)); actual != "d" {
+			t.Errorf("%s range with limit: expected d, actual %s", encoding, actual)
+		}
+		min, _ = ParseScoreBorder("+inf")
+		if removed := s.RemoveByScore(min, max); removed != 1 || s.Len() != 5 {
+			t.Errorf("%s remove by score: expected 1 removed, actual %d", encoding, removed)
+		}
+	}
+	if _, err := ParseScoreBorder("nan"); err == nil {
+		t.Error("expect error for nan border")
+	}
+}
+
+func TestRangeByLex(t *testing.T) {
+	sets := makeTestSortedSets(map[string]float64{"a": 0, "b": 0, "c": 0, "d": 0})
+	cases := []struct {
+		min      string
+		max      string
+		expected string
+	}{
+		{"-", "+", "a,b,c,d"},
+		{"[b", "+", "b,c,d"},
+		{"(b", "+", "c,d"},
+		{"-", "[c", "a,b,c"},
+		{"-", "(c", "a,b"},
+		{"[b", "[c", "b,c"},
+		{"(b", "(c", ""},
+		{"[c", "[b", ""},
+		{"+", "-", ""},
+	}
+	for encoding, s := range sets {
+		for _, c := range cases {
+			min, _ := ParseLexBorder(c.min)
+			max, _ := ParseLexBorder(c.max)
+			if actual := elementsToString(s.RangeByLex(min, max, 0, -1, false)); actual != c.expected {
+				t.Errorf("%s range [%s, %s]: expected %s, actual %s", encoding, c.min, c.max, c.expected, actual)
+			}
+			if actual := s.CountByLex(min, max); actual != int64(len(s.RangeByLex(min, max, 0, -1, false))) {
+				t.Errorf("%s count [%s, %s]: wrong count %d", encoding, c.min, c.max, actual)
+			}
+		}
+		min, _ := ParseLexBorder("[b")
+		max, _ := ParseLexBorder("+")
+		if removed := s.RemoveByLex(min, max); removed != 3 {
+			t.Errorf("%s remove by lex: expected 3, actual %d", encoding, removed)
+		}
+		if s.Len() != 1 {
+			t.Errorf("%s remove by lex: expected len 1, actual %d", encoding, s.Len())
+		}
+	}
+}
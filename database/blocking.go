@@ -0,0 +1,168 @@
+package database
+
+import (
+	"godis/interface/redis"
+	"godis/redis/protocol"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyWaiters wakes up clients of blocking commands once the keys they are waiting for were modified
+type keyWaiters struct {
+	// count is the number of waiting clients, so that notify skips locking while nobody is waiting
+	count int32
+	mu    sync.Mutex
+	// key -> signal channels of waiting clients
+	m map[string]map[chan struct{}]struct{}
+}
+
+func makeKeyWaiters() *keyWaiters {
+	return &keyWaiters{
+		m: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+func (w *keyWaiters) watch(keys []string, signal chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		signals, ok := w.m[key]
+		if !ok {
+			signals = make(map[chan struct{}]struct{})
+			w.m[key] = signals
+		}
+		signals[signal] = struct{}{}
+	}
+	atomic.AddInt32(&w.count, 1)
+}
+
+func (w *keyWaiters) unwatch(keys []string, signal chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		signals := w.m[key]
+		delete(signals, signal)
+		if len(signals) == 0 {
+			delete(w.m, key)
+		}
+	}
+	atomic.AddInt32(&w.count, -1)
+}
+
+// notify wakes up all clients waiting for the given keys, signal channels are buffered so notify never blocks
+func (w *keyWaiters) notify(keys []string) {
+	if atomic.LoadInt32(&w.count) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		for signal := range w.m[key] {
+			select {
+			case signal <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// notifyAll wakes up all waiting clients, e.g. after keys of db were swapped
+func (w *keyWaiters) notifyAll() {
+	if atomic.LoadInt32(&w.count) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, signals := range w.m {
+		for signal := range signals {
+			select {
+			case signal <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// ParseBlockingTimeout parses timeout in seconds of blocking commands, 0 means blocking forever
+func ParseBlockingTimeout(arg []byte) (time.Duration, protocol.ErrorReply) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, protocol.MakeErrReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, protocol.MakeErrReply("ERR timeout is negative")
+	}
+	if seconds > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, protocol.MakeErrReply("ERR timeout is out of range")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// getBlockingTimeout returns the timeout argument of blocking command
+func getBlockingTimeout(cmdName string, args [][]byte) []byte {
+	switch cmdName {
+	case "blmpop":
+		// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+		return args[0]
+	case "bzpopmin", "bzpopmax":
+		// BZPOPMIN key [key ...] timeout
+		return args[len(args)-1]
+	}
+	return nil
+}
+
+func isNullReply(reply redis.Reply) bool {
+	switch reply.(type) {
+	case *protocol.NullBulkReply, *protocol.NullMultiBulkReply:
+		return true
+	}
+	return false
+}
+
+// execBlocking executes blocking command, it retries the command once any of its keys was modified
+// until it gets something, timeout or the client disconnected.
+// The command itself never blocks, so it behaves as non-blocking within MULTI
+func (db *DB) execBlocking(c redis.Connection, cmdLine [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd := cmdTable[cmdName]
+	if !validateArity(cmd.arity, cmdLine) {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	timeout, errReply := ParseBlockingTimeout(getBlockingTimeout(cmdName, cmdLine[1:]))
+	if errReply != nil {
+		return errReply
+	}
+	keys, _ := cmd.prepare(cmdLine[1:])
+
+	// watch keys before the first try, so that modifications between tries are never missed
+	signal := make(chan struct{}, 1)
+	db.waiters.watch(keys, signal)
+	defer db.waiters.unwatch(keys, signal)
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var done <-chan struct{}
+	if c != nil {
+		done = c.Done()
+	}
+	for {
+		result := db.execNormalCommand(c, cmdLine)
+		if !isNullReply(result) {
+			return result
+		}
+		select {
+		case <-signal:
+		case <-deadline:
+			return protocol.MakeNullMultiBulkReply()
+		case <-done:
+			return protocol.MakeNullMultiBulkReply()
+		}
+	}
+}
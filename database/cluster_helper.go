@@ -2,7 +2,9 @@ package database
 
 import (
 	"godis/aof"
+	"godis/constant"
 	"godis/interface/redis"
+	"godis/lib/utils"
 	"godis/redis/parser"
 	"godis/redis/protocol"
 )
@@ -14,7 +16,7 @@ func execExistIn(db *DB, args [][]byte) redis.Reply {
 	var result [][]byte
 	for _, arg := range args {
 		key := string(arg)
-		_, exists := db.GetEntity(key)
+		_, exists := db.peekEntity(key)
 		if exists {
 			result = append(result, []byte(key))
 		}
@@ -25,60 +27,59 @@ func execExistIn(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
-// execDumpKey returns redis serialization protocol data of given key (see aof.EntityToCmd)
+// execDumpKey returns redis serialization protocol data of given key (see aof.EntityToCmds)
+// reply format: dumpCmd ttlCmd [cmd...], following commands restore ttl of hash fields
 func execDumpKey(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	entity, ok := db.GetEntity(key)
+	entity, ok := db.peekEntity(key)
 	if !ok {
 		return protocol.MakeEmptyMultiBulkReply()
 	}
-	dumpCmd := aof.EntityToCmd(key, entity)
-	ttlCmd := toTTLCmd(db, key)
-	resp := protocol.MakeMultiBulkReply([][]byte{
-		dumpCmd.ToBytes(),
-		ttlCmd.ToBytes(),
-	})
-	return resp
+	dumpCmds := aof.EntityToCmds(key, entity)
+	if len(dumpCmds) == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	result := make([][]byte, 0, len(dumpCmds)+1)
+	result = append(result, dumpCmds[0].ToBytes(), toTTLCmd(db, key).ToBytes())
+	for _, cmd := range dumpCmds[1:] {
+		result = append(result, cmd.ToBytes())
+	}
+	return protocol.MakeMultiBulkReply(result)
 }
 
 // execRenameFrom is exactly same as execDel, used for cluster.Rename
 func execRenameFrom(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	db.Remove(key)
+	db.addAof(utils.ToCmdLine3(constant.Del, args...))
 	return protocol.MakeOkReply()
 }
 
 // execRenameTo accepts result of execDumpKey and load the dumped key
-// args format: key dumpCmd ttlCmd
+// args format: key dumpCmd ttlCmd [cmd...]
 // execRenameTo may be partially successful, do not use it without transaction
 func execRenameTo(db *DB, args [][]byte) redis.Reply {
 	key := args[0]
-	dumpRawCmd, err := parser.ParseOne(args[1])
-	if err != nil {
-		return protocol.MakeErrReply("illegal dump cmd: " + err.Error())
-	}
-	dumpCmd, ok := dumpRawCmd.(*protocol.MultiBulkReply)
-	if !ok {
-		return protocol.MakeErrReply("dump cmd is not multi bulk reply")
-	}
-	dumpCmd.Args[1] = key // change key
-	ttlRawCmd, err := parser.ParseOne(args[2])
-	if err != nil {
-		return protocol.MakeErrReply("illegal ttl cmd: " + err.Error())
-	}
-	ttlCmd, ok := ttlRawCmd.(*protocol.MultiBulkReply)
-	if !ok {
-		return protocol.MakeErrReply("ttl cmd is not multi bulk reply")
+	cmdLines := make([]CmdLine, 0, len(args)-1)
+	for _, raw := range args[1:] {
+		cmd, err := parser.ParseOne(raw)
+		if err != nil {
+			return protocol.MakeErrReply("illegal dump cmd: " + err.Error())
+		}
+		cmdLine, ok := cmd.(*protocol.MultiBulkReply)
+		if !ok || len(cmdLine.Args) < 2 {
+			return protocol.MakeErrReply("dump cmd is not multi bulk reply")
+		}
+		cmdLine.Args[1] = key // change key
+		cmdLines = append(cmdLines, cmdLine.Args)
 	}
-	ttlCmd.Args[1] = key
 	db.Remove(string(key))
-	dumpResult := db.execWithLock(dumpCmd.Args)
-	if protocol.IsErrorReply(dumpResult) {
-		return dumpResult
-	}
-	ttlResult := db.execWithLock(ttlCmd.Args)
-	if protocol.IsErrorReply(ttlResult) {
-		return ttlResult
+	db.addAof(utils.ToCmdLine3(constant.Del, key))
+	for _, cmdLine := range cmdLines {
+		result := db.execWithLock(cmdLine)
+		if protocol.IsErrorReply(result) {
+			return result
+		}
 	}
 	return protocol.MakeOkReply()
 }
@@ -89,9 +90,11 @@ func execRenameNxTo(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("DumpKey", execDumpKey, writeAllKeys, undoDel, 2)
-	RegisterCommand("ExistIn", execExistIn, readAllKeys, nil, -1)
-	RegisterCommand("RenameFrom", execRenameFrom, readFirstKey, nil, 2)
-	RegisterCommand("RenameTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("RenameNxTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand("DumpKey", execDumpKey, writeAllKeys, undoDel, 2, flagWrite)
+	// SyncKey is read only version of DumpKey, used for full synchronization of replicas
+	RegisterCommand("SyncKey", execDumpKey, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("ExistIn", execExistIn, readAllKeys, nil, -1, flagReadOnly)
+	RegisterCommand("RenameFrom", execRenameFrom, writeFirstKey, rollbackFirstKey, 2, flagWrite)
+	RegisterCommand("RenameTo", execRenameTo, writeFirstKey, rollbackFirstKey, -4, flagWrite)
+	RegisterCommand("RenameNxTo", execRenameTo, writeFirstKey, rollbackFirstKey, -4, flagWrite)
 }
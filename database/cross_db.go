@@ -0,0 +1,173 @@
+package database
+
+import (
+	"godis/constant"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+	"strconv"
+	"time"
+)
+
+/*
+ * Commands below access keys of multiple databases, so they are executed by MultiDB instead of DB.
+ * Like SELECT, they are not allowed within multi since transaction is executed within one database.
+ */
+
+// isCopyAcrossDB returns true if COPY has DB option other than the selected database
+func isCopyAcrossDB(c redis.Connection, cmdLine [][]byte) bool {
+	if len(cmdLine) < 3 {
+		return false
+	}
+	dbIndex, _, errReply := ParseCopyArgs(cmdLine[1:])
+	// errors are reported by DB
+	return errReply == nil && dbIndex >= 0 && dbIndex != c.GetDBIndex()
+}
+
+func (m *MultiDB) execAcrossDB(c redis.Connection, cmdName string, cmdLine [][]byte) redis.Reply {
+	switch cmdName {
+	case constant.Move:
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return m.execMove(c, cmdLine[1:])
+	case constant.Copy:
+		return m.execCopyAcrossDB(c, cmdLine[1:])
+	case constant.SwapDB:
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return m.execSwapDB(c, cmdLine[1:])
+	}
+	return protocol.MakeErrReply("ERR unknown command '" + cmdName + "'")
+}
+
+// lockAcrossDB locks keys of two databases in order of db index, so that concurrent commands won't dead lock
+func lockAcrossDB(srcDB *DB, src string, destDB *DB, dest string) {
+	if srcDB.index < destDB.index {
+		srcDB.RWLocks([]string{src}, nil)
+		destDB.RWLocks([]string{dest}, nil)
+	} else {
+		destDB.RWLocks([]string{dest}, nil)
+		srcDB.RWLocks([]string{src}, nil)
+	}
+}
+
+func unlockAcrossDB(srcDB *DB, src string, destDB *DB, dest string) {
+	srcDB.RWUnLocks([]string{src}, nil)
+	destDB.RWUnLocks([]string{dest}, nil)
+}
+
+// execMove moves a key from the selected database to the given database
+// MOVE key db
+func (m *MultiDB) execMove(c redis.Connection, args [][]byte) redis.Reply {
+	dbIndex, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if dbIndex < 0 || dbIndex >= len(m.dbSet) || c.GetDBIndex() >= len(m.dbSet) {
+		return protocol.MakeErrReply("ERR DB index is out of range")
+	}
+	if dbIndex == c.GetDBIndex() {
+		return protocol.MakeErrReply("ERR source and destination objects are the same")
+	}
+	key := string(args[0])
+	srcDB, destDB := m.dbSet[c.GetDBIndex()], m.dbSet[dbIndex]
+	lockAcrossDB(srcDB, key, destDB, key)
+	defer unlockAcrossDB(srcDB, key, destDB, key)
+
+	entity, exists := srcDB.GetEntity(key)
+	if !exists {
+		return protocol.MakeIntReply(0)
+	}
+	if _, exists := destDB.peekEntity(key); exists {
+		return protocol.MakeIntReply(0)
+	}
+	rawTTL, hasTTL := srcDB.ttlMap.Get(key)
+	srcDB.Remove(key)
+	destDB.PutEntity(key, entity)
+	if hasTTL {
+		expireTime, _ := rawTTL.(time.Time)
+		destDB.Expire(key, expireTime)
+	}
+	srcDB.addAof(utils.ToCmdLine3(constant.Move, args...))
+	srcDB.addVersion(c, key)
+	destDB.addVersion(c, key)
+	return protocol.MakeIntReply(1)
+}
+
+// execCopyAcrossDB copies a key from the selected database to the database given by DB option
+func (m *MultiDB) execCopyAcrossDB(c redis.Connection, args [][]byte) redis.Reply {
+	dbIndex, replace, errReply := ParseCopyArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	if dbIndex >= len(m.dbSet) || c.GetDBIndex() >= len(m.dbSet) {
+		return protocol.MakeErrReply("ERR DB index is out of range")
+	}
+	src, dest := string(args[0]), string(args[1])
+	srcDB, destDB := m.dbSet[c.GetDBIndex()], m.dbSet[dbIndex]
+	lockAcrossDB(srcDB, src, destDB, dest)
+	defer unlockAcrossDB(srcDB, src, destDB, dest)
+
+	result := copyEntity(srcDB, src, destDB, dest, replace)
+	if intReply, ok := result.(*protocol.IntReply); ok && intReply.Code == 1 {
+		// COPY with DB option is replayed in the source database
+		srcDB.addAof(utils.ToCmdLine3(constant.Copy, args...))
+		destDB.addVersion(c, dest)
+	}
+	return result
+}
+
+// execSwapDB swaps data of two databases, clients selecting one database will see data of the other
+// SWAPDB index1 index2
+func (m *MultiDB) execSwapDB(c redis.Connection, args [][]byte) redis.Reply {
+	first, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid first DB index")
+	}
+	second, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid second DB index")
+	}
+	if first < 0 || first >= len(m.dbSet) || second < 0 || second >= len(m.dbSet) {
+		return protocol.MakeErrReply("ERR DB index is out of range")
+	}
+	if first != second {
+		m.swapDB(c, m.dbSet[first], m.dbSet[second])
+	}
+	cmdLine := utils.ToCmdLine3(constant.SwapDB, args...)
+	if m.aofHandler != nil {
+		m.aofHandler.AddAof(0, cmdLine)
+	}
+	if m.writeCallback != nil {
+		m.writeCallback(0, cmdLine)
+	}
+	return &protocol.OkReply{}
+}
+
+// swapDB exchanges keys of two databases, including their ttl and versions, in O(1)
+func (m *MultiDB) swapDB(c redis.Connection, db1 *DB, db2 *DB) {
+	if db1.index > db2.index {
+		db1, db2 = db2, db1
+	}
+	// wait for commands holding keys of both databases, in order of db index like lockAcrossDB
+	db1.swapMu.Lock()
+	db2.swapMu.Lock()
+	db1.data, db2.data = db2.data, db1.data
+	db1.ttlMap, db2.ttlMap = db2.ttlMap, db1.ttlMap
+	// versions are unique among databases, so that watched keys are changed after swapping
+	db1.versionMap, db2.versionMap = db2.versionMap, db1.versionMap
+	// scheduled expiration finds keys by keysRef
+	db1.keysRef, db2.keysRef = db2.keysRef, db1.keysRef
+	db1.keysRef.db.Store(db1)
+	db2.keysRef.db.Store(db2)
+	db2.swapMu.Unlock()
+	db1.swapMu.Unlock()
+
+	// all keys of both databases are changed
+	for _, db := range []*DB{db1, db2} {
+		db.keysChanged(c, nil)
+		db.waiters.notifyAll()
+	}
+}
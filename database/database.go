@@ -11,6 +11,7 @@ import (
 	"godis/lib/utils"
 	"godis/pubsub"
 	"godis/redis/protocol"
+	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -25,6 +26,13 @@ type MultiDB struct {
 	hub *pubsub.Hub
 	// handle aof persistence
 	aofHandler *aof.Handler
+	// notified when keys were modified
+	keysChanged database.KeysChangedCallback
+	// notified with commands modified data
+	writeCallback database.WriteCallback
+
+	// startupAllocated is the heap allocated after initialization, shown by MEMORY STATS
+	startupAllocated int64
 }
 
 func NewStandaloneServer() *MultiDB {
@@ -55,6 +63,9 @@ func NewStandaloneServer() *MultiDB {
 			}
 		}
 	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	mdb.startupAllocated = int64(ms.HeapAlloc)
 	return mdb
 }
 
@@ -64,6 +75,7 @@ func MakeBasicMultiDB() *MultiDB {
 	mdb.dbSet = make([]*DB, config.Properties.Databases)
 	for i := range mdb.dbSet {
 		mdb.dbSet[i] = makeBasicDB()
+		mdb.dbSet[i].index = i
 	}
 	return mdb
 }
@@ -111,6 +123,13 @@ func (m *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply
 			return protocol.MakeArgNumErrReply(constant.Select)
 		}
 		return execSelect(c, m, cmdLine[1:])
+	} else if cmdName == constant.Move || cmdName == constant.SwapDB || cmdName == constant.Copy && isCopyAcrossDB(c, cmdLine) {
+		if c != nil && c.InMultiState() {
+			return protocol.MakeErrReply("ERR " + cmdName + " across databases is not allowed within multi")
+		}
+		return m.execAcrossDB(c, cmdName, cmdLine)
+	} else if cmdName == constant.Memory && len(cmdLine) >= 2 && strings.ToLower(string(cmdLine[1])) != "usage" {
+		return m.execMemory(cmdLine[1:])
 	}
 	// TODO: support multi database transaction
 
@@ -128,6 +147,33 @@ func (m *MultiDB) AfterClientClose(c redis.Connection) {
 	pubsub.UnsubscribeAll(m.hub, c)
 }
 
+// SetKeysChangedCallback registers the callback fired whenever keys were modified
+func (m *MultiDB) SetKeysChangedCallback(callback database.KeysChangedCallback) {
+	m.keysChanged = callback
+	for _, db := range m.dbSet {
+		// avoid closure
+		singleDB := db
+		singleDB.keysChanged = func(c redis.Connection, keys []string) {
+			callback(c, singleDB.index, keys)
+		}
+	}
+}
+
+// SetWriteCallback registers the callback fired with every command modified data
+func (m *MultiDB) SetWriteCallback(callback database.WriteCallback) {
+	m.writeCallback = callback
+	for _, db := range m.dbSet {
+		// avoid closure
+		singleDB := db
+		singleDB.addAof = func(line CmdLine) {
+			if m.aofHandler != nil {
+				m.aofHandler.AddAof(singleDB.index, line)
+			}
+			callback(singleDB.index, line)
+		}
+	}
+}
+
 // Close shutdown database
 func (m *MultiDB) Close() {
 	if m.aofHandler != nil {
@@ -141,7 +187,10 @@ func (m *MultiDB) ExecWithLock(conn redis.Connection, cmdLine [][]byte) redis.Re
 		panic("ERR DB index is out of range")
 	}
 	db := m.dbSet[conn.GetDBIndex()]
-	return db.execWithLock(cmdLine)
+	result := db.execWithLock(cmdLine)
+	writeKeys, _ := GetRelatedKeys(cmdLine)
+	db.addVersion(conn, writeKeys...)
+	return result
 }
 
 // ExecMulti executes multi commands transaction Atomically and Isolated
@@ -193,9 +242,15 @@ func (m *MultiDB) flushAll() redis.Reply {
 	for _, db := range m.dbSet {
 		db.Flush()
 	}
+	if m.keysChanged != nil {
+		m.keysChanged(nil, -1, nil)
+	}
 	if m.aofHandler != nil {
 		m.aofHandler.AddAof(0, utils.ToCmdLine("FlushAll"))
 	}
+	if m.writeCallback != nil {
+		m.writeCallback(0, utils.ToCmdLine("FlushAll"))
+	}
 	return &protocol.OkReply{}
 }
 
@@ -2,35 +2,56 @@ package database
 
 import (
 	"github.com/shopspring/decimal"
+	"godis/config"
 	"godis/constant"
 	Dict "godis/dataStruct/dict"
 	"godis/interface/database"
 	"godis/interface/redis"
 	"godis/lib/utils"
+	"godis/lib/wildcard"
 	"godis/redis/protocol"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func (db *DB) getAsDict(key string) (Dict.Dict, protocol.ErrorReply) {
+// maxFieldExpireAt is the max unix time in milliseconds of field expiration, same as redis
+const maxFieldExpireAt = 1<<48 - 1
+
+// maxRandomCount limits number of repeatable random elements requested by a negative count,
+// since all of them are allocated before replying
+const maxRandomCount = 1 << 24
+
+// conditions of setting field ttl
+const (
+	fieldExpireAlways = iota
+	fieldExpireNX
+	fieldExpireXX
+	fieldExpireGT
+	fieldExpireLT
+)
+
+func (db *DB) getAsDict(key string) (*Dict.CompactDict, protocol.ErrorReply) {
 	entity, exists := db.GetEntity(key)
 	if !exists {
 		return nil, nil
 	}
-	dict, ok := entity.Data.(Dict.Dict)
+	dict, ok := entity.Data.(*Dict.CompactDict)
 	if !ok {
 		return nil, &protocol.WrongTypeErrReply{}
 	}
 	return dict, nil
 }
 
-func (db *DB) getOrInitDict(key string) (dict Dict.Dict, inited bool, errReply protocol.ErrorReply) {
+func (db *DB) getOrInitDict(key string) (dict *Dict.CompactDict, inited bool, errReply protocol.ErrorReply) {
 	dict, errReply = db.getAsDict(key)
 	if errReply != nil {
 		return nil, false, errReply
 	}
 	inited = false
 	if dict == nil {
-		dict = Dict.MakeSimple()
+		dict = Dict.MakeCompact(config.Properties.HashMaxListpackEntries, config.Properties.HashMaxListpackValue)
 		db.PutEntity(key, &database.DataEntity{
 			Data: dict,
 		})
@@ -53,6 +74,7 @@ func execHSet(db *DB, args [][]byte) redis.Reply {
 	}
 
 	result := dict.Put(field, value)
+	dict.Persist(field)
 	db.addAof(utils.ToCmdLine3(constant.HSet, args...))
 	return protocol.MakeIntReply(int64(result))
 }
@@ -212,6 +234,7 @@ func execHMSet(db *DB, args [][]byte) redis.Reply {
 	for i, field := range fields {
 		value := values[i]
 		dict.Put(field, value)
+		dict.Persist(field)
 	}
 	db.addAof(utils.ToCmdLine3(constant.HMSet, args...))
 	return &protocol.OkReply{}
@@ -386,6 +409,7 @@ func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
 	value, exists := dict.Get(field)
 	if !exists {
 		dict.Put(field, args[2])
+		db.addAof(utils.ToCmdLine3(constant.HIncrByFloat, args...))
 		return protocol.MakeBulkReply(args[2])
 	}
 	val, err := decimal.NewFromString(string(value.([]byte)))
@@ -399,19 +423,461 @@ func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeBulkReply(resultBytes)
 }
 
+// execHStrLen returns the string length of the value of a hash field
+func execHStrLen(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	field := string(args[1])
+
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	if dict == nil {
+		return protocol.MakeIntReply(0)
+	}
+	raw, exists := dict.Get(field)
+	if !exists {
+		return protocol.MakeIntReply(0)
+	}
+	value, _ := raw.([]byte)
+	return protocol.MakeIntReply(int64(len(value)))
+}
+
+// execHRandField returns random fields of hash, fields may be repeated if count is negative
+func execHRandField(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	if len(args) > 3 {
+		return &protocol.SyntaxErrReply{}
+	}
+	withValues := false
+	if len(args) == 3 {
+		if strings.ToLower(string(args[2])) != "withvalues" {
+			return &protocol.SyntaxErrReply{}
+		}
+		withValues = true
+	}
+	var count int64
+	if len(args) >= 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if withValues && (count > math.MaxInt64/2 || count < -math.MaxInt64/2) || count < -maxRandomCount {
+			return protocol.MakeErrReply("ERR value is out of range")
+		}
+	}
+
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 1 {
+		if dict == nil {
+			return &protocol.NullBulkReply{}
+		}
+		fields := dict.RandomKeys(1)
+		if len(fields) == 0 {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(fields[0]))
+	}
+	if dict == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+
+	var fields []string
+	if count > 0 {
+		fields = dict.RandomDistinctKeys(int(count))
+	} else {
+		fields = dict.RandomKeys(int(-count))
+	}
+	result := make([][]byte, 0, len(fields)*2)
+	for _, field := range fields {
+		result = append(result, []byte(field))
+		if withValues {
+			raw, _ := dict.Get(field)
+			value, _ := raw.([]byte)
+			result = append(result, value)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execHScan iterates fields of hash
+func execHScan(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	cursor, err := strconv.Atoi(string(args[1]))
+	if err != nil || cursor < 0 {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	count := 10
+	var pattern *wildcard.Pattern
+	noValues := false
+	for i := 2; i < len(args); i++ {
+		arg := strings.ToLower(string(args[i]))
+		if arg == "novalues" {
+			noValues = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return &protocol.SyntaxErrReply{}
+		}
+		value := string(args[i+1])
+		i++
+		switch arg {
+		case "match":
+			pattern = wildcard.CompilePattern(value)
+		case "count":
+			count, err = strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return &protocol.SyntaxErrReply{}
+			}
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	var fields []string
+	nextCursor := 0
+	if dict != nil {
+		fields, nextCursor = dict.Scan(cursor, count)
+	}
+	result := make([][]byte, 0, len(fields)*2)
+	for _, field := range fields {
+		if pattern != nil && !pattern.IsMatch(field) {
+			continue
+		}
+		result = append(result, []byte(field))
+		if !noValues {
+			raw, _ := dict.Get(field)
+			value, _ := raw.([]byte)
+			result = append(result, value)
+		}
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.Itoa(nextCursor))),
+		protocol.MakeMultiBulkReply(result),
+	})
+}
+
+/* ---- field ttl ---- */
+
+func makeIntsReply(values []int64) redis.Reply {
+	replies := make([]redis.Reply, len(values))
+	for i, value := range values {
+		replies[i] = protocol.MakeIntReply(value)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// parseHashFields parses `FIELDS numfields field [field ...]` at the tail of args
+func parseHashFields(args [][]byte) ([]string, protocol.ErrorReply) {
+	if len(args) < 2 || strings.ToLower(string(args[0])) != "fields" {
+		return nil, protocol.MakeErrReply("ERR Mandatory argument FIELDS is missing or not at the right position")
+	}
+	numFields, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || numFields <= 0 {
+		return nil, protocol.MakeErrReply("ERR Parameter `numFields` should be greater than 0")
+	}
+	if numFields != int64(len(args)-2) {
+		return nil, protocol.MakeErrReply("ERR The `numfields` parameter must match the number of arguments")
+	}
+	fields := make([]string, numFields)
+	for i, arg := range args[2:] {
+		fields[i] = string(arg)
+	}
+	return fields, nil
+}
+
+// parseFieldExpireTime parses expiration time of HEXPIRE family, unit is time.Second or time.Millisecond
+func parseFieldExpireTime(arg []byte, unit time.Duration, absolute bool, cmdName string) (time.Time, protocol.ErrorReply) {
+	val, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if val < 0 {
+		return time.Time{}, protocol.MakeErrReply("ERR invalid expire time, must be >= 0")
+	}
+	invalid := protocol.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+	if unit == time.Second {
+		if val > maxFieldExpireAt/1000 {
+			return time.Time{}, invalid
+		}
+		val *= 1000
+	}
+	if !absolute {
+		now := time.Now().UnixNano() / 1e6
+		if val > maxFieldExpireAt-now {
+			return time.Time{}, invalid
+		}
+		val += now
+	}
+	if val > maxFieldExpireAt {
+		return time.Time{}, invalid
+	}
+	return time.Unix(0, val*int64(time.Millisecond)), nil
+}
+
+// parseFieldExpireArgs parses `key time [NX | XX | GT | LT] FIELDS numfields field [field ...]`
+func parseFieldExpireArgs(args [][]byte, unit time.Duration, absolute bool, cmdName string) (
+	expireTime time.Time, condition int, fields []string, errReply protocol.ErrorReply) {
+	expireTime, errReply = parseFieldExpireTime(args[1], unit, absolute, cmdName)
+	if errReply != nil {
+		return
+	}
+	condition = fieldExpireAlways
+	rest := args[2:]
+	if len(rest) > 0 {
+		switch strings.ToLower(string(rest[0])) {
+		case "nx":
+			condition = fieldExpireNX
+		case "xx":
+			condition = fieldExpireXX
+		case "gt":
+			condition = fieldExpireGT
+		case "lt":
+			condition = fieldExpireLT
+		}
+		if condition != fieldExpireAlways {
+			rest = rest[1:]
+		}
+	}
+	fields, errReply = parseHashFields(rest)
+	return
+}
+
+func makeFieldExpireFunc(unit time.Duration, absolute bool, cmdName string) ExecFunc {
+	return func(db *DB, args [][]byte) redis.Reply {
+		expireTime, condition, fields, errReply := parseFieldExpireArgs(args, unit, absolute, cmdName)
+		if errReply != nil {
+			return errReply
+		}
+		return db.expireHashFields(string(args[0]), expireTime, condition, fields)
+	}
+}
+
+// expireHashFields sets ttl of fields, replies for each field:
+// -2 if field not exists, 0 if condition not met, 1 if ttl was set, 2 if field was deleted since expireTime has passed
+func (db *DB) expireHashFields(key string, expireTime time.Time, condition int, fields []string) redis.Reply {
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]int64, len(fields))
+	if dict == nil {
+		for i := range result {
+			result[i] = -2
+		}
+		return makeIntsReply(result)
+	}
+	var expired, updated []string
+	for i, field := range fields {
+		if _, exists := dict.Get(field); !exists {
+			result[i] = -2
+			continue
+		}
+		current, hasTTL := dict.ExpireTime(field)
+		skip := false
+		switch condition {
+		case fieldExpireNX:
+			skip = hasTTL
+		case fieldExpireXX:
+			skip = !hasTTL
+		case fieldExpireGT:
+			skip = !hasTTL || !expireTime.After(current)
+		case fieldExpireLT:
+			skip = hasTTL && !expireTime.Before(current)
+		}
+		if skip {
+			result[i] = 0
+			continue
+		}
+		if !time.Now().Before(expireTime) {
+			dict.Remove(field)
+			expired = append(expired, field)
+			result[i] = 2
+			continue
+		}
+		dict.Expire(field, expireTime)
+		updated = append(updated, field)
+		result[i] = 1
+	}
+	if len(expired) > 0 {
+		db.addAof(utils.ToCmdLine2(constant.HDel, append([]string{key}, expired...)...))
+		if dict.Len() == 0 {
+			db.Remove(key)
+			return makeIntsReply(result)
+		}
+	}
+	if len(updated) > 0 {
+		expireAt := strconv.FormatInt(expireTime.UnixNano()/1e6, 10)
+		cmdLine := utils.ToCmdLine(constant.HPExpireAt, key, expireAt, "FIELDS", strconv.Itoa(len(updated)))
+		db.addAof(append(cmdLine, utils.ToCmdLine(updated...)...))
+	}
+	db.expireFields(key, dict)
+	return makeIntsReply(result)
+}
+
+func undoFieldsAt(offset int) UndoFunc {
+	return func(db *DB, args [][]byte) []CmdLine {
+		key := string(args[0])
+		fields, errReply := parseHashFields(args[offset:])
+		if errReply != nil {
+			return nil
+		}
+		return rollbackHashFields(db, key, fields...)
+	}
+}
+
+// undoFieldExpire rolls back fields of HEXPIRE family whose condition option is optional
+func undoFieldExpire(db *DB, args [][]byte) []CmdLine {
+	offset := 2
+	if len(args) > offset && strings.ToLower(string(args[offset])) != "fields" {
+		offset++
+	}
+	return undoFieldsAt(offset)(db, args)
+}
+
+func makeFieldTTLFunc(unit time.Duration, absolute bool) ExecFunc {
+	return func(db *DB, args [][]byte) redis.Reply {
+		fields, errReply := parseHashFields(args[1:])
+		if errReply != nil {
+			return errReply
+		}
+		dict, errReply := db.getAsDict(string(args[0]))
+		if errReply != nil {
+			return errReply
+		}
+		result := make([]int64, len(fields))
+		for i, field := range fields {
+			if dict == nil {
+				result[i] = -2
+				continue
+			}
+			if _, exists := dict.Get(field); !exists {
+				result[i] = -2
+				continue
+			}
+			expireTime, ok := dict.ExpireTime(field)
+			if !ok {
+				result[i] = -1
+				continue
+			}
+			if absolute {
+				result[i] = expireTime.UnixNano() / int64(unit)
+			} else {
+				result[i] = int64(expireTime.Sub(time.Now()) / unit)
+			}
+		}
+		return makeIntsReply(result)
+	}
+}
+
+// execHPersist removes ttl of fields, replies for each field: -2 if field not exists, -1 if field has no ttl, 1 if ttl was removed
+func execHPersist(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	fields, errReply := parseHashFields(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]int64, len(fields))
+	var persisted []string
+	for i, field := range fields {
+		if dict == nil {
+			result[i] = -2
+			continue
+		}
+		if _, exists := dict.Get(field); !exists {
+			result[i] = -2
+			continue
+		}
+		if !dict.Persist(field) {
+			result[i] = -1
+			continue
+		}
+		persisted = append(persisted, field)
+		result[i] = 1
+	}
+	if len(persisted) > 0 {
+		cmdLine := utils.ToCmdLine(constant.HPersist, key, "FIELDS", strconv.Itoa(len(persisted)))
+		db.addAof(append(cmdLine, utils.ToCmdLine(persisted...)...))
+		db.expireFields(key, dict)
+	}
+	return makeIntsReply(result)
+}
+
+// execHGetDel returns values of fields and deletes them, the key is deleted if no field left
+func execHGetDel(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	fields, errReply := parseHashFields(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, len(fields))
+	if dict == nil {
+		return protocol.MakeMultiBulkReply(result)
+	}
+	var deleted []string
+	for i, field := range fields {
+		raw, exists := dict.Get(field)
+		if !exists {
+			continue
+		}
+		result[i], _ = raw.([]byte)
+		dict.Remove(field)
+		deleted = append(deleted, field)
+	}
+	if len(deleted) > 0 {
+		db.addAof(utils.ToCmdLine2(constant.HDel, append([]string{key}, deleted...)...))
+		if dict.Len() == 0 {
+			db.Remove(key)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
 func init() {
-	RegisterCommand(constant.HSet, execHSet, writeFirstKey, undoHSet, 4)
-	RegisterCommand(constant.HSetNx, execHSetNX, writeFirstKey, undoHSet, 4)
-	RegisterCommand(constant.HGet, execHGet, readFirstKey, nil, 3)
-	RegisterCommand(constant.HExists, execHExists, readFirstKey, nil, 3)
-	RegisterCommand(constant.HDel, execHDel, writeFirstKey, undoHDel, -3)
-	RegisterCommand(constant.HLen, execHLen, readFirstKey, nil, 2)
-	RegisterCommand(constant.HMSet, execHMSet, writeFirstKey, undoHMSet, -4)
-	RegisterCommand(constant.HMGet, execHMGet, readFirstKey, nil, -3)
-	RegisterCommand(constant.HGet, execHGet, readFirstKey, nil, -3)
-	RegisterCommand(constant.HKeys, execHKeys, readFirstKey, nil, 2)
-	RegisterCommand(constant.HVals, execHVals, readFirstKey, nil, 2)
-	RegisterCommand(constant.HGetAll, execHGetAll, readFirstKey, nil, 2)
-	RegisterCommand(constant.HIncrBy, execHIncrBy, writeFirstKey, undoHIncr, 4)
-	RegisterCommand(constant.HIncrByFloat, execHIncrByFloat, writeFirstKey, undoHIncr, 4)
+	RegisterCommand(constant.HSet, execHSet, writeFirstKey, undoHSet, 4, flagWrite)
+	RegisterCommand(constant.HSetNx, execHSetNX, writeFirstKey, undoHSet, 4, flagWrite)
+	RegisterCommand(constant.HGet, execHGet, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.HExists, execHExists, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.HDel, execHDel, writeFirstKey, undoHDel, -3, flagWrite)
+	RegisterCommand(constant.HLen, execHLen, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.HMSet, execHMSet, writeFirstKey, undoHMSet, -4, flagWrite)
+	RegisterCommand(constant.HMGet, execHMGet, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand(constant.HGet, execHGet, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand(constant.HKeys, execHKeys, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.HVals, execHVals, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.HGetAll, execHGetAll, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.HIncrBy, execHIncrBy, writeFirstKey, undoHIncr, 4, flagWrite)
+	RegisterCommand(constant.HIncrByFloat, execHIncrByFloat, writeFirstKey, undoHIncr, 4, flagWrite)
+	RegisterCommand(constant.HStrLen, execHStrLen, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.HRandField, execHRandField, readFirstKey, nil, -2, flagReadOnly)
+	RegisterCommand(constant.HScan, execHScan, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand(constant.HExpire, makeFieldExpireFunc(time.Second, false, constant.HExpire), writeFirstKey, undoFieldExpire, -6, flagWrite)
+	RegisterCommand(constant.HPExpire, makeFieldExpireFunc(time.Millisecond, false, constant.HPExpire), writeFirstKey, undoFieldExpire, -6, flagWrite)
+	RegisterCommand(constant.HExpireAt, makeFieldExpireFunc(time.Second, true, constant.HExpireAt), writeFirstKey, undoFieldExpire, -6, flagWrite)
+	RegisterCommand(constant.HPExpireAt, makeFieldExpireFunc(time.Millisecond, true, constant.HPExpireAt), writeFirstKey, undoFieldExpire, -6, flagWrite)
+	RegisterCommand(constant.HTTL, makeFieldTTLFunc(time.Second, false), readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand(constant.HPTTL, makeFieldTTLFunc(time.Millisecond, false), readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand(constant.HExpireTime, makeFieldTTLFunc(time.Second, true), readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand(constant.HPExpireTime, makeFieldTTLFunc(time.Millisecond, true), readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand(constant.HPersist, execHPersist, writeFirstKey, undoFieldsAt(1), -5, flagWrite)
+	RegisterCommand(constant.HGetDel, execHGetDel, writeFirstKey, undoFieldsAt(1), -5, flagWrite)
 }
@@ -7,29 +7,40 @@ import (
 	"godis/dataStruct/list"
 	"godis/dataStruct/set"
 	"godis/dataStruct/sortedset"
+	"godis/interface/database"
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/lib/wildcard"
+	"godis/rdb"
 	"godis/redis/protocol"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func init() {
-	RegisterCommand(constant.Del, execDel, writeAllKeys, undoDel, -2)
-	RegisterCommand(constant.Expire, execExpire, writeFirstKey, undoExpire, 3)
-	RegisterCommand(constant.ExpireAt, execExpireAt, writeFirstKey, undoExpire, 3)
-	RegisterCommand(constant.PExpire, execPExpire, writeFirstKey, undoExpire, 3)
-	RegisterCommand(constant.PExpireAt, execPExpireAt, writeFirstKey, undoExpire, 3)
-	RegisterCommand(constant.Ttl, execTTL, readFirstKey, nil, 2)
-	RegisterCommand(constant.PTtl, execPTTL, readFirstKey, nil, 2)
-	RegisterCommand(constant.Persist, execPersist, writeFirstKey, undoExpire, 2)
-	RegisterCommand(constant.Exists, execExists, readAllKeys, nil, -2)
-	RegisterCommand(constant.Type, execType, readFirstKey, nil, 2)
-	RegisterCommand(constant.Rename, execRename, prepareRename, undoRename, 3)
-	RegisterCommand(constant.RenameNx, execRenameNx, prepareRename, undoRename, 3)
-	RegisterCommand(constant.FlushDb, execFlushDB, noPrepare, nil, -1)
-	RegisterCommand(constant.Keys, execKeys, noPrepare, nil, 2)
+	RegisterCommand(constant.Del, execDel, writeAllKeys, undoDel, -2, flagWrite)
+	RegisterCommand(constant.Expire, execExpire, writeFirstKey, undoExpire, 3, flagWrite)
+	RegisterCommand(constant.ExpireAt, execExpireAt, writeFirstKey, undoExpire, 3, flagWrite)
+	RegisterCommand(constant.PExpire, execPExpire, writeFirstKey, undoExpire, 3, flagWrite)
+	RegisterCommand(constant.PExpireAt, execPExpireAt, writeFirstKey, undoExpire, 3, flagWrite)
+	RegisterCommand(constant.Ttl, execTTL, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.PTtl, execPTTL, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.Persist, execPersist, writeFirstKey, undoExpire, 2, flagWrite)
+	RegisterCommand(constant.Exists, execExists, readAllKeys, nil, -2, flagReadOnly)
+	RegisterCommand(constant.Type, execType, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.Rename, execRename, prepareRename, undoRename, 3, flagWrite)
+	RegisterCommand(constant.RenameNx, execRenameNx, prepareRename, undoRename, 3, flagWrite)
+	RegisterCommand(constant.FlushDb, execFlushDB, noPrepare, nil, -1, flagWrite)
+	RegisterCommand(constant.Keys, execKeys, noPrepare, nil, 2, flagReadOnly)
+	RegisterCommand(constant.Scan, execScan, noPrepare, nil, -2, flagReadOnly)
+	RegisterCommand(constant.DBSize, execDBSize, noPrepare, nil, 1, flagReadOnly)
+	RegisterCommand(constant.RandomKey, execRandomKey, noPrepare, nil, 1, flagReadOnly)
+	RegisterCommand(constant.Unlink, execUnlink, writeAllKeys, undoDel, -2, flagWrite)
+	RegisterCommand(constant.Touch, execTouch, readAllKeys, nil, -2, flagReadOnly)
+	RegisterCommand(constant.Dump, execDump, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.Restore, execRestore, writeFirstKey, rollbackFirstKey, -4, flagWrite)
+	RegisterCommand(constant.Copy, execCopy, prepareCopy, undoCopy, -3, flagWrite)
 }
 
 // execDel removes a key from db
@@ -46,6 +57,20 @@ func execDel(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(deleted))
 }
 
+// execUnlink removes keys like DEL, values are reclaimed by garbage collector in background anyway
+func execUnlink(db *DB, args [][]byte) redis.Reply {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+
+	deleted := db.Removes(keys...)
+	if deleted > 0 {
+		db.addAof(utils.ToCmdLine3(constant.Unlink, args...))
+	}
+	return protocol.MakeIntReply(int64(deleted))
+}
+
 func undoDel(db *DB, args [][]byte) []CmdLine {
 	keys := make([]string, len(args))
 	for i, v := range args {
@@ -59,7 +84,7 @@ func execExists(db *DB, args [][]byte) redis.Reply {
 	result := int64(0)
 	for _, arg := range args {
 		key := string(arg)
-		_, exists := db.GetEntity(key)
+		_, exists := db.peekEntity(key)
 		if exists {
 			result++
 		}
@@ -67,9 +92,21 @@ func execExists(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(result)
 }
 
+// execTouch updates access time of keys, returns the number of existing keys
+func execTouch(db *DB, args [][]byte) redis.Reply {
+	result := int64(0)
+	for _, arg := range args {
+		if _, exists := db.GetEntity(string(arg)); exists {
+			result++
+		}
+	}
+	return protocol.MakeIntReply(result)
+}
+
 // execFlushDB removes all keys from current db
 func execFlushDB(db *DB, args [][]byte) redis.Reply {
 	db.Flush()
+	db.notifyFlushed()
 	db.addAof(utils.ToCmdLine3(constant.FlushDb, args...))
 	return &protocol.OkReply{}
 }
@@ -77,23 +114,32 @@ func execFlushDB(db *DB, args [][]byte) redis.Reply {
 // execType returns the type of entity, include string, list, hash, set, and zset
 func execType(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	entity, exists := db.GetEntity(key)
+	entity, exists := db.peekEntity(key)
 	if !exists {
 		return protocol.MakeStatusReply("none")
 	}
+	typeName := getTypeName(entity)
+	if typeName == "" {
+		return &protocol.UnknownErrReply{}
+	}
+	return protocol.MakeStatusReply(typeName)
+}
+
+// getTypeName returns type of entity shown by TYPE command, returns "" if unknown
+func getTypeName(entity *database.DataEntity) string {
 	switch entity.Data.(type) {
 	case []byte:
-		return protocol.MakeStatusReply("string")
-	case *list.LinkedList:
-		return protocol.MakeStatusReply("list")
+		return "string"
+	case *list.QuickList:
+		return "list"
 	case dict.Dict:
-		return protocol.MakeStatusReply("hash")
+		return "hash"
 	case *set.Set:
-		return protocol.MakeStatusReply("set")
+		return "set"
 	case *sortedset.SortedSet:
-		return protocol.MakeStatusReply("zset")
+		return "zset"
 	default:
-		return &protocol.UnknownErrReply{}
+		return ""
 	}
 }
 
@@ -246,7 +292,7 @@ func execPExpireAt(db *DB, args [][]byte) redis.Reply {
 
 func execTTL(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	_, exists := db.GetEntity(key)
+	_, exists := db.peekEntity(key)
 	if !exists {
 		return protocol.MakeIntReply(-2)
 	}
@@ -262,7 +308,7 @@ func execTTL(db *DB, args [][]byte) redis.Reply {
 
 func execPTTL(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	_, exists := db.GetEntity(key)
+	_, exists := db.peekEntity(key)
 	if !exists {
 		return protocol.MakeIntReply(-2)
 	}
@@ -305,6 +351,257 @@ func execKeys(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
+// execScan iterates keys in database
+// args: cursor [MATCH pattern] [COUNT count] [TYPE type]
+// returns next cursor and keys, the iteration is finished once next cursor is 0
+func execScan(db *DB, args [][]byte) redis.Reply {
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	count := 10
+	var pattern *wildcard.Pattern
+	typeName := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return &protocol.SyntaxErrReply{}
+		}
+		arg := strings.ToLower(string(args[i]))
+		value := string(args[i+1])
+		switch arg {
+		case "match":
+			pattern = wildcard.CompilePattern(value)
+		case "count":
+			count, err = strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return &protocol.SyntaxErrReply{}
+			}
+		case "type":
+			typeName = strings.ToLower(value)
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+	keys, nextCursor := db.data.Scan(cursor, count)
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if pattern != nil && !pattern.IsMatch(key) {
+			continue
+		}
+		entity, exists := db.peekEntity(key)
+		if !exists {
+			// expired or removed
+			continue
+		}
+		if typeName != "" && getTypeName(entity) != typeName {
+			continue
+		}
+		result = append(result, []byte(key))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.Itoa(nextCursor))),
+		protocol.MakeMultiBulkReply(result),
+	})
+}
+
+// execDBSize returns count of keys in database
+func execDBSize(db *DB, args [][]byte) redis.Reply {
+	return protocol.MakeIntReply(int64(db.data.Len()))
+}
+
+// execRandomKey returns a random key, or nil if database is empty
+func execRandomKey(db *DB, args [][]byte) redis.Reply {
+	// retry a few times since the picked key may be expired
+	for i := 0; i < 10 && db.data.Len() > 0; i++ {
+		keys := db.data.RandomKeys(1)
+		if len(keys) == 0 {
+			break
+		}
+		if _, exists := db.peekEntity(keys[0]); exists {
+			return protocol.MakeBulkReply([]byte(keys[0]))
+		}
+	}
+	return &protocol.NullBulkReply{}
+}
+
+// execDump returns value of key serialized in rdb format
+func execDump(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return &protocol.NullBulkReply{}
+	}
+	payload := rdb.Dump(entity)
+	if payload == nil {
+		return &protocol.UnknownErrReply{}
+	}
+	return protocol.MakeBulkReply(payload)
+}
+
+// execRestore creates a key from payload of DUMP
+// RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func execRestore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	idleTime, freq := int64(-1), int64(-1)
+	for i := 3; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "REPLACE":
+			replace = true
+		case arg == "ABSTTL":
+			absTTL = true
+		case arg == "IDLETIME" && i+1 < len(args) && freq < 0:
+			idleTime, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if idleTime < 0 {
+				return protocol.MakeErrReply("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			i++
+		case arg == "FREQ" && i+1 < len(args) && idleTime < 0:
+			freq, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > lfuMaxVal {
+				return protocol.MakeErrReply("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			i++
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return protocol.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	entity, err := rdb.Restore(args[2])
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.Unix(0, ttl*int64(time.Millisecond))
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if !expireAt.After(time.Now()) {
+			// key is expired already
+			if db.Removes(key) > 0 {
+				db.addAof(utils.ToCmdLine(constant.Del, key))
+			}
+			return &protocol.OkReply{}
+		}
+	}
+	now := time.Now()
+	if idleTime > 0 {
+		now = now.Add(-time.Duration(idleTime) * time.Second)
+	}
+	entity.AccessTime = now.UnixNano() / int64(time.Millisecond)
+	entity.LFU = lfuMinutes(time.Now())<<8 | lfuInitVal
+	if freq >= 0 {
+		entity.LFU = lfuMinutes(time.Now())<<8 | uint32(freq)
+	}
+	db.Remove(key)
+	db.PutEntity(key, entity)
+	absTTLArg := "0"
+	if ttl > 0 {
+		db.Expire(key, expireAt)
+		absTTLArg = strconv.FormatInt(expireAt.UnixNano()/int64(time.Millisecond), 10)
+	}
+	db.addAof(utils.ToCmdLine3(constant.Restore, []byte(key), []byte(absTTLArg), args[2], []byte("REPLACE"), []byte("ABSTTL")))
+	return &protocol.OkReply{}
+}
+
+// ParseCopyArgs parses options of COPY source destination [DB destination-db] [REPLACE],
+// dbIndex is -1 if DB option is absent
+func ParseCopyArgs(args [][]byte) (dbIndex int, replace bool, errReply redis.Reply) {
+	dbIndex = -1
+	for i := 2; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		if arg == "REPLACE" {
+			replace = true
+		} else if arg == "DB" && i+1 < len(args) {
+			index, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return 0, false, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if index < 0 {
+				return 0, false, protocol.MakeErrReply("ERR DB index is out of range")
+			}
+			dbIndex = index
+			i++
+		} else {
+			return 0, false, protocol.MakeSyntaxErrReply()
+		}
+	}
+	return dbIndex, replace, nil
+}
+
+func prepareCopy(args [][]byte) ([]string, []string) {
+	return []string{string(args[1])}, []string{string(args[0])}
+}
+
+func undoCopy(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+// copyEntity copies value and ttl of src in srcDB to dest in destDB, returns 1 if copied
+func copyEntity(srcDB *DB, src string, destDB *DB, dest string, replace bool) redis.Reply {
+	entity, exists := srcDB.GetEntity(src)
+	if !exists {
+		return protocol.MakeIntReply(0)
+	}
+	if _, exists := destDB.peekEntity(dest); exists && !replace {
+		return protocol.MakeIntReply(0)
+	}
+	cloned := rdb.Clone(entity)
+	if cloned == nil {
+		return &protocol.UnknownErrReply{}
+	}
+	rawTTL, hasTTL := srcDB.ttlMap.Get(src)
+	destDB.Remove(dest)
+	destDB.PutEntity(dest, cloned)
+	if hasTTL {
+		expireTime, _ := rawTTL.(time.Time)
+		destDB.Expire(dest, expireTime)
+	}
+	return protocol.MakeIntReply(1)
+}
+
+// execCopy copies a key within db, copying to another db is handled by MultiDB
+func execCopy(db *DB, args [][]byte) redis.Reply {
+	dbIndex, replace, errReply := ParseCopyArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	if dbIndex >= 0 && dbIndex != db.index {
+		return protocol.MakeErrReply("ERR COPY to another database is not allowed within multi")
+	}
+	src, dest := string(args[0]), string(args[1])
+	if src == dest {
+		return protocol.MakeErrReply("ERR source and destination objects are the same")
+	}
+	result := copyEntity(db, src, db, dest, replace)
+	if intReply, ok := result.(*protocol.IntReply); ok && intReply.Code == 1 {
+		db.addAof(utils.ToCmdLine3(constant.Copy, args...))
+	}
+	return result
+}
+
 func toTTLCmd(db *DB, key string) *protocol.MultiBulkReply {
 	raw, exists := db.ttlMap.Get(key)
 	if !exists {
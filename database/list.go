@@ -1,35 +1,39 @@
 package database
 
 import (
+	"bytes"
+	"godis/config"
 	"godis/constant"
 	List "godis/dataStruct/list"
 	"godis/interface/database"
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/redis/protocol"
+	"math"
 	"strconv"
+	"strings"
 )
 
-func (db *DB) getAsList(key string) (*List.LinkedList, protocol.ErrorReply) {
+func (db *DB) getAsList(key string) (*List.QuickList, protocol.ErrorReply) {
 	entity, ok := db.GetEntity(key)
 	if !ok {
 		return nil, nil
 	}
-	bytes, ok := entity.Data.(*List.LinkedList)
+	bytes, ok := entity.Data.(*List.QuickList)
 	if !ok {
 		return nil, &protocol.WrongTypeErrReply{}
 	}
 	return bytes, nil
 }
 
-func (db *DB) getOrInitList(key string) (list *List.LinkedList, isNew bool, errReply protocol.ErrorReply) {
+func (db *DB) getOrInitList(key string) (list *List.QuickList, isNew bool, errReply protocol.ErrorReply) {
 	list, errReply = db.getAsList(key)
 	if errReply != nil {
 		return nil, false, errReply
 	}
 	isNew = false
 	if list == nil {
-		list = &List.LinkedList{}
+		list = List.MakeQuickList(config.Properties.ListCompressDepth)
 		db.PutEntity(key, &database.DataEntity{
 			Data: list,
 		})
@@ -66,7 +70,7 @@ func execLIndex(db *DB, args [][]byte) redis.Reply {
 		return &protocol.NullBulkReply{}
 	}
 
-	val, _ := list.Get(index).([]byte)
+	val := list.Get(index)
 	return protocol.MakeBulkReply(val)
 }
 
@@ -87,32 +91,85 @@ func execLLen(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(size)
 }
 
-// execLPop removes the first element of list, and return it
-func execLPop(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	key := string(args[0])
+// parsePopCount parses the optional count argument of LPOP and RPOP, count is 1 if not given
+func parsePopCount(cmdName string, args [][]byte) (count int, hasCount bool, errReply protocol.ErrorReply) {
+	if len(args) > 2 {
+		return 0, false, protocol.MakeArgNumErrReply(cmdName)
+	}
+	if len(args) == 1 {
+		return 1, false, nil
+	}
+	count64, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || count64 < 0 {
+		return 0, false, protocol.MakeErrReply("ERR value is out of range, must be positive")
+	}
+	if count64 > math.MaxInt32 {
+		count64 = math.MaxInt32
+	}
+	return int(count64), true, nil
+}
 
-	// get data
+// popElements removes at most count elements from head or tail of list, elements are in popped order
+func popElements(list *List.QuickList, left bool, count int) [][]byte {
+	if count > list.Len() {
+		count = list.Len()
+	}
+	elements := make([][]byte, count)
+	for i := range elements {
+		if left {
+			elements[i] = list.Remove(0)
+		} else {
+			elements[i] = list.RemoveLast()
+		}
+	}
+	return elements
+}
+
+// execPop removes elements from head or tail of list, the reply is an array if count is given
+func execPop(db *DB, args [][]byte, left bool) redis.Reply {
+	cmdName := constant.RPop
+	if left {
+		cmdName = constant.LPop
+	}
+	count, hasCount, errReply := parsePopCount(cmdName, args)
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
 		return errReply
 	}
 	if list == nil {
+		if hasCount {
+			return protocol.MakeNullMultiBulkReply()
+		}
 		return &protocol.NullBulkReply{}
 	}
+	if count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
 
-	val, _ := list.Remove(0).([]byte)
+	elements := popElements(list, left, count)
 	if list.Len() == 0 {
 		db.Remove(key)
 	}
-	db.addAof(utils.ToCmdLine3(constant.LPop, args...))
-	return protocol.MakeBulkReply(val)
+	db.addAof(utils.ToCmdLine3(cmdName, args...))
+	if hasCount {
+		return protocol.MakeMultiBulkReply(elements)
+	}
+	return protocol.MakeBulkReply(elements[0])
+}
+
+// execLPop removes the first elements of list, and return them
+func execLPop(db *DB, args [][]byte) redis.Reply {
+	return execPop(db, args, true)
 }
 
 var lPushCmd = []byte(constant.LPush)
 
-func undoLPop(db *DB, args [][]byte) []CmdLine {
-	key := string(args[0])
+// rollbackListPop returns commands pushing back elements which will be popped from head or tail of list
+func rollbackListPop(db *DB, key string, left bool, count int) []CmdLine {
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
 		return nil
@@ -120,14 +177,28 @@ func undoLPop(db *DB, args [][]byte) []CmdLine {
 	if list == nil || list.Len() == 0 {
 		return nil
 	}
-	element, _ := list.Get(0).([]byte)
-	return []CmdLine{
-		{
-			lPushCmd,
-			args[0],
-			element,
-		},
+	if count > list.Len() {
+		count = list.Len()
+	}
+	if left {
+		// push elements reversely, so that the first popped element becomes head again
+		elements := list.Range(0, count)
+		cmdLine := CmdLine{lPushCmd, []byte(key)}
+		for i := len(elements) - 1; i >= 0; i-- {
+			cmdLine = append(cmdLine, elements[i])
+		}
+		return []CmdLine{cmdLine}
+	}
+	elements := list.Range(list.Len()-count, list.Len())
+	return []CmdLine{append(CmdLine{rPushCmd, []byte(key)}, elements...)}
+}
+
+func undoLPop(db *DB, args [][]byte) []CmdLine {
+	count, _, errReply := parsePopCount(constant.LPop, args)
+	if errReply != nil {
+		return nil
 	}
+	return rollbackListPop(db, string(args[0]), true, count)
 }
 
 // execLPush inserts element at head of list
@@ -230,12 +301,7 @@ func execLRange(db *DB, args [][]byte) redis.Reply {
 
 	// asserts: start in [0, size - 1], stop in [start, size]
 	slice := list.Range(start, stop)
-	result := make([][]byte, len(slice))
-	for i, raw := range slice {
-		bytes, _ := raw.([]byte)
-		result[i] = bytes
-	}
-	return protocol.MakeMultiBulkReply(result)
+	return protocol.MakeMultiBulkReply(slice)
 }
 
 // execLRem removes element of list at specified index
@@ -333,7 +399,7 @@ func undoLSet(db *DB, args [][]byte) []CmdLine {
 	} else if index >= size {
 		return nil
 	}
-	value, _ := list.Get(index).([]byte)
+	value := list.Get(index)
 	return []CmdLine{
 		{
 			[]byte(constant.LSet),
@@ -344,47 +410,19 @@ func undoLSet(db *DB, args [][]byte) []CmdLine {
 	}
 }
 
-// execRPop removes last element of list then return it
+// execRPop removes last elements of list then return them
 func execRPop(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	key := string(args[0])
-
-	// get data
-	list, errReply := db.getAsList(key)
-	if errReply != nil {
-		return errReply
-	}
-	if list == nil {
-		return &protocol.NullBulkReply{}
-	}
-
-	val, _ := list.RemoveLast().([]byte)
-	if list.Len() == 0 {
-		db.Remove(key)
-	}
-	db.addAof(utils.ToCmdLine3(constant.RPop, args...))
-	return protocol.MakeBulkReply(val)
+	return execPop(db, args, false)
 }
 
 var rPushCmd = []byte(constant.RPush)
 
 func undoRPop(db *DB, args [][]byte) []CmdLine {
-	key := string(args[0])
-	list, errReply := db.getAsList(key)
+	count, _, errReply := parsePopCount(constant.RPop, args)
 	if errReply != nil {
 		return nil
 	}
-	if list == nil || list.Len() == 0 {
-		return nil
-	}
-	element, _ := list.Get(list.Len() - 1).([]byte)
-	return []CmdLine{
-		{
-			rPushCmd,
-			args[0],
-			element,
-		},
-	}
+	return rollbackListPop(db, string(args[0]), false, count)
 }
 
 func prepareRPopLPush(args [][]byte) ([]string, []string) {
@@ -394,12 +432,19 @@ func prepareRPopLPush(args [][]byte) ([]string, []string) {
 	}, nil
 }
 
-// execRPopLPush pops last element of list-A then insert it to the head of list-B
-func execRPopLPush(db *DB, args [][]byte) redis.Reply {
-	sourceKey := string(args[0])
-	destKey := string(args[1])
+// parseListSide parses LEFT or RIGHT, returns true for LEFT
+func parseListSide(arg []byte) (left bool, ok bool) {
+	switch strings.ToUpper(string(arg)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
 
-	// get source entity
+// moveElement pops an element from one side of source and pushes it to one side of destination
+func (db *DB) moveElement(sourceKey string, destKey string, fromLeft bool, toLeft bool) redis.Reply {
 	sourceList, errReply := db.getAsList(sourceKey)
 	if errReply != nil {
 		return errReply
@@ -407,27 +452,32 @@ func execRPopLPush(db *DB, args [][]byte) redis.Reply {
 	if sourceList == nil {
 		return &protocol.NullBulkReply{}
 	}
-
-	// get dest entity
-	destList, _, errReply := db.getOrInitList(destKey)
-	if errReply != nil {
+	// check type of destination before popping
+	if _, errReply = db.getAsList(destKey); errReply != nil {
 		return errReply
 	}
 
-	// pop and push
-	val, _ := sourceList.RemoveLast().([]byte)
-	destList.Insert(0, val)
-
+	var val []byte
+	if fromLeft {
+		val = sourceList.Remove(0)
+	} else {
+		val = sourceList.RemoveLast()
+	}
+	// source and destination may be the same list, so push before removing empty source
+	destList, _, _ := db.getOrInitList(destKey)
+	if toLeft {
+		destList.Insert(0, val)
+	} else {
+		destList.Add(val)
+	}
 	if sourceList.Len() == 0 {
 		db.Remove(sourceKey)
 	}
-
-	db.addAof(utils.ToCmdLine3(constant.RPopLPush, args...))
 	return protocol.MakeBulkReply(val)
 }
 
-func undoRPopLPush(db *DB, args [][]byte) []CmdLine {
-	sourceKey := string(args[0])
+// rollbackMoveElement pushes element back to source and pops it from destination
+func rollbackMoveElement(db *DB, sourceKey string, destKey string, fromLeft bool, toLeft bool) []CmdLine {
 	list, errReply := db.getAsList(sourceKey)
 	if errReply != nil {
 		return nil
@@ -435,18 +485,335 @@ func undoRPopLPush(db *DB, args [][]byte) []CmdLine {
 	if list == nil || list.Len() == 0 {
 		return nil
 	}
-	element, _ := list.Get(list.Len() - 1).([]byte)
+	pushBack := utils.ToCmdLine(constant.RPush, sourceKey)
+	element := list.Get(list.Len() - 1)
+	if fromLeft {
+		pushBack = utils.ToCmdLine(constant.LPush, sourceKey)
+		element = list.Get(0)
+	}
+	popDest := utils.ToCmdLine(constant.RPop, destKey)
+	if toLeft {
+		popDest = utils.ToCmdLine(constant.LPop, destKey)
+	}
 	return []CmdLine{
-		{
-			rPushCmd,
-			args[0],
-			element,
-		},
-		{
-			[]byte(constant.LPop),
-			args[1],
-		},
+		append(pushBack, element),
+		popDest,
+	}
+}
+
+// execRPopLPush pops last element of list-A then insert it to the head of list-B
+func execRPopLPush(db *DB, args [][]byte) redis.Reply {
+	result := db.moveElement(string(args[0]), string(args[1]), false, true)
+	if _, ok := result.(*protocol.BulkReply); ok {
+		db.addAof(utils.ToCmdLine3(constant.RPopLPush, args...))
+	}
+	return result
+}
+
+func undoRPopLPush(db *DB, args [][]byte) []CmdLine {
+	return rollbackMoveElement(db, string(args[0]), string(args[1]), false, true)
+}
+
+// execLMove pops an element from one side of source, and pushes it to one side of destination
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func execLMove(db *DB, args [][]byte) redis.Reply {
+	fromLeft, ok1 := parseListSide(args[2])
+	toLeft, ok2 := parseListSide(args[3])
+	if !ok1 || !ok2 {
+		return &protocol.SyntaxErrReply{}
+	}
+	result := db.moveElement(string(args[0]), string(args[1]), fromLeft, toLeft)
+	if _, ok := result.(*protocol.BulkReply); ok {
+		db.addAof(utils.ToCmdLine3(constant.LMove, args...))
+	}
+	return result
+}
+
+func undoLMove(db *DB, args [][]byte) []CmdLine {
+	fromLeft, ok1 := parseListSide(args[2])
+	toLeft, ok2 := parseListSide(args[3])
+	if !ok1 || !ok2 {
+		return nil
+	}
+	return rollbackMoveElement(db, string(args[0]), string(args[1]), fromLeft, toLeft)
+}
+
+// ParseLMPop parses arguments of LMPOP: numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func ParseLMPop(args [][]byte) (keys []string, left bool, count int, errReply protocol.ErrorReply) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, false, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 {
+		return nil, false, 0, protocol.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys >= int64(len(args)-1) {
+		return nil, false, 0, &protocol.SyntaxErrReply{}
+	}
+	keys = make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	left, ok := parseListSide(args[numKeys+1])
+	if !ok {
+		return nil, false, 0, &protocol.SyntaxErrReply{}
+	}
+	count = 1
+	options := args[numKeys+2:]
+	if len(options) > 0 {
+		if len(options) != 2 || strings.ToUpper(string(options[0])) != "COUNT" {
+			return nil, false, 0, &protocol.SyntaxErrReply{}
+		}
+		count64, err := strconv.ParseInt(string(options[1]), 10, 64)
+		if err != nil {
+			return nil, false, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if count64 <= 0 {
+			return nil, false, 0, protocol.MakeErrReply("ERR count should be greater than 0")
+		}
+		if count64 > math.MaxInt32 {
+			count64 = math.MaxInt32
+		}
+		count = int(count64)
+	}
+	return keys, left, count, nil
+}
+
+func prepareLMPop(args [][]byte) ([]string, []string) {
+	keys, _, _, errReply := ParseLMPop(args)
+	if errReply != nil {
+		return nil, nil
+	}
+	return keys, nil
+}
+
+// execLMPop pops elements from the first non-empty list of the given keys
+func execLMPop(db *DB, args [][]byte) redis.Reply {
+	keys, left, count, errReply := ParseLMPop(args)
+	if errReply != nil {
+		return errReply
+	}
+	for _, key := range keys {
+		list, errReply := db.getAsList(key)
+		if errReply != nil {
+			return errReply
+		}
+		if list == nil {
+			continue
+		}
+		elements := popElements(list, left, count)
+		if list.Len() == 0 {
+			db.Remove(key)
+		}
+		cmdName := constant.RPop
+		if left {
+			cmdName = constant.LPop
+		}
+		db.addAof(utils.ToCmdLine(cmdName, key, strconv.Itoa(len(elements))))
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			protocol.MakeMultiBulkReply(elements),
+		})
+	}
+	return protocol.MakeNullMultiBulkReply()
+}
+
+func undoLMPop(db *DB, args [][]byte) []CmdLine {
+	keys, left, count, errReply := ParseLMPop(args)
+	if errReply != nil {
+		return nil
+	}
+	for _, key := range keys {
+		list, errReply := db.getAsList(key)
+		if errReply != nil {
+			return nil
+		}
+		if list != nil {
+			return rollbackListPop(db, key, left, count)
+		}
+	}
+	return nil
+}
+
+func prepareBLMPop(args [][]byte) ([]string, []string) {
+	return prepareLMPop(args[1:])
+}
+
+// execBLMPop is the blocking version of LMPOP, the blocking is done by DB.execBlocking
+// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func execBLMPop(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := ParseBlockingTimeout(args[0]); errReply != nil {
+		return errReply
+	}
+	return execLMPop(db, args[1:])
+}
+
+func undoBLMPop(db *DB, args [][]byte) []CmdLine {
+	return undoLMPop(db, args[1:])
+}
+
+// execLPos returns indexes of elements matching the given element
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func execLPos(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	element := args[1]
+	var rank int64 = 1
+	var count, maxLen int64
+	hasCount := false
+	for i := 2; i < len(args); i += 2 {
+		option := strings.ToUpper(string(args[i]))
+		if i+1 >= len(args) || (option != "RANK" && option != "COUNT" && option != "MAXLEN") {
+			return &protocol.SyntaxErrReply{}
+		}
+		val, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		switch option {
+		case "RANK":
+			if val == 0 {
+				return protocol.MakeErrReply("ERR RANK can't be zero: use 1 to start from the first match, " +
+					"2 from the second ... or use negative to start from the end of the list")
+			}
+			if val == math.MinInt64 {
+				return protocol.MakeErrReply("ERR value is out of range")
+			}
+			rank = val
+		case "COUNT":
+			if val < 0 {
+				return protocol.MakeErrReply("ERR COUNT can't be negative")
+			}
+			count = val
+			hasCount = true
+		case "MAXLEN":
+			if val < 0 {
+				return protocol.MakeErrReply("ERR MAXLEN can't be negative")
+			}
+			maxLen = val
+		}
 	}
+
+	list, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		if hasCount {
+			return &protocol.EmptyMultiBulkReply{}
+		}
+		return &protocol.NullBulkReply{}
+	}
+
+	// skip (|rank| - 1) matches, then collect matches until count reached, 0 count means all
+	skip := rank - 1
+	forEach := list.ForEach
+	if rank < 0 {
+		skip = -rank - 1
+		forEach = list.ReverseForEach
+	}
+	var matches []redis.Reply
+	var compared int64
+	forEach(func(i int, val []byte) bool {
+		if maxLen > 0 && compared >= maxLen {
+			return false
+		}
+		compared++
+		if !bytes.Equal(val, element) {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		matches = append(matches, protocol.MakeIntReply(int64(i)))
+		return hasCount && (count == 0 || int64(len(matches)) < count)
+	})
+	if !hasCount {
+		if len(matches) == 0 {
+			return &protocol.NullBulkReply{}
+		}
+		return matches[0]
+	}
+	return protocol.MakeMultiRawReply(matches)
+}
+
+// execLInsert inserts element before or after the first element equal to pivot
+// LINSERT key BEFORE|AFTER pivot element
+func execLInsert(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	where := strings.ToUpper(string(args[1]))
+	if where != "BEFORE" && where != "AFTER" {
+		return &protocol.SyntaxErrReply{}
+	}
+	pivot := args[2]
+	element := args[3]
+
+	list, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		return protocol.MakeIntReply(0)
+	}
+	index := -1
+	list.ForEach(func(i int, val []byte) bool {
+		if bytes.Equal(val, pivot) {
+			index = i
+			return false
+		}
+		return true
+	})
+	if index < 0 {
+		return protocol.MakeIntReply(-1)
+	}
+	if where == "AFTER" {
+		index++
+	}
+	list.Insert(index, element)
+	db.addAof(utils.ToCmdLine3(constant.LInsert, args...))
+	return protocol.MakeIntReply(int64(list.Len()))
+}
+
+// execLTrim trims list to the elements in given range, both start and stop are inclusive
+func execLTrim(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	start, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+
+	list, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		return &protocol.OkReply{}
+	}
+
+	size := int64(list.Len())
+	if start < 0 {
+		start += size
+	}
+	if stop < 0 {
+		stop += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= size {
+		db.Remove(key)
+	} else {
+		if stop >= size {
+			stop = size - 1
+		}
+		list.Trim(int(start), int(stop+1))
+	}
+	db.addAof(utils.ToCmdLine3(constant.LTrim, args...))
+	return &protocol.OkReply{}
 }
 
 // execRPush inserts element at last of list
@@ -506,16 +873,22 @@ func execRPushX(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand(constant.LPush, execLPush, writeFirstKey, undoLPush, -3)
-	RegisterCommand(constant.LPushX, execLPushX, writeFirstKey, undoLPush, -3)
-	RegisterCommand(constant.RPush, execRPush, writeFirstKey, undoRPush, -3)
-	RegisterCommand(constant.RPushX, execRPushX, writeFirstKey, undoRPush, -3)
-	RegisterCommand(constant.LPop, execLPop, writeFirstKey, undoLPop, 2)
-	RegisterCommand(constant.RPop, execRPop, writeFirstKey, undoRPop, 2)
-	RegisterCommand(constant.RPopLPush, execRPopLPush, prepareRPopLPush, undoRPopLPush, 3)
-	RegisterCommand(constant.LRem, execLRem, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand(constant.LLen, execLLen, readFirstKey, nil, 2)
-	RegisterCommand(constant.LIndex, execLIndex, readFirstKey, nil, 3)
-	RegisterCommand(constant.LSet, execLSet, writeFirstKey, undoLSet, 4)
-	RegisterCommand(constant.LRange, execLRange, readFirstKey, nil, 4)
+	RegisterCommand(constant.LPush, execLPush, writeFirstKey, undoLPush, -3, flagWrite)
+	RegisterCommand(constant.LPushX, execLPushX, writeFirstKey, undoLPush, -3, flagWrite)
+	RegisterCommand(constant.RPush, execRPush, writeFirstKey, undoRPush, -3, flagWrite)
+	RegisterCommand(constant.RPushX, execRPushX, writeFirstKey, undoRPush, -3, flagWrite)
+	RegisterCommand(constant.LPop, execLPop, writeFirstKey, undoLPop, -2, flagWrite)
+	RegisterCommand(constant.RPop, execRPop, writeFirstKey, undoRPop, -2, flagWrite)
+	RegisterCommand(constant.RPopLPush, execRPopLPush, prepareRPopLPush, undoRPopLPush, 3, flagWrite)
+	RegisterCommand(constant.LMove, execLMove, prepareRPopLPush, undoLMove, 5, flagWrite)
+	RegisterCommand(constant.LMPop, execLMPop, prepareLMPop, undoLMPop, -4, flagWrite)
+	RegisterCommand(constant.BLMPop, execBLMPop, prepareBLMPop, undoBLMPop, -5, flagWrite|flagBlocking)
+	RegisterCommand(constant.LRem, execLRem, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand(constant.LLen, execLLen, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.LIndex, execLIndex, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.LSet, execLSet, writeFirstKey, undoLSet, 4, flagWrite)
+	RegisterCommand(constant.LRange, execLRange, readFirstKey, nil, 4, flagReadOnly)
+	RegisterCommand(constant.LPos, execLPos, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand(constant.LInsert, execLInsert, writeFirstKey, rollbackFirstKey, 5, flagWrite)
+	RegisterCommand(constant.LTrim, execLTrim, writeFirstKey, rollbackFirstKey, 4, flagWrite)
 }
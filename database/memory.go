@@ -0,0 +1,320 @@
+package database
+
+import (
+	"fmt"
+	"godis/constant"
+	"godis/dataStruct/dict"
+	"godis/dataStruct/list"
+	"godis/dataStruct/listpack"
+	"godis/dataStruct/set"
+	"godis/dataStruct/sortedset"
+	"godis/interface/database"
+	"godis/interface/redis"
+	"godis/redis/protocol"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+/*
+ * Sizes are estimated from the memory layout of go runtime on 64-bit platforms.
+ * Members of big hashes, sets and sorted sets are sampled like redis, SAMPLES 0 means visiting all members.
+ */
+
+const (
+	defaultMemorySamples = 5
+
+	sliceHeaderSize = 24
+	intsetEntrySize = 8
+	// mapEntrySize is a slot of map[string]interface{} including key header, value and tophash at average load factor
+	mapEntrySize = 48
+	// skiplistNodeSize is a node of skip list with element, backward pointer and 4/3 levels on average
+	skiplistNodeSize = 88
+)
+
+var (
+	// keyOverhead is the cost of a key in db besides its name and data
+	keyOverhead = mapEntrySize + int64(unsafe.Sizeof(database.DataEntity{}))
+	// expireOverhead is the cost of a key in ttl map besides its name
+	expireOverhead = mapEntrySize + int64(unsafe.Sizeof(time.Time{}))
+)
+
+var memoryHelp = []string{
+	"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"DOCTOR",
+	"    Return memory problems reports.",
+	"STATS",
+	"    Return information about the memory usage of the server.",
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return memory in bytes used by <key> and its value. Nested values are",
+	"    sampled up to <count> times (default: 5, 0 means sample all).",
+	"HELP",
+	"    Print this help.",
+}
+
+func init() {
+	RegisterCommand(constant.Memory, execMemoryUsage, prepareMemory, nil, -2, flagReadOnly)
+}
+
+/* ---- estimation ---- */
+
+// sampleSize returns total size of n members estimated by average size of sampled members
+func sampleSize(n int, samples int, visit func(consumer func(size int64) bool)) int64 {
+	if n == 0 {
+		return 0
+	}
+	var total int64
+	count := 0
+	visit(func(size int64) bool {
+		total += size
+		count++
+		return samples <= 0 || count < samples
+	})
+	if count == 0 {
+		return 0
+	}
+	return total * int64(n) / int64(count)
+}
+
+// dataMemoryUsage estimates bytes used by value of a key
+func dataMemoryUsage(data interface{}, samples int) int64 {
+	switch data := data.(type) {
+	case []byte:
+		return sliceHeaderSize + int64(cap(data))
+	case *list.QuickList:
+		return data.MemoryUsage()
+	case *dict.CompactDict:
+		if data.Encoding() == "listpack" {
+			return int64(unsafe.Sizeof(*data)) + sampleSize(data.Len(), samples, func(consumer func(int64) bool) {
+				data.ForEach(func(key string, val interface{}) bool {
+					value, _ := val.([]byte)
+					return consumer(int64(listpack.EntrySize(len(key)) + listpack.EntrySize(len(value))))
+				})
+			})
+		}
+		return int64(unsafe.Sizeof(*data)) + hashMemoryUsage(data, samples)
+	case dict.Dict:
+		return hashMemoryUsage(data, samples)
+	case *set.Set:
+		if data.Encoding() == "intset" {
+			return int64(unsafe.Sizeof(*data)) + sliceHeaderSize + int64(data.Len())*intsetEntrySize
+		}
+		return int64(unsafe.Sizeof(*data)) + sampleSize(data.Len(), samples, func(consumer func(int64) bool) {
+			data.ForEach(func(member string) bool {
+				return consumer(mapEntrySize + int64(len(member)))
+			})
+		})
+	case *sortedset.SortedSet:
+		entrySize := func(member string) int64 {
+			return mapEntrySize + skiplistNodeSize + int64(len(member))
+		}
+		if data.Encoding() == "listpack" {
+			entrySize = func(member string) int64 {
+				return int64(listpack.EntrySize(len(member)) + listpack.EntrySize(8))
+			}
+		}
+		size := int64(data.Len())
+		return int64(unsafe.Sizeof(*data)) + sampleSize(int(size), samples, func(consumer func(int64) bool) {
+			data.ForEach(0, size, false, func(element *sortedset.Element) bool {
+				return consumer(entrySize(element.Member))
+			})
+		})
+	}
+	return 0
+}
+
+func hashMemoryUsage(d dict.Dict, samples int) int64 {
+	return sampleSize(d.Len(), samples, func(consumer func(int64) bool) {
+		d.ForEach(func(key string, val interface{}) bool {
+			value, _ := val.([]byte)
+			return consumer(mapEntrySize + int64(len(key)) + sliceHeaderSize + int64(len(value)))
+		})
+	})
+}
+
+// keyMemoryUsage estimates bytes used by key in db, including its name, data and overhead of db
+func keyMemoryUsage(key string, entity *database.DataEntity, samples int) int64 {
+	return int64(len(key)) + keyOverhead + dataMemoryUsage(entity.Data, samples)
+}
+
+/* ---- MEMORY USAGE ---- */
+
+// prepareMemory returns the key of MEMORY USAGE key
+func prepareMemory(args [][]byte) ([]string, []string) {
+	if len(args) < 2 || strings.ToLower(string(args[0])) != "usage" {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
+// execMemoryUsage: MEMORY USAGE key [SAMPLES count], other sub commands are executed by MultiDB
+func execMemoryUsage(db *DB, args [][]byte) redis.Reply {
+	if strings.ToLower(string(args[0])) != "usage" {
+		return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try MEMORY HELP.")
+	}
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("memory|usage")
+	}
+	samples := defaultMemorySamples
+	for i := 2; i < len(args); i++ {
+		if strings.ToLower(string(args[i])) != "samples" || i+1 >= len(args) {
+			return protocol.MakeSyntaxErrReply()
+		}
+		count, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if count < 0 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		samples = int(count)
+		i++
+	}
+	key := string(args[1])
+	entity, exists := db.peekEntity(key)
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	return protocol.MakeIntReply(keyMemoryUsage(key, entity, samples))
+}
+
+/* ---- MEMORY STATS / DOCTOR ---- */
+
+// memoryStats is the overall breakdown of memory shown by MEMORY STATS.
+// Allocated heap includes garbage not collected yet, so it is larger than live data between GCs
+type memoryStats struct {
+	// heap obtained from OS, it approximates peak of heap since runtime rarely returns address space
+	peakAllocated    int64
+	totalAllocated   int64
+	startupAllocated int64
+	// resident is heap obtained from OS and not released yet
+	resident int64
+	// db index -> [overhead of main dict, overhead of expires]
+	dbOverheads   map[int][2]int64
+	overheadTotal int64
+	keysCount     int64
+	datasetBytes  int64
+}
+
+func (m *MultiDB) getMemoryStats() *memoryStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats := &memoryStats{
+		peakAllocated:    int64(ms.HeapSys),
+		totalAllocated:   int64(ms.HeapAlloc),
+		startupAllocated: m.startupAllocated,
+		resident:         int64(ms.HeapSys - ms.HeapReleased),
+		dbOverheads:      make(map[int][2]int64),
+		overheadTotal:    m.startupAllocated,
+	}
+	for i, db := range m.dbSet {
+		keys := int64(db.data.Len())
+		if keys == 0 {
+			continue
+		}
+		overhead := [2]int64{keys * keyOverhead, int64(db.ttlMap.Len()) * expireOverhead}
+		stats.dbOverheads[i] = overhead
+		stats.overheadTotal += overhead[0] + overhead[1]
+		stats.keysCount += keys
+	}
+	stats.datasetBytes = stats.totalAllocated - stats.overheadTotal
+	if stats.datasetBytes < 0 {
+		stats.datasetBytes = 0
+	}
+	return stats
+}
+
+func percentage(a int64, b int64) float64 {
+	if b <= 0 {
+		return 0
+	}
+	return float64(a) * 100 / float64(b)
+}
+
+func makeFloatReply(f float64) redis.Reply {
+	return protocol.MakeBulkReply([]byte(strconv.FormatFloat(f, 'f', -1, 64)))
+}
+
+// execMemory executes sub commands of MEMORY about the whole server, MEMORY USAGE is executed by DB
+func (m *MultiDB) execMemory(args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "help":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("memory|help")
+		}
+		return makeHelpReply(memoryHelp)
+	case "stats":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("memory|stats")
+		}
+		return m.execMemoryStats()
+	case "doctor":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("memory|doctor")
+		}
+		return protocol.MakeBulkReply([]byte(m.memoryDoctor()))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try MEMORY HELP.")
+}
+
+func (m *MultiDB) execMemoryStats() redis.Reply {
+	stats := m.getMemoryStats()
+	field := func(name string) redis.Reply {
+		return protocol.MakeBulkReply([]byte(name))
+	}
+	replies := []redis.Reply{
+		field("peak.allocated"), protocol.MakeIntReply(stats.peakAllocated),
+		field("total.allocated"), protocol.MakeIntReply(stats.totalAllocated),
+		field("startup.allocated"), protocol.MakeIntReply(stats.startupAllocated),
+	}
+	for i := range m.dbSet {
+		overhead, ok := stats.dbOverheads[i]
+		if !ok {
+			continue
+		}
+		replies = append(replies, field("db."+strconv.Itoa(i)), protocol.MakeMultiRawReply([]redis.Reply{
+			field("overhead.hashtable.main"), protocol.MakeIntReply(overhead[0]),
+			field("overhead.hashtable.expires"), protocol.MakeIntReply(overhead[1]),
+		}))
+	}
+	var bytesPerKey int64
+	if stats.keysCount > 0 {
+		bytesPerKey = (stats.totalAllocated - stats.startupAllocated) / stats.keysCount
+	}
+	replies = append(replies,
+		field("overhead.total"), protocol.MakeIntReply(stats.overheadTotal),
+		field("keys.count"), protocol.MakeIntReply(stats.keysCount),
+		field("keys.bytes-per-key"), protocol.MakeIntReply(bytesPerKey),
+		field("dataset.bytes"), protocol.MakeIntReply(stats.datasetBytes),
+		field("dataset.percentage"), makeFloatReply(percentage(stats.datasetBytes, stats.totalAllocated-stats.startupAllocated)),
+		field("peak.percentage"), makeFloatReply(percentage(stats.totalAllocated, stats.peakAllocated)),
+		field("fragmentation"), makeFloatReply(percentage(stats.resident, stats.totalAllocated)/100),
+	)
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// memoryDoctor reports simple diagnostics of memory
+func (m *MultiDB) memoryDoctor() string {
+	stats := m.getMemoryStats()
+	if stats.keysCount == 0 && stats.totalAllocated-stats.startupAllocated < 5<<20 {
+		return "Memory usage is too small to diagnose, please run MEMORY DOCTOR again after loading some data."
+	}
+	var issues []string
+	if percentage(stats.peakAllocated, stats.totalAllocated) > 150 {
+		issues = append(issues, fmt.Sprintf(" * Peak memory: heap obtained from OS (%d bytes) is more than 150%% "+
+			"of heap in use. Go runtime keeps address space of a past peak, "+
+			"so fragmentation ratio may look high.", stats.peakAllocated))
+	}
+	if percentage(stats.resident, stats.totalAllocated) > 140 {
+		issues = append(issues, fmt.Sprintf(" * High fragmentation: resident heap is %.2f times of heap in use. "+
+			"Freed memory may not have been returned to OS by GC yet, it is released gradually.",
+			percentage(stats.resident, stats.totalAllocated)/100))
+	}
+	if len(issues) == 0 {
+		return "No memory issue detected."
+	}
+	return "Memory issues detected:\n\n" + strings.Join(issues, "\n\n") + "\n"
+}
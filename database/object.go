@@ -0,0 +1,199 @@
+package database
+
+import (
+	"godis/config"
+	"godis/constant"
+	"godis/dataStruct/list"
+	"godis/interface/database"
+	"godis/interface/redis"
+	"godis/redis/protocol"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// embstrSizeLimit is the max length of string encoded as embstr in redis
+	embstrSizeLimit = 44
+
+	// lfuInitVal is the access counter of new keys, so that they have a chance to accumulate accesses
+	lfuInitVal = 5
+	lfuMaxVal  = 255
+	// lfuMinutesMask limits minutes of last decrement to 24 bits
+	lfuMinutesMask = 1<<24 - 1
+)
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+func init() {
+	RegisterCommand(constant.Object, execObject, prepareObject, nil, -2, flagReadOnly)
+}
+
+/* ---- access tracking ---- */
+
+func lfuMinutes(now time.Time) uint32 {
+	return uint32(now.Unix()/60) & lfuMinutesMask
+}
+
+// initEntity records creation of entity as its first access
+func initEntity(entity *database.DataEntity) {
+	if atomic.LoadInt64(&entity.AccessTime) != 0 {
+		return
+	}
+	now := time.Now()
+	atomic.StoreInt64(&entity.AccessTime, now.UnixNano()/int64(time.Millisecond))
+	atomic.StoreUint32(&entity.LFU, lfuMinutes(now)<<8|lfuInitVal)
+}
+
+// overwriteEntity inherits access counter of the overwritten entity like redis, and records the write as an access
+func overwriteEntity(entity *database.DataEntity, old *database.DataEntity) {
+	if atomic.LoadInt64(&entity.AccessTime) != 0 {
+		return
+	}
+	atomic.StoreUint32(&entity.LFU, atomic.LoadUint32(&old.LFU))
+	touchEntity(entity)
+}
+
+// touchEntity updates access time and access counter of entity.
+// Concurrent readers may lose some increments of the counter, which is acceptable for an approximated counter
+func touchEntity(entity *database.DataEntity) {
+	now := time.Now()
+	atomic.StoreInt64(&entity.AccessTime, now.UnixNano()/int64(time.Millisecond))
+	minutes := lfuMinutes(now)
+	counter := lfuDecr(atomic.LoadUint32(&entity.LFU), minutes)
+	counter = lfuLogIncr(counter)
+	atomic.StoreUint32(&entity.LFU, minutes<<8|counter)
+}
+
+// lfuDecr returns the access counter decreased by elapsed periods of lfu-decay-time
+func lfuDecr(lfu uint32, minutes uint32) uint32 {
+	counter := lfu & 0xff
+	if config.Properties.LfuDecayTime <= 0 {
+		return counter
+	}
+	elapsed := (minutes - lfu>>8) & lfuMinutesMask
+	periods := elapsed / uint32(config.Properties.LfuDecayTime)
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// lfuLogIncr increases the counter with probability decreasing as the counter grows
+func lfuLogIncr(counter uint32) uint32 {
+	if counter >= lfuMaxVal {
+		return lfuMaxVal
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	p := 1.0 / (base*float64(config.Properties.LfuLogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+/* ---- OBJECT ---- */
+
+// prepareObject returns the key after sub command, e.g. OBJECT ENCODING key
+func prepareObject(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
+// execObject inspects internals of the given key
+func execObject(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	if subCmd == "help" {
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("object|help")
+		}
+		return makeHelpReply(objectHelp)
+	}
+	switch subCmd {
+	case "encoding", "freq", "idletime", "refcount":
+	default:
+		return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try OBJECT HELP.")
+	}
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("object|" + subCmd)
+	}
+	entity, exists := db.peekEntity(string(args[1]))
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	switch subCmd {
+	case "encoding":
+		encoding := getEncoding(entity)
+		if encoding == "" {
+			return &protocol.UnknownErrReply{}
+		}
+		return protocol.MakeBulkReply([]byte(encoding))
+	case "freq":
+		counter := lfuDecr(atomic.LoadUint32(&entity.LFU), lfuMinutes(time.Now()))
+		return protocol.MakeIntReply(int64(counter))
+	case "idletime":
+		idle := time.Now().UnixNano()/int64(time.Millisecond) - atomic.LoadInt64(&entity.AccessTime)
+		if idle < 0 {
+			idle = 0
+		}
+		return protocol.MakeIntReply(idle / 1000)
+	default:
+		// values are never shared between keys
+		return protocol.MakeIntReply(1)
+	}
+}
+
+// makeHelpReply returns lines of help as status replies, same as redis
+func makeHelpReply(lines []string) redis.Reply {
+	replies := make([]redis.Reply, len(lines))
+	for i, line := range lines {
+		replies[i] = protocol.MakeStatusReply(line)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// getEncoding returns the internal encoding of entity shown by OBJECT ENCODING, returns "" if unknown
+func getEncoding(entity *database.DataEntity) string {
+	switch data := entity.Data.(type) {
+	case []byte:
+		if i, err := strconv.ParseInt(string(data), 10, 64); err == nil && strconv.FormatInt(i, 10) == string(data) {
+			return "int"
+		}
+		if len(data) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case *list.QuickList:
+		return "quicklist"
+	case interface{ Encoding() string }:
+		// compact dict, set and sorted set
+		return data.Encoding()
+	}
+	if getTypeName(entity) == "hash" {
+		return "hashtable"
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func makeTestExec() (*MultiDB, func(args ...string) redis.Reply) {
+	mdb := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	return mdb, func(args ...string) redis.Reply {
+		return mdb.Exec(conn, utils.ToCmdLine(args...))
+	}
+}
+
+func intOf(t *testing.T, reply redis.Reply) int64 {
+	intReply, ok := reply.(*protocol.IntReply)
+	if !ok {
+		t.Fatalf("expect int reply, actual %q", reply.ToBytes())
+	}
+	return intReply.Code
+}
+
+func TestObjectFreqAndIdleTime(t *testing.T) {
+	mdb, exec := makeTestExec()
+	exec("set", "k", "v")
+	if freq := intOf(t, exec("object", "freq", "k")); freq != lfuInitVal {
+		t.Errorf("expect initial freq %d, actual %d", lfuInitVal, freq)
+	}
+	for i := 0; i < 100; i++ {
+		exec("get", "k")
+	}
+	freq := intOf(t, exec("object", "freq", "k"))
+	if freq <= lfuInitVal {
+		t.Errorf("expect freq increased by reads, actual %d", freq)
+	}
+	// inspecting commands do not count as access
+	exec("type", "k")
+	exec("ttl", "k")
+	if actual := intOf(t, exec("object", "freq", "k")); actual != freq {
+		t.Errorf("expect freq %d after inspecting, actual %d", freq, actual)
+	}
+	// overwriting keeps the access counter
+	exec("set", "k", "v2")
+	if actual := intOf(t, exec("object", "freq", "k")); actual < freq {
+		t.Errorf("expect freq kept after overwriting, actual %d", actual)
+	}
+
+	entity, _ := mdb.dbSet[0].peekEntity("k")
+	atomic.AddInt64(&entity.AccessTime, -10000)
+	if idle := intOf(t, exec("object", "idletime", "k")); idle != 10 {
+		t.Errorf("expect idle time 10, actual %d", idle)
+	}
+	exec("get", "k")
+	if idle := intOf(t, exec("object", "idletime", "k")); idle != 0 {
+		t.Errorf("expect idle time reset by access, actual %d", idle)
+	}
+	if reply := exec("object", "freq", "none"); string(reply.ToBytes()) != "$-1\r\n" {
+		t.Errorf("expect nil for missing key, actual %q", reply.ToBytes())
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	_, exec := makeTestExec()
+	if reply := exec("memory", "usage", "none"); string(reply.ToBytes()) != "$-1\r\n" {
+		t.Errorf("expect nil for missing key, actual %q", reply.ToBytes())
+	}
+	exec("set", "str", strings.Repeat("a", 1000))
+	if usage := intOf(t, exec("memory", "usage", "str")); usage < 1000 {
+		t.Errorf("expect usage of string at least its length, actual %d", usage)
+	}
+
+	exec("rpush", "small", "a")
+	args := []string{"rpush", "big"}
+	for i := 0; i < 1000; i++ {
+		args = append(args, strconv.Itoa(i))
+	}
+	exec(args...)
+	small := intOf(t, exec("memory", "usage", "small"))
+	big := intOf(t, exec("memory", "usage", "big", "samples", "0"))
+	if big <= small {
+		t.Errorf("expect usage of big list %d greater than small list %d", big, small)
+	}
+	if reply := exec("memory", "usage", "big", "samples", "-1"); !protocol.IsErrorReply(reply) {
+		t.Errorf("expect error for negative samples, actual %q", reply.ToBytes())
+	}
+	if reply := exec("memory", "doctor"); protocol.IsErrorReply(reply) {
+		t.Errorf("unexpected error %q", reply.ToBytes())
+	}
+}
@@ -13,15 +13,62 @@ type command struct {
 	flags    int
 }
 
+const (
+	flagWrite    = 0
+	flagReadOnly = 1
+	// flagBlocking marks commands waiting for keys until timeout if they got nothing, e.g. blmpop
+	flagBlocking = 2
+)
+
 // RegisterCommand registers a new command
 // arity means allowed number of cmdArgs, arity < 0 means len(args) >= -arity.
 // for example: the arity of `get` is 2, `mget` is -2
-func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback UndoFunc, arity int) {
+func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback UndoFunc, arity int, flags int) {
 	name = strings.ToLower(name)
 	cmdTable[name] = &command{
 		executor: executor,
 		prepare:  prepare,
 		undo:     rollback,
 		arity:    arity,
+		flags:    flags,
+	}
+}
+
+// IsReadOnlyCommand returns true if the command never modifies data
+func IsReadOnlyCommand(name string) bool {
+	name = strings.ToLower(name)
+	cmd, ok := cmdTable[name]
+	if !ok {
+		return false
+	}
+	return cmd.flags&flagReadOnly > 0
+}
+
+// IsWriteCommand returns true if the command is registered and may modify data
+func IsWriteCommand(name string) bool {
+	name = strings.ToLower(name)
+	cmd, ok := cmdTable[name]
+	if !ok {
+		return false
+	}
+	return cmd.flags&flagReadOnly == 0
+}
+
+// IsBlockingCommand returns true if the command may block the client until timeout
+func IsBlockingCommand(name string) bool {
+	name = strings.ToLower(name)
+	cmd, ok := cmdTable[name]
+	if !ok {
+		return false
+	}
+	return cmd.flags&flagBlocking > 0
+}
+
+// ValidateArity returns true if the command is registered and the number of its arguments is allowed
+func ValidateArity(cmdLine [][]byte) bool {
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !ok {
+		return false
 	}
+	return validateArity(cmd.arity, cmdLine)
 }
@@ -1,12 +1,14 @@
 package database
 
 import (
+	"godis/config"
 	"godis/constant"
 	HashSet "godis/dataStruct/set"
 	"godis/interface/database"
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/redis/protocol"
+	"sort"
 	"strconv"
 )
 
@@ -22,6 +24,11 @@ func (db *DB) getAsSet(key string) (*HashSet.Set, protocol.ErrorReply) {
 	return set, nil
 }
 
+// makeSet creates a set encoded as intset until it exceeds set-max-intset-entries
+func makeSet(members ...string) *HashSet.Set {
+	return HashSet.MakeCompact(config.Properties.SetMaxIntsetEntries, members...)
+}
+
 func (db *DB) getOrInitSet(key string) (set *HashSet.Set, inited bool, errReply protocol.ErrorReply) {
 	set, errReply = db.getAsSet(key)
 	if errReply != nil {
@@ -29,7 +36,7 @@ func (db *DB) getOrInitSet(key string) (set *HashSet.Set, inited bool, errReply
 	}
 	inited = false
 	if set == nil {
-		set = HashSet.Make()
+		set = makeSet()
 		db.PutEntity(key, &database.DataEntity{
 			Data: set,
 		})
@@ -140,35 +147,66 @@ func execSMembers(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(arr)
 }
 
-// execSInter intersect multiple sets
-func execSInter(db *DB, args [][]byte) redis.Reply {
-	keys := make([]string, len(args))
-	for i, arg := range args {
-		keys[i] = string(arg)
-	}
-
-	var result *HashSet.Set
-	for _, key := range keys {
+// getSets returns sets of keys, nil for keys not exist
+func (db *DB) getSets(keys []string) ([]*HashSet.Set, protocol.ErrorReply) {
+	sets := make([]*HashSet.Set, len(keys))
+	for i, key := range keys {
 		set, errReply := db.getAsSet(key)
 		if errReply != nil {
-			return errReply
+			return nil, errReply
 		}
+		sets[i] = set
+	}
+	return sets, nil
+}
+
+// sortSetsBySize returns sets ordered by size, so that intersection starts from the smallest set.
+// It returns nil if any set is nil, whose intersection is empty
+func sortSetsBySize(sets []*HashSet.Set) []*HashSet.Set {
+	sorted := make([]*HashSet.Set, len(sets))
+	for i, set := range sets {
 		if set == nil {
-			return &protocol.EmptyMultiBulkReply{}
+			return nil
 		}
+		sorted[i] = set
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Len() < sorted[j].Len()
+	})
+	return sorted
+}
 
-		if result == nil {
-			// init
-			result = HashSet.Make(set.ToSlice()...)
-		} else {
-			result = result.Intersect(set)
-			if result.Len() == 0 {
-				// early termination
-				return &protocol.EmptyMultiBulkReply{}
-			}
+// intersectSets returns intersection of sets, nil sets are treated as empty
+func intersectSets(sets []*HashSet.Set) *HashSet.Set {
+	sorted := sortSetsBySize(sets)
+	if sorted == nil {
+		return makeSet()
+	}
+	result := makeSet(sorted[0].ToSlice()...)
+	for _, set := range sorted[1:] {
+		if result.Len() == 0 {
+			// early termination
+			break
 		}
+		result = result.Intersect(set)
 	}
+	return result
+}
 
+// execSInter intersect multiple sets
+func execSInter(db *DB, args [][]byte) redis.Reply {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	sets, errReply := db.getSets(keys)
+	if errReply != nil {
+		return errReply
+	}
+	result := intersectSets(sets)
+	if result.Len() == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
 	arr := make([][]byte, result.Len())
 	i := 0
 	result.ForEach(func(member string) bool {
@@ -187,37 +225,55 @@ func execSInterStore(db *DB, args [][]byte) redis.Reply {
 	for i, arg := range keyArgs {
 		keys[i] = string(arg)
 	}
+	sets, errReply := db.getSets(keys)
+	if errReply != nil {
+		return errReply
+	}
+	result := intersectSets(sets)
+	db.Remove(dest) // clean ttl and old value
+	if result.Len() > 0 {
+		db.PutEntity(dest, &database.DataEntity{
+			Data: result,
+		})
+	}
+	db.addAof(utils.ToCmdLine3(constant.SInterStore, args...))
+	return protocol.MakeIntReply(int64(result.Len()))
+}
 
-	var result *HashSet.Set
-	for _, key := range keys {
-		set, errReply := db.getAsSet(key)
-		if errReply != nil {
-			return errReply
-		}
-		if set == nil {
-			db.Remove(dest) // clean ttl and old value
-			return protocol.MakeIntReply(0)
-		}
-
-		if result == nil {
-			// init
-			result = HashSet.Make(set.ToSlice()...)
-		} else {
-			result = result.Intersect(set)
-			if result.Len() == 0 {
-				// early termination
-				db.Remove(dest) // clean ttl and old value
-				return protocol.MakeIntReply(0)
+// execSInterCard returns the number of members in intersection of sets
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func execSInterCard(db *DB, args [][]byte) redis.Reply {
+	keys, limit, errReply := ParseInterCardArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	sets, errReply := db.getSets(keys)
+	if errReply != nil {
+		return errReply
+	}
+	sorted := sortSetsBySize(sets)
+	if sorted == nil {
+		return protocol.MakeIntReply(0)
+	}
+	var count int64
+	sorted[0].ForEach(func(member string) bool {
+		for _, set := range sorted[1:] {
+			if !set.Has(member) {
+				return true
 			}
 		}
-	}
-
-	set := HashSet.Make(result.ToSlice()...)
-	db.PutEntity(dest, &database.DataEntity{
-		Data: set,
+		count++
+		return limit <= 0 || count < limit
 	})
-	db.addAof(utils.ToCmdLine3(constant.SInterStore, args...))
-	return protocol.MakeIntReply(int64(set.Len()))
+	return protocol.MakeIntReply(count)
+}
+
+func prepareInterCard(args [][]byte) ([]string, []string) {
+	keys, _, errReply := ParseInterCardArgs(args)
+	if errReply != nil {
+		return nil, nil
+	}
+	return nil, keys
 }
 
 // execSUnion adds multiple sets
@@ -239,7 +295,7 @@ func execSUnion(db *DB, args [][]byte) redis.Reply {
 
 		if result == nil {
 			// init
-			result = HashSet.Make(set.ToSlice()...)
+			result = makeSet(set.ToSlice()...)
 		} else {
 			result = result.Union(set)
 		}
@@ -279,7 +335,7 @@ func execSUnionStore(db *DB, args [][]byte) redis.Reply {
 		}
 		if result == nil {
 			// init
-			result = HashSet.Make(set.ToSlice()...)
+			result = makeSet(set.ToSlice()...)
 		} else {
 			result = result.Union(set)
 		}
@@ -291,7 +347,7 @@ func execSUnionStore(db *DB, args [][]byte) redis.Reply {
 		return &protocol.EmptyMultiBulkReply{}
 	}
 
-	set := HashSet.Make(result.ToSlice()...)
+	set := makeSet(result.ToSlice()...)
 	db.PutEntity(dest, &database.DataEntity{
 		Data: set,
 	})
@@ -322,7 +378,7 @@ func execSDiff(db *DB, args [][]byte) redis.Reply {
 		}
 		if result == nil {
 			// init
-			result = HashSet.Make(set.ToSlice()...)
+			result = makeSet(set.ToSlice()...)
 		} else {
 			result = result.Diff(set)
 			if result.Len() == 0 {
@@ -371,7 +427,7 @@ func execSDiffStore(db *DB, args [][]byte) redis.Reply {
 		}
 		if result == nil {
 			// init
-			result = HashSet.Make(set.ToSlice()...)
+			result = makeSet(set.ToSlice()...)
 		} else {
 			result = result.Diff(set)
 			if result.Len() == 0 {
@@ -387,7 +443,7 @@ func execSDiffStore(db *DB, args [][]byte) redis.Reply {
 		db.Remove(dest)
 		return &protocol.EmptyMultiBulkReply{}
 	}
-	set := HashSet.Make(result.ToSlice()...)
+	set := makeSet(result.ToSlice()...)
 	db.PutEntity(dest, &database.DataEntity{
 		Data: set,
 	})
@@ -396,60 +452,177 @@ func execSDiffStore(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(set.Len()))
 }
 
-// execSRandMember gets random members from set
+// execSRandMember gets random members from set, members may be repeated if count is negative
+// SRANDMEMBER key [count]
 func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	if len(args) != 1 && len(args) != 2 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'srandmember' command")
 	}
 	key := string(args[0])
+	var count int64
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
 
 	// get or init entity
 	set, errReply := db.getAsSet(key)
 	if errReply != nil {
 		return errReply
 	}
-	if set == nil {
-		return &protocol.NullBulkReply{}
-	}
 	if len(args) == 1 {
+		if set == nil {
+			return &protocol.NullBulkReply{}
+		}
 		// get a random member
 		members := set.RandomMembers(1)
 		return protocol.MakeBulkReply([]byte(members[0]))
 	}
-	count64, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	if set == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
 	}
-	count := int(count64)
+	var members []string
 	if count > 0 {
-		members := set.RandomDistinctMembers(count)
-		result := make([][]byte, len(members))
-		for i, v := range members {
-			result[i] = []byte(v)
+		members = set.RandomDistinctMembers(int(count))
+	} else {
+		members = set.RandomMembers(int(-count))
+	}
+	result := make([][]byte, len(members))
+	for i, v := range members {
+		result[i] = []byte(v)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execSPop removes and returns random members from set
+// SPOP key [count]
+func execSPop(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 2 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	key := string(args[0])
+	count := int64(1)
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count < 0 {
+			return protocol.MakeErrReply("ERR value is out of range, must be positive")
 		}
-		return protocol.MakeMultiBulkReply(result)
-	} else if count < 0 {
-		members := set.RandomMembers(-count)
-		result := make([][]byte, len(members))
-		for i, v := range members {
-			result[i] = []byte(v)
+	}
+
+	set, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if set == nil {
+		if len(args) == 1 {
+			return &protocol.NullBulkReply{}
 		}
-		return protocol.MakeMultiBulkReply(result)
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	if count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	if count > int64(set.Len()) {
+		count = int64(set.Len())
+	}
+	members := set.RandomDistinctMembers(int(count))
+	result := make([][]byte, len(members))
+	for i, member := range members {
+		set.Remove(member)
+		result[i] = []byte(member)
 	}
-	return &protocol.EmptyMultiBulkReply{}
+	if set.Len() == 0 {
+		db.Remove(key)
+	}
+	// popped members are random, so they are removed explicitly in aof
+	db.addAof(utils.ToCmdLine3(constant.SRem, append([][]byte{args[0]}, result...)...))
+	if len(args) == 1 {
+		return protocol.MakeBulkReply(result[0])
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execSMIsMember checks whether each member is in set
+func execSMIsMember(db *DB, args [][]byte) redis.Reply {
+	set, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(args)-1)
+	for i, member := range args[1:] {
+		if set != nil && set.Has(string(member)) {
+			result[i] = protocol.MakeIntReply(1)
+		} else {
+			result[i] = protocol.MakeIntReply(0)
+		}
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+func prepareSMove(args [][]byte) ([]string, []string) {
+	return []string{string(args[0]), string(args[1])}, nil
+}
+
+// execSMove moves member from source set to destination set
+// SMOVE source destination member
+func execSMove(db *DB, args [][]byte) redis.Reply {
+	src, dest, member := string(args[0]), string(args[1]), string(args[2])
+	srcSet, errReply := db.getAsSet(src)
+	if errReply != nil {
+		return errReply
+	}
+	if srcSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+	destSet, errReply := db.getAsSet(dest)
+	if errReply != nil {
+		return errReply
+	}
+	if src == dest {
+		if srcSet.Has(member) {
+			return protocol.MakeIntReply(1)
+		}
+		return protocol.MakeIntReply(0)
+	}
+	if srcSet.Remove(member) == 0 {
+		return protocol.MakeIntReply(0)
+	}
+	if srcSet.Len() == 0 {
+		db.Remove(src)
+	}
+	if destSet == nil {
+		destSet, _, _ = db.getOrInitSet(dest)
+	}
+	destSet.Add(member)
+	db.addAof(utils.ToCmdLine3(constant.SMove, args...))
+	return protocol.MakeIntReply(1)
+}
+
+func undoSMove(db *DB, args [][]byte) []CmdLine {
+	member := string(args[2])
+	undoCmdLines := rollbackSetMembers(db, string(args[0]), member)
+	return append(undoCmdLines, rollbackSetMembers(db, string(args[1]), member)...)
 }
 
 func init() {
-	RegisterCommand(constant.SAdd, execSAdd, writeFirstKey, undoSetChange, -3)
-	RegisterCommand(constant.SIsMember, execSIsMember, readFirstKey, nil, 3)
-	RegisterCommand(constant.SRem, execSRem, writeFirstKey, undoSetChange, -3)
-	RegisterCommand(constant.SCard, execSCard, readFirstKey, nil, 2)
-	RegisterCommand(constant.SMembers, execSMembers, readFirstKey, nil, 2)
-	RegisterCommand(constant.SInter, execSInter, prepareSetCalculate, nil, -2)
-	RegisterCommand(constant.SInterStore, execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand(constant.SUnion, execSUnion, prepareSetCalculate, nil, -2)
-	RegisterCommand(constant.SUnionStore, execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand(constant.SDiff, execSDiff, prepareSetCalculate, nil, -2)
-	RegisterCommand(constant.SDiffStore, execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand(constant.SRandMember, execSRandMember, readFirstKey, nil, -2)
+	RegisterCommand(constant.SAdd, execSAdd, writeFirstKey, undoSetChange, -3, flagWrite)
+	RegisterCommand(constant.SIsMember, execSIsMember, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.SRem, execSRem, writeFirstKey, undoSetChange, -3, flagWrite)
+	RegisterCommand(constant.SCard, execSCard, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.SMembers, execSMembers, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.SInter, execSInter, prepareSetCalculate, nil, -2, flagReadOnly)
+	RegisterCommand(constant.SInterStore, execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
+	RegisterCommand(constant.SUnion, execSUnion, prepareSetCalculate, nil, -2, flagReadOnly)
+	RegisterCommand(constant.SUnionStore, execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
+	RegisterCommand(constant.SDiff, execSDiff, prepareSetCalculate, nil, -2, flagReadOnly)
+	RegisterCommand(constant.SDiffStore, execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
+	RegisterCommand(constant.SRandMember, execSRandMember, readFirstKey, nil, -2, flagReadOnly)
+	RegisterCommand(constant.SPop, execSPop, writeFirstKey, rollbackFirstKey, -2, flagWrite)
+	RegisterCommand(constant.SMIsMember, execSMIsMember, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand(constant.SMove, execSMove, prepareSMove, undoSMove, 4, flagWrite)
+	RegisterCommand(constant.SInterCard, execSInterCard, prepareInterCard, nil, -3, flagReadOnly)
 }
@@ -10,6 +10,7 @@ import (
 	"godis/redis/protocol"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,7 +34,15 @@ type DB struct {
 	locker *lock.Locks
 	// stop all data access for execFlushDB
 	stopWorld sync.WaitGroup
-	addAof    func(CmdLine)
+	// swapMu is held in read mode while keys are locked, SWAPDB holds it in write mode to exchange keys
+	swapMu sync.RWMutex
+	// keysRef refers to current db, it moves with keys on SWAPDB, so that scheduled expiration follows the keys
+	keysRef *dbRef
+	addAof  func(CmdLine)
+	// keysChanged is called after versions of keys were bumped, keys is nil if db was flushed
+	keysChanged func(c redis.Connection, keys []string)
+	// waiters are clients of blocking commands waiting for keys
+	waiters *keyWaiters
 }
 
 // ExecFunc is interface for command executor
@@ -51,15 +60,45 @@ type CmdLine = [][]byte
 // execute from head to tail when undo
 type UndoFunc func(db *DB, args [][]byte) []CmdLine
 
+// dbRef refers to the database holding a set of keys
+type dbRef struct {
+	db atomic.Value // *DB
+}
+
+func makeDBRef(db *DB) *dbRef {
+	ref := &dbRef{}
+	ref.db.Store(db)
+	return ref
+}
+
+func (ref *dbRef) get() *DB {
+	return ref.db.Load().(*DB)
+}
+
+// lock locks keys in the database holding them, the keys may be moved by SWAPDB before locked
+func (ref *dbRef) lock(keys []string) *DB {
+	for {
+		db := ref.get()
+		db.RWLocks(keys, nil)
+		if ref.get() == db {
+			return db
+		}
+		db.RWUnLocks(keys, nil)
+	}
+}
+
 // makeDB create DB instance
 func makeDB() *DB {
 	db := &DB{
-		data:       dict.MakeConcurrent(dataDictSize),
-		ttlMap:     dict.MakeConcurrent(ttlDictSize),
-		versionMap: dict.MakeConcurrent(dataDictSize),
-		locker:     lock.Make(lockerSize),
-		addAof:     func(line CmdLine) {},
+		data:        dict.MakeConcurrent(dataDictSize),
+		ttlMap:      dict.MakeConcurrent(ttlDictSize),
+		versionMap:  dict.MakeConcurrent(dataDictSize),
+		locker:      lock.Make(lockerSize),
+		addAof:      func(line CmdLine) {},
+		keysChanged: func(c redis.Connection, keys []string) {},
+		waiters:     makeKeyWaiters(),
 	}
+	db.keysRef = makeDBRef(db)
 	return db
 }
 
@@ -67,12 +106,15 @@ func makeDB() *DB {
 // It is not concurrent safe
 func makeBasicDB() *DB {
 	db := &DB{
-		data:       dict.MakeSimple(),
-		ttlMap:     dict.MakeSimple(),
-		versionMap: dict.MakeSimple(),
-		locker:     lock.Make(1),
-		addAof:     func(line CmdLine) {},
+		data:        dict.MakeSimple(),
+		ttlMap:      dict.MakeSimple(),
+		versionMap:  dict.MakeSimple(),
+		locker:      lock.Make(1),
+		addAof:      func(line CmdLine) {},
+		keysChanged: func(c redis.Connection, keys []string) {},
+		waiters:     makeKeyWaiters(),
 	}
+	db.keysRef = makeDBRef(db)
 	return db
 }
 
@@ -105,11 +147,14 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 		EnqueueCmd(c, cmdLine)
 		return protocol.MakeQueuedReply()
 	}
+	if IsBlockingCommand(cmdName) {
+		return db.execBlocking(c, cmdLine)
+	}
 
-	return db.execNormalCommand(cmdLine)
+	return db.execNormalCommand(c, cmdLine)
 }
 
-func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
+func (db *DB) execNormalCommand(c redis.Connection, cmdLine [][]byte) redis.Reply {
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	cmd, ok := cmdTable[cmdName]
 	if !ok {
@@ -121,11 +166,13 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 
 	prepare := cmd.prepare
 	write, read := prepare(cmdLine[1:])
-	db.addVersion(write...)
 	db.RWLocks(write, read)
 	defer db.RWUnLocks(write, read)
 	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	result := fun(db, cmdLine[1:])
+	// bump versions after execution, so that clients being notified will read the new value
+	db.addVersion(c, write...)
+	return result
 }
 
 func validateArity(arity int, cmdArgs [][]byte) bool {
@@ -138,8 +185,18 @@ func validateArity(arity int, cmdArgs [][]byte) bool {
 
 /* --- Data Access --- */
 
-// GetEntity returns DataEntity bind to given key
+// GetEntity returns DataEntity bind to given key, and records the access for OBJECT IDLETIME and OBJECT FREQ
 func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
+	entity, ok := db.peekEntity(key)
+	if ok {
+		touchEntity(entity)
+	}
+	return entity, ok
+}
+
+// peekEntity returns DataEntity bind to given key without recording the access,
+// used by commands inspecting keys, e.g. TYPE, TTL and OBJECT
+func (db *DB) peekEntity(key string) (*database.DataEntity, bool) {
 	db.stopWorld.Wait()
 
 	raw, ok := db.data.Get(key)
@@ -156,21 +213,39 @@ func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
 // PutEntity puts a DataEntity into DB
 func (db *DB) PutEntity(key string, entity *database.DataEntity) int {
 	db.stopWorld.Wait()
+	db.initEntity(key, entity)
+	if hash, ok := entity.Data.(*dict.CompactDict); ok {
+		if _, hasTTL := hash.NextExpireTime(); hasTTL {
+			// hash carries fields with ttl, e.g. renamed from another key
+			db.expireFields(key, hash)
+		}
+	}
 	return db.data.Put(key, entity)
 }
 
 // PutIfExists edit an existing DataEntity
 func (db *DB) PutIfExists(key string, entity *database.DataEntity) int {
 	db.stopWorld.Wait()
+	db.initEntity(key, entity)
 	return db.data.PutIfExists(key, entity)
 }
 
 // PutIfAbsent insert an DataEntity only if the key not exists
 func (db *DB) PutIfAbsent(key string, entity *database.DataEntity) int {
 	db.stopWorld.Wait()
+	initEntity(entity)
 	return db.data.PutIfAbsent(key, entity)
 }
 
+// initEntity initializes access records of entity to put, access counter of existing key is kept
+func (db *DB) initEntity(key string, entity *database.DataEntity) {
+	if old, ok := db.peekEntity(key); ok {
+		overwriteEntity(entity, old)
+		return
+	}
+	initEntity(entity)
+}
+
 // Remove the given key from db
 func (db *DB) Remove(key string) {
 	db.stopWorld.Wait()
@@ -178,6 +253,7 @@ func (db *DB) Remove(key string) {
 	db.ttlMap.Remove(key)
 	taskKey := genExpireTask(key)
 	timewheel.Cancel(taskKey)
+	timewheel.Cancel(genFieldExpireTask(key))
 }
 
 // Removes the given keys from db
@@ -204,14 +280,22 @@ func (db *DB) Flush() {
 	db.locker = lock.Make(lockerSize)
 }
 
+// notifyFlushed tells keysChanged callback that all keys in db were removed
+func (db *DB) notifyFlushed() {
+	db.keysChanged(nil, nil)
+}
+
 /* --- Lock Function --- */
 
+// RWLocks locks keys, and keeps keys of db from being swapped until unlocked
 func (db *DB) RWLocks(writeKeys []string, readKeys []string) {
+	db.swapMu.RLock()
 	db.locker.RWLocks(writeKeys, readKeys)
 }
 
 func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
 	db.locker.RWUnLocks(writeKeys, readKeys)
+	db.swapMu.RUnlock()
 }
 
 /* --- TLL Function --- */
@@ -225,9 +309,10 @@ func (db *DB) Expire(key string, expireTime time.Time) {
 	db.stopWorld.Wait()
 	db.ttlMap.Put(key, expireTime)
 	taskKey := genExpireTask(key)
+	ref := db.keysRef
 	timewheel.At(expireTime, taskKey, func() {
 		keys := []string{key}
-		db.RWLocks(keys, nil)
+		db := ref.lock(keys)
 		defer db.RWUnLocks(keys, nil)
 		// check-lock-check, ttl may update during the wait
 		logger.Info("expire " + key)
@@ -239,6 +324,7 @@ func (db *DB) Expire(key string, expireTime time.Time) {
 		expired := time.Now().After(expireTime)
 		if expired {
 			db.Remove(key)
+			db.addVersion(nil, key)
 		}
 	})
 }
@@ -251,6 +337,51 @@ func (db *DB) Persist(key string) {
 	timewheel.Cancel(taskKey)
 }
 
+func genFieldExpireTask(key string) string {
+	return "field-expire:" + key
+}
+
+// expireFields schedules removal of expired fields of hash at the earliest expiration time of its fields.
+// Expired fields are invisible before removal, see dict.CompactDict
+func (db *DB) expireFields(key string, hash *dict.CompactDict) {
+	taskKey := genFieldExpireTask(key)
+	timewheel.Cancel(taskKey)
+	next, ok := hash.NextExpireTime()
+	if !ok {
+		return
+	}
+	delay := time.Until(next)
+	if delay < 0 {
+		delay = 0
+	}
+	ref := db.keysRef
+	timewheel.Delay(delay, taskKey, func() {
+		keys := []string{key}
+		db := ref.lock(keys)
+		defer db.RWUnLocks(keys, nil)
+		// the key may be removed or overwritten during the wait
+		raw, ok := db.data.Get(key)
+		if !ok {
+			return
+		}
+		current, ok := raw.(*database.DataEntity).Data.(*dict.CompactDict)
+		if !ok || current != hash {
+			return
+		}
+		if hash.RemoveExpired() == 0 {
+			db.expireFields(key, hash)
+			return
+		}
+		logger.Info("expire fields of " + key)
+		if hash.Len() == 0 {
+			db.Remove(key)
+		} else {
+			db.expireFields(key, hash)
+		}
+		db.addVersion(nil, key)
+	})
+}
+
 // IsExpired check whether a key is expired
 func (db *DB) IsExpired(key string) bool {
 	rawExpireTime, ok := db.ttlMap.Get(key)
@@ -261,17 +392,26 @@ func (db *DB) IsExpired(key string) bool {
 	expired := time.Now().After(expireTime)
 	if expired {
 		db.Remove(key)
+		db.addVersion(nil, key)
 	}
 	return expired
 }
 
 /* --- add version --- */
 
-func (db *DB) addVersion(keys ...string) {
+// versionCounter makes versions unique among databases, so that WATCH notices keys exchanged by SWAPDB
+var versionCounter uint32
+
+// addVersion bumps versions of the given keys modified by c, and notifies keysChanged callback
+func (db *DB) addVersion(c redis.Connection, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
 	for _, key := range keys {
-		versionCode := db.GetVersion(key)
-		db.versionMap.Put(key, versionCode+1)
+		db.versionMap.Put(key, atomic.AddUint32(&versionCounter, 1))
 	}
+	db.keysChanged(c, keys)
+	db.waiters.notify(keys)
 }
 
 // GetVersion returns version code of given key
@@ -285,6 +425,8 @@ func (db *DB) GetVersion(key string) uint32 {
 
 // ForEach traverses all the keys in the database
 func (db *DB) ForEach(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	db.swapMu.RLock()
+	defer db.swapMu.RUnlock()
 	db.data.ForEach(func(key string, raw interface{}) bool {
 		entity, _ := raw.(*database.DataEntity)
 		var expiration *time.Time
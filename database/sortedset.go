@@ -1,12 +1,14 @@
 package database
 
 import (
+	"godis/config"
 	"godis/constant"
 	SortedSet "godis/dataStruct/sortedset"
 	"godis/interface/database"
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/redis/protocol"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -30,7 +32,7 @@ func (db *DB) getOrInitSortedSet(key string) (sortedSet *SortedSet.SortedSet, in
 	}
 	inited = false
 	if sortedSet == nil {
-		sortedSet = SortedSet.Make()
+		sortedSet = SortedSet.MakeCompact(config.Properties.ZSetMaxListpackEntries, config.Properties.ZSetMaxListpackValue)
 		db.PutEntity(key, &database.DataEntity{
 			Data: sortedSet,
 		})
@@ -39,51 +41,170 @@ func (db *DB) getOrInitSortedSet(key string) (sortedSet *SortedSet.SortedSet, in
 	return sortedSet, inited, nil
 }
 
-// execZAdd adds member into sorted set
-func execZAdd(db *DB, args [][]byte) redis.Reply {
-	if len(args)%2 != 1 {
-		return protocol.MakeSyntaxErrReply()
+const (
+	zaddCompareNone = iota
+	zaddCompareGT
+	zaddCompareLT
+)
+
+// zaddArgs is parsed arguments of ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]
+type zaddArgs struct {
+	policy   int // upsertPolicy, insertPolicy(NX) or updatePolicy(XX)
+	compare  int
+	changed  bool
+	incr     bool
+	elements []*SortedSet.Element
+}
+
+func parseScore(arg []byte) (float64, protocol.ErrorReply) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, protocol.MakeErrReply("ERR value is not a valid float")
 	}
-	key := string(args[0])
-	size := (len(args) - 1) / 2
-	elements := make([]*SortedSet.Element, size)
-	for i := 0; i < size; i++ {
-		scoreValue := args[2*i+1]
-		member := string(args[2*i+2])
-		score, err := strconv.ParseFloat(string(scoreValue), 64)
-		if err != nil {
-			return protocol.MakeErrReply("ERR value is not a valid float")
+	return score, nil
+}
+
+func formatScore(score float64) []byte {
+	return []byte(strconv.FormatFloat(score, 'f', -1, 64))
+}
+
+func parseZAddArgs(args [][]byte) (*zaddArgs, protocol.ErrorReply) {
+	result := &zaddArgs{
+		policy:  upsertPolicy,
+		compare: zaddCompareNone,
+	}
+	nx, xx, gt, lt := false, false, false, false
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		case "ch":
+			result.changed = true
+		case "incr":
+			result.incr = true
+		default:
+			break flags
 		}
-		elements[i] = &SortedSet.Element{
-			Member: member,
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, protocol.MakeSyntaxErrReply()
+	}
+	if nx && xx {
+		return nil, protocol.MakeErrReply("ERR XX and NX options at the same time are not compatible")
+	}
+	if gt && lt || (gt || lt) && nx {
+		return nil, protocol.MakeErrReply("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if nx {
+		result.policy = insertPolicy
+	} else if xx {
+		result.policy = updatePolicy
+	}
+	if gt {
+		result.compare = zaddCompareGT
+	} else if lt {
+		result.compare = zaddCompareLT
+	}
+	if result.incr && len(pairs) > 2 {
+		return nil, protocol.MakeErrReply("ERR INCR option supports a single increment-element pair")
+	}
+	result.elements = make([]*SortedSet.Element, len(pairs)/2)
+	for j := range result.elements {
+		score, errReply := parseScore(pairs[2*j])
+		if errReply != nil {
+			return nil, errReply
+		}
+		result.elements[j] = &SortedSet.Element{
+			Member: string(pairs[2*j+1]),
 			Score:  score,
 		}
 	}
+	return result, nil
+}
 
-	// get or init entity
-	sortedSet, _, errReply := db.getOrInitSortedSet(key)
+// execZAdd adds member into sorted set
+func execZAdd(db *DB, args [][]byte) redis.Reply {
+	params, errReply := parseZAddArgs(args)
 	if errReply != nil {
 		return errReply
 	}
+	key := string(args[0])
 
-	i := 0
-	for _, e := range elements {
-		if sortedSet.Add(e.Member, e.Score) {
-			i++
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil && params.policy == updatePolicy {
+		if params.incr {
+			return &protocol.NullBulkReply{}
 		}
+		return protocol.MakeIntReply(0)
+	}
+	if sortedSet == nil {
+		sortedSet, _, _ = db.getOrInitSortedSet(key)
 	}
 
-	db.addAof(utils.ToCmdLine3(constant.ZAdd, args...))
-
-	return protocol.MakeIntReply(int64(i))
+	var added, updated int64
+	var incrResult *float64
+	for _, e := range params.elements {
+		current, exists := sortedSet.Get(e.Member)
+		if exists && params.policy == insertPolicy || !exists && params.policy == updatePolicy {
+			continue
+		}
+		score := e.Score
+		if params.incr && exists {
+			score += current.Score
+			if math.IsNaN(score) {
+				return protocol.MakeErrReply("ERR resulting score is not a number (NaN)")
+			}
+		}
+		if exists {
+			if params.compare == zaddCompareGT && score <= current.Score ||
+				params.compare == zaddCompareLT && score >= current.Score {
+				continue
+			}
+			if score != current.Score {
+				updated++
+			}
+		} else {
+			added++
+		}
+		sortedSet.Add(e.Member, score)
+		incrResult = &score
+	}
+	if added+updated > 0 {
+		db.addAof(utils.ToCmdLine3(constant.ZAdd, args...))
+	}
+	if params.incr {
+		if incrResult == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply(formatScore(*incrResult))
+	}
+	if params.changed {
+		return protocol.MakeIntReply(added + updated)
+	}
+	return protocol.MakeIntReply(added)
 }
 
 func undoZAdd(db *DB, args [][]byte) []CmdLine {
 	key := string(args[0])
-	size := (len(args) - 1) / 2
-	fields := make([]string, size)
-	for i := 0; i < size; i++ {
-		fields[i] = string(args[2*i+2])
+	params, errReply := parseZAddArgs(args)
+	if errReply != nil {
+		return nil
+	}
+	fields := make([]string, len(params.elements))
+	for i, e := range params.elements {
+		fields[i] = e.Member
 	}
 	return rollbackZSetFields(db, key, fields...)
 }
@@ -171,29 +292,175 @@ func execZCard(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(sortedSet.Len())
 }
 
-// execZRange gets members in range, sort by score in ascending order
-func execZRange(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 && len(args) != 4 {
-		return protocol.MakeErrReply("ERR wrong number of arguments for 'zrange' command")
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// zrangeArgs is parsed arguments of ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+type zrangeArgs struct {
+	by         int
+	rev        bool
+	offset     int64
+	limit      int64
+	withScores bool
+
+	// start and stop are ranks if by rank
+	start int64
+	stop  int64
+	// min and max are *SortedSet.ScoreBorder or *SortedSet.LexBorder
+	min SortedSet.Border
+	max SortedSet.Border
+}
+
+// parseZRangeArgs parses arguments of ZRANGE after key, ZRANGESTORE doesn't accept WITHSCORES
+func parseZRangeArgs(args [][]byte, allowWithScores bool) (*zrangeArgs, protocol.ErrorReply) {
+	result := &zrangeArgs{
+		by:    zrangeByRank,
+		limit: -1,
+	}
+	hasLimit := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "byscore":
+			result.by = zrangeByScore
+		case "bylex":
+			result.by = zrangeByLex
+		case "rev":
+			result.rev = true
+		case "withscores":
+			if !allowWithScores {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			result.withScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			var err error
+			result.offset, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			result.limit, err = strconv.ParseInt(string(args[i+2]), 10, 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			hasLimit = true
+			i += 2
+		default:
+			return nil, protocol.MakeSyntaxErrReply()
+		}
 	}
-	withScores := false
-	if len(args) == 4 {
-		if strings.ToUpper(string(args[3])) != "WITHSCORES" {
-			return protocol.MakeErrReply("syntax error")
+	if hasLimit && result.by == zrangeByRank {
+		return nil, protocol.MakeErrReply("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if result.withScores && result.by == zrangeByLex {
+		return nil, protocol.MakeErrReply("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	minArg, maxArg := string(args[0]), string(args[1])
+	if result.rev {
+		minArg, maxArg = maxArg, minArg
+	}
+	var err error
+	switch result.by {
+	case zrangeByRank:
+		result.start, err = strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil {
+			return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		result.stop, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	case zrangeByScore:
+		if result.min, err = SortedSet.ParseScoreBorder(minArg); err == nil {
+			result.max, err = SortedSet.ParseScoreBorder(maxArg)
+		}
+	case zrangeByLex:
+		if result.min, err = SortedSet.ParseLexBorder(minArg); err == nil {
+			result.max, err = SortedSet.ParseLexBorder(maxArg)
 		}
-		withScores = true
 	}
-	key := string(args[0])
-	start, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		return nil, protocol.MakeErrReply(err.Error())
 	}
-	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	return result, nil
+}
+
+// rangeElements returns elements of sorted set selected by params
+func rangeElements(sortedSet *SortedSet.SortedSet, params *zrangeArgs) []*SortedSet.Element {
+	switch params.by {
+	case zrangeByScore:
+		return sortedSet.RangeByScore(params.min.(*SortedSet.ScoreBorder), params.max.(*SortedSet.ScoreBorder),
+			params.offset, params.limit, params.rev)
+	case zrangeByLex:
+		return sortedSet.RangeByLex(params.min.(*SortedSet.LexBorder), params.max.(*SortedSet.LexBorder),
+			params.offset, params.limit, params.rev)
+	}
+	start, stop, ok := normalizeRankRange(params.start, params.stop, sortedSet.Len())
+	if !ok {
+		return nil
+	}
+	return sortedSet.Range(start, stop, params.rev)
+}
+
+// normalizeRankRange converts inclusive ranks which may be negative to [start, stop), returns false if range is empty
+func normalizeRankRange(start int64, stop int64, size int64) (int64, int64, bool) {
+	if start < -1*size {
+		start = 0
+	} else if start < 0 {
+		start = size + start
+	} else if start >= size {
+		return 0, 0, false
+	}
+	if stop < -1*size {
+		stop = 0
+	} else if stop < 0 {
+		stop = size + stop + 1
+	} else if stop < size {
+		stop = stop + 1
+	} else {
+		stop = size
+	}
+	if stop < start {
+		stop = start
 	}
-	return range0(db, key, start, stop, withScores, false)
+	return start, stop, true
+}
+
+func elementsToReply(elements []*SortedSet.Element, withScores bool) redis.Reply {
+	if withScores {
+		result := make([][]byte, 0, len(elements)*2)
+		for _, element := range elements {
+			result = append(result, []byte(element.Member), formatScore(element.Score))
+		}
+		return protocol.MakeMultiBulkReply(result)
+	}
+	result := make([][]byte, len(elements))
+	for i, element := range elements {
+		result[i] = []byte(element.Member)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execZRange gets members in range
+// ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func execZRange(db *DB, args [][]byte) redis.Reply {
+	params, errReply := parseZRangeArgs(args[1:], true)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return elementsToReply(rangeElements(sortedSet, params), params.withScores)
 }
 
 // execZRevRange gets members in range, sort by score in descending order
@@ -204,8 +471,8 @@ func execZRevRange(db *DB, args [][]byte) redis.Reply {
 	}
 	withScores := false
 	if len(args) == 4 {
-		if string(args[3]) != "WITHSCORES" {
-			return protocol.MakeErrReply("syntax error")
+		if strings.ToUpper(string(args[3])) != "WITHSCORES" {
+			return protocol.MakeSyntaxErrReply()
 		}
 		withScores = true
 	}
@@ -231,49 +498,13 @@ func range0(db *DB, key string, start int64, stop int64, withScores bool, desc b
 		return &protocol.EmptyMultiBulkReply{}
 	}
 
-	// compute index
-	size := sortedSet.Len() // asserts: size > 0
-	if start < -1*size {
-		start = 0
-	} else if start < 0 {
-		start = size + start
-	} else if start >= size {
+	start, stop, ok := normalizeRankRange(start, stop, sortedSet.Len())
+	if !ok {
 		return &protocol.EmptyMultiBulkReply{}
 	}
-	if stop < -1*size {
-		stop = 0
-	} else if stop < 0 {
-		stop = size + stop + 1
-	} else if stop < size {
-		stop = stop + 1
-	} else {
-		stop = size
-	}
-	if stop < start {
-		stop = start
-	}
-
 	// asserts: start in [0, size - 1], stop in [start, size]
 	slice := sortedSet.Range(start, stop, desc)
-	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
-			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
-		}
-		return protocol.MakeMultiBulkReply(result)
-	}
-	result := make([][]byte, len(slice))
-	i := 0
-	for _, element := range slice {
-		result[i] = []byte(element.Member)
-		i++
-	}
-	return protocol.MakeMultiBulkReply(result)
+	return elementsToReply(slice, withScores)
 }
 
 // execZCount gets number of members which score within given range
@@ -316,25 +547,7 @@ func rangeByScore0(db *DB, key string, min *SortedSet.ScoreBorder, max *SortedSe
 	}
 
 	slice := sortedSet.RangeByScore(min, max, offset, limit, desc)
-	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
-			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
-		}
-		return protocol.MakeMultiBulkReply(result)
-	}
-	result := make([][]byte, len(slice))
-	i := 0
-	for _, element := range slice {
-		result[i] = []byte(element.Member)
-		i++
-	}
-	return protocol.MakeMultiBulkReply(result)
+	return elementsToReply(slice, withScores)
 }
 
 // execZRangeByScore gets members which score within given range, in ascending order
@@ -454,11 +667,14 @@ func execZRemRangeByScore(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 	if sortedSet == nil {
-		return &protocol.EmptyMultiBulkReply{}
+		return protocol.MakeIntReply(0)
 	}
 
 	removed := sortedSet.RemoveByScore(min, max)
 	if removed > 0 {
+		if sortedSet.Len() == 0 {
+			db.Remove(key)
+		}
 		db.addAof(utils.ToCmdLine3(constant.ZRemRangeByScore, args...))
 	}
 	return protocol.MakeIntReply(removed)
@@ -485,31 +701,16 @@ func execZRemRangeByRank(db *DB, args [][]byte) redis.Reply {
 		return protocol.MakeIntReply(0)
 	}
 
-	// compute index
-	size := sortedSet.Len() // asserts: size > 0
-	if start < -1*size {
-		start = 0
-	} else if start < 0 {
-		start = size + start
-	} else if start >= size {
+	start, stop, ok := normalizeRankRange(start, stop, sortedSet.Len())
+	if !ok {
 		return protocol.MakeIntReply(0)
 	}
-	if stop < -1*size {
-		stop = 0
-	} else if stop < 0 {
-		stop = size + stop + 1
-	} else if stop < size {
-		stop = stop + 1
-	} else {
-		stop = size
-	}
-	if stop < start {
-		stop = start
-	}
-
 	// asserts: start in [0, size - 1], stop in [start, size]
 	removed := sortedSet.RemoveByRank(start, stop)
 	if removed > 0 {
+		if sortedSet.Len() == 0 {
+			db.Remove(key)
+		}
 		db.addAof(utils.ToCmdLine3(constant.ZRemRangeByRank, args...))
 	}
 	return protocol.MakeIntReply(removed)
@@ -541,6 +742,9 @@ func execZRem(db *DB, args [][]byte) redis.Reply {
 		}
 	}
 	if deleted > 0 {
+		if sortedSet.Len() == 0 {
+			db.Remove(key)
+		}
 		db.addAof(utils.ToCmdLine3(constant.ZRem, args...))
 	}
 	return protocol.MakeIntReply(deleted)
@@ -561,9 +765,9 @@ func execZIncrBy(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	rawDelta := string(args[1])
 	field := string(args[2])
-	delta, err := strconv.ParseFloat(rawDelta, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not a valid float")
+	delta, errReply := parseScore([]byte(rawDelta))
+	if errReply != nil {
+		return errReply
 	}
 
 	// get or init entity
@@ -572,17 +776,16 @@ func execZIncrBy(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 
-	element, exists := sortedSet.Get(field)
-	if !exists {
-		sortedSet.Add(field, delta)
-		db.addAof(utils.ToCmdLine3(constant.ZIncrBy, args...))
-		return protocol.MakeBulkReply(args[1])
+	score := delta
+	if element, exists := sortedSet.Get(field); exists {
+		score += element.Score
+		if math.IsNaN(score) {
+			return protocol.MakeErrReply("ERR resulting score is not a number (NaN)")
+		}
 	}
-	score := element.Score + delta
 	sortedSet.Add(field, score)
-	bytes := []byte(strconv.FormatFloat(score, 'f', -1, 64))
 	db.addAof(utils.ToCmdLine3(constant.ZIncrBy, args...))
-	return protocol.MakeBulkReply(bytes)
+	return protocol.MakeBulkReply(formatScore(score))
 }
 
 func undoZIncr(db *DB, args [][]byte) []CmdLine {
@@ -591,19 +794,560 @@ func undoZIncr(db *DB, args [][]byte) []CmdLine {
 	return rollbackZSetFields(db, key, field)
 }
 
+// parseLexRange parses min and max of lex range commands
+func parseLexRange(minArg []byte, maxArg []byte) (min *SortedSet.LexBorder, max *SortedSet.LexBorder, errReply protocol.ErrorReply) {
+	min, err := SortedSet.ParseLexBorder(string(minArg))
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply(err.Error())
+	}
+	max, err = SortedSet.ParseLexBorder(string(maxArg))
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply(err.Error())
+	}
+	return min, max, nil
+}
+
+// rangeByLex0 implements ZRANGEBYLEX key min max [LIMIT offset count] and ZREVRANGEBYLEX key max min [LIMIT offset count]
+func rangeByLex0(db *DB, args [][]byte, desc bool) redis.Reply {
+	minArg, maxArg := args[1], args[2]
+	if desc {
+		minArg, maxArg = maxArg, minArg
+	}
+	var offset int64 = 0
+	var limit int64 = -1
+	if len(args) > 3 {
+		if len(args) != 6 || strings.ToUpper(string(args[3])) != "LIMIT" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		var err error
+		offset, err = strconv.ParseInt(string(args[4]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		limit, err = strconv.ParseInt(string(args[5]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
+	min, max, errReply := parseLexRange(minArg, maxArg)
+	if errReply != nil {
+		return errReply
+	}
+
+	sortedSet, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return elementsToReply(sortedSet.RangeByLex(min, max, offset, limit, desc), false)
+}
+
+// execZRangeByLex gets members within given lex range, in ascending order
+func execZRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, false)
+}
+
+// execZRevRangeByLex gets members within given lex range, in descending order
+func execZRevRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, true)
+}
+
+// execZLexCount gets number of members within given lex range
+func execZLexCount(db *DB, args [][]byte) redis.Reply {
+	min, max, errReply := parseLexRange(args[1], args[2])
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(sortedSet.CountByLex(min, max))
+}
+
+// execZRemRangeByLex removes members within given lex range
+func execZRemRangeByLex(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	min, max, errReply := parseLexRange(args[1], args[2])
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+	removed := sortedSet.RemoveByLex(min, max)
+	if removed > 0 {
+		if sortedSet.Len() == 0 {
+			db.Remove(key)
+		}
+		db.addAof(utils.ToCmdLine3(constant.ZRemRangeByLex, args...))
+	}
+	return protocol.MakeIntReply(removed)
+}
+
+// popSortedSet removes and returns members with the lowest or highest scores, the key is removed if it becomes empty
+func (db *DB) popSortedSet(key string, sortedSet *SortedSet.SortedSet, count int64, max bool) []*SortedSet.Element {
+	var elements []*SortedSet.Element
+	cmdName := constant.ZPopMin
+	if max {
+		elements = sortedSet.PopMax(count)
+		cmdName = constant.ZPopMax
+	} else {
+		elements = sortedSet.PopMin(count)
+	}
+	if sortedSet.Len() == 0 {
+		db.Remove(key)
+	}
+	db.addAof(utils.ToCmdLine(cmdName, key, strconv.Itoa(len(elements))))
+	return elements
+}
+
+// zpop implements ZPOPMIN key [count] and ZPOPMAX key [count]
+func zpop(db *DB, args [][]byte, max bool) redis.Reply {
+	key := string(args[0])
+	var count int64 = 1
+	if len(args) > 2 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count < 0 {
+			return protocol.MakeErrReply("ERR value is out of range, must be positive")
+		}
+	}
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return elementsToReply(db.popSortedSet(key, sortedSet, count, max), true)
+}
+
+// execZPopMin removes and returns members with the lowest scores
+func execZPopMin(db *DB, args [][]byte) redis.Reply {
+	return zpop(db, args, false)
+}
+
+// execZPopMax removes and returns members with the highest scores
+func execZPopMax(db *DB, args [][]byte) redis.Reply {
+	return zpop(db, args, true)
+}
+
+func prepareBZPop(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args)-1)
+	for i := range keys {
+		keys[i] = string(args[i])
+	}
+	return keys, nil
+}
+
+// bzpop pops a member from the first non-empty sorted set, the blocking is done by DB.execBlocking
+// BZPOPMIN key [key ...] timeout
+func bzpop(db *DB, args [][]byte, max bool) redis.Reply {
+	if _, errReply := ParseBlockingTimeout(args[len(args)-1]); errReply != nil {
+		return errReply
+	}
+	for _, arg := range args[:len(args)-1] {
+		key := string(arg)
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if sortedSet == nil {
+			continue
+		}
+		element := db.popSortedSet(key, sortedSet, 1, max)[0]
+		return protocol.MakeMultiBulkReply([][]byte{
+			[]byte(key),
+			[]byte(element.Member),
+			formatScore(element.Score),
+		})
+	}
+	return protocol.MakeNullMultiBulkReply()
+}
+
+// execBZPopMin is the blocking version of ZPOPMIN
+func execBZPopMin(db *DB, args [][]byte) redis.Reply {
+	return bzpop(db, args, false)
+}
+
+// execBZPopMax is the blocking version of ZPOPMAX
+func execBZPopMax(db *DB, args [][]byte) redis.Reply {
+	return bzpop(db, args, true)
+}
+
+func undoBZPop(db *DB, args [][]byte) []CmdLine {
+	keys, _ := prepareBZPop(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+// execZRandMember returns random members, members may be repeated if count is negative
+// ZRANDMEMBER key [count [WITHSCORES]]
+func execZRandMember(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	if len(args) > 3 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	withScores := false
+	if len(args) == 3 {
+		if strings.ToLower(string(args[2])) != "withscores" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		withScores = true
+	}
+	var count int64
+	if len(args) >= 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if withScores && (count > math.MaxInt64/2 || count < -math.MaxInt64/2) || count < -maxRandomCount {
+			return protocol.MakeErrReply("ERR value is out of range")
+		}
+	}
+
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 1 {
+		if sortedSet == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(sortedSet.RandomMembers(1)[0].Member))
+	}
+	if sortedSet == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	var elements []*SortedSet.Element
+	if count > 0 {
+		elements = sortedSet.RandomDistinctMembers(int(count))
+	} else {
+		elements = sortedSet.RandomMembers(int(-count))
+	}
+	return elementsToReply(elements, withScores)
+}
+
+// execZMScore gets scores of members, score of missing member is nil
+func execZMScore(db *DB, args [][]byte) redis.Reply {
+	sortedSet, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, len(args)-1)
+	if sortedSet == nil {
+		return protocol.MakeMultiBulkReply(result)
+	}
+	for i, member := range args[1:] {
+		if element, exists := sortedSet.Get(string(member)); exists {
+			result[i] = formatScore(element.Score)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+/* ---- algebra ---- */
+
+// ZSetAlgebraArgs is parsed arguments of ZUNION, ZINTER, ZDIFF and their STORE variants after destination:
+// numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+type ZSetAlgebraArgs struct {
+	Keys       []string
+	Weights    []float64
+	Aggregate  int
+	WithScores bool
+
+	// op is zunion, zinter or zdiff
+	op string
+}
+
+// ParseZSetAlgebraArgs parses arguments from numkeys, STORE variants don't accept WITHSCORES
+// and ZDIFF doesn't accept WEIGHTS or AGGREGATE
+func ParseZSetAlgebraArgs(cmdName string, args [][]byte) (*ZSetAlgebraArgs, protocol.ErrorReply) {
+	cmdName = strings.ToLower(cmdName)
+	op := strings.TrimSuffix(cmdName, "store")
+	store := op != cmdName
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 1 {
+		return nil, protocol.MakeErrReply("ERR at least 1 input key is needed for '" + cmdName + "' command")
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, protocol.MakeSyntaxErrReply()
+	}
+	result := &ZSetAlgebraArgs{
+		Keys:      make([]string, numKeys),
+		Weights:   make([]float64, numKeys),
+		Aggregate: SortedSet.AggregateSum,
+		op:        op,
+	}
+	for i := range result.Keys {
+		result.Keys[i] = string(args[1+i])
+		result.Weights[i] = 1
+	}
+	for i := int(1 + numKeys); i < len(args); {
+		switch strings.ToLower(string(args[i])) {
+		case "weights":
+			if op == constant.ZDiff || i+len(result.Weights) >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			for j := range result.Weights {
+				weight, err := strconv.ParseFloat(string(args[i+1+j]), 64)
+				if err != nil || math.IsNaN(weight) {
+					return nil, protocol.MakeErrReply("ERR weight value is not a float")
+				}
+				result.Weights[j] = weight
+			}
+			i += 1 + len(result.Weights)
+		case "aggregate":
+			if op == constant.ZDiff || i+1 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			switch strings.ToLower(string(args[i+1])) {
+			case "sum":
+				result.Aggregate = SortedSet.AggregateSum
+			case "min":
+				result.Aggregate = SortedSet.AggregateMin
+			case "max":
+				result.Aggregate = SortedSet.AggregateMax
+			default:
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			i += 2
+		case "withscores":
+			if store {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			result.WithScores = true
+			i++
+		default:
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+	}
+	return result, nil
+}
+
+// Compute returns union, intersection or difference of the given sorted sets, nil sets are treated as empty
+func (params *ZSetAlgebraArgs) Compute(sets []*SortedSet.SortedSet) *SortedSet.SortedSet {
+	var scores map[string]float64
+	switch params.op {
+	case constant.ZInter:
+		scores = SortedSet.Intersect(sets, params.Weights, params.Aggregate)
+	case constant.ZDiff:
+		scores = SortedSet.Diff(sets)
+	default:
+		scores = SortedSet.Union(sets, params.Weights, params.Aggregate)
+	}
+	result := SortedSet.MakeCompact(config.Properties.ZSetMaxListpackEntries, config.Properties.ZSetMaxListpackValue)
+	for member, score := range scores {
+		result.Add(member, score)
+	}
+	return result
+}
+
+// MakeReply returns members of result ordered by score, with scores if WITHSCORES is given
+func (params *ZSetAlgebraArgs) MakeReply(result *SortedSet.SortedSet) redis.Reply {
+	return elementsToReply(result.Range(0, result.Len(), false), params.WithScores)
+}
+
+// getSortedSets returns sorted sets of keys, nil for keys not exist
+func (db *DB) getSortedSets(keys []string) ([]*SortedSet.SortedSet, protocol.ErrorReply) {
+	sets := make([]*SortedSet.SortedSet, len(keys))
+	for i, key := range keys {
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		sets[i] = sortedSet
+	}
+	return sets, nil
+}
+
+// storeSortedSet replaces dest with the given sorted set, dest is removed if the sorted set is empty
+func (db *DB) storeSortedSet(dest string, sortedSet *SortedSet.SortedSet) {
+	db.Remove(dest) // clean ttl and old value
+	if sortedSet.Len() > 0 {
+		db.PutEntity(dest, &database.DataEntity{
+			Data: sortedSet,
+		})
+	}
+}
+
+func prepareZSetAlgebra(cmdName string) PreFunc {
+	return func(args [][]byte) ([]string, []string) {
+		params, errReply := ParseZSetAlgebraArgs(cmdName, args)
+		if errReply != nil {
+			return nil, nil
+		}
+		return nil, params.Keys
+	}
+}
+
+func prepareZSetAlgebraStore(cmdName string) PreFunc {
+	return func(args [][]byte) ([]string, []string) {
+		params, errReply := ParseZSetAlgebraArgs(cmdName, args[1:])
+		if errReply != nil {
+			return nil, nil
+		}
+		return []string{string(args[0])}, params.Keys
+	}
+}
+
+// execZSetAlgebra returns ZUNION, ZINTER or ZDIFF of sorted sets
+func execZSetAlgebra(cmdName string) ExecFunc {
+	return func(db *DB, args [][]byte) redis.Reply {
+		params, errReply := ParseZSetAlgebraArgs(cmdName, args)
+		if errReply != nil {
+			return errReply
+		}
+		sets, errReply := db.getSortedSets(params.Keys)
+		if errReply != nil {
+			return errReply
+		}
+		return params.MakeReply(params.Compute(sets))
+	}
+}
+
+// execZSetAlgebraStore stores ZUNION, ZINTER or ZDIFF of sorted sets into destination
+func execZSetAlgebraStore(cmdName string) ExecFunc {
+	return func(db *DB, args [][]byte) redis.Reply {
+		params, errReply := ParseZSetAlgebraArgs(cmdName, args[1:])
+		if errReply != nil {
+			return errReply
+		}
+		sets, errReply := db.getSortedSets(params.Keys)
+		if errReply != nil {
+			return errReply
+		}
+		result := params.Compute(sets)
+		db.storeSortedSet(string(args[0]), result)
+		db.addAof(utils.ToCmdLine3(cmdName, args...))
+		return protocol.MakeIntReply(result.Len())
+	}
+}
+
+// ParseInterCardArgs parses arguments of ZINTERCARD and SINTERCARD:
+// numkeys key [key ...] [LIMIT limit], limit 0 means unlimited
+func ParseInterCardArgs(args [][]byte) (keys []string, limit int64, errReply protocol.ErrorReply) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || numKeys <= 0 {
+		return nil, 0, protocol.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, 0, protocol.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys = make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[1+i])
+	}
+	for i := int(1 + numKeys); i < len(args); i += 2 {
+		if strings.ToLower(string(args[i])) != "limit" || i+1 >= len(args) {
+			return nil, 0, protocol.MakeSyntaxErrReply()
+		}
+		limit, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil || limit < 0 {
+			return nil, 0, protocol.MakeErrReply("ERR LIMIT can't be negative")
+		}
+	}
+	return keys, limit, nil
+}
+
+// execZInterCard returns the number of members in intersection of sorted sets
+// ZINTERCARD numkeys key [key ...] [LIMIT limit]
+func execZInterCard(db *DB, args [][]byte) redis.Reply {
+	keys, limit, errReply := ParseInterCardArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	sets, errReply := db.getSortedSets(keys)
+	if errReply != nil {
+		return errReply
+	}
+	return protocol.MakeIntReply(SortedSet.IntersectCard(sets, limit))
+}
+
+// ZRangeStoreElements returns elements of sorted set selected by arguments of ZRANGESTORE after source:
+// min max [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+func ZRangeStoreElements(sortedSet *SortedSet.SortedSet, args [][]byte) ([]*SortedSet.Element, protocol.ErrorReply) {
+	params, errReply := parseZRangeArgs(args, false)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if sortedSet == nil {
+		return nil, nil
+	}
+	return rangeElements(sortedSet, params), nil
+}
+
+// execZRangeStore stores members in range of source into destination
+// ZRANGESTORE dst src min max [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+func execZRangeStore(db *DB, args [][]byte) redis.Reply {
+	sortedSet, errReply := db.getAsSortedSet(string(args[1]))
+	if errReply != nil {
+		return errReply
+	}
+	elements, errReply := ZRangeStoreElements(sortedSet, args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	result := SortedSet.MakeCompact(config.Properties.ZSetMaxListpackEntries, config.Properties.ZSetMaxListpackValue)
+	for _, element := range elements {
+		result.Add(element.Member, element.Score)
+	}
+	db.storeSortedSet(string(args[0]), result)
+	db.addAof(utils.ToCmdLine3(constant.ZRangeStore, args...))
+	return protocol.MakeIntReply(result.Len())
+}
+
+func prepareZRangeStore(args [][]byte) ([]string, []string) {
+	return []string{string(args[0])}, []string{string(args[1])}
+}
+
 func init() {
-	RegisterCommand(constant.ZAdd, execZAdd, writeFirstKey, undoZAdd, -4)
-	RegisterCommand(constant.ZScore, execZScore, readFirstKey, nil, 3)
-	RegisterCommand(constant.ZIncrBy, execZIncrBy, writeFirstKey, undoZIncr, 4)
-	RegisterCommand(constant.ZRank, execZRank, readFirstKey, nil, 3)
-	RegisterCommand(constant.ZCount, execZCount, readFirstKey, nil, 4)
-	RegisterCommand(constant.ZRevRank, execZRevRank, readFirstKey, nil, 3)
-	RegisterCommand(constant.ZCard, execZCard, readFirstKey, nil, 2)
-	RegisterCommand(constant.ZRange, execZRange, readFirstKey, nil, -4)
-	RegisterCommand(constant.ZRangeByScore, execZRangeByScore, readFirstKey, nil, -4)
-	RegisterCommand(constant.ZRevRange, execZRevRange, readFirstKey, nil, -4)
-	RegisterCommand(constant.ZRevRangeByScore, execZRevRangeByScore, readFirstKey, nil, -4)
-	RegisterCommand(constant.ZRem, execZRem, writeFirstKey, undoZRem, -3)
-	RegisterCommand(constant.ZRemRangeByScore, execZRemRangeByScore, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand(constant.ZRemRangeByRank, execZRemRangeByRank, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand(constant.ZAdd, execZAdd, writeFirstKey, undoZAdd, -4, flagWrite)
+	RegisterCommand(constant.ZScore, execZScore, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.ZIncrBy, execZIncrBy, writeFirstKey, undoZIncr, 4, flagWrite)
+	RegisterCommand(constant.ZRank, execZRank, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.ZCount, execZCount, readFirstKey, nil, 4, flagReadOnly)
+	RegisterCommand(constant.ZRevRank, execZRevRank, readFirstKey, nil, 3, flagReadOnly)
+	RegisterCommand(constant.ZCard, execZCard, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.ZRange, execZRange, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand(constant.ZRangeByScore, execZRangeByScore, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand(constant.ZRevRange, execZRevRange, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand(constant.ZRevRangeByScore, execZRevRangeByScore, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand(constant.ZRem, execZRem, writeFirstKey, undoZRem, -3, flagWrite)
+	RegisterCommand(constant.ZRemRangeByScore, execZRemRangeByScore, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand(constant.ZRemRangeByRank, execZRemRangeByRank, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand(constant.ZRangeByLex, execZRangeByLex, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand(constant.ZRevRangeByLex, execZRevRangeByLex, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand(constant.ZLexCount, execZLexCount, readFirstKey, nil, 4, flagReadOnly)
+	RegisterCommand(constant.ZRemRangeByLex, execZRemRangeByLex, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand(constant.ZPopMin, execZPopMin, writeFirstKey, rollbackFirstKey, -2, flagWrite)
+	RegisterCommand(constant.ZPopMax, execZPopMax, writeFirstKey, rollbackFirstKey, -2, flagWrite)
+	RegisterCommand(constant.BZPopMin, execBZPopMin, prepareBZPop, undoBZPop, -3, flagWrite|flagBlocking)
+	RegisterCommand(constant.BZPopMax, execBZPopMax, prepareBZPop, undoBZPop, -3, flagWrite|flagBlocking)
+	RegisterCommand(constant.ZRandMember, execZRandMember, readFirstKey, nil, -2, flagReadOnly)
+	RegisterCommand(constant.ZMScore, execZMScore, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand(constant.ZUnion, execZSetAlgebra(constant.ZUnion), prepareZSetAlgebra(constant.ZUnion), nil, -3, flagReadOnly)
+	RegisterCommand(constant.ZInter, execZSetAlgebra(constant.ZInter), prepareZSetAlgebra(constant.ZInter), nil, -3, flagReadOnly)
+	RegisterCommand(constant.ZDiff, execZSetAlgebra(constant.ZDiff), prepareZSetAlgebra(constant.ZDiff), nil, -3, flagReadOnly)
+	RegisterCommand(constant.ZUnionStore, execZSetAlgebraStore(constant.ZUnionStore), prepareZSetAlgebraStore(constant.ZUnionStore), rollbackFirstKey, -4, flagWrite)
+	RegisterCommand(constant.ZInterStore, execZSetAlgebraStore(constant.ZInterStore), prepareZSetAlgebraStore(constant.ZInterStore), rollbackFirstKey, -4, flagWrite)
+	RegisterCommand(constant.ZDiffStore, execZSetAlgebraStore(constant.ZDiffStore), prepareZSetAlgebraStore(constant.ZDiffStore), rollbackFirstKey, -4, flagWrite)
+	RegisterCommand(constant.ZInterCard, execZInterCard, prepareInterCard, nil, -3, flagReadOnly)
+	RegisterCommand(constant.ZRangeStore, execZRangeStore, prepareZRangeStore, rollbackFirstKey, -5, flagWrite)
 }
@@ -8,6 +8,7 @@ import (
 	"godis/interface/redis"
 	"godis/lib/utils"
 	"godis/redis/protocol"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -39,104 +40,149 @@ func execGet(db *DB, args [][]byte) redis.Reply {
 }
 
 const (
-	upsertPolicy = iota // default
-	insertPolicy        // set nx
-	updatePolicy        // set ex
+	upsertPolicy  = iota // default
+	insertPolicy         // set nx
+	updatePolicy         // set xx
+	ifEqualPolicy        // set ifeq
 )
 
-const unlimitedTTL int64 = 0
+// maxStringLen is the max length of string value, same as proto-max-bulk-len of redis
+const maxStringLen = 512 * 1024 * 1024
+
+// parseStrictInt parses canonical integers only, so that "+1", " 1" or "01" is rejected like redis
+func parseStrictInt(bytes []byte) (int64, bool) {
+	val, err := strconv.ParseInt(string(bytes), 10, 64)
+	if err != nil || strconv.FormatInt(val, 10) != string(bytes) {
+		return 0, false
+	}
+	return val, true
+}
+
+// parseExpireTime parses argument of EX, PX, EXAT or PXAT option into expire time
+func parseExpireTime(option string, arg []byte, cmdName string) (time.Time, protocol.ErrorReply) {
+	val, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	invalidErr := protocol.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+	if val <= 0 {
+		return time.Time{}, invalidErr
+	}
+	if option == "EX" || option == "EXAT" {
+		if val > math.MaxInt64/1000 {
+			return time.Time{}, invalidErr
+		}
+		val *= 1000
+	}
+	if option == "EX" || option == "PX" {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		if val > math.MaxInt64-now {
+			return time.Time{}, invalidErr
+		}
+		val += now
+	}
+	return time.Unix(val/1000, val%1000*int64(time.Millisecond)), nil
+}
 
 // execSet sets string value and time to live to the given key
+// SET key value [NX | XX | IFEQ comparison-value] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
 func execSet(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[1]
 	policy := upsertPolicy
-	ttl := unlimitedTTL
+	var comparison []byte
+	var expireTime time.Time
+	expireOption := ""
+	expireArg := 0 // index of argument of expireOption
+	keepTTL := false
+	returnOld := false
 
 	// parse options
-	if len(args) > 2 {
-		for i := 2; i < len(args); i++ {
-			arg := strings.ToUpper(string(args[i]))
-			if arg == "NX" { // insert
-				if policy == updatePolicy {
-					return &protocol.SyntaxErrReply{}
-				}
-				policy = insertPolicy
-			} else if arg == "XX" { // update policy
-				if policy == insertPolicy {
-					return &protocol.SyntaxErrReply{}
-				}
+	for i := 2; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "NX", "XX":
+			if policy != upsertPolicy {
+				return &protocol.SyntaxErrReply{}
+			}
+			policy = insertPolicy
+			if arg == "XX" {
 				policy = updatePolicy
-			} else if arg == "EX" { // ttl in seconds
-				if ttl != unlimitedTTL {
-					// ttl has been set
-					return &protocol.SyntaxErrReply{}
-				}
-				if i+1 >= len(args) {
-					return &protocol.SyntaxErrReply{}
-				}
-				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-				if err != nil {
-					return &protocol.SyntaxErrReply{}
-				}
-				if ttlArg <= 0 {
-					return protocol.MakeErrReply("ERR invalid expire time in set")
-				}
-				ttl = ttlArg * 1000
-				i++ // skip next arg
-			} else if arg == "PX" { // ttl in milliseconds
-				if ttl != unlimitedTTL {
-					return &protocol.SyntaxErrReply{}
-				}
-				if i+1 >= len(args) {
-					return &protocol.SyntaxErrReply{}
-				}
-				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-				if err != nil {
-					return &protocol.SyntaxErrReply{}
-				}
-				if ttlArg <= 0 {
-					return protocol.MakeErrReply("ERR invalid expire time in set")
-				}
-				ttl = ttlArg
-				i++ // skip next arg
-			} else {
+			}
+		case "IFEQ":
+			if policy != upsertPolicy || i+1 >= len(args) {
+				return &protocol.SyntaxErrReply{}
+			}
+			policy = ifEqualPolicy
+			comparison = args[i+1]
+			i++ // skip next arg
+		case "GET":
+			returnOld = true
+		case "KEEPTTL":
+			if keepTTL || expireOption != "" {
+				return &protocol.SyntaxErrReply{}
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if keepTTL || expireOption != "" || i+1 >= len(args) {
 				return &protocol.SyntaxErrReply{}
 			}
+			expireOption = arg
+			expireArg = i + 1
+			i++ // skip next arg
+		default:
+			return &protocol.SyntaxErrReply{}
 		}
 	}
-
-	entity := &database.DataEntity{
-		Data: value,
+	if expireOption != "" {
+		// parse expire time after all options are checked, same as redis
+		var errReply protocol.ErrorReply
+		expireTime, errReply = parseExpireTime(expireOption, args[expireArg], "set")
+		if errReply != nil {
+			return errReply
+		}
 	}
 
-	var result int
+	old, errReply := db.getAsString(key)
+	if errReply != nil && (returnOld || policy == ifEqualPolicy) {
+		return errReply
+	}
+	exists := old != nil || errReply != nil
+	var ok bool
 	switch policy {
-	case upsertPolicy:
-		db.PutEntity(key, entity)
-		result = 1
 	case insertPolicy:
-		result = db.PutIfAbsent(key, entity)
+		ok = !exists
 	case updatePolicy:
-		result = db.PutIfExists(key, entity)
+		ok = exists
+	case ifEqualPolicy:
+		ok = old != nil && utils.BytesEquals(old, comparison)
+	default:
+		ok = true
 	}
-	if result > 0 {
-		if ttl != unlimitedTTL {
-			expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+
+	if ok {
+		db.PutEntity(key, &database.DataEntity{
+			Data: value,
+		})
+		if expireOption != "" {
 			db.Expire(key, expireTime)
-			db.addAof(CmdLine{
-				[]byte("SET"),
-				args[0],
-				args[1],
-			})
+			db.addAof(utils.ToCmdLine3(constant.Set, args[0], value))
 			db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
+		} else if keepTTL {
+			db.addAof(utils.ToCmdLine3(constant.Set, args[0], value, []byte("KEEPTTL")))
 		} else {
 			db.Persist(key) // override ttl
-			db.addAof(utils.ToCmdLine3("set", args...))
+			db.addAof(utils.ToCmdLine3(constant.Set, args[0], value))
 		}
 	}
 
-	if result > 0 {
+	if returnOld {
+		if old == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply(old)
+	}
+	if ok {
 		return &protocol.OkReply{}
 	}
 	return &protocol.NullBulkReply{}
@@ -146,34 +192,30 @@ func execSet(db *DB, args [][]byte) redis.Reply {
 func execSetNX(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[1]
-	entity := &database.DataEntity{
-		Data: value,
+	if _, exists := db.GetEntity(key); exists {
+		return protocol.MakeIntReply(0)
 	}
-	result := db.PutIfAbsent(key, entity)
+	db.PutEntity(key, &database.DataEntity{
+		Data: value,
+	})
 	db.addAof(utils.ToCmdLine3(constant.SetNx, args...))
-	return protocol.MakeIntReply(int64(result))
+	return protocol.MakeIntReply(1)
 }
 
 // execSetEX sets string and its ttl
 func execSetEX(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[2]
-
-	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return &protocol.SyntaxErrReply{}
-	}
-	if ttlArg <= 0 {
-		return protocol.MakeErrReply("ERR invalid expire time in setex")
+	expireTime, errReply := parseExpireTime("EX", args[1], constant.SetEx)
+	if errReply != nil {
+		return errReply
 	}
-	ttl := ttlArg * 1000
 
 	entity := &database.DataEntity{
 		Data: value,
 	}
 
 	db.PutEntity(key, entity)
-	expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
 	db.Expire(key, expireTime)
 	db.addAof(utils.ToCmdLine3(constant.SetEx, args...))
 	db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
@@ -184,13 +226,9 @@ func execSetEX(db *DB, args [][]byte) redis.Reply {
 func execPSetEX(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[2]
-
-	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return &protocol.SyntaxErrReply{}
-	}
-	if ttlArg <= 0 {
-		return protocol.MakeErrReply("ERR invalid expire time in setex")
+	expireTime, errReply := parseExpireTime("PX", args[1], constant.PSetEx)
+	if errReply != nil {
+		return errReply
 	}
 
 	entity := &database.DataEntity{
@@ -198,14 +236,70 @@ func execPSetEX(db *DB, args [][]byte) redis.Reply {
 	}
 
 	db.PutEntity(key, entity)
-	expireTime := time.Now().Add(time.Duration(ttlArg) * time.Millisecond)
 	db.Expire(key, expireTime)
-	db.addAof(utils.ToCmdLine3(constant.SetEx, args...))
+	db.addAof(utils.ToCmdLine3(constant.PSetEx, args...))
 	db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
 
 	return &protocol.OkReply{}
 }
 
+// execGetEX returns string value bound to key and optionally sets or removes its ttl
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+func execGetEX(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	option := ""
+	var expireTime time.Time
+	if len(args) > 1 {
+		option = strings.ToUpper(string(args[1]))
+		switch {
+		case option == "PERSIST" && len(args) == 2:
+		case (option == "EX" || option == "PX" || option == "EXAT" || option == "PXAT") && len(args) == 3:
+			var errReply protocol.ErrorReply
+			expireTime, errReply = parseExpireTime(option, args[2], constant.GetEx)
+			if errReply != nil {
+				return errReply
+			}
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	if bytes == nil {
+		return &protocol.NullBulkReply{}
+	}
+	switch option {
+	case "":
+	case "PERSIST":
+		if _, ok := db.ttlMap.Get(key); ok {
+			db.Persist(key)
+			db.addAof(utils.ToCmdLine3(constant.Persist, args[0]))
+		}
+	default:
+		db.Expire(key, expireTime)
+		db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
+	}
+	return protocol.MakeBulkReply(bytes)
+}
+
+// execGetDel returns string value bound to key and removes the key
+func execGetDel(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	if bytes == nil {
+		return &protocol.NullBulkReply{}
+	}
+	db.Remove(key)
+	db.addAof(utils.ToCmdLine3(constant.Del, args[0]))
+	return protocol.MakeBulkReply(bytes)
+}
+
 func prepareMSet(args [][]byte) ([]string, []string) {
 	size := len(args) / 2
 	keys := make([]string, size)
@@ -223,7 +317,7 @@ func undoMSet(db *DB, args [][]byte) []CmdLine {
 // execMSet sets multi key-value in database
 func execMSet(db *DB, args [][]byte) redis.Reply {
 	if len(args)%2 != 0 {
-		return protocol.MakeSyntaxErrReply()
+		return protocol.MakeArgNumErrReply(constant.MSet)
 	}
 
 	size := len(args) / 2
@@ -237,6 +331,7 @@ func execMSet(db *DB, args [][]byte) redis.Reply {
 	for i, key := range keys {
 		value := values[i]
 		db.PutEntity(key, &database.DataEntity{Data: value})
+		db.Persist(key) // override ttl
 	}
 	db.addAof(utils.ToCmdLine3(constant.MSet, args...))
 	return &protocol.OkReply{}
@@ -279,7 +374,7 @@ func execMGet(db *DB, args [][]byte) redis.Reply {
 func execMSetNX(db *DB, args [][]byte) redis.Reply {
 	// parse args
 	if len(args)%2 != 0 {
-		return protocol.MakeSyntaxErrReply()
+		return protocol.MakeArgNumErrReply(constant.MSetNx)
 	}
 	size := len(args) / 2
 	values := make([][]byte, size)
@@ -323,62 +418,50 @@ func execGetSet(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeBulkReply(old)
 }
 
-// execIncr increments the integer value of a key by one
-func execIncr(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-
-	bytes, err := db.getAsString(key)
-	if err != nil {
-		return err
+// incrBy adds delta to the integer value of a key, a key not exists is regarded as 0
+func (db *DB) incrBy(key string, delta int64) redis.Reply {
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
 	}
+	var val int64
 	if bytes != nil {
-		val, err := strconv.ParseInt(string(bytes), 10, 64)
-		if err != nil {
+		var ok bool
+		val, ok = parseStrictInt(bytes)
+		if !ok {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
-		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val+1, 10)),
-		})
-		db.addAof(utils.ToCmdLine3(constant.Incr, args...))
-		return protocol.MakeIntReply(val + 1)
 	}
+	if (delta > 0 && val > math.MaxInt64-delta) || (delta < 0 && val < math.MinInt64-delta) {
+		return protocol.MakeErrReply("ERR increment or decrement would overflow")
+	}
+	val += delta
 	db.PutEntity(key, &database.DataEntity{
-		Data: []byte("1"),
+		Data: []byte(strconv.FormatInt(val, 10)),
 	})
-	db.addAof(utils.ToCmdLine3(constant.Incr, args...))
-	return protocol.MakeIntReply(1)
+	return protocol.MakeIntReply(val)
+}
+
+// execIncr increments the integer value of a key by one
+func execIncr(db *DB, args [][]byte) redis.Reply {
+	result := db.incrBy(string(args[0]), 1)
+	if !protocol.IsErrorReply(result) {
+		db.addAof(utils.ToCmdLine3(constant.Incr, args...))
+	}
+	return result
 }
 
 // execIncrBy increments the integer value of a key by given value
 func execIncrBy(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-	rawDelta := string(args[1])
-	delta, err := strconv.ParseInt(rawDelta, 10, 64)
-	if err != nil {
+	delta, ok := parseStrictInt(args[1])
+	if !ok {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
-
-	bytes, errReply := db.getAsString(key)
-	if errReply != nil {
-		return errReply
-	}
-	if bytes != nil {
-		// existed value
-		val, err := strconv.ParseInt(string(bytes), 10, 64)
-		if err != nil {
-			return protocol.MakeErrReply("ERR value is not an integer or out of range")
-		}
-		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val+delta, 10)),
-		})
+	result := db.incrBy(string(args[0]), delta)
+	if !protocol.IsErrorReply(result) {
 		db.addAof(utils.ToCmdLine3(constant.IncrBy, args...))
-		return protocol.MakeIntReply(val + delta)
 	}
-	db.PutEntity(key, &database.DataEntity{
-		Data: args[1],
-	})
-	db.addAof(utils.ToCmdLine3(constant.IncrBy, args...))
-	return protocol.MakeIntReply(delta)
+	return result
 }
 
 // execIncrByFloat increments the float value of a key by given value
@@ -394,82 +477,45 @@ func execIncrByFloat(db *DB, args [][]byte) redis.Reply {
 	if errReply != nil {
 		return errReply
 	}
+	val := decimal.Zero
 	if bytes != nil {
-		val, err := decimal.NewFromString(string(bytes))
+		val, err = decimal.NewFromString(string(bytes))
 		if err != nil {
 			return protocol.MakeErrReply("ERR value is not a valid float")
 		}
-		resultBytes := []byte(val.Add(delta).String())
-		db.PutEntity(key, &database.DataEntity{
-			Data: resultBytes,
-		})
-		db.addAof(utils.ToCmdLine3(constant.IncrByFloat, args...))
-		return protocol.MakeBulkReply(resultBytes)
 	}
+	resultBytes := []byte(val.Add(delta).String())
 	db.PutEntity(key, &database.DataEntity{
-		Data: args[1],
+		Data: resultBytes,
 	})
-	db.addAof(utils.ToCmdLine3(constant.IncrByFloat, args...))
-	return protocol.MakeBulkReply(args[1])
+	// write result into aof, so that replaying gets the same value
+	db.addAof(utils.ToCmdLine3(constant.Set, args[0], resultBytes, []byte("KEEPTTL")))
+	return protocol.MakeBulkReply(resultBytes)
 }
 
 // execDecr decrements the integer value of a key by one
 func execDecr(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-
-	bytes, errReply := db.getAsString(key)
-	if errReply != nil {
-		return errReply
-	}
-	if bytes != nil {
-		val, err := strconv.ParseInt(string(bytes), 10, 64)
-		if err != nil {
-			return protocol.MakeErrReply("ERR value is not an integer or out of range")
-		}
-		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val-1, 10)),
-		})
+	result := db.incrBy(string(args[0]), -1)
+	if !protocol.IsErrorReply(result) {
 		db.addAof(utils.ToCmdLine3(constant.Decr, args...))
-		return protocol.MakeIntReply(val - 1)
 	}
-	entity := &database.DataEntity{
-		Data: []byte("-1"),
-	}
-	db.PutEntity(key, entity)
-	db.addAof(utils.ToCmdLine3(constant.Decr, args...))
-	return protocol.MakeIntReply(-1)
+	return result
 }
 
-// execDecrBy decrements the integer value of a key by onedecrement
+// execDecrBy decrements the integer value of a key by decrement
 func execDecrBy(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-	rawDelta := string(args[1])
-	delta, err := strconv.ParseInt(rawDelta, 10, 64)
-	if err != nil {
+	delta, ok := parseStrictInt(args[1])
+	if !ok {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
-
-	bytes, errReply := db.getAsString(key)
-	if errReply != nil {
-		return errReply
+	if delta == math.MinInt64 {
+		return protocol.MakeErrReply("ERR decrement would overflow")
 	}
-	if bytes != nil {
-		val, err := strconv.ParseInt(string(bytes), 10, 64)
-		if err != nil {
-			return protocol.MakeErrReply("ERR value is not an integer or out of range")
-		}
-		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val-delta, 10)),
-		})
+	result := db.incrBy(string(args[0]), -delta)
+	if !protocol.IsErrorReply(result) {
 		db.addAof(utils.ToCmdLine3(constant.DecrBy, args...))
-		return protocol.MakeIntReply(val - delta)
 	}
-	valueStr := strconv.FormatInt(-delta, 10)
-	db.PutEntity(key, &database.DataEntity{
-		Data: []byte(valueStr),
-	})
-	db.addAof(utils.ToCmdLine3(constant.DecrBy, args...))
-	return protocol.MakeIntReply(-delta)
+	return result
 }
 
 // execStrLen returns len of string value bound to the given key
@@ -492,6 +538,9 @@ func execAppend(db *DB, args [][]byte) redis.Reply {
 	if err != nil {
 		return err
 	}
+	if len(bytes)+len(args[1]) > maxStringLen {
+		return protocol.MakeErrReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
 	bytes = append(bytes, args[1]...)
 	db.PutEntity(key, &database.DataEntity{
 		Data: bytes,
@@ -506,44 +555,48 @@ func execSetRange(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	offset, errNative := strconv.ParseInt(string(args[1]), 10, 64)
 	if errNative != nil {
-		return protocol.MakeErrReply(errNative.Error())
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if offset < 0 {
+		return protocol.MakeErrReply("ERR offset is out of range")
 	}
 	value := args[2]
 	bytes, err := db.getAsString(key)
 	if err != nil {
 		return err
 	}
-	bytesLen := int64(len(bytes))
-	if bytesLen < offset {
-		diff := offset - bytesLen
-		diffArray := make([]byte, diff)
-		bytes = append(bytes, diffArray...)
-		bytesLen = int64(len(bytes))
-	}
-	for i := 0; i < len(value); i++ {
-		idx := offset + int64(i)
-		if idx >= bytesLen {
-			bytes = append(bytes, value[i])
-		} else {
-			bytes[idx] = value[i]
-		}
+	if len(value) == 0 {
+		// nothing to write, and the key won't be created
+		return protocol.MakeIntReply(int64(len(bytes)))
+	}
+	if offset+int64(len(value)) > maxStringLen {
+		return protocol.MakeErrReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	// write into a copy, because the old value may be shared with undo logs or aof rewriting
+	size := int(offset) + len(value)
+	if size < len(bytes) {
+		size = len(bytes)
 	}
+	result := make([]byte, size)
+	copy(result, bytes)
+	copy(result[offset:], value)
 	db.PutEntity(key, &database.DataEntity{
-		Data: bytes,
+		Data: result,
 	})
 	db.addAof(utils.ToCmdLine3(constant.SetRange, args...))
-	return protocol.MakeIntReply(int64(len(bytes)))
+	return protocol.MakeIntReply(int64(len(result)))
 }
 
+// execGetRange returns substring of the string stored at key, both start and end are inclusive
 func execGetRange(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	startIdx, errNative := strconv.ParseInt(string(args[1]), 10, 64)
 	if errNative != nil {
-		return protocol.MakeErrReply(errNative.Error())
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	endIdx, errNative := strconv.ParseInt(string(args[2]), 10, 64)
 	if errNative != nil {
-		return protocol.MakeErrReply(errNative.Error())
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
 
 	bytes, err := db.getAsString(key)
@@ -551,51 +604,195 @@ func execGetRange(db *DB, args [][]byte) redis.Reply {
 		return err
 	}
 
-	if bytes == nil {
-		return protocol.MakeNullBulkReply()
+	bytesLen := int64(len(bytes))
+	if startIdx < 0 && endIdx < 0 && startIdx > endIdx {
+		return protocol.MakeBulkReply([]byte{})
+	}
+	if startIdx < 0 {
+		startIdx += bytesLen
 	}
+	if endIdx < 0 {
+		endIdx += bytesLen
+	}
+	if startIdx < 0 {
+		startIdx = 0
+	}
+	if endIdx < 0 {
+		endIdx = 0
+	}
+	if endIdx >= bytesLen {
+		endIdx = bytesLen - 1
+	}
+	if startIdx > endIdx || bytesLen == 0 {
+		return protocol.MakeBulkReply([]byte{})
+	}
+	return protocol.MakeBulkReply(bytes[startIdx : endIdx+1])
+}
 
-	bytesLen := int64(len(bytes))
-	if startIdx < -1*bytesLen {
-		return &protocol.NullBulkReply{}
-	} else if startIdx < 0 {
-		startIdx = bytesLen + startIdx
-	} else if startIdx >= bytesLen {
-		return &protocol.NullBulkReply{}
+// prepareLCS returns keys of LCS key1 key2 [options...]
+func prepareLCS(args [][]byte) ([]string, []string) {
+	return nil, []string{string(args[0]), string(args[1])}
+}
+
+// execLCS finds the longest common subsequence of two strings
+func execLCS(db *DB, args [][]byte) redis.Reply {
+	values := make([][]byte, 2)
+	for i := range values {
+		bytes, errReply := db.getAsString(string(args[i]))
+		if errReply != nil {
+			return protocol.MakeErrReply("ERR The specified keys must contain string values")
+		}
+		values[i] = bytes
 	}
-	if endIdx < -1*bytesLen {
-		return &protocol.NullBulkReply{}
-	} else if endIdx < 0 {
-		endIdx = bytesLen + endIdx + 1
-	} else if endIdx < bytesLen {
-		endIdx = endIdx + 1
-	} else {
-		endIdx = bytesLen
+	return LCS(values[0], values[1], args[2:])
+}
+
+// LCS computes the longest common subsequence of a and b, options are the same as LCS command:
+// [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+func LCS(a []byte, b []byte, options [][]byte) redis.Reply {
+	getLen := false
+	getIdx := false
+	withMatchLen := false
+	var minMatchLen int64
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(string(options[i]))
+		switch {
+		case option == "LEN":
+			getLen = true
+		case option == "IDX":
+			getIdx = true
+		case option == "WITHMATCHLEN":
+			withMatchLen = true
+		case option == "MINMATCHLEN" && i+1 < len(options):
+			var err error
+			minMatchLen, err = strconv.ParseInt(string(options[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if minMatchLen < 0 {
+				minMatchLen = 0
+			}
+			i++
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+	if getLen && getIdx {
+		return protocol.MakeErrReply("ERR If you want both the length and indexes, please just use IDX.")
 	}
-	if startIdx > endIdx {
-		return protocol.MakeNullBulkReply()
+
+	// dp[i*(len(b)+1)+j] is the length of LCS of a[:i] and b[:j]
+	aLen, bLen := len(a), len(b)
+	if int64(aLen+1)*int64(bLen+1)*4 > maxStringLen {
+		return protocol.MakeErrReply("ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+	width := bLen + 1
+	dp := make([]uint32, (aLen+1)*width)
+	for i := 1; i <= aLen; i++ {
+		for j := 1; j <= bLen; j++ {
+			if a[i-1] == b[j-1] {
+				dp[i*width+j] = dp[(i-1)*width+j-1] + 1
+			} else if dp[(i-1)*width+j] > dp[i*width+j-1] {
+				dp[i*width+j] = dp[(i-1)*width+j]
+			} else {
+				dp[i*width+j] = dp[i*width+j-1]
+			}
+		}
+	}
+	idx := int(dp[aLen*width+bLen])
+	if getLen {
+		return protocol.MakeIntReply(int64(idx))
+	}
+
+	// walk back from the end of dp table to collect the subsequence and matched ranges
+	result := make([]byte, idx)
+	total := idx
+	var matches []redis.Reply
+	aStart, aEnd, bStart, bEnd := aLen, 0, 0, 0 // aStart == aLen means no range in progress
+	for i, j := aLen, bLen; i > 0 && j > 0; {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aStart == aLen {
+				aStart, aEnd, bStart, bEnd = i-1, i-1, j-1, j-1
+			} else if aStart == i && bStart == j {
+				// extend the range backward since it is contiguous
+				aStart--
+				bStart--
+			} else {
+				emitRange = true
+			}
+			// emit the range if it reaches the head of either string
+			if aStart == 0 || bStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if dp[(i-1)*width+j] > dp[i*width+j-1] {
+				i--
+			} else {
+				j--
+			}
+			if aStart != aLen {
+				emitRange = true
+			}
+		}
+		if emitRange {
+			matchLen := int64(aEnd - aStart + 1)
+			if getIdx && (minMatchLen == 0 || matchLen >= minMatchLen) {
+				match := []redis.Reply{
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(aStart)),
+						protocol.MakeIntReply(int64(aEnd)),
+					}),
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(bStart)),
+						protocol.MakeIntReply(int64(bEnd)),
+					}),
+				}
+				if withMatchLen {
+					match = append(match, protocol.MakeIntReply(matchLen))
+				}
+				matches = append(matches, protocol.MakeMultiRawReply(match))
+			}
+			aStart = aLen // restart at the next match
+		}
 	}
 
-	return protocol.MakeBulkReply(bytes[startIdx:endIdx])
+	if getIdx {
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("matches")),
+			protocol.MakeMultiRawReply(matches),
+			protocol.MakeBulkReply([]byte("len")),
+			protocol.MakeIntReply(int64(total)),
+		})
+	}
+	return protocol.MakeBulkReply(result)
 }
 
 func init() {
-	RegisterCommand(constant.Set, execSet, writeFirstKey, rollbackFirstKey, -3)
-	RegisterCommand(constant.SetNx, execSetNX, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand(constant.SetEx, execSetEX, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand(constant.PSetEx, execPSetEX, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand(constant.MSet, execMSet, prepareMSet, undoMSet, -3)
-	RegisterCommand(constant.MGet, execMGet, prepareMGet, nil, -2)
-	RegisterCommand(constant.MSetNx, execMSetNX, prepareMSet, undoMSet, -3)
-	RegisterCommand(constant.Get, execGet, readFirstKey, nil, 2)
-	RegisterCommand(constant.GetSet, execGetSet, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand(constant.Incr, execIncr, writeFirstKey, rollbackFirstKey, 2)
-	RegisterCommand(constant.IncrBy, execIncrBy, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand(constant.IncrByFloat, execIncrByFloat, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand(constant.Decr, execDecr, writeFirstKey, rollbackFirstKey, 2)
-	RegisterCommand(constant.DecrBy, execDecrBy, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand(constant.StrLen, execStrLen, readFirstKey, nil, 2)
-	RegisterCommand(constant.Append, execAppend, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand(constant.SetRange, execSetRange, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand(constant.GetRange, execGetRange, readFirstKey, nil, 4)
+	RegisterCommand(constant.Set, execSet, writeFirstKey, rollbackFirstKey, -3, flagWrite)
+	RegisterCommand(constant.SetNx, execSetNX, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+	RegisterCommand(constant.SetEx, execSetEX, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand(constant.PSetEx, execPSetEX, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand(constant.MSet, execMSet, prepareMSet, undoMSet, -3, flagWrite)
+	RegisterCommand(constant.MGet, execMGet, prepareMGet, nil, -2, flagReadOnly)
+	RegisterCommand(constant.MSetNx, execMSetNX, prepareMSet, undoMSet, -3, flagWrite)
+	RegisterCommand(constant.Get, execGet, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.GetSet, execGetSet, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+	RegisterCommand(constant.Incr, execIncr, writeFirstKey, rollbackFirstKey, 2, flagWrite)
+	RegisterCommand(constant.IncrBy, execIncrBy, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+	RegisterCommand(constant.IncrByFloat, execIncrByFloat, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+	RegisterCommand(constant.Decr, execDecr, writeFirstKey, rollbackFirstKey, 2, flagWrite)
+	RegisterCommand(constant.DecrBy, execDecrBy, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+	RegisterCommand(constant.StrLen, execStrLen, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand(constant.Append, execAppend, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+	RegisterCommand(constant.SetRange, execSetRange, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand(constant.GetRange, execGetRange, readFirstKey, nil, 4, flagReadOnly)
+	RegisterCommand(constant.SubStr, execGetRange, readFirstKey, nil, 4, flagReadOnly)
+	RegisterCommand(constant.GetEx, execGetEX, writeFirstKey, undoExpire, -2, flagWrite)
+	RegisterCommand(constant.GetDel, execGetDel, writeFirstKey, rollbackFirstKey, 2, flagWrite)
+	RegisterCommand(constant.Lcs, execLCS, prepareLCS, nil, -3, flagReadOnly)
 }
@@ -0,0 +1,27 @@
+package database
+
+import "testing"
+
+func TestSetIfEqWithExpireOption(t *testing.T) {
+	_, exec := makeTestExec()
+	exec("set", "k", "EX")
+	if reply := exec("set", "k", "v", "IFEQ", "EX", "EX", "10"); string(reply.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("expect OK, actual %q", reply.ToBytes())
+	}
+	if ttl := intOf(t, exec("ttl", "k")); ttl <= 0 || ttl > 10 {
+		t.Errorf("expect ttl 10, actual %d", ttl)
+	}
+	exec("set", "k", "PX")
+	if reply := exec("set", "k", "v", "IFEQ", "PX", "PX", "5000"); string(reply.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("expect OK, actual %q", reply.ToBytes())
+	}
+	if ttl := intOf(t, exec("pttl", "k")); ttl <= 0 || ttl > 5000 {
+		t.Errorf("expect pttl 5000, actual %d", ttl)
+	}
+	if reply := exec("set", "k", "v2", "IFEQ", "PX", "PX", "5000"); string(reply.ToBytes()) != "$-1\r\n" {
+		t.Errorf("expect nil when value differs, actual %q", reply.ToBytes())
+	}
+	if reply := exec("set", "k", "v", "EX", "PX"); string(reply.ToBytes()) != "-ERR value is not an integer or out of range\r\n" {
+		t.Errorf("expect integer error, actual %q", reply.ToBytes())
+	}
+}
@@ -42,5 +42,5 @@ func isAuthenticated(c redis.Connection) bool {
 }
 
 func init() {
-	RegisterCommand(constant.Ping, Ping, noPrepare, nil, -1)
+	RegisterCommand(constant.Ping, Ping, noPrepare, nil, -1, flagReadOnly)
 }
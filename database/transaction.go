@@ -12,8 +12,13 @@ var forbiddenInMulti = set.Make("flushdb", "flushall")
 // Watch set watching keys
 func Watch(db *DB, conn redis.Connection, args [][]byte) redis.Reply {
 	watching := conn.GetWatching()
-	for _, bkey := range args {
-		key := string(bkey)
+	keys := make([]string, len(args))
+	for i, bkey := range args {
+		keys[i] = string(bkey)
+	}
+	db.RWLocks(nil, keys)
+	defer db.RWUnLocks(nil, keys)
+	for _, key := range keys {
 		watching[key] = db.GetVersion(key)
 	}
 	return protocol.MakeOkReply()
@@ -26,7 +31,7 @@ func execGetVersion(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("GetVer", execGetVersion, readAllKeys, nil, 2)
+	RegisterCommand("GetVer", execGetVersion, readAllKeys, nil, 2, flagReadOnly)
 }
 
 // invoker should lock watching keys
@@ -120,7 +125,7 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 		results = append(results, result)
 	}
 	if !aborted { //success
-		db.addVersion(writeKeys...)
+		db.addVersion(conn, writeKeys...)
 		return protocol.MakeMultiRawReply(results)
 	}
 	// undo if aborted
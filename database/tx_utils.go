@@ -54,17 +54,19 @@ func rollbackFirstKey(db *DB, args [][]byte) []CmdLine {
 func rollbackGivenKeys(db *DB, keys ...string) []CmdLine {
 	var undoCmdLines [][][]byte
 	for _, key := range keys {
-		entity, ok := db.GetEntity(key)
+		entity, ok := db.peekEntity(key)
+		undoCmdLines = append(undoCmdLines,
+			utils.ToCmdLine(constant.Del, key), // clean existed first
+		)
 		if !ok {
-			undoCmdLines = append(undoCmdLines,
-				utils.ToCmdLine(constant.Del, key),
-			)
-		} else {
-			undoCmdLines = append(undoCmdLines,
-				utils.ToCmdLine(constant.Del, key), // clean existed first
-				aof.EntityToCmd(key, entity).Args,
-				toTTLCmd(db, key).Args,
-			)
+			continue
+		}
+		cmds := aof.EntityToCmds(key, entity)
+		for _, cmd := range cmds {
+			undoCmdLines = append(undoCmdLines, cmd.Args)
+		}
+		if len(cmds) > 0 {
+			undoCmdLines = append(undoCmdLines, toTTLCmd(db, key).Args)
 		}
 	}
 	return undoCmdLines
@@ -93,6 +95,13 @@ func rollbackHashFields(db *DB, key string, fields ...string) []CmdLine {
 			undoCmdLines = append(undoCmdLines,
 				utils.ToCmdLine(constant.HSet, key, field, string(value)),
 			)
+			// HSET clears ttl of field
+			if expireTime, ok := dict.ExpireTime(field); ok {
+				expireAt := strconv.FormatInt(expireTime.UnixNano()/1e6, 10)
+				undoCmdLines = append(undoCmdLines,
+					utils.ToCmdLine(constant.HPExpireAt, key, expireAt, "FIELDS", "1", field),
+				)
+			}
 		}
 	}
 	return undoCmdLines
@@ -2,7 +2,4 @@ module godis
 
 go 1.17
 
-require (
-	github.com/jolestar/go-commons-pool/v2 v2.1.2
-	github.com/shopspring/decimal v1.3.1
-)
+require github.com/shopspring/decimal v1.3.1
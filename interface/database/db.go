@@ -8,10 +8,21 @@ import (
 // CmdLine is alias for [][]byte which represents a command line
 type CmdLine = [][]byte
 
+// KeysChangedCallback is called after keys were modified
+// c is the connection who modified the keys, it is nil if keys were modified by server, e.g. expiration.
+// keys is nil if the whole database was flushed, and dbIndex is -1 if all databases were flushed
+type KeysChangedCallback func(c redis.Connection, dbIndex int, keys []string)
+
+// WriteCallback is called with every command line modified data, same as the command appended to aof.
+// It is called in order of execution while holding locks of related keys, so it should not block
+type WriteCallback func(dbIndex int, cmdLine CmdLine)
+
 type DB interface {
 	Exec(client redis.Connection, args [][]byte) redis.Reply
 	AfterClientClose(c redis.Connection)
 	Close()
+	// SetKeysChangedCallback registers the callback fired whenever keys were modified, used for client side caching
+	SetKeysChangedCallback(callback KeysChangedCallback)
 }
 
 // EmbedDB is the embedding storage engine exposing more methods for complex application
@@ -23,9 +34,15 @@ type EmbedDB interface {
 	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
 	RWLocks(dbIndex int, writeKeys []string, readKeys []string)
 	RWUnLocks(dbIndex int, writeKeys []string, readKeys []string)
+	// SetWriteCallback registers the callback fired whenever data were modified, used for replication
+	SetWriteCallback(callback WriteCallback)
 }
 
 // DataEntity stores data bound to a key, including a string, list, hash, set and so on
 type DataEntity struct {
 	Data interface{}
+	// AccessTime is the unix milliseconds of last access, accessed atomically
+	AccessTime int64
+	// LFU packs minutes of last decrement in high 24 bits and logarithmic access counter in low 8 bits, accessed atomically
+	LFU uint32
 }
@@ -23,4 +23,7 @@ type Connection interface {
 	// used for multi database
 	GetDBIndex() int
 	SelectDB(int)
+
+	// used for blocking commands, the channel is closed after the connection closed
+	Done() <-chan struct{}
 }
@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // HashFunc defines function to generate hash code
@@ -12,6 +13,7 @@ type HashFunc func(data []byte) uint32
 
 // Map stores nodes and you can pick node from Map
 type Map struct {
+	mu       sync.RWMutex
 	hashFunc HashFunc
 	replicas int
 	keys     []int // sorted
@@ -33,11 +35,15 @@ func New(replicas int, fn HashFunc) *Map {
 
 // IsEmpty returns if there is no node in Map
 func (m *Map) IsEmpty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return len(m.keys) == 0
 }
 
 // AddNode add the given nodes into consistent hash circle
 func (m *Map) AddNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, key := range keys {
 		if key == "" {
 			continue
@@ -51,25 +57,49 @@ func (m *Map) AddNode(keys ...string) {
 	sort.Ints(m.keys)
 }
 
-// hash tag
-func getPartitionKey(key string) string {
+// RemoveNode removes the given nodes from consistent hash circle, keys of removed nodes go to the next node
+func (m *Map) RemoveNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		removed[key] = struct{}{}
+	}
+	hashes := m.keys[:0]
+	for _, hash := range m.keys {
+		if _, ok := removed[m.hashMap[hash]]; ok {
+			delete(m.hashMap, hash)
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	m.keys = hashes
+}
+
+// GetPartitionKey returns hash tag of key, keys with the same hash tag will be stored in the same node.
+// Like redis cluster, hash tag is the content between the first '{' and the first '}' after it.
+// Previous version took the first '}' of the whole key, results differ only if a '}' is before the first '{',
+// which made previous version panic, so keys stored by previous version stay on the same node.
+func GetPartitionKey(key string) string {
 	beg := strings.Index(key, "{")
 	if beg == -1 {
 		return key
 	}
-	end := strings.Index(key, "}")
-	if end == -1 || end == beg+1 {
+	end := strings.Index(key[beg+1:], "}")
+	if end <= 0 {
 		return key
 	}
-	return key[beg+1 : end]
+	return key[beg+1 : beg+1+end]
 }
 
 // PickNode gets the closest item in the hash to the provided key
 func (m *Map) PickNode(key string) string {
-	if m.IsEmpty() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
 		return ""
 	}
-	partitionKey := getPartitionKey(key)
+	partitionKey := GetPartitionKey(key)
 	hash := int(m.hashFunc([]byte(partitionKey)))
 
 	// Binary search for appropriate replica
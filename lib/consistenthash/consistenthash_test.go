@@ -0,0 +1,21 @@
+package consistenthash
+
+import "testing"
+
+func TestGetPartitionKey(t *testing.T) {
+	cases := map[string]string{
+		"foo":         "foo",
+		"{user}:1":    "user",
+		"a{user}b{c}": "user",
+		"{}user":      "{}user",
+		"{user":       "{user",
+		"user}":       "user}",
+		"a}{user}":    "user",
+		"a}{user":     "a}{user",
+	}
+	for key, expected := range cases {
+		if actual := GetPartitionKey(key); actual != expected {
+			t.Errorf("partition key of %s: expect %s, actual %s", key, expected, actual)
+		}
+	}
+}
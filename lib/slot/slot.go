@@ -0,0 +1,406 @@
+package slot
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"godis/lib/consistenthash"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SlotCount is the number of hash slots, same as redis cluster
+const SlotCount = 16384
+
+// GetSlot returns hash slot of key, hash tag is respected
+func GetSlot(key string) uint32 {
+	partitionKey := consistenthash.GetPartitionKey(key)
+	return uint32(CRC16([]byte(partitionKey))) % SlotCount
+}
+
+// GenNodeID generates id of node from its address, so that all nodes have the same view without negotiation
+func GenNodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// Range is a continuous range of slots served by a node
+type Range struct {
+	Start uint32
+	End   uint32 // inclusive
+	Node  string
+}
+
+// Map stores the owner node of each slot, it implements cluster.PeerPicker
+type Map struct {
+	mu    sync.RWMutex
+	slots [SlotCount]string // slot -> node address
+	nodes []string          // sorted
+	// slot -> target node, slot is being moved to target node
+	migrating map[uint32]string
+	// slot -> source node, slot is being moved from source node
+	importing map[uint32]string
+}
+
+// New creates a new Map
+func New() *Map {
+	return &Map{
+		migrating: make(map[uint32]string),
+		importing: make(map[uint32]string),
+	}
+}
+
+// AddNode adds nodes, new nodes take slots from nodes serving more than their share, other slots stay.
+// Slots are split evenly in order of address if no slot was assigned, so every node gets the same assignment
+// from the same node list
+func (m *Map) AddNode(nodes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var added []string
+	for _, node := range nodes {
+		if node == "" || m.containsNode(node) {
+			continue
+		}
+		m.nodes = append(m.nodes, node)
+		added = append(added, node)
+	}
+	if len(added) == 0 {
+		return
+	}
+	sort.Strings(m.nodes)
+	sort.Strings(added)
+	m.rebalance(added)
+}
+
+// RemoveNode removes nodes, slots of removed nodes are given to remaining nodes serving less than their share
+func (m *Map) RemoveNode(nodes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	remaining := m.nodes[:0]
+	for _, node := range m.nodes {
+		removed := false
+		for _, n := range nodes {
+			if n == node {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			remaining = append(remaining, node)
+		}
+	}
+	m.nodes = remaining
+	m.rebalance(nil)
+}
+
+// ReplaceNode gives all slots of old node to the new one, e.g. a failed master replaced by its replica
+func (m *Map) ReplaceNode(old string, node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.containsNode(node) {
+		m.nodes = append(m.nodes, node)
+	}
+	remaining := m.nodes[:0]
+	for _, n := range m.nodes {
+		if n != old {
+			remaining = append(remaining, n)
+		}
+	}
+	m.nodes = remaining
+	sort.Strings(m.nodes)
+	for s, owner := range m.slots {
+		if owner == old {
+			m.assign(uint32(s), node)
+		}
+	}
+	m.clearStates()
+}
+
+// rebalance moves slots of removed nodes, unassigned slots and slots over share of nodes when receivers were added,
+// to receivers or nodes serving less than their share. Slots are moved in continuous ranges as far as possible.
+// Invoker should hold m.mu
+func (m *Map) rebalance(receivers []string) {
+	n := len(m.nodes)
+	counts := make(map[string]int, n)
+	var free []uint32
+	for s, owner := range m.slots {
+		if owner == "" || !m.containsNode(owner) {
+			free = append(free, uint32(s))
+			continue
+		}
+		counts[owner]++
+	}
+	if n == 0 {
+		for _, s := range free {
+			m.assign(s, "")
+		}
+		m.clearStates()
+		return
+	}
+	// nodes serving more slots take the remainder, so that a node never loses slots when others are removed
+	byCount := make([]string, n)
+	copy(byCount, m.nodes)
+	sort.SliceStable(byCount, func(i, j int) bool {
+		return counts[byCount[i]] > counts[byCount[j]]
+	})
+	quota := make(map[string]int, n)
+	for i, node := range byCount {
+		quota[node] = SlotCount / n
+		if i < SlotCount%n {
+			quota[node]++
+		}
+	}
+	if len(receivers) > 0 {
+		// release the last slots of nodes over share
+		for s := SlotCount - 1; s >= 0; s-- {
+			owner := m.slots[s]
+			if counts[owner] > quota[owner] {
+				counts[owner]--
+				free = append(free, uint32(s))
+			}
+		}
+		sort.Slice(free, func(i, j int) bool {
+			return free[i] < free[j]
+		})
+	} else {
+		receivers = m.nodes
+	}
+	for _, node := range receivers {
+		for counts[node] < quota[node] && len(free) > 0 {
+			m.assign(free[0], node)
+			counts[node]++
+			free = free[1:]
+		}
+	}
+	// nodes may be over share because of manual assignment, give the rest to the node serving fewest slots
+	for _, s := range free {
+		target := m.nodes[0]
+		for _, node := range m.nodes {
+			if counts[node] < counts[target] {
+				target = node
+			}
+		}
+		m.assign(s, target)
+		counts[target]++
+	}
+	m.clearStates()
+}
+
+// assign changes owner of slot and clears its migrating or importing state, invoker should hold m.mu
+func (m *Map) assign(slot uint32, node string) {
+	if m.slots[slot] == node {
+		return
+	}
+	m.slots[slot] = node
+	delete(m.migrating, slot)
+	delete(m.importing, slot)
+}
+
+// clearStates clears migrating or importing states related to removed nodes, invoker should hold m.mu
+func (m *Map) clearStates() {
+	for s, target := range m.migrating {
+		if !m.containsNode(target) {
+			delete(m.migrating, s)
+		}
+	}
+	for s, source := range m.importing {
+		if !m.containsNode(source) {
+			delete(m.importing, s)
+		}
+	}
+}
+
+func (m *Map) containsNode(node string) bool {
+	for _, n := range m.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// PickNode returns the node serving the given key
+func (m *Map) PickNode(key string) string {
+	return m.GetNode(GetSlot(key))
+}
+
+// GetNode returns the node serving the given slot
+func (m *Map) GetNode(slot uint32) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.slots[slot]
+}
+
+// SetNode assigns slot to node, migrating or importing state of the slot is cleared
+func (m *Map) SetNode(slot uint32, node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.containsNode(node) {
+		m.nodes = append(m.nodes, node)
+		sort.Strings(m.nodes)
+	}
+	m.slots[slot] = node
+	delete(m.migrating, slot)
+	delete(m.importing, slot)
+}
+
+// GetNodes returns all nodes in order of address
+func (m *Map) GetNodes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]string, len(m.nodes))
+	copy(nodes, m.nodes)
+	return nodes
+}
+
+// GetNodeByID returns address of node by its id
+func (m *Map) GetNodeByID(id string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, node := range m.nodes {
+		if GenNodeID(node) == id {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// GetRanges returns continuous slot ranges in order of start slot, unassigned slots are skipped
+func (m *Map) GetRanges() []*Range {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ranges []*Range
+	var current *Range
+	for s := uint32(0); s < SlotCount; s++ {
+		node := m.slots[s]
+		if current != nil && current.Node == node && current.End == s-1 {
+			current.End = s
+			continue
+		}
+		if node == "" {
+			current = nil
+			continue
+		}
+		current = &Range{Start: s, End: s, Node: node}
+		ranges = append(ranges, current)
+	}
+	return ranges
+}
+
+// SetRanges replaces nodes and assignment of slots, e.g. with the view of another node,
+// migrating or importing states of slots whose owner is unchanged are kept
+func (m *Map) SetRanges(nodes []string, ranges []*Range) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes = make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node != "" && !m.containsNode(node) {
+			m.nodes = append(m.nodes, node)
+		}
+	}
+	var slots [SlotCount]string
+	for _, r := range ranges {
+		if !m.containsNode(r.Node) {
+			m.nodes = append(m.nodes, r.Node)
+		}
+		for s := r.Start; s <= r.End && s < SlotCount; s++ {
+			slots[s] = r.Node
+		}
+	}
+	sort.Strings(m.nodes)
+	for s, node := range slots {
+		m.assign(uint32(s), node)
+	}
+	m.clearStates()
+}
+
+// Clone returns a copy of m
+func (m *Map) Clone() *Map {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cloned := New()
+	cloned.slots = m.slots
+	cloned.nodes = make([]string, len(m.nodes))
+	copy(cloned.nodes, m.nodes)
+	for s, target := range m.migrating {
+		cloned.migrating[s] = target
+	}
+	for s, source := range m.importing {
+		cloned.importing[s] = source
+	}
+	return cloned
+}
+
+// FormatRanges encodes ranges as `start-end=node,...`
+func FormatRanges(ranges []*Range) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.Itoa(int(r.Start)) + "-" + strconv.Itoa(int(r.End)) + "=" + r.Node
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseRanges decodes ranges encoded by FormatRanges
+func ParseRanges(str string) ([]*Range, error) {
+	if str == "" {
+		return nil, nil
+	}
+	parts := strings.Split(str, ",")
+	ranges := make([]*Range, 0, len(parts))
+	for _, part := range parts {
+		i := strings.Index(part, "=")
+		j := strings.Index(part, "-")
+		if i < 0 || j < 0 || j > i {
+			return nil, errors.New("illegal slot range: " + part)
+		}
+		start, err1 := strconv.ParseUint(part[:j], 10, 32)
+		end, err2 := strconv.ParseUint(part[j+1:i], 10, 32)
+		if err1 != nil || err2 != nil || start > end || end >= SlotCount {
+			return nil, errors.New("illegal slot range: " + part)
+		}
+		ranges = append(ranges, &Range{Start: uint32(start), End: uint32(end), Node: part[i+1:]})
+	}
+	return ranges, nil
+}
+
+// SetMigrating marks slot is being moved to target node
+func (m *Map) SetMigrating(slot uint32, target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.migrating[slot] = target
+	delete(m.importing, slot)
+}
+
+// SetImporting marks slot is being moved from source node
+func (m *Map) SetImporting(slot uint32, source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.importing[slot] = source
+	delete(m.migrating, slot)
+}
+
+// SetStable clears migrating or importing state of slot
+func (m *Map) SetStable(slot uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.migrating, slot)
+	delete(m.importing, slot)
+}
+
+// GetMigrating returns target node if slot is being moved out
+func (m *Map) GetMigrating(slot uint32) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	target, ok := m.migrating[slot]
+	return target, ok
+}
+
+// GetImporting returns source node if slot is being moved in
+func (m *Map) GetImporting(slot uint32) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	source, ok := m.importing[slot]
+	return source, ok
+}
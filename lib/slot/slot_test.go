@@ -0,0 +1,163 @@
+package slot
+
+import "testing"
+
+func TestGetSlot(t *testing.T) {
+	// checksums are taken from redis `CLUSTER KEYSLOT`
+	cases := map[string]uint32{
+		"":                     0,
+		"a":                    15495,
+		"foo":                  12182,
+		"123456789":            12739,
+		"{user1000}.following": 3443,
+		"{user1000}.followers": 3443,
+		"foo{}{bar}":           8363,
+		"foo{{bar}}zap":        4015,
+		"foo{bar}{zap}":        5061,
+	}
+	for key, expected := range cases {
+		if actual := GetSlot(key); actual != expected {
+			t.Errorf("wrong slot of %s, expect %d, actual %d", key, expected, actual)
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	m := New()
+	m.AddNode("b:6379", "a:6379", "c:6379")
+	ranges := m.GetRanges()
+	if len(ranges) != 3 {
+		t.Errorf("expect 3 ranges, actual %d", len(ranges))
+		return
+	}
+	if ranges[0].Start != 0 || ranges[0].Node != "a:6379" ||
+		ranges[2].End != SlotCount-1 || ranges[2].Node != "c:6379" {
+		t.Errorf("wrong ranges: %+v %+v %+v", ranges[0], ranges[1], ranges[2])
+	}
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Start != ranges[i-1].End+1 {
+			t.Errorf("ranges are not continuous")
+		}
+	}
+
+	slot := GetSlot("foo")
+	owner := m.PickNode("foo")
+	m.SetMigrating(slot, "a:6379")
+	if target, ok := m.GetMigrating(slot); !ok || target != "a:6379" {
+		t.Error("set migrating failed")
+	}
+	m.SetNode(slot, "a:6379")
+	if _, ok := m.GetMigrating(slot); ok {
+		t.Error("migrating state should be cleared")
+	}
+	if m.PickNode("foo") != "a:6379" || owner == "a:6379" {
+		t.Error("set node failed")
+	}
+	if len(m.GetRanges()) != 5 {
+		t.Errorf("expect 5 ranges, actual %d", len(m.GetRanges()))
+	}
+	if node, ok := m.GetNodeByID(GenNodeID("b:6379")); !ok || node != "b:6379" {
+		t.Error("get node by id failed")
+	}
+
+	m.RemoveNode("a:6379")
+	for _, r := range m.GetRanges() {
+		if r.Node == "a:6379" {
+			t.Error("removed node still serves slots")
+		}
+	}
+	if len(m.GetNodes()) != 2 {
+		t.Errorf("expect 2 nodes, actual %d", len(m.GetNodes()))
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	m := New()
+	m.AddNode("a", "b", "c")
+	prev := m.Clone()
+	unaffected := GetSlot("foo")
+	m.SetMigrating(unaffected, "b")
+
+	// new node only takes slots from others
+	m.AddNode("d")
+	counts := make(map[string]int)
+	for s := uint32(0); s < SlotCount; s++ {
+		owner := m.GetNode(s)
+		counts[owner]++
+		if owner != prev.GetNode(s) && owner != "d" {
+			t.Fatalf("slot %d moved from %s to %s", s, prev.GetNode(s), owner)
+		}
+	}
+	for _, node := range []string{"a", "b", "c", "d"} {
+		if counts[node] != SlotCount/4 {
+			t.Errorf("expect %d slots of %s, actual %d", SlotCount/4, node, counts[node])
+		}
+	}
+	if len(m.GetRanges()) > 7 {
+		t.Errorf("slots should be moved in ranges, actual %d ranges", len(m.GetRanges()))
+	}
+	if m.GetNode(unaffected) != "d" {
+		if _, ok := m.GetMigrating(unaffected); !ok {
+			t.Error("migrating state of unaffected slot should be kept")
+		}
+	}
+
+	// only slots of removed node are moved
+	prev = m.Clone()
+	m.RemoveNode("b")
+	counts = make(map[string]int)
+	for s := uint32(0); s < SlotCount; s++ {
+		owner := m.GetNode(s)
+		counts[owner]++
+		if owner != prev.GetNode(s) && prev.GetNode(s) != "b" {
+			t.Fatalf("slot %d moved from %s to %s", s, prev.GetNode(s), owner)
+		}
+	}
+	if counts["b"] != 0 || counts["a"]+counts["c"]+counts["d"] != SlotCount {
+		t.Errorf("wrong counts: %v", counts)
+	}
+	for _, node := range []string{"a", "c", "d"} {
+		if counts[node] < SlotCount/3 || counts[node] > SlotCount/3+1 {
+			t.Errorf("wrong slots of %s: %d", node, counts[node])
+		}
+	}
+
+	// replica takes all slots of its master
+	prev = m.Clone()
+	m.ReplaceNode("c", "e")
+	for s := uint32(0); s < SlotCount; s++ {
+		if expected := prev.GetNode(s); expected != "c" && m.GetNode(s) != expected ||
+			expected == "c" && m.GetNode(s) != "e" {
+			t.Fatalf("wrong owner of slot %d: %s", s, m.GetNode(s))
+		}
+	}
+	if nodes := m.GetNodes(); len(nodes) != 3 || nodes[2] != "e" {
+		t.Errorf("wrong nodes: %v", nodes)
+	}
+}
+
+func TestRangesFormat(t *testing.T) {
+	m := New()
+	m.AddNode("127.0.0.1:7001", "127.0.0.1:7002")
+	m.SetNode(100, "127.0.0.1:7002")
+	str := FormatRanges(m.GetRanges())
+	ranges, err := ParseRanges(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := New()
+	copied.SetRanges([]string{"127.0.0.1:7003"}, ranges)
+	for s := uint32(0); s < SlotCount; s++ {
+		if copied.GetNode(s) != m.GetNode(s) {
+			t.Fatalf("wrong owner of slot %d", s)
+		}
+	}
+	if len(copied.GetNodes()) != 3 {
+		t.Errorf("wrong nodes: %v", copied.GetNodes())
+	}
+	for _, str := range []string{"1-0=a", "0-16384=a", "x-1=a", "0=a", "1=a-b"} {
+		if _, err := ParseRanges(str); err == nil {
+			t.Errorf("expect error of %s", str)
+		}
+	}
+}
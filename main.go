@@ -8,6 +8,7 @@ import (
 	RedisServer "godis/redis/server"
 	"godis/tcp"
 	"os"
+	"time"
 )
 
 var banner = `
@@ -17,13 +18,6 @@ var banner = `
 / /_/ / /_/ / /_/ / (__  )
 \____/\____/\__,_/_/____/
 `
-var defaultProperties = &config.ServerProperties{
-	Bind:           "0.0.0.0",
-	Port:           6399,
-	AppendOnly:     false,
-	AppendFilename: "",
-	MaxClients:     1000,
-}
 
 func main() {
 	print(banner)
@@ -38,14 +32,23 @@ func main() {
 		if utils.FileExists("redis.conf") {
 			config.SetupConfig("redis.conf")
 		} else {
-			config.Properties = defaultProperties
+			// default properties of config package, listening on all interfaces
+			config.Properties.Bind = "0.0.0.0"
+			config.Properties.Port = 6399
 		}
 	} else {
 		config.SetupConfig(configName)
 	}
 
+	keepAlive := time.Duration(config.Properties.TcpKeepalive) * time.Second
+	if keepAlive == 0 {
+		keepAlive = -1 // disabled
+	}
 	err := tcp.ListenAndServeWithSignal(&tcp.Config{
-		Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
+		Address:    fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
+		MaxConnect: uint32(config.Properties.MaxClients),
+		Timeout:    time.Duration(config.Properties.Timeout) * time.Second,
+		KeepAlive:  keepAlive,
 	}, RedisServer.MakeHandler())
 	if err != nil {
 		logger.Error(err)
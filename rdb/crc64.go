@@ -0,0 +1,12 @@
+package rdb
+
+import "hash/crc64"
+
+// jonesTable is the table of crc-64-jones used by redis, the polynomial is in reversed form
+var jonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// checksum returns crc-64-jones of data.
+// hash/crc64 inverts crc before and after update, while redis doesn't, so the inversion is undone here
+func checksum(data []byte) uint64 {
+	return ^crc64.Update(^uint64(0), jonesTable, data)
+}
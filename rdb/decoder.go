@@ -0,0 +1,515 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"godis/config"
+	"godis/dataStruct/dict"
+	"godis/dataStruct/list"
+	"godis/dataStruct/set"
+	"godis/dataStruct/sortedset"
+	"math"
+	"strconv"
+	"time"
+)
+
+// special encodings of string, following the length flag 0b11
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// containers of quicklist node in typeListQuicklist2
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, ErrBadFormat
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *decoder) readBytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, ErrBadFormat
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readUint64() (uint64, error) {
+	b, err := d.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// readLen reads a length, encoded is true if the length is actually a special encoding of string
+func (d *decoder) readLen() (n uint64, encoded bool, err error) {
+	first, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3f), false, nil
+	case 1:
+		second, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3f)<<8 | uint64(second), false, nil
+	case 3:
+		return uint64(first & 0x3f), true, nil
+	}
+	switch first {
+	case 0x80:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	case 0x81:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(b), false, nil
+	}
+	return 0, false, ErrBadFormat
+}
+
+// readCount reads number of elements, which must be positive and can't exceed remaining bytes
+func (d *decoder) readCount() (int, error) {
+	n, encoded, err := d.readLen()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n == 0 || n > uint64(len(d.data)-d.pos) {
+		return 0, ErrBadFormat
+	}
+	return int(n), nil
+}
+
+func (d *decoder) readString() ([]byte, error) {
+	n, encoded, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, ErrBadFormat
+		}
+		return d.readBytes(int(n))
+	}
+	switch n {
+	case encInt8:
+		b, err := d.readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int8(b[0])), 10)), nil
+	case encInt16:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(b))), 10)), nil
+	case encInt32:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(b))), 10)), nil
+	case encLZF:
+		compressedLen, _, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		length, _, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if compressedLen > uint64(len(d.data)-d.pos) || length > math.MaxInt32 {
+			return nil, ErrBadFormat
+		}
+		compressed, err := d.readBytes(int(compressedLen))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, int(length))
+	}
+	return nil, ErrBadFormat
+}
+
+// readDouble reads score of typeZSet which is saved as string, with special lengths for NaN and infinities
+func (d *decoder) readDouble() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := d.readBytes(int(n))
+	if err != nil {
+		return 0, err
+	}
+	score, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, ErrBadFormat
+	}
+	return score, nil
+}
+
+func (d *decoder) readObject() (interface{}, error) {
+	objType, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch objType {
+	case typeString:
+		return d.readString()
+	case typeList:
+		return d.readList()
+	case typeListZiplist:
+		return d.readPackedList(ziplistEntries)
+	case typeListQuicklist, typeListQuicklist2:
+		return d.readQuicklist(objType == typeListQuicklist2)
+	case typeSet:
+		return d.readSet()
+	case typeSetIntset:
+		return d.readPackedSet(intsetEntries)
+	case typeSetListpack:
+		return d.readPackedSet(listpackEntries)
+	case typeZSet, typeZSet2:
+		return d.readZSet(objType == typeZSet2)
+	case typeZSetZiplist:
+		return d.readPackedZSet(ziplistEntries)
+	case typeZSetListpack:
+		return d.readPackedZSet(listpackEntries)
+	case typeHash, typeHashMetadata:
+		return d.readHash(objType == typeHashMetadata)
+	case typeHashZiplist:
+		return d.readPackedHash(ziplistEntries, false)
+	case typeHashListpack:
+		return d.readPackedHash(listpackEntries, false)
+	case typeHashListpackEx:
+		return d.readPackedHash(listpackEntries, true)
+	}
+	// modules, streams and obsolete encodings are not supported
+	return nil, ErrBadFormat
+}
+
+/* ---- list ---- */
+
+func makeList() *list.QuickList {
+	return list.MakeQuickList(config.Properties.ListCompressDepth)
+}
+
+func (d *decoder) readList() (interface{}, error) {
+	count, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	result := makeList()
+	for i := 0; i < count; i++ {
+		val, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		result.Add(val)
+	}
+	return result, nil
+}
+
+func (d *decoder) readPackedList(unpack func([]byte) ([][]byte, error)) (interface{}, error) {
+	blob, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	vals, err := unpack(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, ErrBadFormat
+	}
+	result := makeList()
+	for _, val := range vals {
+		result.Add(val)
+	}
+	return result, nil
+}
+
+// readQuicklist reads nodes of quicklist, nodes are ziplists in typeListQuicklist,
+// and plain elements or listpacks in typeListQuicklist2
+func (d *decoder) readQuicklist(v2 bool) (interface{}, error) {
+	count, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	result := makeList()
+	for i := 0; i < count; i++ {
+		container := uint64(quicklistNodePacked)
+		if v2 {
+			if container, _, err = d.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case container == quicklistNodePlain:
+			result.Add(blob)
+			continue
+		case container != quicklistNodePacked:
+			return nil, ErrBadFormat
+		}
+		var vals [][]byte
+		if v2 {
+			vals, err = listpackEntries(blob)
+		} else {
+			vals, err = ziplistEntries(blob)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			result.Add(val)
+		}
+	}
+	if result.Len() == 0 {
+		return nil, ErrBadFormat
+	}
+	return result, nil
+}
+
+/* ---- set ---- */
+
+func makeSet() *set.Set {
+	return set.MakeCompact(config.Properties.SetMaxIntsetEntries)
+}
+
+func (d *decoder) readSet() (interface{}, error) {
+	count, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	result := makeSet()
+	for i := 0; i < count; i++ {
+		member, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if result.Add(string(member)) == 0 {
+			// duplicated member
+			return nil, ErrBadFormat
+		}
+	}
+	return result, nil
+}
+
+func (d *decoder) readPackedSet(unpack func([]byte) ([][]byte, error)) (interface{}, error) {
+	blob, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	members, err := unpack(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, ErrBadFormat
+	}
+	result := makeSet()
+	for _, member := range members {
+		if result.Add(string(member)) == 0 {
+			return nil, ErrBadFormat
+		}
+	}
+	return result, nil
+}
+
+/* ---- sorted set ---- */
+
+func makeSortedSet() *sortedset.SortedSet {
+	return sortedset.MakeCompact(config.Properties.ZSetMaxListpackEntries, config.Properties.ZSetMaxListpackValue)
+}
+
+// readZSet reads members and scores, scores are binary in typeZSet2 and strings in typeZSet
+func (d *decoder) readZSet(binaryScore bool) (interface{}, error) {
+	count, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	result := makeSortedSet()
+	for i := 0; i < count; i++ {
+		member, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScore {
+			bits, err := d.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(bits)
+		} else if score, err = d.readDouble(); err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) || !result.Add(string(member), score) {
+			// NaN score or duplicated member
+			return nil, ErrBadFormat
+		}
+	}
+	return result, nil
+}
+
+// readPackedZSet reads ziplist or listpack of member score member score ...
+func (d *decoder) readPackedZSet(unpack func([]byte) ([][]byte, error)) (interface{}, error) {
+	blob, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := unpack(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || len(entries)%2 != 0 {
+		return nil, ErrBadFormat
+	}
+	result := makeSortedSet()
+	for i := 0; i < len(entries); i += 2 {
+		score, err := strconv.ParseFloat(string(entries[i+1]), 64)
+		if err != nil || math.IsNaN(score) || !result.Add(string(entries[i]), score) {
+			return nil, ErrBadFormat
+		}
+	}
+	return result, nil
+}
+
+/* ---- hash ---- */
+
+func makeHash() *dict.CompactDict {
+	return dict.MakeCompact(config.Properties.HashMaxListpackEntries, config.Properties.HashMaxListpackValue)
+}
+
+// putField puts a field with expiration time in unix milliseconds, 0 means no ttl.
+// Expired fields are skipped, it returns false if the field is duplicated
+func putField(hash *dict.CompactDict, field []byte, value []byte, expireAt int64) bool {
+	if expireAt > 0 && expireAt <= time.Now().UnixNano()/int64(time.Millisecond) {
+		return true
+	}
+	if hash.Put(string(field), value) == 0 {
+		return false
+	}
+	if expireAt > 0 {
+		hash.Expire(string(field), time.Unix(0, expireAt*int64(time.Millisecond)))
+	}
+	return true
+}
+
+// readHash reads fields and values, with ttl of each field in typeHashMetadata
+func (d *decoder) readHash(withTTL bool) (interface{}, error) {
+	var minExpire uint64
+	var err error
+	if withTTL {
+		if minExpire, err = d.readUint64(); err != nil {
+			return nil, err
+		}
+	}
+	count, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	result := makeHash()
+	for i := 0; i < count; i++ {
+		var expireAt int64
+		if withTTL {
+			ttl, encoded, err := d.readLen()
+			if err != nil || encoded {
+				return nil, ErrBadFormat
+			}
+			if ttl > 0 {
+				expireAt = int64(ttl + minExpire - 1)
+			}
+		}
+		field, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if !putField(result, field, value, expireAt) {
+			return nil, ErrBadFormat
+		}
+	}
+	if result.Len() == 0 {
+		return nil, ErrBadFormat
+	}
+	return result, nil
+}
+
+// readPackedHash reads ziplist or listpack of field value field value ...,
+// listpack of typeHashListpackEx follows min expiration time, and each field has an absolute ttl after value
+func (d *decoder) readPackedHash(unpack func([]byte) ([][]byte, error), withTTL bool) (interface{}, error) {
+	step := 2
+	if withTTL {
+		if _, err := d.readUint64(); err != nil {
+			return nil, err
+		}
+		step = 3
+	}
+	blob, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := unpack(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || len(entries)%step != 0 {
+		return nil, ErrBadFormat
+	}
+	result := makeHash()
+	for i := 0; i < len(entries); i += step {
+		var expireAt int64
+		if withTTL {
+			expireAt, err = strconv.ParseInt(string(entries[i+2]), 10, 64)
+			if err != nil || expireAt < 0 {
+				return nil, ErrBadFormat
+			}
+		}
+		if !putField(result, entries[i], entries[i+1], expireAt) {
+			return nil, ErrBadFormat
+		}
+	}
+	if result.Len() == 0 {
+		return nil, ErrBadFormat
+	}
+	return result, nil
+}
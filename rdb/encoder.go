@@ -0,0 +1,126 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"godis/dataStruct/dict"
+	"godis/dataStruct/list"
+	"godis/dataStruct/set"
+	"godis/dataStruct/sortedset"
+	"math"
+	"time"
+)
+
+type encoder struct {
+	buf []byte
+}
+
+// writeLen writes length in the variable length encoding of rdb
+func (e *encoder) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.buf = append(e.buf, byte(n))
+	case n < 1<<14:
+		e.buf = append(e.buf, byte(0x40|n>>8), byte(n))
+	case n <= math.MaxUint32:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n))
+		e.buf = append(append(e.buf, 0x80), b[:]...)
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		e.buf = append(append(e.buf, 0x81), b[:]...)
+	}
+}
+
+func (e *encoder) writeString(s []byte) {
+	e.writeLen(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeUint64(n uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// writeObject writes type and value, returns rdb version required by the value and false if type is unknown
+func (e *encoder) writeObject(data interface{}) (uint16, bool) {
+	switch val := data.(type) {
+	case []byte:
+		e.buf = append(e.buf, typeString)
+		e.writeString(val)
+	case *list.QuickList:
+		e.buf = append(e.buf, typeList)
+		e.writeLen(uint64(val.Len()))
+		val.ForEach(func(i int, v []byte) bool {
+			e.writeString(v)
+			return true
+		})
+	case *set.Set:
+		e.buf = append(e.buf, typeSet)
+		e.writeLen(uint64(val.Len()))
+		val.ForEach(func(member string) bool {
+			e.writeString([]byte(member))
+			return true
+		})
+	case dict.Dict:
+		return e.writeHash(val), true
+	case *sortedset.SortedSet:
+		e.buf = append(e.buf, typeZSet2)
+		e.writeLen(uint64(val.Len()))
+		val.ForEach(0, val.Len(), false, func(element *sortedset.Element) bool {
+			e.writeString([]byte(element.Member))
+			e.writeUint64(math.Float64bits(element.Score))
+			return true
+		})
+	default:
+		return 0, false
+	}
+	return dumpVersion, true
+}
+
+// writeHash writes hash as typeHash, or typeHashMetadata if any field has ttl
+func (e *encoder) writeHash(hash dict.Dict) uint16 {
+	var fields []string
+	var values [][]byte
+	hash.ForEach(func(field string, val interface{}) bool {
+		bytes, _ := val.([]byte)
+		fields = append(fields, field)
+		values = append(values, bytes)
+		return true
+	})
+	var minExpire int64
+	compact, _ := hash.(*dict.CompactDict)
+	if compact != nil {
+		compact.ForEachExpire(func(field string, expireTime time.Time) bool {
+			expireAt := expireTime.UnixNano() / int64(time.Millisecond)
+			if minExpire == 0 || expireAt < minExpire {
+				minExpire = expireAt
+			}
+			return true
+		})
+	}
+	if minExpire == 0 {
+		e.buf = append(e.buf, typeHash)
+		e.writeLen(uint64(len(fields)))
+		for i, field := range fields {
+			e.writeString([]byte(field))
+			e.writeString(values[i])
+		}
+		return dumpVersion
+	}
+	// ttl of each field is saved as offset from the min expiration time plus 1, 0 means no ttl
+	e.buf = append(e.buf, typeHashMetadata)
+	e.writeUint64(uint64(minExpire))
+	e.writeLen(uint64(len(fields)))
+	for i, field := range fields {
+		var ttl uint64
+		if expireTime, ok := compact.ExpireTime(field); ok {
+			ttl = uint64(expireTime.UnixNano()/int64(time.Millisecond)-minExpire) + 1
+		}
+		e.writeLen(ttl)
+		e.writeString([]byte(field))
+		e.writeString(values[i])
+	}
+	return hashTTLVersion
+}
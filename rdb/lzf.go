@@ -0,0 +1,46 @@
+package rdb
+
+// lzfDecompress decompresses data compressed by lzf into a buffer of the given length
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// literal run of ctrl+1 bytes
+			size := ctrl + 1
+			if i+size > len(in) || len(out)+size > length {
+				return nil, ErrBadFormat
+			}
+			out = append(out, in[i:i+size]...)
+			i += size
+			continue
+		}
+		// back reference
+		size := ctrl >> 5
+		if size == 7 {
+			if i >= len(in) {
+				return nil, ErrBadFormat
+			}
+			size += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrBadFormat
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		size += 2
+		if ref < 0 || len(out)+size > length {
+			return nil, ErrBadFormat
+		}
+		// copy byte by byte since the reference may overlap the output
+		for j := 0; j < size; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, ErrBadFormat
+	}
+	return out, nil
+}
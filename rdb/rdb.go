@@ -0,0 +1,103 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"godis/interface/database"
+)
+
+/*
+ * Package rdb serializes a value into the payload of DUMP and deserializes payload of RESTORE, compatible with redis.
+ * A payload is a value in rdb format: type value, followed by a footer: rdb version (2 bytes) and crc64 (8 bytes),
+ * both little endian, crc64 covers all bytes before it.
+ * Values are dumped by basic types which can be restored by any redis since 5.0, except hash with ttl of fields.
+ * Payload dumped by redis may use compact encodings, e.g. listpack, ziplist and intset, they are all supported.
+ */
+
+// value types of rdb
+const (
+	typeString         = 0
+	typeList           = 1
+	typeSet            = 2
+	typeZSet           = 3
+	typeHash           = 4
+	typeZSet2          = 5
+	typeListZiplist    = 10
+	typeSetIntset      = 11
+	typeZSetZiplist    = 12
+	typeHashZiplist    = 13
+	typeListQuicklist  = 14
+	typeHashListpack   = 16
+	typeZSetListpack   = 17
+	typeListQuicklist2 = 18
+	typeSetListpack    = 20
+	typeHashMetadata   = 24
+	typeHashListpackEx = 25
+)
+
+const (
+	// dumpVersion is the rdb version of redis 5.0, all basic types are supported since it
+	dumpVersion = 9
+	// hashTTLVersion is the rdb version of redis 7.4, which supports ttl of hash fields
+	hashTTLVersion = 12
+	// maxVersion is the max rdb version of payload which could be restored
+	maxVersion = 12
+
+	footerLen = 10
+)
+
+var (
+	// ErrBadPayload means the footer of payload is corrupted
+	ErrBadPayload = errors.New("DUMP payload version or checksum are wrong")
+	// ErrBadFormat means the value in payload is corrupted or of unsupported type
+	ErrBadFormat = errors.New("Bad data format")
+)
+
+// Dump serializes value of entity into payload of DUMP, returns nil if the type of value is unknown
+func Dump(entity *database.DataEntity) []byte {
+	e := &encoder{}
+	version, ok := e.writeObject(entity.Data)
+	if !ok {
+		return nil
+	}
+	var footer [footerLen]byte
+	binary.LittleEndian.PutUint16(footer[:2], version)
+	e.buf = append(e.buf, footer[:2]...)
+	binary.LittleEndian.PutUint64(footer[2:], checksum(e.buf))
+	return append(e.buf, footer[2:]...)
+}
+
+// Restore deserializes payload of DUMP into a new entity
+func Restore(payload []byte) (*database.DataEntity, error) {
+	if len(payload) < footerLen {
+		return nil, ErrBadPayload
+	}
+	body := payload[:len(payload)-footerLen+2]
+	footer := payload[len(payload)-footerLen:]
+	if binary.LittleEndian.Uint16(footer[:2]) > maxVersion {
+		return nil, ErrBadPayload
+	}
+	if binary.LittleEndian.Uint64(footer[2:]) != checksum(body) {
+		return nil, ErrBadPayload
+	}
+	d := &decoder{data: payload[:len(payload)-footerLen]}
+	data, err := d.readObject()
+	if err != nil {
+		return nil, err
+	}
+	return &database.DataEntity{Data: data}, nil
+}
+
+// Clone returns a deep copy of entity, returns nil if the type of value is unknown
+func Clone(entity *database.DataEntity) *database.DataEntity {
+	e := &encoder{}
+	if _, ok := e.writeObject(entity.Data); !ok {
+		return nil
+	}
+	d := &decoder{data: e.buf}
+	data, err := d.readObject()
+	if err != nil {
+		return nil
+	}
+	return &database.DataEntity{Data: data}
+}
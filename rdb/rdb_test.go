@@ -0,0 +1,275 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"godis/dataStruct/dict"
+	"godis/dataStruct/list"
+	"godis/dataStruct/set"
+	"godis/dataStruct/sortedset"
+	"godis/interface/database"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// makePayload appends footer of the given version to a value
+func makePayload(body []byte, version uint16) []byte {
+	payload := append([]byte(nil), body...)
+	payload = append(payload, byte(version), byte(version>>8))
+	var crc [8]byte
+	binary.LittleEndian.PutUint64(crc[:], checksum(payload))
+	return append(payload, crc[:]...)
+}
+
+func TestChecksum(t *testing.T) {
+	if crc := checksum([]byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("wrong crc64: %x", crc)
+	}
+}
+
+func TestRestoreRedisPayload(t *testing.T) {
+	// DUMP of "10" by redis
+	entity, err := Restore([]byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entity.Data.([]byte)) != "10" {
+		t.Errorf("wrong value: %s", entity.Data)
+	}
+}
+
+// sameData compares values, members of set and fields of hash are unordered
+func sameData(a interface{}, b interface{}) bool {
+	switch b := b.(type) {
+	case *set.Set:
+		a := a.(*set.Set)
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, member := range b.ToSlice() {
+			if !a.Has(member) {
+				return false
+			}
+		}
+		return true
+	case dict.Dict:
+		a := a.(dict.Dict)
+		if a.Len() != b.Len() {
+			return false
+		}
+		same := true
+		b.ForEach(func(field string, val interface{}) bool {
+			restored, _ := a.Get(field)
+			bytes1, _ := restored.([]byte)
+			same = bytes.Equal(bytes1, val.([]byte))
+			return same
+		})
+		return same
+	}
+	return bytes.Equal(Dump(&database.DataEntity{Data: a}), Dump(&database.DataEntity{Data: b}))
+}
+
+func TestDumpRestore(t *testing.T) {
+	l := list.MakeQuickList(0)
+	s := set.MakeCompact(512)
+	h := dict.MakeCompact(128, 64)
+	z := sortedset.MakeCompact(128, 64)
+	for i := 0; i < 300; i++ {
+		member := strconv.Itoa(i)
+		l.Add([]byte(member))
+		s.Add(member)
+		h.Put(member, []byte("v"+member))
+		z.Add(member, float64(i)/3)
+	}
+	z.Add("inf", math.Inf(1))
+	s.Add("a")
+	for _, data := range []interface{}{[]byte("hello"), []byte{}, l, s, h, z} {
+		payload := Dump(&database.DataEntity{Data: data})
+		if version := binary.LittleEndian.Uint16(payload[len(payload)-footerLen:]); version != dumpVersion {
+			t.Errorf("wrong version: %d", version)
+		}
+		entity, err := Restore(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameData(entity.Data, data) {
+			t.Errorf("restored value of %T differs", data)
+		}
+	}
+	if Dump(&database.DataEntity{Data: 1}) != nil {
+		t.Error("unknown type should not be dumped")
+	}
+}
+
+func TestDumpRestoreHashTTL(t *testing.T) {
+	h := dict.MakeCompact(128, 64)
+	h.Put("a", []byte("1"))
+	h.Put("b", []byte("2"))
+	h.Put("c", []byte("3"))
+	expireTime := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	h.Expire("a", expireTime)
+	h.Expire("b", expireTime.Add(time.Second))
+	payload := Dump(&database.DataEntity{Data: h})
+	if version := binary.LittleEndian.Uint16(payload[len(payload)-footerLen:]); version != hashTTLVersion {
+		t.Errorf("wrong version: %d", version)
+	}
+	entity, err := Restore(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := entity.Data.(*dict.CompactDict)
+	if restored.Len() != 3 {
+		t.Fatalf("wrong len: %d", restored.Len())
+	}
+	if ttl, ok := restored.ExpireTime("a"); !ok || !ttl.Equal(expireTime) {
+		t.Errorf("wrong ttl of a: %v", ttl)
+	}
+	if ttl, ok := restored.ExpireTime("b"); !ok || !ttl.Equal(expireTime.Add(time.Second)) {
+		t.Errorf("wrong ttl of b: %v", ttl)
+	}
+	if _, ok := restored.ExpireTime("c"); ok {
+		t.Error("c should not have ttl")
+	}
+}
+
+func TestRestoreBadPayload(t *testing.T) {
+	payload := Dump(&database.DataEntity{Data: []byte("hello")})
+	corrupted := append([]byte(nil), payload...)
+	corrupted[1]++
+	if _, err := Restore(corrupted); err != ErrBadPayload {
+		t.Errorf("expect ErrBadPayload of checksum, actual %v", err)
+	}
+	if _, err := Restore(makePayload([]byte("\x00\x05hello"), maxVersion+1)); err != ErrBadPayload {
+		t.Errorf("expect ErrBadPayload of version, actual %v", err)
+	}
+	if _, err := Restore(payload[:5]); err != ErrBadPayload {
+		t.Errorf("expect ErrBadPayload of short payload, actual %v", err)
+	}
+	for _, body := range []string{
+		"\x00\x06hello",      // string is too short
+		"\x02\x02\x01a\x01a", // duplicated member
+		"\x02\x00",           // empty set
+		"\x15\x00",           // stream
+	} {
+		if _, err := Restore(makePayload([]byte(body), dumpVersion)); err != ErrBadFormat {
+			t.Errorf("expect ErrBadFormat of %q, actual %v", body, err)
+		}
+	}
+}
+
+// listpack builds a listpack of given encoded entries, each with its backlen
+func listpack(entries ...string) []byte {
+	blob := make([]byte, 6)
+	for _, entry := range entries {
+		blob = append(blob, entry...)
+		blob = append(blob, byte(len(entry)))
+	}
+	blob = append(blob, packEnd)
+	binary.LittleEndian.PutUint32(blob, uint32(len(blob)))
+	binary.LittleEndian.PutUint16(blob[4:], uint16(len(entries)))
+	return blob
+}
+
+// ziplist builds a ziplist of given encoded entries, each with its prevlen
+func ziplist(entries ...string) []byte {
+	blob := make([]byte, 10)
+	prev := 0
+	for _, entry := range entries {
+		blob = append(blob, byte(prev))
+		blob = append(blob, entry...)
+		prev = len(entry) + 1
+	}
+	blob = append(blob, packEnd)
+	binary.LittleEndian.PutUint32(blob, uint32(len(blob)))
+	binary.LittleEndian.PutUint16(blob[8:], uint16(len(entries)))
+	return blob
+}
+
+func withString(objType byte, blob []byte) []byte {
+	e := &encoder{buf: []byte{objType}}
+	e.writeString(blob)
+	return e.buf
+}
+
+func TestRestorePacked(t *testing.T) {
+	lp := listpack("\x83abc", "\x05", "\xdf\xff", "\xf1\x00\x80", "\xf3\x00\x00\x00\x80")
+	zl := ziplist("\x03abc", "\xf6", "\xfe\xff", "\xc0\x00\x80", "\xd0\x00\x00\x00\x80")
+	expected := []string{"abc", "5", "-1", "-32768", "-2147483648"}
+	quicklist2 := append([]byte{typeListQuicklist2, 2, quicklistNodePacked}, withString(0, lp)[1:]...)
+	quicklist2 = append(quicklist2, quicklistNodePlain, 1, 'x')
+	for _, body := range [][]byte{
+		withString(typeListZiplist, zl),
+		append([]byte{typeListQuicklist, 1}, withString(0, zl)[1:]...),
+		quicklist2,
+	} {
+		entity, err := Restore(makePayload(body, maxVersion))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := entity.Data.(*list.QuickList)
+		vals := l.Range(0, l.Len())
+		if len(vals) < len(expected) {
+			t.Fatalf("wrong len: %d", len(vals))
+		}
+		for i, val := range expected {
+			if string(vals[i]) != val {
+				t.Errorf("expect %s, actual %s", val, vals[i])
+			}
+		}
+	}
+
+	intset := []byte{2, 0, 0, 0, 3, 0, 0, 0, 0xff, 0xff, 1, 0, 2, 0}
+	for _, body := range [][]byte{withString(typeSetIntset, intset), withString(typeSetListpack, listpack("\x7f", "\x01", "\x02"))} {
+		entity, err := Restore(makePayload(body, maxVersion))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := entity.Data.(*set.Set); s.Len() != 3 || !s.Has("1") || !s.Has("2") {
+			t.Errorf("wrong set: %v", s.ToSlice())
+		}
+	}
+
+	entity, err := Restore(makePayload(withString(typeZSetListpack, listpack("\x81a", "\x84-1.5", "\x81b", "\x02")), maxVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := entity.Data.(*sortedset.SortedSet)
+	if element, _ := z.Get("a"); element == nil || element.Score != -1.5 {
+		t.Error("wrong score of a")
+	}
+	if element, _ := z.Get("b"); element == nil || element.Score != 2 {
+		t.Error("wrong score of b")
+	}
+
+	expireAt := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	var ttl [9]byte
+	ttl[0] = 0xf4
+	binary.LittleEndian.PutUint64(ttl[1:], uint64(expireAt))
+	hashEx := append([]byte{typeHashListpackEx}, make([]byte, 8)...)
+	hashEx = append(hashEx, withString(0, listpack("\x81a", "\x01", string(ttl[:]), "\x81b", "\x02", "\x00", "\x81c", "\x03", "\x01"))[1:]...)
+	entity, err = Restore(makePayload(hashEx, maxVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := entity.Data.(*dict.CompactDict)
+	if h.Len() != 2 {
+		t.Fatalf("expired field should be skipped, len: %d", h.Len())
+	}
+	if expireTime, ok := h.ExpireTime("a"); !ok || expireTime.UnixNano()/int64(time.Millisecond) != expireAt {
+		t.Error("wrong ttl of a")
+	}
+	if val, _ := h.Get("b"); string(val.([]byte)) != "2" {
+		t.Error("wrong value of b")
+	}
+}
+
+func TestClone(t *testing.T) {
+	s := set.Make("a", "b")
+	cloned := Clone(&database.DataEntity{Data: s}).Data.(*set.Set)
+	cloned.Add("c")
+	if s.Len() != 2 || cloned.Len() != 3 {
+		t.Error("clone should be a deep copy")
+	}
+}
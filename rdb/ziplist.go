@@ -0,0 +1,210 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+/*
+ * Compact encodings dumped by redis: listpack (redis 7.0+), ziplist (before 7.0) and intset.
+ * Integer entries are formatted as decimal strings, which is how redis returns them.
+ */
+
+const packEnd = 0xff
+
+func formatInt(n int64) []byte {
+	return []byte(strconv.FormatInt(n, 10))
+}
+
+// signExtend interprets the lowest bits of n as a signed integer
+func signExtend(n uint64, bits uint) int64 {
+	shift := 64 - bits
+	return int64(n<<shift) >> shift
+}
+
+// readUintLE reads an unsigned integer of len(b) bytes in little endian
+func readUintLE(b []byte) uint64 {
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	return n
+}
+
+// listpackBacklenSize returns the size of backlen following an entry of the given length
+func listpackBacklenSize(entryLen int) int {
+	switch {
+	case entryLen <= 127:
+		return 1
+	case entryLen < 16383:
+		return 2
+	case entryLen < 2097151:
+		return 3
+	case entryLen < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// listpackEntries returns all entries of a listpack
+func listpackEntries(blob []byte) ([][]byte, error) {
+	// header: total bytes (4 bytes) and number of elements (2 bytes)
+	if len(blob) < 7 || int(binary.LittleEndian.Uint32(blob)) != len(blob) {
+		return nil, ErrBadFormat
+	}
+	var entries [][]byte
+	pos := 6
+	for pos < len(blob) && blob[pos] != packEnd {
+		enc := blob[pos]
+		var headerLen, dataLen int
+		var entry []byte
+		switch {
+		case enc&0x80 == 0:
+			// 7 bit unsigned integer
+			headerLen = 1
+			entry = formatInt(int64(enc & 0x7f))
+		case enc&0xc0 == 0x80:
+			// string with 6 bit length
+			headerLen, dataLen = 1, int(enc&0x3f)
+		case enc&0xe0 == 0xc0:
+			// 13 bit signed integer
+			if pos+2 > len(blob) {
+				return nil, ErrBadFormat
+			}
+			headerLen = 2
+			entry = formatInt(signExtend(uint64(enc&0x1f)<<8|uint64(blob[pos+1]), 13))
+		case enc&0xf0 == 0xe0:
+			// string with 12 bit length
+			if pos+2 > len(blob) {
+				return nil, ErrBadFormat
+			}
+			headerLen, dataLen = 2, int(enc&0x0f)<<8|int(blob[pos+1])
+		case enc == 0xf0:
+			// string with 32 bit length
+			if pos+5 > len(blob) {
+				return nil, ErrBadFormat
+			}
+			headerLen, dataLen = 5, int(binary.LittleEndian.Uint32(blob[pos+1:]))
+		case enc >= 0xf1 && enc <= 0xf4:
+			// 16, 24, 32 and 64 bit signed integer
+			size := [...]int{2, 3, 4, 8}[enc-0xf1]
+			if pos+1+size > len(blob) {
+				return nil, ErrBadFormat
+			}
+			headerLen = 1 + size
+			entry = formatInt(signExtend(readUintLE(blob[pos+1:pos+1+size]), uint(size*8)))
+		default:
+			return nil, ErrBadFormat
+		}
+		entryLen := headerLen + dataLen
+		if dataLen < 0 || pos+entryLen > len(blob) {
+			return nil, ErrBadFormat
+		}
+		if entry == nil {
+			entry = blob[pos+headerLen : pos+entryLen]
+		}
+		entries = append(entries, entry)
+		pos += entryLen + listpackBacklenSize(entryLen)
+	}
+	if pos != len(blob)-1 {
+		return nil, ErrBadFormat
+	}
+	return entries, nil
+}
+
+// ziplistEntries returns all entries of a ziplist
+func ziplistEntries(blob []byte) ([][]byte, error) {
+	// header: total bytes (4 bytes), offset of tail (4 bytes) and number of elements (2 bytes)
+	if len(blob) < 11 || int(binary.LittleEndian.Uint32(blob)) != len(blob) {
+		return nil, ErrBadFormat
+	}
+	var entries [][]byte
+	pos := 10
+	for pos < len(blob) && blob[pos] != packEnd {
+		// skip length of previous entry
+		if blob[pos] == 0xfe {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(blob) {
+			return nil, ErrBadFormat
+		}
+		enc := blob[pos]
+		var headerLen, dataLen int
+		var entry []byte
+		switch {
+		case enc>>6 == 0:
+			// string with 6 bit length
+			headerLen, dataLen = 1, int(enc&0x3f)
+		case enc>>6 == 1:
+			// string with 14 bit length in big endian
+			if pos+2 > len(blob) {
+				return nil, ErrBadFormat
+			}
+			headerLen, dataLen = 2, int(enc&0x3f)<<8|int(blob[pos+1])
+		case enc == 0x80:
+			// string with 32 bit length in big endian
+			if pos+5 > len(blob) {
+				return nil, ErrBadFormat
+			}
+			headerLen, dataLen = 5, int(binary.BigEndian.Uint32(blob[pos+1:]))
+		case enc >= 0xf1 && enc <= 0xfd:
+			// 4 bit immediate integer from 0 to 12
+			headerLen = 1
+			entry = formatInt(int64(enc&0x0f) - 1)
+		default:
+			var size int
+			switch enc {
+			case 0xc0:
+				size = 2
+			case 0xd0:
+				size = 4
+			case 0xe0:
+				size = 8
+			case 0xf0:
+				size = 3
+			case 0xfe:
+				size = 1
+			default:
+				return nil, ErrBadFormat
+			}
+			if pos+1+size > len(blob) {
+				return nil, ErrBadFormat
+			}
+			headerLen = 1 + size
+			entry = formatInt(signExtend(readUintLE(blob[pos+1:pos+1+size]), uint(size*8)))
+		}
+		entryLen := headerLen + dataLen
+		if dataLen < 0 || pos+entryLen > len(blob) {
+			return nil, ErrBadFormat
+		}
+		if entry == nil {
+			entry = blob[pos+headerLen : pos+entryLen]
+		}
+		entries = append(entries, entry)
+		pos += entryLen
+	}
+	if pos != len(blob)-1 {
+		return nil, ErrBadFormat
+	}
+	return entries, nil
+}
+
+// intsetEntries returns all members of an intset
+func intsetEntries(blob []byte) ([][]byte, error) {
+	// header: size of each integer (4 bytes) and number of integers (4 bytes)
+	if len(blob) < 8 {
+		return nil, ErrBadFormat
+	}
+	size := int(binary.LittleEndian.Uint32(blob))
+	count := int(binary.LittleEndian.Uint32(blob[4:]))
+	if size != 2 && size != 4 && size != 8 || count < 0 || len(blob) != 8+size*count {
+		return nil, ErrBadFormat
+	}
+	entries := make([][]byte, 0, count)
+	for pos := 8; pos < len(blob); pos += size {
+		entries = append(entries, formatInt(signExtend(readUintLE(blob[pos:pos+size]), uint(size*8))))
+	}
+	return entries, nil
+}
@@ -2,23 +2,78 @@ package connection
 
 import (
 	"bytes"
+	"errors"
+	"godis/config"
+	"godis/lib/logger"
 	"godis/lib/sync/wait"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// idCounter generates unique client id, just like redis client id
+var idCounter uint64
+
+var (
+	// ErrClosed is returned when writing to a closed connection
+	ErrClosed = errors.New("connection closed")
+	// ErrOutputBufferLimit is returned when client is disconnected for reaching client-output-buffer-limit
+	ErrOutputBufferLimit = errors.New("client output buffer limit reached")
+)
+
 type Connection struct {
 	conn net.Conn
 
+	// unique id of connection
+	id uint64
+	// created time of connection
+	createdAt time.Time
+
+	// metaMu protects client info which may be read by other connections, e.g. `client list`
+	metaMu sync.RWMutex
+	// name set by `client setname`
+	name string
+	// time of the last command
+	lastInteraction time.Time
+	// name of the last command
+	lastCmd string
+	// set by `client no-evict`
+	noEvict bool
+	// connection is streaming executed commands by `monitor`
+	monitor bool
+	// protocol version set by `hello`, 2 or 3
+	protocol int
+	// connection is waiting for blocking commands, e.g. blpop
+	blocked bool
+
 	// waiting until protocol finished
 	waitingReply wait.Wait
 
-	// lock while server sending response
+	// outMu protects output buffer, data in it is sent by writeLoop asynchronously
+	outMu sync.Mutex
+	// pending replies
+	outQueue [][]byte
+	// size of pending replies
+	outBytes int64
+	// time when output buffer exceeds soft limit, zero if not exceeded
+	softLimitReachedAt time.Time
+	// closed output buffer refuses new replies
+	outClosed bool
+	// notifies writeLoop of new replies
+	outSignal chan struct{}
+	// closed when writeLoop should exit
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	// mu protects subscribing channels, transaction state and selected db, which may be read by other connections,
+	// e.g. `client list`
 	mu sync.Mutex
 
 	// subscribing channels
 	subs map[string]bool
+	// subsCount is the size of subs, accessed atomically so that it can be read without mu
+	subsCount int32
 
 	// password may be changed by CONFIG command during runtime, so store the password
 	password string
@@ -37,32 +92,280 @@ func (c *Connection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
-// Close disconnect with the client
+// Close disconnect with the client after pending replies sent
 func (c *Connection) Close() error {
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
+	c.stop()
 	_ = c.conn.Close()
 	return nil
 }
 
+// stop refuses new replies and stops writeLoop
+func (c *Connection) stop() {
+	c.closeOnce.Do(func() {
+		c.outMu.Lock()
+		c.outClosed = true
+		c.outMu.Unlock()
+		close(c.stopped)
+	})
+}
+
 // NewConn creates Connection instance
 func NewConn(conn net.Conn) *Connection {
-	return &Connection{conn: conn}
+	now := time.Now()
+	c := &Connection{
+		conn:            conn,
+		id:              atomic.AddUint64(&idCounter, 1),
+		createdAt:       now,
+		lastInteraction: now,
+		protocol:        2,
+		outSignal:       make(chan struct{}, 1),
+		stopped:         make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// LocalAddr returns the local network address
+func (c *Connection) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// GetID returns unique id of the connection
+func (c *Connection) GetID() uint64 {
+	return c.id
 }
 
-// Write sends response to client over tcp connection
+// GetCreatedAt returns the time when connection established
+func (c *Connection) GetCreatedAt() time.Time {
+	return c.createdAt
+}
+
+// SetName sets connection name
+func (c *Connection) SetName(name string) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	c.name = name
+}
+
+// GetName returns connection name
+func (c *Connection) GetName() string {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.name
+}
+
+// SetLastCmd records the command being processed and refreshes the interaction time
+func (c *Connection) SetLastCmd(cmdName string) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	c.lastCmd = cmdName
+	c.lastInteraction = time.Now()
+}
+
+// GetLastCmd returns name of the last command
+func (c *Connection) GetLastCmd() string {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.lastCmd
+}
+
+// GetLastInteraction returns time of the last command
+func (c *Connection) GetLastInteraction() time.Time {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.lastInteraction
+}
+
+// SetNoEvict sets no-evict flag
+func (c *Connection) SetNoEvict(noEvict bool) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	c.noEvict = noEvict
+}
+
+// IsNoEvict returns no-evict flag
+func (c *Connection) IsNoEvict() bool {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.noEvict
+}
+
+// SetMonitor marks connection as a monitor
+func (c *Connection) SetMonitor(monitor bool) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	c.monitor = monitor
+}
+
+// IsMonitor returns whether the connection is a monitor
+func (c *Connection) IsMonitor() bool {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.monitor
+}
+
+// SetBlocked marks connection as waiting for blocking commands
+func (c *Connection) SetBlocked(blocked bool) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	c.blocked = blocked
+}
+
+// IsBlocked returns whether the connection is waiting for blocking commands
+func (c *Connection) IsBlocked() bool {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.blocked
+}
+
+// Done returns a channel closed after the connection closed, so that blocking commands can stop waiting
+func (c *Connection) Done() <-chan struct{} {
+	return c.stopped
+}
+
+// SetProtocol sets RESP version of connection
+func (c *Connection) SetProtocol(protocol int) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	c.protocol = protocol
+}
+
+// GetProtocol returns RESP version of connection, 2 or 3
+func (c *Connection) GetProtocol() int {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return c.protocol
+}
+
+// Write puts response into output buffer, it will be sent to client asynchronously.
+// Write never blocks, client will be disconnected if it cannot keep up with output, see config.OutputBufferLimit
 func (c *Connection) Write(bytes []byte) error {
 	if len(bytes) == 0 {
 		return nil
 	}
-	c.mu.Lock()
+	c.outMu.Lock()
+	if c.outClosed {
+		c.outMu.Unlock()
+		return ErrClosed
+	}
+	c.outQueue = append(c.outQueue, bytes)
+	c.outBytes += int64(len(bytes))
 	c.waitingReply.Add(1)
-	defer func() {
+	if c.isOutputBufferLimitReached() {
+		c.discardOutput()
+		c.outMu.Unlock()
+		c.disconnectForOutputLimit()
+		return ErrOutputBufferLimit
+	}
+	c.outMu.Unlock()
+	select {
+	case c.outSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeLoop sends pending replies to client
+func (c *Connection) writeLoop() {
+	for {
+		select {
+		case <-c.outSignal:
+		case <-c.stopped:
+			return
+		}
+		for {
+			c.outMu.Lock()
+			batch := c.outQueue
+			c.outQueue = nil
+			c.outMu.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+			buffers := net.Buffers(batch)
+			_, err := buffers.WriteTo(c.conn)
+			size := int64(0)
+			for _, b := range batch {
+				size += int64(len(b))
+			}
+			c.outMu.Lock()
+			c.outBytes -= size
+			if !c.softLimitReachedAt.IsZero() && c.outBytes <= c.getOutputBufferLimit().SoftLimit {
+				c.softLimitReachedAt = time.Time{}
+			}
+			c.outMu.Unlock()
+			for range batch {
+				c.waitingReply.Done()
+			}
+			if err != nil {
+				// connection broken, replies are useless
+				c.outMu.Lock()
+				c.discardOutput()
+				c.outClosed = true
+				c.outMu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// discardOutput drops pending replies, invoker should hold outMu
+func (c *Connection) discardOutput() {
+	for range c.outQueue {
 		c.waitingReply.Done()
-		c.mu.Unlock()
-	}()
+	}
+	c.outQueue = nil
+	c.outClosed = true
+}
+
+// GetClientClass returns class used for client-output-buffer-limit.
+// Write calls it from goroutines of publishers, so it reads the atomic count rather than subs
+func (c *Connection) GetClientClass() string {
+	if atomic.LoadInt32(&c.subsCount) > 0 {
+		return config.ClientClassPubSub
+	}
+	return config.ClientClassNormal
+}
 
-	_, err := c.conn.Write(bytes)
-	return err
+func (c *Connection) getOutputBufferLimit() *config.OutputBufferLimit {
+	return config.Properties.GetOutputBufferLimit(c.GetClientClass())
+}
+
+// isOutputBufferLimitReached checks hard and soft limit, invoker should hold outMu
+func (c *Connection) isOutputBufferLimitReached() bool {
+	limit := c.getOutputBufferLimit()
+	if limit == nil {
+		return false
+	}
+	if limit.HardLimit > 0 && c.outBytes >= limit.HardLimit {
+		return true
+	}
+	if limit.SoftLimit > 0 && c.outBytes >= limit.SoftLimit {
+		now := time.Now()
+		if c.softLimitReachedAt.IsZero() {
+			c.softLimitReachedAt = now
+		}
+		if now.Sub(c.softLimitReachedAt) >= time.Duration(limit.SoftSeconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// disconnectForOutputLimit closes the connection, server will clean it once reading failed
+func (c *Connection) disconnectForOutputLimit() {
+	class := c.GetClientClass()
+	RecordOutputLimitDisconnection(class)
+	logger.Warn("client " + c.RemoteAddr().String() + " (" + class + ") reached output buffer limit, disconnecting")
+	c.stop()
+	_ = c.conn.Close()
+}
+
+// GetOutputBufferSize returns count and size of pending replies
+func (c *Connection) GetOutputBufferSize() (int, int64) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return len(c.outQueue), c.outBytes
 }
 
 // SetPassword stores password for authentication
@@ -84,6 +387,7 @@ func (c *Connection) Subscribe(channel string) {
 		c.subs = make(map[string]bool)
 	}
 	c.subs[channel] = true
+	atomic.StoreInt32(&c.subsCount, int32(len(c.subs)))
 }
 
 // UnSubscribe removes current connection into subscribers of the given channel
@@ -97,15 +401,25 @@ func (c *Connection) UnSubscribe(channel string) {
 	if _, ok := c.subs[channel]; ok {
 		delete(c.subs, channel)
 	}
+	atomic.StoreInt32(&c.subsCount, int32(len(c.subs)))
 }
 
 // SubsCount returns the number of subscribing channels
 func (c *Connection) SubsCount() int {
-	return len(c.subs)
+	return int(atomic.LoadInt32(&c.subsCount))
+}
+
+// IsSubscribed returns whether the connection is subscribing the given channel
+func (c *Connection) IsSubscribed(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subs[channel]
 }
 
-// GetChannels returns all subscribing channels
+// GetChannels returns a copy of all subscribing channels
 func (c *Connection) GetChannels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.subs == nil {
 		return make([]string, 0)
 	}
@@ -120,11 +434,15 @@ func (c *Connection) GetChannels() []string {
 
 // InMultiState tells is connection in an uncommitted transaction
 func (c *Connection) InMultiState() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.multiState
 }
 
 // SetMultiState sets transaction flag
 func (c *Connection) SetMultiState(state bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if !state { // reset data when cancel multi
 		c.watching = nil
 		c.queue = nil
@@ -134,16 +452,22 @@ func (c *Connection) SetMultiState(state bool) {
 
 // GetQueuedCmdLine returns queued commands of current transaction
 func (c *Connection) GetQueuedCmdLine() [][][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.queue
 }
 
 // EnqueueCmd  enqueues command of current transaction
 func (c *Connection) EnqueueCmd(cmdLine [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.queue = append(c.queue, cmdLine)
 }
 
 // ClearQueuedCmds clears queued commands of current transaction
 func (c *Connection) ClearQueuedCmds() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.queue = nil
 }
 
@@ -157,11 +481,15 @@ func (c *Connection) GetWatching() map[string]uint32 {
 
 // GetDBIndex returns selected db
 func (c *Connection) GetDBIndex() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.selectedDB
 }
 
 // SelectDB selects a database
 func (c *Connection) SelectDB(dbNum int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.selectedDB = dbNum
 }
 
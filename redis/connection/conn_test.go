@@ -0,0 +1,129 @@
+package connection
+
+import (
+	"godis/config"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOutputBufferLimit(t *testing.T) {
+	file, err := os.CreateTemp("", "godis*.conf")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	_, _ = file.WriteString("client-output-buffer-limit pubsub 4kb 0 0\n")
+	_ = file.Close()
+	properties := config.Properties
+	config.SetupConfig(file.Name())
+	defer func() {
+		config.Properties = properties
+	}()
+
+	server, client := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	conn := NewConn(server)
+	chunk := make([]byte, 1024)
+	// normal client has no limit, write won't block even if client never reads
+	for i := 0; i < 8; i++ {
+		if err := conn.Write(chunk); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+	}
+	if count, _ := conn.GetOutputBufferSize(); count == 0 {
+		t.Error("replies should be pending")
+	}
+
+	server2, client2 := net.Pipe()
+	defer func() {
+		_ = client2.Close()
+	}()
+	subscriber := NewConn(server2)
+	subscriber.Subscribe("ch")
+	before := GetOutputLimitDisconnections(config.ClientClassPubSub)
+	var writeErr error
+	for i := 0; i < 8 && writeErr == nil; i++ {
+		writeErr = subscriber.Write(chunk)
+	}
+	if writeErr != ErrOutputBufferLimit {
+		t.Errorf("expect output buffer limit error, actual %v", writeErr)
+	}
+	if GetOutputLimitDisconnections(config.ClientClassPubSub) != before+1 {
+		t.Error("disconnection is not recorded")
+	}
+	if err := subscriber.Write(chunk); err != ErrClosed {
+		t.Errorf("expect closed error, actual %v", err)
+	}
+	// client side should see the connection closed
+	_ = client2.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 8192)
+	for {
+		if _, err := client2.Read(buf); err != nil {
+			break
+		}
+	}
+}
+
+// TestSubscriptionRace reads subscriptions of a connection while it is subscribing, run it with -race
+func TestSubscriptionRace(t *testing.T) {
+	conn := &FakeConn{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			conn.Subscribe("a")
+			conn.Subscribe("b")
+			conn.UnSubscribe("a")
+			conn.UnSubscribe("b")
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		conn.IsSubscribed("a")
+		conn.GetChannels()
+		conn.SubsCount()
+	}
+	<-done
+	if conn.IsSubscribed("a") || len(conn.GetChannels()) != 0 || conn.SubsCount() != 0 {
+		t.Error("expect no subscription")
+	}
+}
+
+// TestWriteWhileSubscribing writes to a connection like publishers while it is subscribing, run it with -race
+func TestWriteWhileSubscribing(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn := NewConn(server)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			conn.Subscribe("ch")
+			conn.UnSubscribe("ch")
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if err := conn.Write([]byte("+OK\r\n")); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			break
+		}
+	}
+	<-done
+}
@@ -0,0 +1,38 @@
+package connection
+
+import (
+	"godis/config"
+	"sync/atomic"
+)
+
+// counters of clients disconnected for reaching client-output-buffer-limit
+var (
+	normalOutputLimitDisconnections  int64
+	pubsubOutputLimitDisconnections  int64
+	replicaOutputLimitDisconnections int64
+)
+
+// RecordOutputLimitDisconnection counts a client disconnected for reaching output buffer limit of given class
+func RecordOutputLimitDisconnection(class string) {
+	switch class {
+	case config.ClientClassNormal:
+		atomic.AddInt64(&normalOutputLimitDisconnections, 1)
+	case config.ClientClassPubSub:
+		atomic.AddInt64(&pubsubOutputLimitDisconnections, 1)
+	case config.ClientClassReplica:
+		atomic.AddInt64(&replicaOutputLimitDisconnections, 1)
+	}
+}
+
+// GetOutputLimitDisconnections returns count of clients disconnected for reaching output buffer limit of given class
+func GetOutputLimitDisconnections(class string) int64 {
+	switch class {
+	case config.ClientClassNormal:
+		return atomic.LoadInt64(&normalOutputLimitDisconnections)
+	case config.ClientClassPubSub:
+		return atomic.LoadInt64(&pubsubOutputLimitDisconnections)
+	case config.ClientClassReplica:
+		return atomic.LoadInt64(&replicaOutputLimitDisconnections)
+	}
+	return 0
+}
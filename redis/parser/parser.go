@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"godis/config"
 	"godis/interface/redis"
 	"godis/lib/logger"
 	"godis/redis/protocol"
@@ -62,21 +63,72 @@ func ParseOne(data []byte) (redis.Reply, error) {
 }
 
 type readState struct {
-	readingMultiLine  bool
-	expectedArgsCount int
-	msgType           byte
-	args              [][]byte
-	bulkLen           int64
+	readingBulk bool
+	bulkLen     int64
+	// arrays being read, the last one is innermost
+	arrays []*arrayState
 }
 
-func (s *readState) finished() bool {
-	return s.expectedArgsCount > 0 && len(s.args) == s.expectedArgsCount
+// arrayState is a multi bulk reply waiting for its elements, elements may be nested arrays
+type arrayState struct {
+	expectedCount int
+	elements      []redis.Reply
+}
+
+// toReply returns MultiBulkReply if all elements are bulk strings, otherwise MultiRawReply
+func (s *arrayState) toReply() redis.Reply {
+	args := make([][]byte, 0, len(s.elements))
+	for _, element := range s.elements {
+		switch reply := element.(type) {
+		case *protocol.BulkReply:
+			args = append(args, reply.Arg)
+		case *protocol.NullBulkReply:
+			args = append(args, nil)
+		default:
+			return protocol.MakeMultiRawReply(s.elements)
+		}
+	}
+	return protocol.MakeMultiBulkReply(args)
+}
+
+// complete adds reply to the innermost array, returns the whole reply if it was finished
+func (s *readState) complete(reply redis.Reply) (redis.Reply, bool) {
+	for len(s.arrays) > 0 {
+		array := s.arrays[len(s.arrays)-1]
+		array.elements = append(array.elements, reply)
+		if len(array.elements) < array.expectedCount {
+			return nil, false
+		}
+		s.arrays = s.arrays[:len(s.arrays)-1]
+		reply = array.toReply()
+	}
+	return reply, true
+}
+
+const (
+	// maxPreallocElements limits memory allocated for an array before its elements arrived
+	maxPreallocElements = 1024
+	// maxPreallocBulkLen limits memory allocated for a bulk string before its body arrived
+	maxPreallocBulkLen = 64 * 1024
+)
+
+// getMaxBulkLen returns the max length of bulk strings and arrays, see proto-max-bulk-len
+func getMaxBulkLen() int64 {
+	if config.Properties.ProtoMaxBulkLen <= 0 {
+		return 512 * 1024 * 1024
+	}
+	return int64(config.Properties.ProtoMaxBulkLen)
 }
 
 func parse0(reader io.Reader, ch chan<- *Payload) {
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Error(string(debug.Stack()))
+			// reader is in unknown state, stop parsing
+			ch <- &Payload{
+				Err: fmt.Errorf("protocol error: %v", err),
+			}
+			close(ch)
 		}
 	}()
 	// 初始化读取状态
@@ -87,6 +139,7 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 	for {
 		// read line
 		var ioErr bool
+		readingBulkBody := state.readingBulk
 		msg, ioErr, err = readLine(bufReader, &state)
 		logger.Info(fmt.Sprintf("msg read from reader. msg=%s, ioErr=%v, err=%v", string(msg), ioErr, err))
 		if err != nil {
@@ -108,84 +161,93 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 
 		// parse line: protocol 分为两类
 		// 单行：StatusReply, IntReply, ErrorReply
-		// 多行: BulkString, MultiBulkReply
-		if !state.readingMultiLine {
-			// receive new response
-			if msg[0] == '*' {
-				// multi bulk protocol
-				err = parseMultiBulkHeader(msg, &state)
-				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error: " + string(msg)),
-					}
-					// read state
-					state = readState{}
-					continue
-				}
-				if state.expectedArgsCount == 0 {
-					ch <- &Payload{
-						Data: &protocol.EmptyMultiBulkReply{},
-					}
-					// reset state
-					state = readState{}
-					continue
+		// 多行: BulkString, MultiBulkReply, elements of MultiBulkReply may be any protocol including MultiBulkReply
+		var result redis.Reply
+		if readingBulkBody {
+			// bulk body is binary safe, it may start with '$'
+			result = protocol.MakeBulkReply(msg[:len(msg)-2])
+		} else if len(msg) == 2 {
+			// skip empty line, e.g. typed in telnet
+			continue
+		} else if msg[0] == '*' {
+			// multi bulk protocol
+			var count int64
+			count, err = parseHeader(msg)
+			if err != nil {
+				ch <- &Payload{
+					Err: err,
 				}
-			} else if msg[0] == '$' {
-				// bulk protocol
-				err = parseBulkHeader(msg, &state)
-				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error: " + string(msg)),
-					}
-					// reset state
-					state = readState{}
-					continue
+				// read state
+				state = readState{}
+				continue
+			}
+			if count > getMaxBulkLen() {
+				// the rest of stream cannot be parsed, stop reading like redis closes the connection
+				ch <- &Payload{
+					Err: errors.New("protocol error: invalid multibulk length"),
 				}
-				if state.bulkLen == -1 {
-					// null bulk protocol
-					ch <- &Payload{
-						Data: &protocol.NullBulkReply{},
-					}
-					// reset state
-					state = readState{}
-					continue
+				close(ch)
+				return
+			}
+			if count > 0 {
+				prealloc := count
+				if prealloc > maxPreallocElements {
+					prealloc = maxPreallocElements
 				}
+				state.arrays = append(state.arrays, &arrayState{
+					expectedCount: int(count),
+					elements:      make([]redis.Reply, 0, prealloc),
+				})
+				continue
+			}
+			if count == 0 {
+				result = &protocol.EmptyMultiBulkReply{}
 			} else {
-				// single line protocol
-				result, err := parseSingleLineReply(msg)
+				// null array, e.g. relayed reply of BLPOP timed out, it differs from null bulk string
+				result = &protocol.NullMultiBulkReply{}
+			}
+		} else if msg[0] == '$' {
+			// bulk protocol
+			state.bulkLen, err = parseHeader(msg)
+			if err != nil {
 				ch <- &Payload{
-					Data: result,
-					Err:  err,
+					Err: err,
 				}
 				// reset state
 				state = readState{}
 				continue
 			}
-		} else {
-			// receive following bulk protocol
-			err = readBody(msg, &state)
-			if err != nil {
+			if state.bulkLen > getMaxBulkLen() {
 				ch <- &Payload{
-					Err: errors.New("protocol error: " + string(msg)),
+					Err: errors.New("protocol error: invalid bulk length"),
 				}
-				// reset state
-				state = readState{}
+				close(ch)
+				return
+			}
+			if state.bulkLen >= 0 {
+				state.readingBulk = true
 				continue
 			}
-			// if sending finish
-			if state.finished() {
-				var result redis.Reply
-				if state.msgType == '*' {
-					result = protocol.MakeMultiBulkReply(state.args)
-				} else if state.msgType == '$' {
-					result = protocol.MakeBulkReply(state.args[0])
-				}
+			// null bulk protocol
+			result = &protocol.NullBulkReply{}
+		} else if len(state.arrays) > 0 && msg[0] != '+' && msg[0] != '-' && msg[0] != ':' {
+			// plain text in multi bulk
+			result = protocol.MakeBulkReply(msg[:len(msg)-2])
+		} else {
+			// single line protocol
+			result, err = parseSingleLineReply(msg)
+			if err != nil {
 				ch <- &Payload{
-					Data: result,
-					Err:  err,
+					Err: err,
 				}
 				// reset state
 				state = readState{}
+				continue
+			}
+		}
+		if reply, finished := state.complete(result); finished {
+			ch <- &Payload{
+				Data: reply,
 			}
 		}
 	}
@@ -195,71 +257,46 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
 	var msg []byte
 	var err error
-	if state.bulkLen == 0 {
+	if !state.readingBulk {
 		// read normal line
 		msg, err = bufReader.ReadBytes('\n')
 		if err != nil {
 			return nil, true, err
 		}
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' {
+		if len(msg) < 2 || msg[len(msg)-2] != '\r' {
 			return nil, false, errors.New("protocol error: " + string(msg))
 		}
 	} else {
 		// read bulk line(binary safe)
-		msg = make([]byte, state.bulkLen+2)
-		_, err = io.ReadFull(bufReader, msg)
+		if state.bulkLen <= maxPreallocBulkLen {
+			msg = make([]byte, state.bulkLen+2)
+			_, err = io.ReadFull(bufReader, msg)
+		} else {
+			// buffer grows as data arrives, so that a large header alone does not allocate memory
+			var buf bytes.Buffer
+			_, err = io.CopyN(&buf, bufReader, state.bulkLen+2)
+			msg = buf.Bytes()
+		}
 		if err != nil {
 			return nil, true, err
 		}
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' || msg[len(msg)-1] != '\n' {
+		state.readingBulk = false
+		state.bulkLen = 0
+		if msg[len(msg)-2] != '\r' || msg[len(msg)-1] != '\n' {
 			return nil, false, errors.New("protocol error: " + string(msg))
 		}
-		state.bulkLen = 0
 	}
 
 	return msg, false, nil
 }
 
-func parseMultiBulkHeader(msg []byte, state *readState) error {
-	var err error
-	var expectedLine uint64
-	expectedLine, err = strconv.ParseUint(string(msg[1:len(msg)-2]), 10, 32)
-	if err != nil {
-		return errors.New("protocol error: " + string(msg))
-	}
-	if expectedLine == 0 {
-		state.expectedArgsCount = 0
-		return nil
-	} else if expectedLine > 0 {
-		// first line of multi bulk protocol
-		state.msgType = msg[0]
-		state.readingMultiLine = true
-		state.expectedArgsCount = int(expectedLine)
-		state.args = make([][]byte, 0, expectedLine)
-		return nil
-	} else {
-		return errors.New("protocol error: " + string(msg))
-	}
-}
-
-func parseBulkHeader(msg []byte, state *readState) error {
-	var err error
-	state.bulkLen, err = strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 64)
-	if err != nil {
-		return errors.New("protocol error: " + string(msg))
-	}
-	if state.bulkLen == -1 {
-		// null bulk
-		return nil
-	} else if state.bulkLen > 0 {
-		state.msgType = msg[0]
-		state.readingMultiLine = true
-		state.expectedArgsCount = 1
-		state.args = make([][]byte, 0, 1)
-		return nil
-	} else {
-		return errors.New("protocol error: " + string(msg))
+// parseHeader parses length in header line of bulk or multi bulk protocol, -1 means null
+func parseHeader(msg []byte) (int64, error) {
+	length, err := strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 64)
+	if err != nil || length < -1 {
+		return 0, errors.New("protocol error: " + string(msg))
 	}
+	return length, nil
 }
 
 func parseSingleLineReply(msg []byte) (redis.Reply, error) {
@@ -287,24 +324,3 @@ func parseSingleLineReply(msg []byte) (redis.Reply, error) {
 	}
 	return result, nil
 }
-
-// read the non-first lines of multi bulk protocol or bulk protocol
-func readBody(msg []byte, state *readState) error {
-	line := msg[0 : len(msg)-2]
-	var err error
-	if line[0] == '$' {
-		// bulk protocol
-		state.bulkLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
-		if err != nil {
-			return errors.New("protocol error: " + string(msg))
-		}
-		if state.bulkLen <= 0 {
-			// null bulk in multi bulks
-			state.args = append(state.args, []byte{})
-			state.bulkLen = 0
-		}
-	} else {
-		state.args = append(state.args, line)
-	}
-	return nil
-}
@@ -0,0 +1,122 @@
+package parser
+
+import (
+	"bytes"
+	"godis/config"
+	"godis/interface/redis"
+	"godis/redis/protocol"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseReplies(t *testing.T) {
+	replies := []redis.Reply{
+		protocol.MakeStatusReply("OK"),
+		protocol.MakeErrReply("ERR unknown"),
+		protocol.MakeIntReply(-10),
+		protocol.MakeBulkReply([]byte("a\r\nb")),
+		protocol.MakeBulkReply([]byte("$3\r\nabc")),
+		protocol.MakeBulkReply([]byte{}),
+		protocol.MakeNullBulkReply(),
+		protocol.MakeNullMultiBulkReply(),
+		protocol.MakeEmptyMultiBulkReply(),
+		protocol.MakeMultiBulkReply([][]byte{[]byte("set"), []byte("$key"), nil, {}}),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeIntReply(1),
+			protocol.MakeMultiBulkReply([][]byte{[]byte("a")}),
+			protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeNullMultiBulkReply(),
+				protocol.MakeStatusReply("OK"),
+			}),
+			protocol.MakeBulkReply([]byte("*1")),
+		}),
+	}
+	var data []byte
+	for _, reply := range replies {
+		data = append(data, reply.ToBytes()...)
+	}
+	results, err := ParseBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(replies) {
+		t.Fatalf("expect %d replies, actual %d", len(replies), len(results))
+	}
+	for i, reply := range replies {
+		if !bytes.Equal(results[i].ToBytes(), reply.ToBytes()) {
+			t.Errorf("expect %q, actual %q", reply.ToBytes(), results[i].ToBytes())
+		}
+	}
+	if _, ok := results[7].(*protocol.NullMultiBulkReply); !ok {
+		t.Errorf("null array should not be parsed as %T", results[7])
+	}
+	if _, ok := results[8].(*protocol.EmptyMultiBulkReply); !ok {
+		t.Errorf("empty array should not be parsed as %T", results[8])
+	}
+	if _, ok := results[9].(*protocol.MultiBulkReply); !ok {
+		t.Errorf("array of bulk strings should not be parsed as %T", results[9])
+	}
+}
+
+func TestParseMalformedHeader(t *testing.T) {
+	for _, header := range []string{"*abc\r\n", "$-2\r\n", "*1\n", "$1x\r\n", ":1.5\r\n"} {
+		ch := ParseStream(strings.NewReader(header + "+OK\r\n"))
+		payload := <-ch
+		if payload.Err == nil || !strings.HasPrefix(payload.Err.Error(), "protocol error") {
+			t.Errorf("expect protocol error of %q, actual %v", header, payload)
+			continue
+		}
+		// parser recovers from malformed line
+		payload = <-ch
+		if payload.Err != nil || string(payload.Data.ToBytes()) != "+OK\r\n" {
+			t.Errorf("expect +OK after %q, actual %v", header, payload)
+		}
+	}
+}
+
+func TestParseLengthLimit(t *testing.T) {
+	maxBulkLen := config.Properties.ProtoMaxBulkLen
+	config.Properties.ProtoMaxBulkLen = 16
+	defer func() {
+		config.Properties.ProtoMaxBulkLen = maxBulkLen
+	}()
+	for _, header := range []string{"*17\r\n", "$17\r\n", "*1\r\n$9223372036854775807\r\n"} {
+		ch := ParseStream(strings.NewReader(header + "+OK\r\n"))
+		payload := <-ch
+		if payload.Err == nil || !strings.Contains(payload.Err.Error(), "length") {
+			t.Errorf("expect length error of %q, actual %v", header, payload)
+		}
+		// the rest of stream is dropped
+		if _, ok := <-ch; ok {
+			t.Errorf("channel should be closed after %q", header)
+		}
+	}
+	reply, err := ParseOne([]byte("*16\r\n" + strings.Repeat("$16\r\n0123456789abcdef\r\n", 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := reply.(*protocol.MultiBulkReply).Args; len(args) != 16 || string(args[15]) != "0123456789abcdef" {
+		t.Errorf("wrong args: %q", args)
+	}
+}
+
+func TestParseIncomplete(t *testing.T) {
+	// a huge array header only allocates for the elements arrived
+	ch := ParseStream(strings.NewReader("*100000000\r\n$1\r\na\r\n"))
+	if payload := <-ch; payload.Err != io.EOF {
+		t.Errorf("expect EOF, actual %v", payload)
+	}
+	body := strings.Repeat("x", maxPreallocBulkLen+1)
+	reply, err := ParseOne([]byte("$" + "65537" + "\r\n" + body + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.(*protocol.BulkReply).Arg) != body {
+		t.Error("wrong large bulk")
+	}
+	ch = ParseStream(strings.NewReader("$65537\r\nabc"))
+	if payload := <-ch; payload.Err == nil {
+		t.Error("expect error of truncated bulk")
+	}
+}
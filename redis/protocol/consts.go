@@ -42,6 +42,21 @@ func MakeNullBulkReply() *NullBulkReply {
 	return &NullBulkReply{}
 }
 
+var nullMultiBulkBytes = []byte("*-1\r\n")
+
+// NullMultiBulkReply is nil array, e.g. LMPOP found nothing to pop
+type NullMultiBulkReply struct{}
+
+// ToBytes marshal redis.Reply
+func (r *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
+// MakeNullMultiBulkReply creates a new NullMultiBulkReply
+func MakeNullMultiBulkReply() *NullMultiBulkReply {
+	return &NullMultiBulkReply{}
+}
+
 var emptyMultiBulkBytes = []byte("*0\r\n")
 
 // EmptyMultiBulkReply is a empty list
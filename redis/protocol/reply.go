@@ -7,7 +7,7 @@ import (
 )
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
+	nullBulkReplyBytes = []byte("$-1\r\n")
 
 	// CRLF is the line separator of redis serialization protocol
 	CRLF = "\r\n"
@@ -29,7 +29,7 @@ func MakeBulkReply(arg []byte) *BulkReply {
 
 // ToBytes marshal redis.Reply
 func (r *BulkReply) ToBytes() []byte {
-	if len(r.Arg) == 0 {
+	if r.Arg == nil {
 		return nullBulkReplyBytes
 	}
 	return []byte("$" + strconv.Itoa(len(r.Arg)) + CRLF + string(r.Arg) + CRLF)
@@ -89,6 +89,55 @@ func (r *MultiRawReply) ToBytes() []byte {
 	return buf.Bytes()
 }
 
+/* ---- Map Reply ---- */
+
+// MapReply stores key-value pairs, it is a map in RESP3
+type MapReply struct {
+	// Pairs stores keys and values alternately
+	Pairs []redis.Reply
+}
+
+// MakeMapReply creates MapReply
+func MakeMapReply(pairs []redis.Reply) *MapReply {
+	return &MapReply{
+		Pairs: pairs,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *MapReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%" + strconv.Itoa(len(r.Pairs)/2) + CRLF)
+	for _, arg := range r.Pairs {
+		buf.Write(arg.ToBytes())
+	}
+	return buf.Bytes()
+}
+
+/* ---- Push Reply ---- */
+
+// PushReply is an out of band message of RESP3, e.g. invalidation message of client side caching
+type PushReply struct {
+	Replies []redis.Reply
+}
+
+// MakePushReply creates PushReply
+func MakePushReply(replies []redis.Reply) *PushReply {
+	return &PushReply{
+		Replies: replies,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *PushReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(">" + strconv.Itoa(len(r.Replies)) + CRLF)
+	for _, arg := range r.Replies {
+		buf.Write(arg.ToBytes())
+	}
+	return buf.Bytes()
+}
+
 /* ---- Status Reply ---- */
 
 // StatusReply stores a simple status string
@@ -124,7 +173,7 @@ func MakeIntReply(code int64) *IntReply {
 
 // ToBytes marshal redis.Reply
 func (r *IntReply) ToBytes() []byte {
-	return []byte(":" + strconv.FormatInt(r.Code, 10))
+	return []byte(":" + strconv.FormatInt(r.Code, 10) + CRLF)
 }
 
 /* ---- Error Reply ---- */
@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestBulkReplyToBytes(t *testing.T) {
+	cases := []struct {
+		reply    *BulkReply
+		expected string
+	}{
+		// null bulk string is a complete line, so that the following reply in the same stream is not corrupted
+		{MakeBulkReply(nil), "$-1\r\n"},
+		// empty string is a value, e.g. GET of a key set to "", it differs from null
+		{MakeBulkReply([]byte{}), "$0\r\n\r\n"},
+		{MakeBulkReply([]byte("a\r\nb")), "$4\r\na\r\nb\r\n"},
+	}
+	for _, c := range cases {
+		if actual := string(c.reply.ToBytes()); actual != c.expected {
+			t.Errorf("expect %q, actual %q", c.expected, actual)
+		}
+	}
+	if string(MakeBulkReply(nil).ToBytes()) != string(MakeNullBulkReply().ToBytes()) {
+		t.Error("nil bulk should be encoded as NullBulkReply")
+	}
+}
+
+func TestMultiBulkReplyToBytes(t *testing.T) {
+	reply := MakeMultiBulkReply([][]byte{[]byte("a"), nil, {}})
+	expected := "*3\r\n$1\r\na\r\n$-1\r\n$0\r\n\r\n"
+	if actual := string(reply.ToBytes()); actual != expected {
+		t.Errorf("expect %q, actual %q", expected, actual)
+	}
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"bytes"
+	"godis/interface/redis"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * client.go implements `CLIENT` command family
+ * these commands operate on connections of Handler, so they are handled before database
+ */
+
+const (
+	clientTypeNormal = "normal"
+	clientTypePubSub = "pubsub"
+)
+
+// execClient dispatches CLIENT sub commands
+// returns closeSelf = true if the connection should be closed after reply sent
+func (h *Handler) execClient(client *connection.Connection, args [][]byte) (result redis.Reply, closeSelf bool) {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("client"), false
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	switch subCmd {
+	case "id":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|id"), false
+		}
+		return protocol.MakeIntReply(int64(client.GetID())), false
+	case "setname":
+		return execClientSetName(client, args[2:]), false
+	case "getname":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|getname"), false
+		}
+		name := client.GetName()
+		if name == "" {
+			return protocol.MakeNullBulkReply(), false
+		}
+		return protocol.MakeBulkReply([]byte(name)), false
+	case "info":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|info"), false
+		}
+		return protocol.MakeBulkReply([]byte(h.clientInfo(client) + "\n")), false
+	case "list":
+		return h.execClientList(args[2:]), false
+	case "kill":
+		return h.execClientKill(client, args[2:])
+	case "pause":
+		return h.execClientPause(args[2:]), false
+	case "unpause":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|unpause"), false
+		}
+		h.unpause()
+		return protocol.MakeOkReply(), false
+	case "tracking":
+		return h.execClientTracking(client, args[2:]), false
+	case "caching":
+		return h.execClientCaching(client, args[2:]), false
+	case "getredir":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|getredir"), false
+		}
+		return h.execClientGetRedir(client), false
+	case "trackinginfo":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|trackinginfo"), false
+		}
+		return h.execClientTrackingInfo(client), false
+	case "no-evict":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("client|no-evict"), false
+		}
+		switch strings.ToLower(string(args[2])) {
+		case "on":
+			client.SetNoEvict(true)
+		case "off":
+			client.SetNoEvict(false)
+		default:
+			return protocol.MakeSyntaxErrReply(), false
+		}
+		return protocol.MakeOkReply(), false
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CLIENT HELP."), false
+}
+
+func execClientSetName(client *connection.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("client|setname")
+	}
+	name := string(args[0])
+	// redis doesn't allow spaces or newlines in client name
+	for _, ch := range name {
+		if ch < '!' || ch > '~' {
+			return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	client.SetName(name)
+	return protocol.MakeOkReply()
+}
+
+// getClientType returns normal or pubsub
+func getClientType(client *connection.Connection) string {
+	if client.SubsCount() > 0 {
+		return clientTypePubSub
+	}
+	return clientTypeNormal
+}
+
+// clientFlags returns flags field of CLIENT LIST
+func (h *Handler) clientFlags(client *connection.Connection) string {
+	flags := ""
+	if client.SubsCount() > 0 {
+		flags += "P"
+	}
+	if client.InMultiState() {
+		flags += "x"
+	}
+	if client.IsMonitor() {
+		flags += "O"
+	}
+	if client.IsBlocked() {
+		flags += "b"
+	}
+	if tracking, redirectBroken := h.isTracking(client); tracking {
+		flags += "t"
+		if redirectBroken {
+			flags += "R"
+		}
+	}
+	if client.IsNoEvict() {
+		flags += "e"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	return flags
+}
+
+// clientInfo formats connection properties as a line of CLIENT LIST
+func (h *Handler) clientInfo(client *connection.Connection) string {
+	now := time.Now()
+	multi := -1
+	if client.InMultiState() {
+		multi = len(client.GetQueuedCmdLine())
+	}
+	lastCmd := client.GetLastCmd()
+	if lastCmd == "" {
+		lastCmd = "NULL"
+	}
+	var buf bytes.Buffer
+	buf.WriteString("id=" + strconv.FormatUint(client.GetID(), 10))
+	buf.WriteString(" addr=" + client.RemoteAddr().String())
+	buf.WriteString(" laddr=" + client.LocalAddr().String())
+	buf.WriteString(" name=" + client.GetName())
+	buf.WriteString(" age=" + strconv.FormatInt(int64(now.Sub(client.GetCreatedAt())/time.Second), 10))
+	buf.WriteString(" idle=" + strconv.FormatInt(int64(now.Sub(client.GetLastInteraction())/time.Second), 10))
+	buf.WriteString(" flags=" + h.clientFlags(client))
+	buf.WriteString(" db=" + strconv.Itoa(client.GetDBIndex()))
+	buf.WriteString(" sub=" + strconv.Itoa(client.SubsCount()))
+	buf.WriteString(" psub=0")
+	buf.WriteString(" multi=" + strconv.Itoa(multi))
+	outCount, outSize := client.GetOutputBufferSize()
+	buf.WriteString(" oll=" + strconv.Itoa(outCount))
+	buf.WriteString(" omem=" + strconv.FormatInt(outSize, 10))
+	buf.WriteString(" cmd=" + lastCmd)
+	buf.WriteString(" redir=" + strconv.FormatInt(h.getRedirectID(client), 10))
+	buf.WriteString(" resp=" + strconv.Itoa(client.GetProtocol()))
+	return buf.String()
+}
+
+// forEachClient visits all active connections
+func (h *Handler) forEachClient(consumer func(client *connection.Connection) bool) {
+	h.activeConn.Range(func(key, val interface{}) bool {
+		client := key.(*connection.Connection)
+		return consumer(client)
+	})
+}
+
+// execClientList: CLIENT LIST [TYPE normal|master|replica|pubsub] [ID client-id [client-id ...]]
+func (h *Handler) execClientList(args [][]byte) redis.Reply {
+	var clientType string
+	var ids map[uint64]struct{}
+	if len(args) > 0 {
+		option := strings.ToLower(string(args[0]))
+		switch {
+		case option == "type" && len(args) == 2:
+			clientType = strings.ToLower(string(args[1]))
+			if !isValidClientType(clientType) {
+				return protocol.MakeErrReply("ERR Unknown client type '" + clientType + "'")
+			}
+		case option == "id" && len(args) >= 2:
+			ids = make(map[uint64]struct{}, len(args)-1)
+			for _, arg := range args[1:] {
+				id, err := strconv.ParseUint(string(arg), 10, 64)
+				if err != nil || id == 0 {
+					return protocol.MakeErrReply("ERR Invalid client ID")
+				}
+				ids[id] = struct{}{}
+			}
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	var buf bytes.Buffer
+	h.forEachClient(func(client *connection.Connection) bool {
+		if clientType != "" && getClientType(client) != clientType {
+			return true
+		}
+		if ids != nil {
+			if _, ok := ids[client.GetID()]; !ok {
+				return true
+			}
+		}
+		buf.WriteString(h.clientInfo(client))
+		buf.WriteByte('\n')
+		return true
+	})
+	return protocol.MakeBulkReply(buf.Bytes())
+}
+
+func isValidClientType(clientType string) bool {
+	switch clientType {
+	case clientTypeNormal, clientTypePubSub, "master", "replica", "slave":
+		return true
+	}
+	return false
+}
+
+// killFilter stores the filters of CLIENT KILL
+type killFilter struct {
+	id         uint64
+	addr       string
+	laddr      string
+	clientType string
+	skipMe     bool
+	maxAge     int64
+}
+
+func (f *killFilter) match(self *connection.Connection, client *connection.Connection) bool {
+	if f.skipMe && client == self {
+		return false
+	}
+	if f.id != 0 && client.GetID() != f.id {
+		return false
+	}
+	if f.addr != "" && client.RemoteAddr().String() != f.addr {
+		return false
+	}
+	if f.laddr != "" && client.LocalAddr().String() != f.laddr {
+		return false
+	}
+	if f.clientType != "" && getClientType(client) != f.clientType {
+		return false
+	}
+	if f.maxAge > 0 && int64(time.Since(client.GetCreatedAt())/time.Second) < f.maxAge {
+		return false
+	}
+	return true
+}
+
+// execClientKill:
+// CLIENT KILL ip:port
+// CLIENT KILL [ID client-id] [TYPE normal|master|replica|pubsub] [USER username] [ADDR ip:port] [LADDR ip:port] [SKIPME yes/no] [MAXAGE maxage]
+func (h *Handler) execClientKill(self *connection.Connection, args [][]byte) (redis.Reply, bool) {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("client|kill"), false
+	}
+	// old style: CLIENT KILL addr
+	if len(args) == 1 {
+		addr := string(args[0])
+		var target *connection.Connection
+		h.forEachClient(func(client *connection.Connection) bool {
+			if client.RemoteAddr().String() == addr {
+				target = client
+				return false
+			}
+			return true
+		})
+		if target == nil {
+			return protocol.MakeErrReply("ERR No such client"), false
+		}
+		if target == self {
+			return protocol.MakeOkReply(), true
+		}
+		// closing waits for pending replies of target, do not block current client
+		go h.closeClient(target)
+		return protocol.MakeOkReply(), false
+	}
+
+	if len(args)%2 != 0 {
+		return protocol.MakeSyntaxErrReply(), false
+	}
+	filter := &killFilter{skipMe: true}
+	for i := 0; i < len(args); i += 2 {
+		option := strings.ToLower(string(args[i]))
+		value := string(args[i+1])
+		switch option {
+		case "id":
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || id == 0 {
+				return protocol.MakeErrReply("ERR client-id should be greater than 0"), false
+			}
+			filter.id = id
+		case "addr":
+			filter.addr = value
+		case "laddr":
+			filter.laddr = value
+		case "type":
+			clientType := strings.ToLower(value)
+			if !isValidClientType(clientType) {
+				return protocol.MakeErrReply("ERR Unknown client type '" + value + "'"), false
+			}
+			filter.clientType = clientType
+		case "user":
+			// godis has no ACL users, every connection is the default user
+			if value != "default" {
+				return protocol.MakeErrReply("ERR No such user '" + value + "'"), false
+			}
+		case "skipme":
+			switch strings.ToLower(value) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				return protocol.MakeSyntaxErrReply(), false
+			}
+		case "maxage":
+			maxAge, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || maxAge <= 0 {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range"), false
+			}
+			filter.maxAge = maxAge
+		default:
+			return protocol.MakeSyntaxErrReply(), false
+		}
+	}
+
+	var targets []*connection.Connection
+	h.forEachClient(func(client *connection.Connection) bool {
+		if filter.match(self, client) {
+			targets = append(targets, client)
+		}
+		return true
+	})
+	closeSelf := false
+	for _, target := range targets {
+		if target == self {
+			// close self after reply sent
+			closeSelf = true
+			continue
+		}
+		go h.closeClient(target)
+	}
+	return protocol.MakeIntReply(int64(len(targets))), closeSelf
+}
+
+// execClientPause: CLIENT PAUSE timeout [WRITE|ALL]
+func (h *Handler) execClientPause(args [][]byte) redis.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return protocol.MakeArgNumErrReply("client|pause")
+	}
+	timeout, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || timeout < 0 {
+		return protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	pauseAll := true
+	if len(args) == 2 {
+		switch strings.ToLower(string(args[1])) {
+		case "all":
+			pauseAll = true
+		case "write":
+			pauseAll = false
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	h.pause(time.Now().Add(time.Duration(timeout)*time.Millisecond), pauseAll)
+	return protocol.MakeOkReply()
+}
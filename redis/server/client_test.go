@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"godis/redis/protocol"
+	"godis/tcp"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sendCmd(t *testing.T, conn net.Conn, reader *bufio.Reader, args ...string) string {
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	_, err := conn.Write(protocol.MakeMultiBulkReply(cmdLine).ToBytes())
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	if line[0] == '$' && line != "$-1\r\n" {
+		size, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		body := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			t.Error(err)
+			return ""
+		}
+		return string(body[:size])
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestClientCommands(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+		time.Sleep(time.Second)
+	}()
+
+	conn1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader1 := bufio.NewReader(conn1)
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader2 := bufio.NewReader(conn2)
+
+	if ret := sendCmd(t, conn1, reader1, "CLIENT", "GETNAME"); ret != "$-1" {
+		t.Errorf("expect null name, actual %s", ret)
+	}
+	if ret := sendCmd(t, conn1, reader1, "CLIENT", "SETNAME", "conn1"); ret != "+OK" {
+		t.Errorf("setname failed: %s", ret)
+	}
+	if ret := sendCmd(t, conn1, reader1, "CLIENT", "SETNAME", "a b"); !strings.HasPrefix(ret, "-ERR") {
+		t.Errorf("expect error, actual %s", ret)
+	}
+	if ret := sendCmd(t, conn1, reader1, "CLIENT", "GETNAME"); ret != "conn1" {
+		t.Errorf("expect conn1, actual %s", ret)
+	}
+	id2 := strings.TrimPrefix(sendCmd(t, conn2, reader2, "CLIENT", "ID"), ":")
+	if ret := sendCmd(t, conn2, reader2, "CLIENT", "INFO"); !strings.HasPrefix(ret, "id="+id2+" ") {
+		t.Errorf("wrong client info: %s", ret)
+	}
+
+	list := sendCmd(t, conn1, reader1, "CLIENT", "LIST")
+	if !strings.Contains(list, "name=conn1") || !strings.Contains(list, "id="+id2+" ") {
+		t.Errorf("wrong client list: %s", list)
+	}
+	list = sendCmd(t, conn1, reader1, "CLIENT", "LIST", "ID", id2)
+	if strings.Contains(list, "name=conn1") || !strings.Contains(list, "id="+id2+" ") {
+		t.Errorf("wrong client list: %s", list)
+	}
+
+	if ret := sendCmd(t, conn1, reader1, "CLIENT", "KILL", "ID", id2); ret != ":1" {
+		t.Errorf("kill failed: %s", ret)
+	}
+	_ = conn2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader2.ReadByte(); err == nil {
+		t.Error("expect connection closed")
+	}
+
+	// pause write commands
+	if ret := sendCmd(t, conn1, reader1, "CLIENT", "PAUSE", "300", "WRITE"); ret != "+OK" {
+		t.Errorf("pause failed: %s", ret)
+	}
+	begin := time.Now()
+	sendCmd(t, conn1, reader1, "GET", "a")
+	if time.Since(begin) > 200*time.Millisecond {
+		t.Error("read command should not be paused")
+	}
+	sendCmd(t, conn1, reader1, "SET", "a", "a")
+	if time.Since(begin) < 250*time.Millisecond {
+		t.Error("write command should be paused")
+	}
+}
+
+// TestClientListRace reads states of a client by CLIENT LIST while the client is changing them, run it with -race
+func TestClientListRace(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+		time.Sleep(time.Second)
+	}()
+
+	conn1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader1 := bufio.NewReader(conn1)
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn2.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, conn2)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var cmds []byte
+		for _, args := range [][][]byte{
+			{[]byte("SUBSCRIBE"), []byte("a"), []byte("b")},
+			{[]byte("UNSUBSCRIBE"), []byte("a")},
+			{[]byte("UNSUBSCRIBE")},
+			{[]byte("SELECT"), []byte("1")},
+			{[]byte("MULTI")},
+			{[]byte("PING")},
+			{[]byte("DISCARD")},
+			{[]byte("SELECT"), []byte("0")},
+		} {
+			cmds = append(cmds, protocol.MakeMultiBulkReply(args).ToBytes()...)
+		}
+		for i := 0; i < 200; i++ {
+			if _, err := conn2.Write(cmds); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if list := sendCmd(t, conn1, reader1, "CLIENT", "LIST"); !strings.Contains(list, "id=") {
+			t.Errorf("wrong client list: %s", list)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"godis/config"
+	"godis/lib/logger"
+	"godis/redis/connection"
+	"sync/atomic"
+	"time"
+)
+
+// clientsCron checks clients periodically until handler closed, like clientsCron of redis
+func (h *Handler) clientsCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.closeIdleClients()
+		case <-h.stopCron:
+			return
+		}
+	}
+}
+
+// closeIdleClients closes clients idle for more than `timeout` seconds,
+// pub/sub, monitor and blocked clients are not closed since they are idle by design
+func (h *Handler) closeIdleClients() {
+	timeout := time.Duration(config.Properties.Timeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+	now := time.Now()
+	var idleClients []*connection.Connection
+	h.forEachClient(func(client *connection.Connection) bool {
+		if client.SubsCount() > 0 || client.IsMonitor() || client.IsBlocked() {
+			return true
+		}
+		if now.Sub(client.GetLastInteraction()) > timeout {
+			idleClients = append(idleClients, client)
+		}
+		return true
+	})
+	for _, client := range idleClients {
+		logger.Info("closing idle client: " + client.RemoteAddr().String())
+		atomic.AddInt64(&h.stats.expiredIdleClients, 1)
+		// closing waits for pending replies, do not block the cron
+		go h.closeClient(client)
+	}
+}
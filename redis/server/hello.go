@@ -0,0 +1,87 @@
+package server
+
+import (
+	"godis/config"
+	"godis/interface/redis"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// execHello: HELLO [protover [AUTH username password] [SETNAME clientname]]
+// switches protocol version and returns server info, RESP3 is required by push messages of client side caching
+func (h *Handler) execHello(client *connection.Connection, args [][]byte) redis.Reply {
+	protover := client.GetProtocol()
+	var password, name string
+	var setName bool
+	if len(args) >= 2 {
+		ver, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if ver != 2 && ver != 3 {
+			return protocol.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		protover = ver
+		for i := 2; i < len(args); i++ {
+			option := strings.ToLower(string(args[i]))
+			switch {
+			case option == "auth" && i+2 < len(args):
+				// godis has no ACL users, every connection is the default user
+				if string(args[i+1]) != "default" {
+					return protocol.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+				}
+				password = string(args[i+2])
+				i += 2
+			case option == "setname" && i+1 < len(args):
+				name = string(args[i+1])
+				setName = true
+				i++
+			default:
+				return protocol.MakeErrReply("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+			}
+		}
+	}
+	if password != "" {
+		if config.Properties.RequirePass == "" {
+			return protocol.MakeErrReply("ERR Client sent AUTH, but no password is set")
+		}
+		if password != config.Properties.RequirePass {
+			return protocol.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+		}
+		client.SetPassword(password)
+	}
+	if !isAuthenticated(client) {
+		return protocol.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	if setName {
+		if reply := execClientSetName(client, [][]byte{[]byte(name)}); protocol.IsErrorReply(reply) {
+			return reply
+		}
+	}
+	client.SetProtocol(protover)
+
+	mode := getServerMode()
+	pairs := []redis.Reply{
+		protocol.MakeBulkReply([]byte("server")),
+		protocol.MakeBulkReply([]byte("godis")),
+		protocol.MakeBulkReply([]byte("version")),
+		protocol.MakeBulkReply([]byte("6.2.0")),
+		protocol.MakeBulkReply([]byte("proto")),
+		protocol.MakeIntReply(int64(protover)),
+		protocol.MakeBulkReply([]byte("id")),
+		protocol.MakeIntReply(int64(client.GetID())),
+		protocol.MakeBulkReply([]byte("mode")),
+		protocol.MakeBulkReply([]byte(mode)),
+		protocol.MakeBulkReply([]byte("role")),
+		protocol.MakeBulkReply([]byte("master")),
+		protocol.MakeBulkReply([]byte("modules")),
+		protocol.MakeEmptyMultiBulkReply(),
+	}
+	if protover == 3 {
+		return protocol.MakeMapReply(pairs)
+	}
+	return protocol.MakeMultiRawReply(pairs)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"godis/config"
+	"godis/interface/redis"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats stores statistics shown by `INFO`
+type serverStats struct {
+	startedAt           time.Time
+	totalConnections    int64
+	rejectedConnections int64
+	expiredIdleClients  int64
+	totalCommands       int64
+}
+
+// infoSections are sections shown by `INFO` without arguments, in order
+var infoSections = []string{"server", "clients", "stats"}
+
+// execInfo: INFO [section [section ...]]
+func (h *Handler) execInfo(args [][]byte) redis.Reply {
+	sections := infoSections
+	if len(args) > 1 {
+		sections = nil
+		for _, arg := range args[1:] {
+			section := strings.ToLower(string(arg))
+			if section == "all" || section == "default" || section == "everything" {
+				sections = infoSections
+				break
+			}
+			sections = append(sections, section)
+		}
+	}
+	var buf bytes.Buffer
+	for _, section := range sections {
+		var fields [][2]string
+		switch section {
+		case "server":
+			fields = h.serverInfo()
+		case "clients":
+			fields = h.clientsInfo()
+		case "stats":
+			fields = h.statsInfo()
+		default:
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString(protocol.CRLF)
+		}
+		buf.WriteString("# " + strings.ToUpper(section[:1]) + section[1:] + protocol.CRLF)
+		for _, field := range fields {
+			buf.WriteString(field[0] + ":" + field[1] + protocol.CRLF)
+		}
+	}
+	return protocol.MakeBulkReply(buf.Bytes())
+}
+
+func (h *Handler) serverInfo() [][2]string {
+	mode := getServerMode()
+	uptime := int64(time.Since(h.stats.startedAt) / time.Second)
+	return [][2]string{
+		{"redis_version", "6.2.0"},
+		{"redis_mode", mode},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"tcp_port", strconv.Itoa(config.Properties.Port)},
+		{"uptime_in_seconds", strconv.FormatInt(uptime, 10)},
+		{"uptime_in_days", strconv.FormatInt(uptime/(24*3600), 10)},
+	}
+}
+
+func (h *Handler) clientsInfo() [][2]string {
+	var connected, pubsub, tracking int
+	var maxOutput int64
+	h.forEachClient(func(client *connection.Connection) bool {
+		connected++
+		if client.SubsCount() > 0 {
+			pubsub++
+		}
+		if isTracking, _ := h.isTracking(client); isTracking {
+			tracking++
+		}
+		if _, size := client.GetOutputBufferSize(); size > maxOutput {
+			maxOutput = size
+		}
+		return true
+	})
+	return [][2]string{
+		{"connected_clients", strconv.Itoa(connected)},
+		{"maxclients", strconv.Itoa(config.Properties.MaxClients)},
+		{"client_recent_max_output_buffer", strconv.FormatInt(maxOutput, 10)},
+		{"pubsub_clients", strconv.Itoa(pubsub)},
+		{"tracking_clients", strconv.Itoa(tracking)},
+	}
+}
+
+func (h *Handler) statsInfo() [][2]string {
+	normal := connection.GetOutputLimitDisconnections(config.ClientClassNormal)
+	pubsub := connection.GetOutputLimitDisconnections(config.ClientClassPubSub)
+	replica := connection.GetOutputLimitDisconnections(config.ClientClassReplica)
+	return [][2]string{
+		{"total_connections_received", strconv.FormatInt(atomic.LoadInt64(&h.stats.totalConnections), 10)},
+		{"total_commands_processed", strconv.FormatInt(atomic.LoadInt64(&h.stats.totalCommands), 10)},
+		{"rejected_connections", strconv.FormatInt(atomic.LoadInt64(&h.stats.rejectedConnections), 10)},
+		{"expired_idle_clients", strconv.FormatInt(atomic.LoadInt64(&h.stats.expiredIdleClients), 10)},
+		{"client_output_buffer_limit_disconnections", strconv.FormatInt(normal+pubsub+replica, 10)},
+		{"client_output_buffer_limit_disconnections_normal", strconv.FormatInt(normal, 10)},
+		{"client_output_buffer_limit_disconnections_pubsub", strconv.FormatInt(pubsub, 10)},
+		{"client_output_buffer_limit_disconnections_replica", strconv.FormatInt(replica, 10)},
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * monitor.go implements `MONITOR` command
+ * every command processed by Handler is streamed to monitors through a bounded buffer,
+ * lines are dropped if a monitor cannot keep up, so that a slow monitor never blocks the server
+ */
+
+// monitorBufferSize is the max count of lines waiting to be sent to a monitor
+const monitorBufferSize = 4096
+
+// monitorMaxOutputSize is the max size of output buffer of a monitor, lines are dropped once it is reached
+const monitorMaxOutputSize = 1 << 20
+
+type monitor struct {
+	client  *connection.Connection
+	lines   chan []byte
+	done    chan struct{}
+	dropped uint64 // only accessed by feeding goroutines under Handler.monitorMu
+}
+
+// execMonitor turns the client into a monitor
+// returns nil if OK reply has been queued
+func (h *Handler) execMonitor(client *connection.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("monitor")
+	}
+	if client.InMultiState() {
+		return protocol.MakeErrReply("ERR MONITOR isn't allowed in a MULTI context")
+	}
+	if client.IsMonitor() {
+		return protocol.MakeOkReply()
+	}
+	m := &monitor{
+		client: client,
+		lines:  make(chan []byte, monitorBufferSize),
+		done:   make(chan struct{}),
+	}
+	// OK reply goes through the buffer, so that it is sent before any monitored line
+	m.lines <- protocol.MakeOkReply().ToBytes()
+	client.SetMonitor(true)
+	h.monitorMu.Lock()
+	if h.monitors == nil {
+		h.monitors = make(map[*connection.Connection]*monitor)
+	}
+	h.monitors[client] = m
+	h.monitorMu.Unlock()
+	go m.drain()
+	return nil
+}
+
+// execMonitoring handles commands sent by a monitor, which is output-only
+// only QUIT and RESET are accepted, QUIT closes the connection and RESET turns the client back to normal
+func (h *Handler) execMonitoring(client *connection.Connection, cmdName string) (result redis.Reply, closeAfterReply bool) {
+	switch cmdName {
+	case "quit":
+		return protocol.MakeOkReply(), true
+	case "reset":
+		h.removeMonitor(client)
+		client.SetMonitor(false)
+		return protocol.MakeStatusReply("RESET"), false
+	default:
+		return protocol.MakeErrReply("ERR only QUIT and RESET are allowed in MONITOR mode"), false
+	}
+}
+
+// drain sends buffered lines to the monitor until it is removed
+func (m *monitor) drain() {
+	for {
+		select {
+		case line := <-m.lines:
+			if _, size := m.client.GetOutputBufferSize(); size >= monitorMaxOutputSize {
+				// monitor cannot keep up
+				continue
+			}
+			if err := m.client.Write(line); err != nil {
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// removeMonitor stops streaming to the given client, it is safe to call on non-monitor clients
+func (h *Handler) removeMonitor(client *connection.Connection) {
+	h.monitorMu.Lock()
+	defer h.monitorMu.Unlock()
+	m, ok := h.monitors[client]
+	if !ok {
+		return
+	}
+	delete(h.monitors, client)
+	close(m.done)
+}
+
+// feedMonitors sends the command line to all monitors
+func (h *Handler) feedMonitors(client *connection.Connection, cmdLine [][]byte) {
+	h.monitorMu.Lock()
+	defer h.monitorMu.Unlock()
+	if len(h.monitors) == 0 {
+		return
+	}
+	line := formatMonitorLine(time.Now(), client, cmdLine)
+	for _, m := range h.monitors {
+		select {
+		case m.lines <- line:
+			m.dropped = 0
+		default:
+			if m.dropped == 0 {
+				logger.Warn(fmt.Sprintf("monitor %s is too slow, dropping lines", m.client.RemoteAddr().String()))
+			}
+			m.dropped++
+		}
+	}
+}
+
+// formatMonitorLine formats command line like: +1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func formatMonitorLine(now time.Time, client *connection.Connection, cmdLine [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("+" + strconv.FormatInt(now.Unix(), 10) + "." + fmt.Sprintf("%06d", now.Nanosecond()/1000))
+	buf.WriteString(" [" + strconv.Itoa(client.GetDBIndex()) + " " + client.RemoteAddr().String() + "]")
+	for _, arg := range redactCommand(cmdLine) {
+		buf.WriteByte(' ')
+		if arg == nil {
+			buf.WriteString(`"(redacted)"`)
+			continue
+		}
+		buf.WriteString(strconv.Quote(string(arg)))
+	}
+	buf.WriteString(protocol.CRLF)
+	return buf.Bytes()
+}
+
+// redactCommand returns a copy of cmdLine whose passwords are replaced by nil,
+// e.g. arguments of AUTH and the username-password pair of HELLO
+func redactCommand(cmdLine [][]byte) [][]byte {
+	if len(cmdLine) == 0 {
+		return cmdLine
+	}
+	redacted := make([][]byte, len(cmdLine))
+	copy(redacted, cmdLine)
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "auth":
+		for i := 1; i < len(redacted); i++ {
+			redacted[i] = nil
+		}
+	case "hello":
+		// HELLO protover [AUTH username password] [SETNAME clientname]
+		for i := 2; i < len(redacted); i++ {
+			switch strings.ToLower(string(cmdLine[i])) {
+			case "auth":
+				for j := i + 1; j <= i+2 && j < len(redacted); j++ {
+					redacted[j] = nil
+				}
+				i += 2
+			case "setname":
+				i++
+			}
+		}
+	}
+	return redacted
+}
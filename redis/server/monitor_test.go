@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"godis/tcp"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+		time.Sleep(time.Second)
+	}()
+
+	monitorConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	monitorReader := bufio.NewReader(monitorConn)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader := bufio.NewReader(conn)
+
+	if ret := sendCmd(t, monitorConn, monitorReader, "MONITOR"); ret != "+OK" {
+		t.Errorf("monitor failed: %s", ret)
+		return
+	}
+	sendCmd(t, conn, reader, "SET", "a", "hello world")
+	sendCmd(t, conn, reader, "AUTH", "secret")
+	sendCmd(t, conn, reader, "HELLO", "3", "AUTH", "default", "secret", "SETNAME", "auth")
+
+	_ = monitorConn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := monitorReader.ReadString('\n')
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := "[0 " + conn.LocalAddr().String() + `] "SET" "a" "hello world"`
+	if !strings.HasPrefix(line, "+") || !strings.HasSuffix(line, expected+"\r\n") {
+		t.Errorf("wrong monitor line: %s", line)
+	}
+	line, err = monitorReader.ReadString('\n')
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasSuffix(line, `"AUTH" "(redacted)"`+"\r\n") {
+		t.Errorf("password should be redacted: %s", line)
+	}
+	line, err = monitorReader.ReadString('\n')
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasSuffix(line, `"HELLO" "3" "AUTH" "(redacted)" "(redacted)" "SETNAME" "auth"`+"\r\n") {
+		t.Errorf("password of HELLO should be redacted: %s", line)
+	}
+}
+
+func TestMonitorOutputOnly(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+		time.Sleep(time.Second)
+	}()
+
+	monitorConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	monitorReader := bufio.NewReader(monitorConn)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader := bufio.NewReader(conn)
+
+	if ret := sendCmd(t, monitorConn, monitorReader, "MONITOR"); ret != "+OK" {
+		t.Errorf("monitor failed: %s", ret)
+		return
+	}
+	if ret := sendCmd(t, monitorConn, monitorReader, "SET", "a", "1"); !strings.HasPrefix(ret, "-ERR") {
+		t.Errorf("expect error for command in monitor mode, actual %s", ret)
+	}
+	if ret := sendCmd(t, conn, reader, "GET", "a"); ret != "$-1" {
+		t.Errorf("command of monitor should not be executed, actual %s", ret)
+	}
+
+	// RESET turns the monitor back to a normal client, skip monitored lines before its reply
+	_ = monitorConn.SetReadDeadline(time.Now().Add(time.Second))
+	line := sendCmd(t, monitorConn, monitorReader, "RESET")
+	for line != "" && line != "+RESET" {
+		line, err = monitorReader.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+	}
+	if ret := sendCmd(t, monitorConn, monitorReader, "SET", "a", "1"); ret != "+OK" {
+		t.Errorf("expect OK after reset, actual %s", ret)
+	}
+
+	if ret := sendCmd(t, monitorConn, monitorReader, "MONITOR"); ret != "+OK" {
+		t.Errorf("monitor failed: %s", ret)
+		return
+	}
+	if ret := sendCmd(t, monitorConn, monitorReader, "QUIT"); ret != "+OK" {
+		t.Errorf("expect OK for quit, actual %s", ret)
+	}
+	if _, err := monitorReader.ReadString('\n'); err == nil {
+		t.Error("expect connection closed after quit")
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	database2 "godis/database"
+	"godis/redis/connection"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pauseState stores the state of `CLIENT PAUSE`
+type pauseState struct {
+	mu    sync.Mutex
+	until time.Time
+	// all == false means only write commands are paused
+	all bool
+	// closed when clients are unpaused
+	unpaused chan struct{}
+}
+
+// specialWriteCommands are write commands not registered in database cmdTable
+var specialWriteCommands = map[string]struct{}{
+	"flushall":     {},
+	"publish":      {},
+	"bgrewriteaof": {},
+	"rewriteaof":   {},
+}
+
+func isWriteCommand(cmdName string) bool {
+	if _, ok := specialWriteCommands[cmdName]; ok {
+		return true
+	}
+	return database2.IsWriteCommand(cmdName)
+}
+
+// pause suspends clients until the given time,
+// if another pause is in effect, the later deadline and the more restrictive mode wins
+func (h *Handler) pause(until time.Time, all bool) {
+	h.pauseState.mu.Lock()
+	defer h.pauseState.mu.Unlock()
+	if h.pauseState.unpaused == nil || time.Now().After(h.pauseState.until) {
+		// start a new pause
+		h.pauseState.until = until
+		h.pauseState.all = all
+		h.pauseState.unpaused = make(chan struct{})
+		return
+	}
+	if until.After(h.pauseState.until) {
+		h.pauseState.until = until
+	}
+	h.pauseState.all = h.pauseState.all || all
+}
+
+// unpause resumes all paused clients
+func (h *Handler) unpause() {
+	h.pauseState.mu.Lock()
+	defer h.pauseState.mu.Unlock()
+	if h.pauseState.unpaused != nil {
+		close(h.pauseState.unpaused)
+		h.pauseState.unpaused = nil
+	}
+}
+
+// shouldPause returns whether the command line should wait for `CLIENT PAUSE`
+func shouldPause(client *connection.Connection, cmdName string, all bool) bool {
+	if cmdName == "client" {
+		// client commands are never paused, so that we can `CLIENT UNPAUSE`
+		return false
+	}
+	if all {
+		return true
+	}
+	if cmdName == "exec" {
+		for _, cmdLine := range client.GetQueuedCmdLine() {
+			if isWriteCommand(strings.ToLower(string(cmdLine[0]))) {
+				return true
+			}
+		}
+		return false
+	}
+	if client.InMultiState() {
+		// just queue it
+		return false
+	}
+	return isWriteCommand(cmdName)
+}
+
+// waitIfPaused blocks until the pause is over if the given command should be paused
+func (h *Handler) waitIfPaused(client *connection.Connection, cmdName string) {
+	for {
+		h.pauseState.mu.Lock()
+		unpaused := h.pauseState.unpaused
+		until := h.pauseState.until
+		all := h.pauseState.all
+		h.pauseState.mu.Unlock()
+		if unpaused == nil || !time.Now().Before(until) || !shouldPause(client, cmdName, all) {
+			return
+		}
+		timer := time.NewTimer(time.Until(until))
+		select {
+		case <-unpaused:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"godis/config"
 	database2 "godis/database"
 	"godis/interface/database"
+	"godis/interface/redis"
 	"godis/lib/logger"
 	"godis/lib/sync/atomic"
 	"godis/redis/connection"
@@ -20,52 +21,100 @@ import (
 	"net"
 	"strings"
 	"sync"
+	atomic2 "sync/atomic"
+	"time"
 )
 
 var (
-	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+	unknownErrReplyBytes    = []byte("-ERR unknown\r\n")
+	maxClientsErrReplyBytes = []byte("-ERR max number of clients reached\r\n")
 )
 
 // Handler implements tcp.Handler and serves as s redis server
 type Handler struct {
-	activeConn sync.Map // *client -> placeholder
-	db         database.DB
-	closing    atomic.Boolean // refusing new client and new request
+	activeConn  sync.Map // *client -> placeholder
+	clientCount int64    // count of activeConn
+	db          database.DB
+	closing     atomic.Boolean // refusing new client and new request
+	closeOnce   sync.Once
+	stopCron    chan struct{} // stops clientsCron
+	pauseState  pauseState    // state of `CLIENT PAUSE`
+
+	monitorMu sync.Mutex
+	monitors  map[*connection.Connection]*monitor
+
+	tracking trackingTable // state of `CLIENT TRACKING`
+
+	stats serverStats // statistics for `INFO`
 }
 
 // MakeHandler creates a Handler instance
 func MakeHandler() *Handler {
 	var db database.DB
-	if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
+	if len(config.Properties.ProxyBackends) > 0 {
+		db = cluster.MakeProxy()
+	} else if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
 		db = cluster.MakeCluster()
 	} else {
 		logger.Info("multiDB created successfully")
 		db = database2.NewStandaloneServer()
 	}
-	return &Handler{db: db}
+	h := &Handler{
+		db:       db,
+		stopCron: make(chan struct{}),
+		stats:    serverStats{startedAt: time.Now()},
+	}
+	db.SetKeysChangedCallback(h.onKeysChanged)
+	go h.clientsCron()
+	return h
 }
 
+// closeClient closes connection and cleans its state, it is safe to call it more than once
 func (h *Handler) closeClient(client *connection.Connection) {
+	// remove client first, so that the cron and CLIENT KILL won't find it again while waiting for closing
+	if _, loaded := h.activeConn.LoadAndDelete(client); !loaded {
+		return
+	}
 	_ = client.Close()
+	atomic2.AddInt64(&h.clientCount, -1)
+	h.removeMonitor(client)
+	h.afterTrackingClientClose(client)
 	h.db.AfterClientClose(client)
-	h.activeConn.Delete(client)
 }
 
 func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	if h.closing.Get() {
 		// closing handler refuse new connection
 		_ = conn.Close()
+		return
 	}
 
 	client := connection.NewConn(conn)
+	atomic2.AddInt64(&h.stats.totalConnections, 1)
+	count := atomic2.AddInt64(&h.clientCount, 1)
 	h.activeConn.Store(client, 1)
+	if config.Properties.MaxClients > 0 && count > int64(config.Properties.MaxClients) {
+		atomic2.AddInt64(&h.stats.rejectedConnections, 1)
+		_ = client.Write(maxClientsErrReplyBytes)
+		h.closeClient(client)
+		return
+	}
 
 	ch := parser.ParseStream(conn)
-	for payload := range ch {
+	// next is the payload received while executing blocking command
+	var next *parser.Payload
+	for {
+		payload := next
+		next = nil
+		if payload == nil {
+			var ok bool
+			if payload, ok = <-ch; !ok {
+				h.closeClient(client)
+				return
+			}
+		}
 		if payload.Err != nil {
-			if payload.Err == io.EOF ||
-				payload.Err == io.ErrUnexpectedEOF ||
-				strings.Contains(payload.Err.Error(), "use of closed network connection") {
+			if isClosedErr(payload.Err) {
 				// connection closed
 				h.closeClient(client)
 				logger.Info("connection closed: " + client.RemoteAddr().String())
@@ -90,19 +139,130 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 			logger.Error("require multi bulk protocol")
 			continue
 		}
-		result := h.db.Exec(client, r.Args)
-		logger.Info(fmt.Sprintf("result=%v", string(result.ToBytes())))
+		if len(r.Args) == 0 {
+			continue
+		}
+		cmdName := strings.ToLower(string(r.Args[0]))
+		atomic2.AddInt64(&h.stats.totalCommands, 1)
+		client.SetLastCmd(cmdName)
+		h.waitIfPaused(client, cmdName)
+		if isConnCommand(cmdName) && !isAuthenticated(client) {
+			_ = client.Write(protocol.MakeErrReply("NOAUTH Authentication required").ToBytes())
+			continue
+		}
+		if cmdName == "monitor" {
+			if result := h.execMonitor(client, r.Args); result != nil {
+				_ = client.Write(result.ToBytes())
+			}
+			continue
+		}
+		if client.IsMonitor() {
+			result, closeAfterReply := h.execMonitoring(client, cmdName)
+			_ = client.Write(result.ToBytes())
+			if closeAfterReply {
+				h.closeClient(client)
+				logger.Info("connection closed: " + client.RemoteAddr().String())
+				return
+			}
+			continue
+		}
+		h.feedMonitors(client, r.Args)
+		h.trackReads(client, cmdName, r.Args)
+		var result redis.Reply
+		closeAfterReply := false
+		switch cmdName {
+		case "client":
+			result, closeAfterReply = h.execClient(client, r.Args)
+		case "hello":
+			result = h.execHello(client, r.Args)
+		case "info":
+			result = h.execInfo(r.Args)
+		default:
+			if database2.IsBlockingCommand(cmdName) {
+				result, next = h.execBlocking(client, r.Args, ch)
+			} else {
+				result = h.db.Exec(client, r.Args)
+			}
+		}
 		if result != nil {
+			logger.Info(fmt.Sprintf("result=%v", string(result.ToBytes())))
 			_ = client.Write(result.ToBytes())
 		} else {
 			_ = client.Write(unknownErrReplyBytes)
 		}
+		if closeAfterReply {
+			h.closeClient(client)
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			return
+		}
+	}
+}
+
+// isClosedErr returns whether the error means the connection was closed
+func isClosedErr(err error) bool {
+	return err == io.EOF ||
+		err == io.ErrUnexpectedEOF ||
+		strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// execBlocking executes blocking command, e.g. BLMPOP, while watching the connection,
+// so that the command stops waiting once the client disconnected.
+// The payload received during execution is returned to be handled after the command
+func (h *Handler) execBlocking(client *connection.Connection, cmdLine [][]byte, ch <-chan *parser.Payload) (redis.Reply, *parser.Payload) {
+	client.SetBlocked(true)
+	defer client.SetBlocked(false)
+	finished := make(chan struct{})
+	received := make(chan *parser.Payload, 1)
+	go func() {
+		defer close(received)
+		select {
+		case <-finished:
+		case payload, ok := <-ch:
+			if !ok {
+				_ = client.Close()
+				return
+			}
+			if payload.Err != nil && isClosedErr(payload.Err) {
+				// closing connection cancels the blocking command
+				_ = client.Close()
+			}
+			received <- payload
+		}
+	}()
+	result := h.db.Exec(client, cmdLine)
+	close(finished)
+	return result, <-received
+}
+
+// getServerMode returns standalone, cluster or proxy
+func getServerMode() string {
+	if len(config.Properties.ProxyBackends) > 0 {
+		return "proxy"
+	}
+	if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
+		return "cluster"
+	}
+	return "standalone"
+}
+
+// isConnCommand returns whether the command operates on connections of Handler, rather than database
+func isConnCommand(cmdName string) bool {
+	return cmdName == "client" || cmdName == "monitor" || cmdName == "info"
+}
+
+func isAuthenticated(client *connection.Connection) bool {
+	if config.Properties.RequirePass == "" {
+		return true
 	}
+	return client.GetPassword() == config.Properties.RequirePass
 }
 
 func (h *Handler) Close() error {
 	logger.Info("handler shutting down...")
 	h.closing.Set(true)
+	h.closeOnce.Do(func() {
+		close(h.stopCron)
+	})
 	// TODO: concurrent wait
 	h.activeConn.Range(func(key, val interface{}) bool {
 		client := key.(*connection.Connection)
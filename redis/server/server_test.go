@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"godis/config"
 	"godis/tcp"
 	"net"
 	"testing"
@@ -42,3 +43,52 @@ func TestListenAndServe(t *testing.T) {
 	closeChan <- struct{}{}
 	time.Sleep(time.Second)
 }
+
+func TestMaxClientsAndTimeout(t *testing.T) {
+	maxClients, timeout := config.Properties.MaxClients, config.Properties.Timeout
+	config.Properties.MaxClients = 1
+	config.Properties.Timeout = 1
+	defer func() {
+		config.Properties.MaxClients = maxClients
+		config.Properties.Timeout = timeout
+	}()
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+		time.Sleep(time.Second)
+	}()
+
+	conn1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader1 := bufio.NewReader(conn1)
+	if ret := sendCmd(t, conn1, reader1, "PING"); ret != "+PONG" {
+		t.Errorf("get wrong response: %s", ret)
+	}
+
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = conn2.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn2).ReadString('\n')
+	if err != nil || line != "-ERR max number of clients reached\r\n" {
+		t.Errorf("expect max clients error, actual %s %v", line, err)
+	}
+
+	// conn1 is closed after being idle for a while
+	_ = conn1.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := reader1.ReadByte(); err == nil {
+		t.Error("expect idle connection closed")
+	}
+}
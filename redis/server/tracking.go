@@ -0,0 +1,543 @@
+package server
+
+import (
+	database2 "godis/database"
+	"godis/interface/redis"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * tracking.go implements server assisted client side caching, see `CLIENT TRACKING`
+ * In default mode, server remembers keys read by each tracking client, and sends invalidation message once a key changed.
+ * In BCAST mode, server sends invalidation message for every changed key matching prefixes subscribed by client.
+ * Invalidation message is sent by RESP3 push, or as message of __redis__:invalidate channel to the REDIRECT connection.
+ */
+
+const invalidateChannel = "__redis__:invalidate"
+
+const (
+	cachingUnset = iota
+	cachingYes
+	cachingNo
+)
+
+var (
+	invalidateBytes  = []byte("invalidate")
+	redirBrokenBytes = []byte("tracking-redir-broken")
+	messageBytes     = []byte("message")
+)
+
+// trackingState stores tracking options of a client
+type trackingState struct {
+	client *connection.Connection
+	// redirect is the connection receiving invalidation messages, nil means client itself
+	redirect       *connection.Connection
+	redirectBroken bool
+	bcast          bool
+	prefixes       []string
+	optIn          bool
+	optOut         bool
+	noLoop         bool
+	// caching is set by `CLIENT CACHING`, and consumed by the next command
+	caching int
+}
+
+// trackingTable stores tracking clients and keys they are interested in
+type trackingTable struct {
+	mu      sync.Mutex
+	clients map[*connection.Connection]*trackingState
+	// key -> clients who read it, only for default mode. Entries are removed once invalidated
+	keys map[string]map[*connection.Connection]struct{}
+	// prefix -> clients in BCAST mode
+	prefixes map[string]map[*connection.Connection]struct{}
+}
+
+// invalidation is a message waiting to be sent
+type invalidation struct {
+	client   *connection.Connection
+	redirect *connection.Connection
+	// keys is nil if all keys are invalidated
+	keys []string
+}
+
+func (t *trackingTable) init() {
+	if t.clients == nil {
+		t.clients = make(map[*connection.Connection]*trackingState)
+		t.keys = make(map[string]map[*connection.Connection]struct{})
+		t.prefixes = make(map[string]map[*connection.Connection]struct{})
+	}
+}
+
+// execClientTracking: CLIENT TRACKING ON|OFF [REDIRECT client-id] [PREFIX prefix [PREFIX prefix ...]] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func (h *Handler) execClientTracking(client *connection.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("client|tracking")
+	}
+	var on bool
+	switch strings.ToLower(string(args[0])) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	state := &trackingState{client: client}
+	var redirectID uint64
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch option {
+		case "redirect":
+			if i+1 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			i++
+			id, err := strconv.ParseUint(string(args[i]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if id == client.GetID() {
+				// redirect to itself is the same as no redirect
+				continue
+			}
+			redirectID = id
+		case "prefix":
+			if i+1 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			i++
+			state.prefixes = append(state.prefixes, string(args[i]))
+		case "bcast":
+			state.bcast = true
+		case "optin":
+			state.optIn = true
+		case "optout":
+			state.optOut = true
+		case "noloop":
+			state.noLoop = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	if !on {
+		h.disableTracking(client)
+		return protocol.MakeOkReply()
+	}
+	if len(state.prefixes) > 0 && !state.bcast {
+		return protocol.MakeErrReply("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if state.optIn && state.optOut {
+		return protocol.MakeErrReply("ERR You can't use both OPTIN and OPTOUT")
+	}
+	if state.bcast && (state.optIn || state.optOut) {
+		return protocol.MakeErrReply("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	}
+	if redirectID != 0 {
+		h.forEachClient(func(c *connection.Connection) bool {
+			if c.GetID() == redirectID {
+				state.redirect = c
+				return false
+			}
+			return true
+		})
+		if state.redirect == nil {
+			return protocol.MakeErrReply("ERR The client ID you want redirect to does not exist")
+		}
+	}
+	if errReply := h.enableTracking(state); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeOkReply()
+}
+
+// enableTracking turns on tracking or updates options of a tracking client
+func (h *Handler) enableTracking(state *trackingState) redis.Reply {
+	t := &h.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	client := state.client
+	old := t.clients[client]
+	if old != nil {
+		if old.bcast != state.bcast {
+			return protocol.MakeErrReply("ERR You can't switch BCAST mode on/off before disabling tracking " +
+				"for this client, and then re-enabling it with a different mode.")
+		}
+		if old.optIn != state.optIn || old.optOut != state.optOut {
+			return protocol.MakeErrReply("ERR You can't switch OPTIN/OPTOUT mode before disabling tracking " +
+				"for this client, and then re-enabling it with a different mode.")
+		}
+	}
+	// prefixes are accumulated
+	var prefixes []string
+	if old != nil {
+		prefixes = old.prefixes
+	}
+	for _, prefix := range state.prefixes {
+		if overlapped, ok := findOverlappedPrefix(prefix, prefixes); ok {
+			if overlapped == prefix {
+				continue
+			}
+			return protocol.MakeErrReply("ERR Prefix '" + prefix + "' overlaps with an existing prefix '" +
+				overlapped + "'. Prefixes for a single client must not overlap.")
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	state.prefixes = prefixes
+	if state.bcast && len(state.prefixes) == 0 {
+		// empty prefix matches all keys
+		state.prefixes = []string{""}
+	}
+	t.clients[client] = state
+	for _, prefix := range state.prefixes {
+		clients := t.prefixes[prefix]
+		if clients == nil {
+			clients = make(map[*connection.Connection]struct{})
+			t.prefixes[prefix] = clients
+		}
+		clients[client] = struct{}{}
+	}
+	return nil
+}
+
+// findOverlappedPrefix returns the prefix which is a prefix of the given one, or vice versa
+func findOverlappedPrefix(prefix string, prefixes []string) (string, bool) {
+	for _, p := range prefixes {
+		if strings.HasPrefix(prefix, p) || strings.HasPrefix(p, prefix) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// disableTracking turns off tracking of the client, keys read by it will be removed lazily
+func (h *Handler) disableTracking(client *connection.Connection) {
+	t := &h.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.clients[client]
+	if state == nil {
+		return
+	}
+	delete(t.clients, client)
+	for _, prefix := range state.prefixes {
+		clients := t.prefixes[prefix]
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+}
+
+// afterTrackingClientClose cleans tracking state of closed client, and tells clients who redirect to it
+func (h *Handler) afterTrackingClientClose(client *connection.Connection) {
+	h.disableTracking(client)
+	t := &h.tracking
+	var broken []*connection.Connection
+	t.mu.Lock()
+	for _, state := range t.clients {
+		if state.redirect == client && !state.redirectBroken {
+			state.redirectBroken = true
+			broken = append(broken, state.client)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range broken {
+		if c.GetProtocol() == 3 {
+			msg := protocol.MakePushReply([]redis.Reply{
+				protocol.MakeBulkReply(redirBrokenBytes),
+				protocol.MakeIntReply(int64(client.GetID())),
+			})
+			_ = c.Write(msg.ToBytes())
+		}
+	}
+}
+
+// execClientCaching: CLIENT CACHING YES|NO
+func (h *Handler) execClientCaching(client *connection.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("client|caching")
+	}
+	t := &h.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.clients[client]
+	if state == nil || (!state.optIn && !state.optOut) {
+		return protocol.MakeErrReply("ERR CLIENT CACHING can be called only when the client is in tracking mode " +
+			"with OPTIN or OPTOUT mode enabled")
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "yes":
+		if !state.optIn {
+			return protocol.MakeErrReply("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+		}
+		state.caching = cachingYes
+	case "no":
+		if !state.optOut {
+			return protocol.MakeErrReply("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+		}
+		state.caching = cachingNo
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	return protocol.MakeOkReply()
+}
+
+// execClientGetRedir: CLIENT GETREDIR
+func (h *Handler) execClientGetRedir(client *connection.Connection) redis.Reply {
+	return protocol.MakeIntReply(h.getRedirectID(client))
+}
+
+// getRedirectID returns id of redirect client, 0 if not redirected and -1 if tracking is off
+func (h *Handler) getRedirectID(client *connection.Connection) int64 {
+	t := &h.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.clients[client]
+	if state == nil {
+		return -1
+	}
+	if state.redirect == nil {
+		return 0
+	}
+	return int64(state.redirect.GetID())
+}
+
+// execClientTrackingInfo returns tracking options of current client
+func (h *Handler) execClientTrackingInfo(client *connection.Connection) redis.Reply {
+	t := &h.tracking
+	t.mu.Lock()
+	state := t.clients[client]
+	var flags [][]byte
+	redirect := int64(-1)
+	var prefixes [][]byte
+	if state == nil {
+		flags = append(flags, []byte("off"))
+	} else {
+		flags = append(flags, []byte("on"))
+		redirect = 0
+		if state.redirect != nil {
+			redirect = int64(state.redirect.GetID())
+		}
+		if state.bcast {
+			flags = append(flags, []byte("bcast"))
+			for _, prefix := range state.prefixes {
+				prefixes = append(prefixes, []byte(prefix))
+			}
+		}
+		if state.optIn {
+			flags = append(flags, []byte("optin"))
+			if state.caching == cachingYes {
+				flags = append(flags, []byte("caching-yes"))
+			}
+		}
+		if state.optOut {
+			flags = append(flags, []byte("optout"))
+			if state.caching == cachingNo {
+				flags = append(flags, []byte("caching-no"))
+			}
+		}
+		if state.noLoop {
+			flags = append(flags, []byte("noloop"))
+		}
+		if state.redirectBroken {
+			flags = append(flags, []byte("broken_redirect"))
+		}
+	}
+	t.mu.Unlock()
+	pairs := []redis.Reply{
+		protocol.MakeBulkReply([]byte("flags")),
+		protocol.MakeMultiBulkReply(flags),
+		protocol.MakeBulkReply([]byte("redirect")),
+		protocol.MakeIntReply(redirect),
+		protocol.MakeBulkReply([]byte("prefixes")),
+		protocol.MakeMultiBulkReply(prefixes),
+	}
+	if client.GetProtocol() == 3 {
+		return protocol.MakeMapReply(pairs)
+	}
+	return protocol.MakeMultiRawReply(pairs)
+}
+
+// isTracking returns whether the client is in tracking mode, and whether its redirect connection is closed
+func (h *Handler) isTracking(client *connection.Connection) (tracking bool, redirectBroken bool) {
+	t := &h.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.clients[client]
+	if state == nil {
+		return false, false
+	}
+	return true, state.redirectBroken
+}
+
+// trackReads remembers keys to be read by the command line, it must be called before execution
+// so that invalidation caused by concurrent modification won't be missed
+func (h *Handler) trackReads(client *connection.Connection, cmdName string, cmdLine [][]byte) {
+	if cmdName == "client" || cmdName == "multi" {
+		// don't consume `CLIENT CACHING` flag
+		return
+	}
+	if cmdName != "exec" && client.InMultiState() {
+		// keys will be tracked when exec
+		return
+	}
+	t := &h.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.clients[client]
+	if state == nil || state.bcast {
+		return
+	}
+	caching := state.caching
+	state.caching = cachingUnset
+	if state.optIn && caching != cachingYes {
+		return
+	}
+	if state.optOut && caching == cachingNo {
+		return
+	}
+	var cmdLines [][][]byte
+	if cmdName == "exec" {
+		cmdLines = client.GetQueuedCmdLine()
+	} else {
+		cmdLines = [][][]byte{cmdLine}
+	}
+	for _, line := range cmdLines {
+		if !database2.IsReadOnlyCommand(strings.ToLower(string(line[0]))) {
+			continue
+		}
+		_, readKeys := database2.GetRelatedKeys(line)
+		for _, key := range readKeys {
+			clients := t.keys[key]
+			if clients == nil {
+				clients = make(map[*connection.Connection]struct{})
+				t.keys[key] = clients
+			}
+			clients[client] = struct{}{}
+		}
+	}
+}
+
+// onKeysChanged is registered as database.KeysChangedCallback, it sends invalidation messages to tracking clients
+func (h *Handler) onKeysChanged(c redis.Connection, dbIndex int, keys []string) {
+	t := &h.tracking
+	t.mu.Lock()
+	if len(t.clients) == 0 {
+		if keys == nil {
+			t.keys = make(map[string]map[*connection.Connection]struct{})
+		} else {
+			for _, key := range keys {
+				delete(t.keys, key)
+			}
+		}
+		t.mu.Unlock()
+		return
+	}
+	var messages []*invalidation
+	if keys == nil {
+		// db flushed, invalidate all keys
+		t.keys = make(map[string]map[*connection.Connection]struct{})
+		for _, state := range t.clients {
+			if state.redirectBroken {
+				continue
+			}
+			messages = append(messages, &invalidation{
+				client:   state.client,
+				redirect: state.redirect,
+			})
+		}
+	} else {
+		targets := make(map[*connection.Connection]*invalidation)
+		addTarget := func(state *trackingState, key string) {
+			if state.redirectBroken || (state.noLoop && c == redis.Connection(state.client)) {
+				return
+			}
+			msg := targets[state.client]
+			if msg == nil {
+				msg = &invalidation{
+					client:   state.client,
+					redirect: state.redirect,
+				}
+				targets[state.client] = msg
+				messages = append(messages, msg)
+			}
+			msg.keys = append(msg.keys, key)
+		}
+		for _, key := range keys {
+			for client := range t.keys[key] {
+				state := t.clients[client]
+				if state == nil || state.bcast {
+					continue
+				}
+				addTarget(state, key)
+			}
+			delete(t.keys, key)
+			for prefix, clients := range t.prefixes {
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				for client := range clients {
+					addTarget(t.clients[client], key)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, msg := range messages {
+		sendInvalidation(msg)
+	}
+}
+
+// sendInvalidation sends RESP3 push to client itself, or message of __redis__:invalidate to redirect connection
+func sendInvalidation(msg *invalidation) {
+	target := msg.client
+	if msg.redirect != nil {
+		target = msg.redirect
+	}
+	var keysReply redis.Reply
+	if msg.keys == nil {
+		keysReply = &nullArrayReply{resp3: target.GetProtocol() == 3}
+	} else {
+		keys := make([][]byte, len(msg.keys))
+		for i, key := range msg.keys {
+			keys[i] = []byte(key)
+		}
+		keysReply = protocol.MakeMultiBulkReply(keys)
+	}
+	if target.GetProtocol() == 3 {
+		push := protocol.MakePushReply([]redis.Reply{
+			protocol.MakeBulkReply(invalidateBytes),
+			keysReply,
+		})
+		_ = target.Write(push.ToBytes())
+		return
+	}
+	// RESP2 connection can only receive invalidation as pub/sub message, so it must be subscribing the channel
+	if msg.redirect == nil || !target.IsSubscribed(invalidateChannel) {
+		return
+	}
+	message := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply(messageBytes),
+		protocol.MakeBulkReply([]byte(invalidateChannel)),
+		keysReply,
+	})
+	_ = target.Write(message.ToBytes())
+}
+
+// nullArrayReply is null in RESP3 and null array in RESP2, it is sent when all keys are invalidated
+type nullArrayReply struct {
+	resp3 bool
+}
+
+func (r *nullArrayReply) ToBytes() []byte {
+	if r.resp3 {
+		return []byte("_" + protocol.CRLF)
+	}
+	return []byte("*-1" + protocol.CRLF)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bufio"
+	"godis/tcp"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLines reads n lines from reader, it is used to check messages sent by server
+func readLines(t *testing.T, conn net.Conn, reader *bufio.Reader, n int) []string {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	lines := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return lines
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+	}
+	return lines
+}
+
+func TestClientTracking(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+		time.Sleep(time.Second)
+	}()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	writer, writerReader := dial()
+
+	// default mode with RESP3 push
+	tracker, trackerReader := dial()
+	sendCmd(t, tracker, trackerReader, "HELLO", "3")
+	readLines(t, tracker, trackerReader, 25) // rest of HELLO map
+	if ret := sendCmd(t, tracker, trackerReader, "CLIENT", "TRACKING", "ON"); ret != "+OK" {
+		t.Errorf("tracking failed: %s", ret)
+	}
+	sendCmd(t, tracker, trackerReader, "GET", "tracked")
+	sendCmd(t, writer, writerReader, "SET", "tracked", "1")
+	lines := readLines(t, tracker, trackerReader, 6)
+	expected := []string{">2", "$10", "invalidate", "*1", "$7", "tracked"}
+	if strings.Join(lines, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong invalidation: %v", lines)
+	}
+	// key is invalidated only once until read again
+	sendCmd(t, writer, writerReader, "SET", "tracked", "2")
+	if ret := sendCmd(t, tracker, trackerReader, "PING"); ret != "+PONG" {
+		t.Errorf("expect no invalidation, actual %s", ret)
+	}
+
+	// redirect to RESP2 connection subscribing __redis__:invalidate
+	receiver, receiverReader := dial()
+	receiverID := strings.TrimPrefix(sendCmd(t, receiver, receiverReader, "CLIENT", "ID"), ":")
+	sendCmd(t, receiver, receiverReader, "SUBSCRIBE", "__redis__:invalidate")
+	readLines(t, receiver, receiverReader, 5) // rest of subscribe message
+	redirected, redirectedReader := dial()
+	if ret := sendCmd(t, redirected, redirectedReader, "CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "REDIRECT", receiverID); ret != "+OK" {
+		t.Errorf("tracking failed: %s", ret)
+	}
+	if ret := sendCmd(t, redirected, redirectedReader, "CLIENT", "GETREDIR"); ret != ":"+receiverID {
+		t.Errorf("wrong redirect: %s", ret)
+	}
+	sendCmd(t, writer, writerReader, "SET", "order:1", "1")
+	sendCmd(t, writer, writerReader, "SET", "user:1", "1")
+	lines = readLines(t, receiver, receiverReader, 8)
+	expected = []string{"*3", "$7", "message", "$20", "__redis__:invalidate", "*1", "$6", "user:1"}
+	if strings.Join(lines, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong invalidation: %v", lines)
+	}
+
+	// noloop
+	if ret := sendCmd(t, tracker, trackerReader, "CLIENT", "TRACKING", "ON", "NOLOOP"); ret != "+OK" {
+		t.Errorf("tracking failed: %s", ret)
+	}
+	sendCmd(t, tracker, trackerReader, "GET", "tracked")
+	sendCmd(t, tracker, trackerReader, "SET", "tracked", "3")
+	if ret := sendCmd(t, tracker, trackerReader, "PING"); ret != "+PONG" {
+		t.Errorf("expect no invalidation, actual %s", ret)
+	}
+
+	// invalid options
+	if ret := sendCmd(t, writer, writerReader, "CLIENT", "TRACKING", "ON", "PREFIX", "a"); !strings.HasPrefix(ret, "-ERR") {
+		t.Errorf("expect error, actual %s", ret)
+	}
+	if ret := sendCmd(t, writer, writerReader, "CLIENT", "TRACKING", "ON", "OPTIN", "OPTOUT"); !strings.HasPrefix(ret, "-ERR") {
+		t.Errorf("expect error, actual %s", ret)
+	}
+	if ret := sendCmd(t, writer, writerReader, "CLIENT", "CACHING", "YES"); !strings.HasPrefix(ret, "-ERR") {
+		t.Errorf("expect error, actual %s", ret)
+	}
+}
@@ -15,15 +15,19 @@ import (
 
 // Config stores tcp server properties
 type Config struct {
-	Address    string        `yaml:"address"`
+	Address string `yaml:"address"`
+	// MaxConnect and Timeout are limits on clients, they are enforced by handler who knows the state of clients,
+	// see maxclients and timeout in config
 	MaxConnect uint32        `yaml:"max-connect"`
 	Timeout    time.Duration `yaml:"timeout"`
+	// KeepAlive is the period of TCP keepalive probes on accepted connections, negative means disabled
+	KeepAlive time.Duration `yaml:"keep-alive"`
 }
 
 // ListenAndServeWithSignal binds port and handle requests, blocking until receive stop signal
 func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 	closeChan := make(chan struct{})
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	// 接受信号通知服务停止
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
@@ -34,7 +38,8 @@ func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 		}
 	}()
 	// 开始监听端口
-	listener, err := net.Listen("tcp", cfg.Address)
+	listenConfig := net.ListenConfig{KeepAlive: cfg.KeepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", cfg.Address)
 	if err != nil {
 		return err
 	}